@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"log"
-	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
-	"volt/db/config"
 	"volt/auth-service/pkg/middlewares"
 	"volt/auth-service/pkg/routes"
+	"volt/auth-service/pkg/utils"
+	"volt/common/health"
+	"volt/common/lifecycle"
+	"volt/common/metrics"
+	"volt/common/requestid"
+	"volt/common/tracing"
+	"volt/db/config"
 
 	"github.com/joho/godotenv"
 
@@ -24,16 +28,38 @@ func main() {
 	if err := config.InitDatabase(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer config.CloseDatabase()
+
+	lc := lifecycle.New()
+	lc.OnShutdown("database", func(ctx context.Context) error {
+		config.CloseDatabase()
+		return nil
+	})
 
 	if err := config.AutoMigrate(); err != nil {
 		log.Fatalf("Failed to run database migrations: %v", err)
 	}
 
+	shutdownTracing, err := tracing.Init(context.Background(), "auth-service", config.GetEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""))
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	lc.OnShutdown("tracing", shutdownTracing)
+
+	if sqlDB, err := config.DB.DB(); err == nil {
+		if err := metrics.RegisterDBStats(sqlDB); err != nil {
+			log.Printf("Failed to register database metrics: %v", err)
+		}
+		health.Register("database", health.DatabaseCheck(sqlDB))
+	}
+	health.Register("jwt_secret", health.SecretCheck("JWT_SECRET", utils.JWTSecret, utils.DevelopmentJWTSecret))
+
 	router := mux.NewRouter()
 
+	router.Use(tracing.Middleware("auth-service"))
+	router.Use(requestid.Middleware)
 	router.Use(middlewares.CorsMiddleware)
 	router.Use(middlewares.LoggingMiddleware)
+	router.Use(metrics.Middleware)
 
 	routes.SetupRoutes(router)
 
@@ -41,16 +67,22 @@ func main() {
 
 	log.Printf("Auth service starting on port %s", port)
 
-	// Graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	serverConfig := lifecycle.ServerConfig{
+		ReadHeaderTimeout: config.GetEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       config.GetEnvDuration("HTTP_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      config.GetEnvDuration("HTTP_WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:       config.GetEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		ReadinessDelay:    config.GetEnvDuration("SHUTDOWN_READINESS_DELAY", 5*time.Second),
+		DrainTimeout:      config.GetEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second),
+	}
+	server := lifecycle.NewServer(":"+port, router, serverConfig)
 
-	go func() {
-		<-c
+	err = lifecycle.Serve(server, lc, serverConfig, func() {
+		health.SetShuttingDown()
 		log.Println("Shutting down auth service...")
-		config.CloseDatabase()
-		os.Exit(0)
-	}()
-
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	})
+	if err != nil {
+		log.Fatalf("Error during shutdown: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
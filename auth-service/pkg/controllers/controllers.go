@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"volt/common/metrics"
+	"volt/common/problem"
 	"volt/db/config"
 	"volt/db/models"
 
@@ -13,13 +15,15 @@ import (
 	"gorm.io/gorm"
 )
 
+// HealthCheck is the legacy health endpoint, which the gateway exposes.
+// Like /livez it only reports that the service is up; the dependency checks,
+// whose errors name misconfigured secrets, are reported on /readyz alone.
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":   "healthy",
-		"service":  "auth-service",
-		"database": "connected",
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "healthy",
+		"service": "auth-service",
 	})
 }
 
@@ -28,10 +32,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 
 	var userReq models.UserRequest
 	if err := json.NewDecoder(r.Body).Decode(&userReq); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Invalid request body",
-		})
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body")
 		return
 	}
 
@@ -39,47 +40,33 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		Username: userReq.Username,
 		Email:    userReq.Email,
 		Password: userReq.Password,
+		Role:     models.RoleUser,
 	}
 
 	if err := user.ValidateUser(); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": err.Error(),
-		})
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeValidationFailed, err.Error())
 		return
 	}
 
 	var existingUser models.User
-	if err := config.DB.Where("email = ?", user.Email).First(&existingUser).Error; err == nil {
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "User with this email already exists",
-		})
+	if err := config.DB.WithContext(r.Context()).Where("email = ?", user.Email).First(&existingUser).Error; err == nil {
+		problem.Write(w, r, http.StatusConflict, problem.CodeConflict, "User with this email already exists")
 		return
 	}
 
-	if err := config.DB.Where("username = ?", user.Username).First(&existingUser).Error; err == nil {
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "User with this username already exists",
-		})
+	if err := config.DB.WithContext(r.Context()).Where("username = ?", user.Username).First(&existingUser).Error; err == nil {
+		problem.Write(w, r, http.StatusConflict, problem.CodeConflict, "User with this username already exists")
 		return
 	}
 
-	if err := config.DB.Create(&user).Error; err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Failed to create user",
-		})
+	if err := config.DB.WithContext(r.Context()).Create(&user).Error; err != nil {
+		problem.Internal(w, r, "Failed to create user", err)
 		return
 	}
 
-	token, err := utils.GenerateJWT(user.ID, user.Username, user.Email)
+	token, err := utils.GenerateJWT(user.ID, user.Username, user.Email, user.Role)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Failed to generate token",
-		})
+		problem.Internal(w, r, "Failed to generate token", err)
 		return
 	}
 
@@ -97,46 +84,35 @@ func Login(w http.ResponseWriter, r *http.Request) {
 
 	var loginReq models.LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Invalid request body",
-		})
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body")
 		return
 	}
 
 	var user models.User
-	if err := config.DB.Where("email = ?", loginReq.Email).First(&user).Error; err != nil {
+	if err := config.DB.WithContext(r.Context()).Where("email = ?", loginReq.Email).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{
-				"message": "Invalid credentials",
-			})
+			metrics.LoginAttemptsTotal.WithLabelValues("failure").Inc()
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Invalid credentials")
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Database error",
-		})
+		problem.Internal(w, r, "Failed to look up user", err)
 		return
 	}
 
 	if err := user.CheckPassword(loginReq.Password); err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Invalid credentials",
-		})
+		metrics.LoginAttemptsTotal.WithLabelValues("failure").Inc()
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Invalid credentials")
 		return
 	}
 
-	token, err := utils.GenerateJWT(user.ID, user.Username, user.Email)
+	token, err := utils.GenerateJWT(user.ID, user.Username, user.Email, user.Role)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": "Failed to generate token",
-		})
+		problem.Internal(w, r, "Failed to generate token", err)
 		return
 	}
 
+	metrics.LoginAttemptsTotal.WithLabelValues("success").Inc()
+
 	response := models.AuthResponse{
 		Token: token,
 		User:  user.ToResponse(),
@@ -150,17 +126,17 @@ func GetProfile(w http.ResponseWriter, r *http.Request) {
 
 	claims := middlewares.GetUserFromContext(r)
 	if claims == nil {
-		http.Error(w, "User not found in context", http.StatusUnauthorized)
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User not found in context")
 		return
 	}
 
 	var user models.User
-	if err := config.DB.Where("id = ?", claims.UserID).First(&user).Error; err != nil {
+	if err := config.DB.WithContext(r.Context()).Where("id = ?", claims.UserID).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "User not found", http.StatusNotFound)
+			problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
 			return
 		}
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		problem.Internal(w, r, "Failed to look up user", err)
 		return
 	}
 
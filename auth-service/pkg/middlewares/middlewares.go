@@ -2,11 +2,14 @@ package middlewares
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"strings"
 
 	"volt/auth-service/pkg/utils"
+	"volt/common/metrics"
+	"volt/common/problem"
+	"volt/common/requestid"
+	"volt/common/tracing"
 )
 
 type contextKey string
@@ -17,7 +20,8 @@ func CorsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -30,7 +34,7 @@ func CorsMiddleware(next http.Handler) http.Handler {
 
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.Method, r.RequestURI, r.RemoteAddr)
+		tracing.Logf(r.Context(), "request_id=%s %s %s %s", requestid.FromContext(r.Context()), r.Method, r.RequestURI, r.RemoteAddr)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -39,20 +43,23 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			metrics.JWTValidationFailuresTotal.WithLabelValues("missing").Inc()
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Authorization header required")
 			return
 		}
 
 		tokenParts := strings.Split(authHeader, " ")
 		if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+			metrics.JWTValidationFailuresTotal.WithLabelValues("malformed").Inc()
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid authorization header format")
 			return
 		}
 
 		token := tokenParts[1]
 		claims, err := utils.ValidateJWT(token)
 		if err != nil {
-			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+			metrics.JWTValidationFailuresTotal.WithLabelValues("invalid").Inc()
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid or expired token")
 			return
 		}
 
@@ -3,11 +3,21 @@ package routes
 import (
 	"volt/auth-service/pkg/controllers"
 	"volt/auth-service/pkg/middlewares"
+	"volt/common/health"
+	"volt/common/metrics"
+	"volt/common/problem"
 
 	"github.com/gorilla/mux"
 )
 
 func SetupRoutes(router *mux.Router) {
+	router.NotFoundHandler = problem.NotFoundHandler()
+	router.MethodNotAllowedHandler = problem.MethodNotAllowedHandler()
+
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	router.HandleFunc("/livez", health.LivenessHandler).Methods("GET")
+	router.HandleFunc("/readyz", health.ReadinessHandler).Methods("GET")
+
 	api := router.PathPrefix("/api/v1").Subrouter()
 
 	// Public routes
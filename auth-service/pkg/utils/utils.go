@@ -8,22 +8,33 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret = []byte(config.GetEnv("JWT_SECRET", "fallback-jwt-token-secret--dhairya-is-awsm"))
+// DevelopmentJWTSecret signs tokens while JWT_SECRET is unset. It is only
+// fit for local development; the readiness check fails while it is in use.
+const DevelopmentJWTSecret = "fallback-jwt-token-secret--dhairya-is-awsm"
+
+var jwtSecret = []byte(config.GetEnv("JWT_SECRET", DevelopmentJWTSecret))
+
+// JWTSecret returns the key used to sign and verify tokens.
+func JWTSecret() []byte {
+	return jwtSecret
+}
 
 type Claims struct {
 	UserID   uint   `json:"user_id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
+	Role     string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(userID uint, username, email string) (string, error) {
+func GenerateJWT(userID uint, username, email, role string) (string, error) {
 	expirationTime := time.Now().Add(24 * time.Hour)
 
 	claims := &Claims{
 		UserID:   userID,
 		Username: username,
 		Email:    email,
+		Role:     role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -68,5 +79,5 @@ func RefreshToken(tokenString string) (string, error) {
 		return "", err
 	}
 
-	return GenerateJWT(claims.UserID, claims.Username, claims.Email)
+	return GenerateJWT(claims.UserID, claims.Username, claims.Email, claims.Role)
 }
@@ -58,7 +58,7 @@ export const DashboardPage = () => {
       });
 
       if (status === 200) {
-        setFiles(Array.isArray(data) ? data : []);
+        setFiles(Array.isArray(data?.items) ? data.items : []);
       }
       // @ts-expect-error
     } catch ({ status, data }) {
@@ -3,13 +3,16 @@ export const handleErrors = (
   setErrors: (errors: Record<string, string>) => void,
   data: any,
 ) => {
+  // Services respond with RFC 7807 problem documents: { code, detail, ... }.
+  const detail: string = data?.detail ?? '';
+
   switch (status) {
     case 400:
       if (data.errors && typeof data.errors === 'object') {
         setErrors(data.errors);
       } else {
         setErrors({
-          general: data.message || 'Please check your input and try again.',
+          general: detail || 'Please check your input and try again.',
         });
       }
       break;
@@ -19,11 +22,11 @@ export const handleErrors = (
       });
       break;
     case 409:
-      if (data?.message.includes('email')) {
+      if (detail.includes('email')) {
         setErrors({
           email: 'An account with this email already exists.',
         });
-      } else if (data?.message.includes('username')) {
+      } else if (detail.includes('username')) {
         setErrors({
           username: 'This username is already taken.',
         });
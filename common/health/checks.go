@@ -0,0 +1,77 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// DatabaseCheck pings the connection pool.
+func DatabaseCheck(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// StorageCheck writes a small probe file into dir, reads it back and removes
+// it, proving the directory is writable and readable.
+func StorageCheck(dir string) Check {
+	return func(ctx context.Context) error {
+		probe := make([]byte, 32)
+		if _, err := rand.Read(probe); err != nil {
+			return err
+		}
+
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return fmt.Errorf("write probe: %w", err)
+		}
+		path := f.Name()
+		defer os.Remove(path)
+
+		_, err = f.Write(probe)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("write probe: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		got, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read probe: %w", err)
+		}
+		if !bytes.Equal(got, probe) {
+			return errors.New("read probe: content mismatch")
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("delete probe: %w", err)
+		}
+		return nil
+	}
+}
+
+// SecretCheck fails when secret returns an empty value, e.g. a signing key
+// that could not be loaded, or the built-in development default, which
+// anyone with the source can sign with.
+func SecretCheck(name string, secret func() []byte, development string) Check {
+	return func(ctx context.Context) error {
+		value := secret()
+		if len(value) == 0 {
+			return fmt.Errorf("%s is not configured", name)
+		}
+		if string(value) == development {
+			return fmt.Errorf("%s is not set; the built-in development secret is in use", name)
+		}
+		return nil
+	}
+}
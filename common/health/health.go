@@ -0,0 +1,176 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check reports whether a dependency is usable. It must honour ctx
+// cancellation; the checker gives each check its own deadline.
+type Check func(ctx context.Context) error
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+var ErrShuttingDown = errors.New("service is shutting down")
+
+type CheckResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type Checker struct {
+	Timeout time.Duration
+
+	mu           sync.RWMutex
+	names        []string
+	checks       map[string]Check
+	shuttingDown atomic.Bool
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		Timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Register adds or replaces the readiness check called name.
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.checks[name]; !exists {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// SetShuttingDown makes every subsequent readiness probe fail so the load
+// balancer stops routing new traffic while in-flight requests drain.
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+func (c *Checker) ShuttingDown() bool {
+	return c.shuttingDown.Load()
+}
+
+// Run executes all registered checks in parallel, each bounded by Timeout.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	names := append([]string(nil), c.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.RUnlock()
+
+	results := make([]CheckResult, len(names))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.runOne(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(names)+1)}
+	for i, name := range names {
+		report.Checks[name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+
+	if c.ShuttingDown() {
+		report.Status = StatusFail
+		report.Checks["shutdown"] = CheckResult{Status: StatusFail, Error: ErrShuttingDown.Error()}
+	}
+
+	return report
+}
+
+func (c *Checker) runOne(ctx context.Context, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := CheckResult{Status: StatusOK, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// LivenessHandler only reports that the process is able to serve HTTP. It
+// deliberately ignores dependencies so a database outage does not get every
+// pod restarted.
+func (c *Checker) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": StatusOK})
+}
+
+func (c *Checker) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == StatusOK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Default is the process-wide checker used by the package-level helpers.
+var Default = NewChecker(2 * time.Second)
+
+func Register(name string, check Check) {
+	Default.Register(name, check)
+}
+
+func SetShuttingDown() {
+	Default.SetShuttingDown()
+}
+
+func Run(ctx context.Context) Report {
+	return Default.Run(ctx)
+}
+
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	Default.LivenessHandler(w, r)
+}
+
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	Default.ReadinessHandler(w, r)
+}
@@ -0,0 +1,56 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretCheck(t *testing.T) {
+	const dev = "development-secret"
+	tests := []struct {
+		secret string
+		want   string
+	}{
+		{secret: "a-real-secret"},
+		{secret: "", want: "JWT_SECRET is not configured"},
+		{secret: dev, want: "JWT_SECRET is not set"},
+	}
+	for _, tt := range tests {
+		err := SecretCheck("JWT_SECRET", func() []byte { return []byte(tt.secret) }, dev)(t.Context())
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("secret %q: %v, want %q", tt.secret, err, tt.want)
+		}
+	}
+}
+
+func TestProbes(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Register("jwt_secret", SecretCheck("JWT_SECRET", func() []byte { return nil }, "dev"))
+
+	// Readiness reports the failing check.
+	rec := httptest.NewRecorder()
+	c.ReadinessHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || report.Status != StatusFail || report.Checks["jwt_secret"].Status != StatusFail {
+		t.Errorf("readiness = %d %+v, want the secret check failing", rec.Code, report)
+	}
+
+	// Liveness neither runs nor reports it.
+	rec = httptest.NewRecorder()
+	c.LivenessHandler(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "JWT_SECRET") {
+		t.Errorf("liveness = %d %s", rec.Code, rec.Body)
+	}
+
+	c.SetShuttingDown()
+	if report := c.Run(t.Context()); report.Checks["shutdown"].Status != StatusFail {
+		t.Errorf("report while shutting down = %+v", report)
+	}
+}
@@ -0,0 +1,162 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Manager owns the background workers and cleanup hooks of a service so they
+// can be stopped in a well-defined order on shutdown.
+type Manager struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	hooks []hook
+}
+
+func New() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{ctx: ctx, cancel: cancel}
+}
+
+// Context is cancelled as soon as Shutdown starts.
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// Go runs fn in a goroutine. fn must return promptly once ctx is cancelled;
+// Shutdown waits for it before running the hooks.
+func (m *Manager) Go(name string, fn func(ctx context.Context)) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		fn(m.ctx)
+		log.Printf("Worker %s stopped", name)
+	}()
+}
+
+// OnShutdown registers fn to run after all workers have stopped. Hooks run in
+// reverse registration order, so dependencies registered first close last.
+func (m *Manager) OnShutdown(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, hook{name: name, fn: fn})
+}
+
+// Shutdown cancels the worker context, waits for workers until ctx expires
+// and then runs the shutdown hooks.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	var errs []error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("workers did not stop in time: %w", ctx.Err()))
+	}
+
+	m.mu.Lock()
+	hooks := append([]hook(nil), m.hooks...)
+	m.mu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hooks[i].name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// ReadinessDelay is how long to keep serving after readiness starts
+	// failing, giving load balancers time to stop sending new requests.
+	ReadinessDelay time.Duration
+	// DrainTimeout bounds how long in-flight requests may take to finish.
+	DrainTimeout time.Duration
+}
+
+func NewServer(addr string, handler http.Handler, cfg ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// Serve runs srv until SIGINT or SIGTERM, then calls beforeDrain, waits for
+// cfg.ReadinessDelay, drains in-flight requests and finally shuts down m.
+func Serve(srv *http.Server, m *Manager, cfg ServerConfig, beforeDrain func()) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+		defer cancel()
+		return errors.Join(err, m.Shutdown(shutdownCtx))
+	case s := <-sig:
+		log.Printf("Received %s, starting graceful shutdown", s)
+	}
+
+	if beforeDrain != nil {
+		beforeDrain()
+	}
+	time.Sleep(cfg.ReadinessDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+
+	var errs []error
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("http server: %w", err))
+		srv.Close()
+	}
+
+	// Workers and hooks get their own budget so a slow drain cannot starve
+	// the database close and trace flush.
+	workersCtx, cancelWorkers := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancelWorkers()
+	if err := m.Shutdown(workersCtx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
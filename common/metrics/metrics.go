@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "volt"
+
+var (
+	HTTPRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests by route template, method and status code.",
+	}, []string{"method", "route", "code"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	HTTPRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests currently being served.",
+	})
+
+	UploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploads_total",
+		Help:      "Total number of file uploads by result.",
+	}, []string{"result"})
+
+	UploadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Total number of bytes received through successful uploads.",
+	})
+
+	DedupTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dedup_total",
+		Help:      "Uploaded files that matched an existing blob (hit) or created a new one (new).",
+	}, []string{"result"})
+
+	DedupSavedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dedup_saved_bytes_total",
+		Help:      "Total number of bytes not written to storage thanks to deduplication.",
+	})
+
+	CompressionSavedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "compression_saved_bytes_total",
+		Help:      "Total number of bytes not written to storage thanks to compression, by when the blob was compressed (upload, recompress).",
+	}, []string{"source"})
+
+	ScansTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "malware_scans_total",
+		Help:      "Malware scans of blobs by outcome (clean, infected, error).",
+	}, []string{"result"})
+
+	FsckIssues = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "fsck_issues",
+		Help:      "Issues found by the last storage integrity check, by kind.",
+	}, []string{"kind"})
+
+	FsckLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "fsck_last_run_timestamp_seconds",
+		Help:      "Unix time the last storage integrity check finished.",
+	})
+
+	GCSweptTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gc_swept_total",
+		Help:      "Unused blobs and temporary files deleted by the garbage collector, by kind (blob, chunk, preview, temp).",
+	}, []string{"kind"})
+
+	GCSweptBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gc_swept_bytes_total",
+		Help:      "Total number of bytes freed by the garbage collector.",
+	})
+
+	GCLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "gc_last_run_timestamp_seconds",
+		Help:      "Unix time the last garbage collection on this replica finished.",
+	})
+
+	GCLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "gc_leader",
+		Help:      "1 if this replica led the last garbage collection, 0 otherwise.",
+	})
+
+	TierMovesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tier_moves_total",
+		Help:      "Blobs moved between storage tiers, by destination tier (hot, cold) and reason (lifecycle, restore).",
+	}, []string{"tier", "reason"})
+
+	TierMovedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tier_moved_bytes_total",
+		Help:      "Stored bytes moved between storage tiers, by destination tier.",
+	}, []string{"tier"})
+
+	ReplicaWriteFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replica_write_failures_total",
+		Help:      "Blob writes a storage replica failed, by replica.",
+	}, []string{"replica"})
+
+	ReplicaReadFailoversTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replica_read_failovers_total",
+		Help:      "Blob reads moved to another replica after an error, by the replica that failed.",
+	}, []string{"replica"})
+
+	ReplicaRepairsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replica_repairs_total",
+		Help:      "Blob copies written by the replication repair worker, by destination replica.",
+	}, []string{"replica"})
+
+	UnderReplicatedBlobs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "under_replicated_blobs",
+		Help:      "Live blobs held by fewer replicas than configured, as of the last repair.",
+	})
+
+	ErasureWriteFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "erasure_write_failures_total",
+		Help:      "Shard writes an erasure-coding backend failed, by backend.",
+	}, []string{"backend"})
+
+	ErasureReconstructedStripesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "erasure_reconstructed_stripes_total",
+		Help:      "Stripes of erasure-coded blobs reads had to reconstruct from parity.",
+	})
+
+	ErasureShardsRebuiltTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "erasure_shards_rebuilt_total",
+		Help:      "Shards rewritten by the erasure-coding scrubber, by destination backend.",
+	}, []string{"backend"})
+
+	DegradedErasureBlobs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "degraded_erasure_blobs",
+		Help:      "Erasure-coded blobs missing shards, as of the last scrub.",
+	})
+
+	UploadPolicyViolationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_policy_violations_total",
+		Help:      "Upload policy rule violations by rule and mode (enforced, dry_run).",
+	}, []string{"rule", "mode"})
+
+	LoginAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "Total number of login attempts by result.",
+	}, []string{"result"})
+
+	JWTValidationFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwt_validation_failures_total",
+		Help:      "Total number of rejected bearer tokens by reason.",
+	}, []string{"reason"})
+)
+
+// RegisterDBStats exposes the connection pool statistics of db under the
+// volt_db_* metric family.
+func RegisterDBStats(db *sql.DB) error {
+	return prometheus.Register(collectors.NewDBStatsCollector(db, "volt"))
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware records request counts and latency per mux route template so
+// that label cardinality stays bounded regardless of the raw request path.
+// It must be installed with router.Use so the matched route is available.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		HTTPRequestsInFlight.Inc()
+		defer HTTPRequestsInFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		HTTPRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+		HTTPRequestsTotal.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+	})
+}
@@ -0,0 +1,112 @@
+// Package problem writes error responses as RFC 7807 application/problem+json
+// documents with a stable machine-readable code.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"volt/common/requestid"
+	"volt/common/tracing"
+)
+
+const ContentType = "application/problem+json"
+
+// Codes are part of the public API; clients switch on them, so never rename.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeInvalidToken         = "invalid_token"
+	CodeInvalidCredentials   = "invalid_credentials"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeMalwareDetected      = "malware_detected"
+	CodeInternal             = "internal_error"
+	CodeUnavailable          = "service_unavailable"
+	CodeRestoring            = "restoring"
+	CodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeChecksumMismatch     = "checksum_mismatch"
+)
+
+// Problem is both the response body and an error value, so lower layers can
+// return one and have handlers pass it through unchanged.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Code + ": " + p.Detail
+	}
+	return p.Code
+}
+
+// Write sends a problem response for status, code and a client-safe detail.
+func Write(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	send(w, r, New(status, code, detail))
+}
+
+// Internal logs err with the request's IDs and responds with a generic 500;
+// the underlying error is never exposed to the client.
+func Internal(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	tracing.Logf(r.Context(), "request_id=%s %s: %v", requestid.FromContext(r.Context()), msg, err)
+	send(w, r, New(http.StatusInternalServerError, CodeInternal, msg))
+}
+
+// FromError writes err as-is when it is (or wraps) a *Problem and as an
+// internal error otherwise.
+func FromError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	var p *Problem
+	if errors.As(err, &p) {
+		send(w, r, p)
+		return
+	}
+	Internal(w, r, msg, err)
+}
+
+func send(w http.ResponseWriter, r *http.Request, p *Problem) {
+	body := *p
+	body.Instance = r.URL.Path
+	body.RequestID = requestid.FromContext(r.Context())
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(body.Status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// NotFoundHandler and MethodNotAllowedHandler replace mux's plain-text
+// defaults so unmatched requests get the same envelope as everything else.
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Write(w, r, http.StatusNotFound, CodeNotFound, "No route matches "+r.URL.Path)
+	})
+}
+
+func MethodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Write(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+	})
+}
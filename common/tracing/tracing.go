@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Init installs a global tracer provider for serviceName and the W3C
+// trace-context propagator. Spans are exported over OTLP/HTTP to endpoint
+// (host:port or URL); when endpoint is empty spans are still created, so trace
+// IDs appear in logs and are propagated, but nothing is exported.
+// The returned function flushes and stops the provider.
+func Init(ctx context.Context, serviceName, endpoint string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	if endpoint != "" {
+		var err error
+		exporter, err = otlptracehttp.New(ctx, endpointOptions(endpoint)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		log.Printf("Exporting traces to %s", endpoint)
+	}
+
+	tp := NewProvider(serviceName, exporter)
+	Install(tp)
+	return tp.Shutdown, nil
+}
+
+// NewProvider builds a tracer provider that batches spans to exporter. Tests
+// can pass an in-memory exporter such as tracetest.NewInMemoryExporter.
+func NewProvider(serviceName string, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+func Install(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// Middleware starts a server span per request, named after the mux route
+// template, continuing any trace passed in the traceparent header.
+func Middleware(serviceName string) func(http.Handler) http.Handler {
+	return otelmux.Middleware(serviceName)
+}
+
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// TraceID returns the hex trace ID of the span in ctx, or "" when there is none.
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Logf logs like log.Printf, prefixed with the trace ID from ctx if present.
+func Logf(ctx context.Context, format string, args ...interface{}) {
+	if id := TraceID(ctx); id != "" {
+		format = "trace_id=" + id + " " + format
+	}
+	log.Printf(format, args...)
+}
+
+// RecordError marks span as failed with err and returns err unchanged.
+func RecordError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// endpointOptions accepts either a full URL, whose scheme decides TLS, or a
+// bare host:port, which is assumed to be a plaintext in-cluster collector.
+func endpointOptions(endpoint string) []otlptracehttp.Option {
+	if u, err := url.Parse(endpoint); err == nil && u.Scheme != "" && u.Host != "" {
+		return []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint)}
+	}
+	return []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure()}
+}
@@ -0,0 +1,168 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// record installs a provider exporting to memory for the rest of the test and
+// returns a function that flushes it and returns the spans ended so far.
+func record(t *testing.T) func() tracetest.SpanStubs {
+	t.Helper()
+	prev := otel.GetTracerProvider()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := NewProvider("volt-test", exporter)
+	Install(tp)
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prev)
+	})
+	return func() tracetest.SpanStubs {
+		if err := tp.ForceFlush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return exporter.GetSpans()
+	}
+}
+
+// captureLog redirects the standard logger for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+func find(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	spans := record(t)
+	logged := captureLog(t)
+
+	router := mux.NewRouter()
+	router.Use(Middleware("volt-test"))
+	router.HandleFunc("/files/{ID}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Tracer("volt/test").Start(r.Context(), "handler.work")
+		span.End()
+		Logf(r.Context(), "listing files of %s", mux.Vars(r)["ID"])
+	})
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodGet, "/files/42", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	got := spans()
+	server := find(got, "/files/{ID}")
+	if server == nil {
+		t.Fatalf("no span named after the route among %d spans", len(got))
+	}
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("span kind = %v, want server", server.SpanKind)
+	}
+	if id := server.SpanContext.TraceID().String(); id != traceID {
+		t.Errorf("trace ID = %s, want the incoming %s", id, traceID)
+	}
+	if id := server.Parent.SpanID().String(); id != parentID || !server.Parent.IsRemote() {
+		t.Errorf("parent = %s (remote %v), want the incoming %s", id, server.Parent.IsRemote(), parentID)
+	}
+
+	child := find(got, "handler.work")
+	if child == nil {
+		t.Fatal("no span from the handler")
+	}
+	if child.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("the handler's span is not a child of the request span")
+	}
+
+	if want := "trace_id=" + traceID + " listing files of 42"; !strings.Contains(logged.String(), want) {
+		t.Errorf("log = %q, want it to contain %q", logged, want)
+	}
+}
+
+func TestMiddlewareStartsTrace(t *testing.T) {
+	spans := record(t)
+
+	var seen string
+	router := mux.NewRouter()
+	router.Use(Middleware("volt-test"))
+	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		seen = TraceID(r.Context())
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	got := spans()
+	if len(got) != 1 {
+		t.Fatalf("%d spans, want 1", len(got))
+	}
+	if got[0].Parent.IsValid() {
+		t.Error("a request without traceparent has a parent span")
+	}
+	if seen == "" || seen != got[0].SpanContext.TraceID().String() {
+		t.Errorf("handler saw trace ID %q, span has %s", seen, got[0].SpanContext.TraceID())
+	}
+}
+
+func TestLogf(t *testing.T) {
+	record(t)
+	logged := captureLog(t)
+
+	Logf(context.Background(), "no span %d", 1)
+	if line := logged.String(); strings.Contains(line, "trace_id=") || !strings.Contains(line, "no span 1") {
+		t.Errorf("log without a span = %q", line)
+	}
+
+	logged.Reset()
+	ctx, span := Tracer("volt/test").Start(context.Background(), "work")
+	defer span.End()
+	Logf(ctx, "with span %d", 2)
+	want := "trace_id=" + span.SpanContext().TraceID().String() + " with span 2"
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("log = %q, want it to contain %q", logged, want)
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	spans := record(t)
+
+	_, span := Tracer("volt/test").Start(context.Background(), "failing")
+	errFailed := errors.New("failed")
+	if err := RecordError(span, errFailed); err != errFailed {
+		t.Errorf("RecordError = %v, want the error unchanged", err)
+	}
+	span.End()
+	_, span = Tracer("volt/test").Start(context.Background(), "working")
+	if err := RecordError(span, nil); err != nil {
+		t.Errorf("RecordError(nil) = %v", err)
+	}
+	span.End()
+
+	got := spans()
+	if s := find(got, "failing"); s == nil || s.Status.Code != codes.Error || len(s.Events) != 1 {
+		t.Errorf("failing span = %+v, want an error status and event", s)
+	}
+	if s := find(got, "working"); s == nil || s.Status.Code != codes.Unset || len(s.Events) != 0 {
+		t.Errorf("working span = %+v, want no error", s)
+	}
+}
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 	"volt/db/models"
 
 	"gorm.io/driver/postgres"
@@ -41,12 +44,12 @@ func InitDatabase() error {
 		if dsn == "" {
 			return fmt.Errorf("DATABASE_URL environment variable is not set")
 		}
-		fmt.Printf("Running in production mode with DATABASE_URL: %s\n", dsn)
+		log.Println("Running in production mode with DATABASE_URL")
 	} else {
 		config := GetDatabaseConfig()
 		dsn = fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=UTC",
 			config.Host, config.User, config.Password, config.DBName, config.Port)
-		fmt.Printf("Running in development mode with DSN: %s\n", dsn)
+		log.Printf("Running in development mode with database %s on %s:%s as %s", config.DBName, config.Host, config.Port, config.User)
 	}
 
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
@@ -56,6 +59,10 @@ func InitDatabase() error {
 		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
+	if err := db.Use(&tracingPlugin{}); err != nil {
+		return fmt.Errorf("failed to register tracing plugin: %w", err)
+	}
+
 	DB = db
 	log.Println("Successfully connected to PostgreSQL database")
 	return nil
@@ -66,11 +73,82 @@ func AutoMigrate() error {
 		return fmt.Errorf("database connection not initialized")
 	}
 
-	return DB.AutoMigrate(
+	if err := DB.AutoMigrate(
 		&models.User{},
 		&models.File{},
 		&models.FileReference{},
-	)
+		&models.FileText{},
+		&models.FileSearchEntry{},
+		&models.FilePreview{},
+		&models.ExtractionJob{},
+		&models.Chunk{},
+		&models.FileChunk{},
+		&models.DataKey{},
+		&models.BlobReplica{},
+		&models.BlobLayout{},
+		&models.IdempotencyKey{},
+	); err != nil {
+		return err
+	}
+
+	if err := backfillReferenceColumns(); err != nil {
+		return err
+	}
+	if err := dropObsoleteIndexes(); err != nil {
+		return err
+	}
+	return createIndexes()
+}
+
+// backfillReferenceColumns copies each File's size and MIME type onto the
+// references created before file_references had its own copy of them.
+func backfillReferenceColumns() error {
+	err := DB.Exec(`UPDATE file_references SET size = files.size, mime_type = files.mime_type
+		FROM files WHERE files.id = file_references.file_id AND file_references.mime_type = ''`).Error
+	if err != nil {
+		return fmt.Errorf("failed to backfill file reference columns: %w", err)
+	}
+	return nil
+}
+
+// obsoleteIndexes were created by earlier versions for the listing's size
+// and type filters, which now use the copies on file_references.
+var obsoleteIndexes = []string{
+	`idx_files_size`,
+	`idx_files_mime_type_prefix`,
+}
+
+func dropObsoleteIndexes() error {
+	for _, name := range obsoleteIndexes {
+		if err := DB.Exec(`DROP INDEX IF EXISTS ` + name).Error; err != nil {
+			return fmt.Errorf("failed to drop index %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// listingIndexes back the keyset pagination in the file listing: each sort
+// key is indexed together with the id tie-breaker, scoped to a user and to
+// rows that are not soft-deleted.
+var listingIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS idx_file_refs_user_created ON file_references (user_id, created_at, id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_refs_user_updated ON file_references (user_id, updated_at, id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_refs_user_name ON file_references (user_id, display_name, id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_refs_user_size ON file_references (user_id, size, id) WHERE deleted_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_file_refs_user_mime ON file_references (user_id, mime_type, id) WHERE deleted_at IS NULL`,
+}
+
+var searchIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS idx_file_search_document ON file_search_entries USING GIN (document)`,
+}
+
+func createIndexes() error {
+	for _, stmt := range append(listingIndexes, searchIndexes...) {
+		if err := DB.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
 }
 
 func CloseDatabase() {
@@ -90,6 +168,23 @@ func GetDB() *gorm.DB {
 	return DB
 }
 
+type txKey struct{}
+
+// WithTx returns a context that makes DBFrom use tx, so writes made deep
+// in a call, such as a blob store recording where it put a blob, join the
+// caller's transaction.
+func WithTx(ctx context.Context, tx *gorm.DB) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+// DBFrom returns the transaction ctx carries, or DB, bound to ctx.
+func DBFrom(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx.WithContext(ctx)
+	}
+	return DB.WithContext(ctx)
+}
+
 func GetEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -97,3 +192,33 @@ func GetEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+// GetEnvDuration parses key as a time.Duration (e.g. "30s"), falling back to
+// defaultValue when it is unset or invalid.
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// GetEnvInt parses key as an integer, falling back to defaultValue when it is
+// unset or invalid.
+func GetEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer %q for %s, using %d", value, key, defaultValue)
+		return defaultValue
+	}
+	return n
+}
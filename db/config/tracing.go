@@ -0,0 +1,81 @@
+package config
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanInstanceKey = "volt:span"
+
+// tracingPlugin wraps every GORM callback chain in a client span. Queries only
+// join the caller's trace when issued through DB.WithContext(ctx).
+type tracingPlugin struct {
+	tracer trace.Tracer
+}
+
+func (tracingPlugin) Name() string {
+	return "volt:tracing"
+}
+
+func (p *tracingPlugin) Initialize(db *gorm.DB) error {
+	p.tracer = otel.Tracer("volt/db")
+
+	cb := db.Callback()
+	hooks := []struct {
+		name   string
+		before func(string, func(*gorm.DB)) error
+		after  func(string, func(*gorm.DB)) error
+	}{
+		{"create", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register},
+		{"query", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register},
+		{"update", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register},
+		{"delete", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register},
+		{"row", cb.Row().Before("gorm:row").Register, cb.Row().After("gorm:row").Register},
+		{"raw", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register},
+	}
+
+	for _, h := range hooks {
+		if err := h.before("volt:trace_before_"+h.name, p.before(h.name)); err != nil {
+			return err
+		}
+		if err := h.after("volt:trace_after_"+h.name, p.after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *tracingPlugin) before(op string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx, span := p.tracer.Start(db.Statement.Context, "gorm."+op,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("db.system", "postgresql")),
+		)
+		db.Statement.Context = ctx
+		db.InstanceSet(spanInstanceKey, span)
+	}
+}
+
+func (p *tracingPlugin) after(db *gorm.DB) {
+	v, ok := db.InstanceGet(spanInstanceKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.sql.table", db.Statement.Table),
+		attribute.String("db.statement", db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+}
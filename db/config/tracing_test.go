@@ -0,0 +1,108 @@
+package config
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type tracedRow struct {
+	ID   uint
+	Name string
+}
+
+// tracedDB returns a database that builds statements without running them,
+// with the tracing plugin reporting to an in-memory exporter.
+func tracedDB(t *testing.T) (*gorm.DB, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prev)
+	})
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost dbname=volt_test"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(&tracingPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	return db, exporter
+}
+
+func attr(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestQueriesAreChildSpans(t *testing.T) {
+	db, exporter := tracedDB(t)
+
+	ctx, parent := otel.Tracer("volt/test").Start(context.Background(), "GET /files/{ID}")
+	var rows []tracedRow
+	db.WithContext(ctx).Where("name = ?", "notes.txt").Find(&rows)
+	db.WithContext(ctx).Create(&tracedRow{Name: "notes.txt"})
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans, want the request and two queries", len(spans))
+	}
+	for i, op := range []string{"query", "create"} {
+		span := spans[i]
+		if span.Name != "gorm."+op {
+			t.Errorf("span %d is %s, want gorm.%s", i, span.Name, op)
+		}
+		if span.SpanKind != trace.SpanKindClient {
+			t.Errorf("%s: kind = %v, want client", span.Name, span.SpanKind)
+		}
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() || span.SpanContext.TraceID() != parent.SpanContext().TraceID() {
+			t.Errorf("%s is not a child of the request span", span.Name)
+		}
+		if table := attr(span, "db.sql.table"); table != "traced_rows" {
+			t.Errorf("%s: db.sql.table = %q", span.Name, table)
+		}
+	}
+	if stmt := attr(spans[0], "db.statement"); !strings.HasPrefix(stmt, "SELECT") || !strings.Contains(stmt, "name = $1") {
+		t.Errorf("db.statement = %q", stmt)
+	}
+	if system := attr(spans[0], "db.system"); system != "postgresql" {
+		t.Errorf("db.system = %q", system)
+	}
+}
+
+func TestQueriesWithoutContextStartTraces(t *testing.T) {
+	db, exporter := tracedDB(t)
+
+	_, parent := otel.Tracer("volt/test").Start(context.Background(), "GET /files/{ID}")
+	var rows []tracedRow
+	db.Find(&rows)
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 || spans[0].Name != "gorm.query" {
+		t.Fatalf("spans = %v, want a query and the request", spans)
+	}
+	if spans[0].Parent.IsValid() {
+		t.Error("a query issued without the request's context joined a trace")
+	}
+}
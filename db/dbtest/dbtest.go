@@ -0,0 +1,79 @@
+// Package dbtest gives tests a migrated Postgres database of their own. The
+// server is named by TEST_DATABASE_URL; tests that need it are skipped when
+// it is unset.
+package dbtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"volt/db/config"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open creates a schema for the test, migrates it and points config.DB at
+// it until the test ends, when the schema is dropped again. Tests using it
+// must not run in parallel, since config.DB is shared.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	b := make([]byte, 6)
+	rand.Read(b)
+	schema := "volt_test_" + hex.EncodeToString(b)
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("creating schema %s: %v", schema, err)
+	}
+
+	db, err := gorm.Open(postgres.Open(withSearchPath(dsn, schema)), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("connecting to schema %s: %v", schema, err)
+	}
+
+	prev := config.DB
+	config.DB = db
+	t.Cleanup(func() {
+		config.DB = prev
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		if err := admin.Exec("DROP SCHEMA " + schema + " CASCADE").Error; err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	if err := config.AutoMigrate(); err != nil {
+		t.Fatalf("migrating schema %s: %v", schema, err)
+	}
+	return db
+}
+
+// withSearchPath adds a search_path runtime parameter to a URL or key=value
+// connection string.
+func withSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return strings.TrimSpace(dsn) + fmt.Sprintf(" search_path=%s", schema)
+}
@@ -0,0 +1,46 @@
+package models
+
+const (
+	BulkActionDelete     = "delete"
+	BulkActionSetPrivate = "set_private"
+	BulkActionRename     = "rename"
+)
+
+const (
+	BulkStatusOK    = "ok"
+	BulkStatusError = "error"
+)
+
+// BulkRequest applies one action to many file references. Delete and
+// set_private take IDs; rename takes Items, each with its new name.
+type BulkRequest struct {
+	Action    string     `json:"action"`
+	IDs       []uint     `json:"ids"`
+	IsPrivate *bool      `json:"is_private,omitempty"`
+	Items     []BulkItem `json:"items,omitempty"`
+}
+
+type BulkItem struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+type BulkResult struct {
+	ID     uint   `json:"id"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BulkResponse struct {
+	Action    string       `json:"action"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"`
+}
+
+// ArchiveRequest selects the file references to download as one ZIP.
+type ArchiveRequest struct {
+	IDs  []uint `json:"ids"`
+	Name string `json:"name,omitempty"`
+}
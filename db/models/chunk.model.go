@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Chunk is a content-addressed piece of one or more chunked Files.
+// ReferenceCount counts manifest entries, so a chunk repeated within a File
+// is counted once per occurrence.
+type Chunk struct {
+	Hash           string    `gorm:"primaryKey;size:64" json:"hash"`
+	Size           int64     `gorm:"not null" json:"size"`
+	StorageKey     string    `gorm:"not null;size:500" json:"-"`
+	ReferenceCount int       `gorm:"not null;default:0" json:"reference_count"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (Chunk) TableName() string {
+	return "chunks"
+}
+
+// FileChunk is one entry of a chunked File's manifest: the Seq-th piece of
+// the content, starting at byte Start.
+type FileChunk struct {
+	FileID    uint   `gorm:"primaryKey;autoIncrement:false" json:"file_id"`
+	Seq       int    `gorm:"primaryKey;autoIncrement:false" json:"seq"`
+	ChunkHash string `gorm:"not null;size:64;index" json:"chunk_hash"`
+	Start     int64  `gorm:"not null" json:"start"`
+	Size      int64  `gorm:"not null" json:"size"`
+}
+
+func (FileChunk) TableName() string {
+	return "file_chunks"
+}
+
+// releaseChunks drops a File's manifest and its chunk references, deleting
+// the rows of chunks nothing else uses; their blobs are left to the garbage
+// collector. The chunk rows are locked in hash order first, the same order
+// writers insert them in, so concurrent releases and uploads sharing chunks
+// cannot deadlock.
+func (f *File) releaseChunks(tx *gorm.DB) error {
+	var hashes []string
+	err := tx.Raw(`
+		SELECT hash FROM chunks
+		WHERE hash IN (SELECT chunk_hash FROM file_chunks WHERE file_id = ?)
+		ORDER BY hash
+		FOR UPDATE`, f.ID).Scan(&hashes).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Exec(`
+		UPDATE chunks SET reference_count = chunks.reference_count - uses.n
+		FROM (SELECT chunk_hash, COUNT(*) AS n FROM file_chunks WHERE file_id = ? GROUP BY chunk_hash) AS uses
+		WHERE chunks.hash = uses.chunk_hash`, f.ID).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.Exec(`
+		DELETE FROM chunks
+		WHERE reference_count <= 0 AND hash IN (SELECT chunk_hash FROM file_chunks WHERE file_id = ?)`, f.ID).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Where("file_id = ?", f.ID).Delete(&FileChunk{}).Error
+}
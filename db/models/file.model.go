@@ -1,31 +1,84 @@
 package models
 
 import (
-	"os"
+	"hash/fnv"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// File is a stored blob, shared by every reference with the same content.
+// Chunked Files have no blob at StoragePath; their content is the
+// concatenation of the chunks listed in file_chunks. Codec is how the blob
+// is encoded and StoredSize its size as stored; Size is always the size of
+// the content. StoredSize is 0 for Files stored before it was recorded.
+// Tier is the storage tier holding the blob; lifecycle rules move Files
+// between tiers based on LastAccessedAt, which is nil until the first
+// download. RestoreRequestedAt is set while a cold File waits to be moved
+// back to the hot tier.
 type File struct {
-	ID             uint           `gorm:"primarykey" json:"id"`
-	Hash           string         `gorm:"unique;not null;size:64;index" json:"hash"`
-	OriginalName   string         `gorm:"not null;size:255" json:"original_name"`
-	MimeType       string         `gorm:"not null;size:255;index" json:"mime_type"`
-	Size           int64          `gorm:"not null" json:"size"`
-	StoragePath    string         `gorm:"not null;size:500" json:"storage_path"`
-	ReferenceCount int            `gorm:"default:1" json:"reference_count"`
-	CreatedAt      time.Time      `json:"created_at"`
-	UpdatedAt      time.Time      `json:"updated_at"`
-	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                 uint           `gorm:"primarykey" json:"id"`
+	Hash               string         `gorm:"unique;not null;size:64;index" json:"hash"`
+	OriginalName       string         `gorm:"not null;size:255" json:"original_name"`
+	MimeType           string         `gorm:"not null;size:255;index" json:"mime_type"`
+	Size               int64          `gorm:"not null" json:"size"`
+	StoragePath        string         `gorm:"not null;size:500" json:"storage_path"`
+	Chunked            bool           `gorm:"not null;default:false" json:"chunked"`
+	Codec              string         `gorm:"not null;size:16;default:none" json:"codec"`
+	StoredSize         int64          `gorm:"not null;default:0" json:"stored_size"`
+	Tier               string         `gorm:"not null;size:16;default:hot;index" json:"tier"`
+	LastAccessedAt     *time.Time     `json:"last_accessed_at,omitempty"`
+	RestoreRequestedAt *time.Time     `gorm:"index" json:"restore_requested_at,omitempty"`
+	ReferenceCount     int            `gorm:"not null;default:0" json:"reference_count"`
+	ScanStatus         string         `gorm:"size:20;index" json:"scan_status"`
+	ScanSignature      string         `gorm:"size:255" json:"scan_signature,omitempty"`
+	ScannedAt          *time.Time     `json:"scanned_at,omitempty"`
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+	DeletedAt          gorm.DeletedAt `gorm:"index" json:"-"`
 
 	FileReferences []FileReference `gorm:"foreignKey:FileID" json:"file_references,omitempty"`
 }
 
+// Scan statuses of a File. Files stored while no scanner was configured,
+// and files from before scanning existed, are unscanned.
+const (
+	ScanStatusUnscanned = "unscanned"
+	ScanStatusClean     = "clean"
+	ScanStatusInfected  = "infected"
+	ScanStatusError     = "error"
+)
+
 func (File) TableName() string {
 	return "files"
 }
 
+// Codecs of a File's blob.
+const (
+	CodecNone = "none"
+	CodecZstd = "zstd"
+)
+
+// Storage tiers of a File's blob. Chunks and previews are always hot.
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// hashLockSpace is the first key of the advisory locks taken per content
+// hash, keeping them apart from any other advisory locks.
+const hashLockSpace = 0x766f6c74 // "volt"
+
+// LockHash takes a transaction-scoped advisory lock on a content hash. Every
+// path that creates, references or releases a File holds it until commit, so
+// concurrent uploads and deletes of the same content run one at a time. The
+// lock is reentrant within a transaction.
+func LockHash(tx *gorm.DB, hash string) error {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	return tx.Exec("SELECT pg_advisory_xact_lock(?::int, ?::int)", hashLockSpace, int32(h.Sum32())).Error
+}
+
 func (f *File) IncrementReferenceCount(tx *gorm.DB) error {
 	return tx.Model(f).UpdateColumn("reference_count", gorm.Expr("reference_count + 1")).Error
 }
@@ -45,6 +98,9 @@ func (f *File) CanBeDeleted(tx *gorm.DB) (bool, error) {
 	return count <= 0, err
 }
 
+// FileReference is a user's file. Size and MimeType are copies of the
+// File's, whose content never changes, so that the listing can sort and
+// filter on indexed columns of file_references.
 type FileReference struct {
 	ID          uint           `gorm:"primarykey" json:"id"`
 	UserID      uint           `gorm:"not null;index" json:"user_id"`
@@ -52,6 +108,9 @@ type FileReference struct {
 	DisplayName string         `gorm:"not null;size:255" json:"display_name"`
 	IsDuplicate bool           `gorm:"default:false" json:"is_duplicate"`
 	IsPrivate   bool           `gorm:"default:true" json:"is_private"`
+	Tags        string         `gorm:"size:1000" json:"tags"`
+	Size        int64          `gorm:"not null;default:0" json:"size"`
+	MimeType    string         `gorm:"not null;size:255;default:''" json:"mime_type"`
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
@@ -64,11 +123,18 @@ func (FileReference) TableName() string {
 	return "file_references"
 }
 
+// The reference hooks run inside the create or delete transaction and hold
+// the File's hash lock, so a count never races with an upload that is about
+// to reference the same File.
 func (fr *FileReference) BeforeCreate(tx *gorm.DB) error {
 	var file File
 	if err := tx.First(&file, fr.FileID).Error; err != nil {
 		return err
 	}
+	if err := LockHash(tx, file.Hash); err != nil {
+		return err
+	}
+	fr.Size, fr.MimeType = file.Size, file.MimeType
 	return file.IncrementReferenceCount(tx)
 }
 
@@ -77,6 +143,9 @@ func (fr *FileReference) AfterDelete(tx *gorm.DB) error {
 	if err := tx.First(&file, fr.FileID).Error; err != nil {
 		return err
 	}
+	if err := LockHash(tx, file.Hash); err != nil {
+		return err
+	}
 
 	if err := file.DecrementReferenceCount(tx); err != nil {
 		return err
@@ -88,46 +157,133 @@ func (fr *FileReference) AfterDelete(tx *gorm.DB) error {
 	}
 
 	if canDelete {
-		if file.StoragePath != "" {
+		return file.Release(tx)
+	}
 
-			os.Remove(file.StoragePath)
-		}
+	return nil
+}
 
-		return tx.Delete(&File{}, file.ID).Error
+// Release deletes an unreferenced File together with its previews. Only
+// rows are deleted: the blobs stay until the garbage collector finds
+// nothing using them, so rolling back the transaction loses no content.
+// The caller must hold the File's hash lock.
+func (f *File) Release(tx *gorm.DB) error {
+	if f.Chunked {
+		if err := f.releaseChunks(tx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Where("file_id = ?", f.ID).Delete(&FilePreview{}).Error; err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Delete(&File{}, f.ID).Error
 }
 
+// UserStorageStats describes a user's files. ChunkSavedBytes is how much of
+// their chunked content is shared with other chunked content: each chunk's
+// size is split evenly between its uses, and the rest of the logical size
+// is saved. LogicalBytes is the size of their files' content, as is
+// TotalStorageUsed; PhysicalBytes is what that content takes as stored,
+// after compression.
 type UserStorageStats struct {
-	UserID             int     `json:"user_id"`
-	TotalFiles         int     `json:"total_files"`
-	DuplicateFiles     int     `json:"duplicate_files"`
-	TotalStorageUsed  int64            `json:"total_storage_used"`
+	UserID           int   `json:"user_id"`
+	TotalFiles       int   `json:"total_files"`
+	DuplicateFiles   int   `json:"duplicate_files"`
+	TotalStorageUsed int64 `json:"total_storage_used"`
+	LogicalBytes     int64 `json:"logical_bytes"`
+	PhysicalBytes    int64 `json:"physical_bytes"`
+	ChunkSavedBytes  int64 `json:"chunk_saved_bytes"`
 }
 
 type UploadResponse struct {
 	Success      bool               `json:"success"`
 	Message      string             `json:"message"`
 	Files        []FileUploadResult `json:"files"`
+	Summary      UploadSummary      `json:"summary"`
 	StorageStats UserStorageStats   `json:"storage_stats"`
 }
 
+const (
+	UploadStatusUploaded  = "uploaded"
+	UploadStatusDuplicate = "duplicate"
+	UploadStatusError     = "error"
+)
+
+// FileUploadResult is the outcome of one file of an upload. Failed files
+// carry Code and Error instead of a reference; Err keeps the original error
+// for logging and is never serialised. ChunkSavedBytes is the part of new
+// chunked content that was already stored as chunks of other files.
+// Digests holds the hex digests of the uploaded bytes by algorithm, for
+// clients to compare with their own.
 type FileUploadResult struct {
-	FileReference FileReference `json:"file_reference"`
-	File          File          `json:"file"`
-	WasDuplicate  bool          `json:"was_duplicate"`
-	SavedBytes    int64         `json:"saved_bytes"`
+	Name            string            `json:"name"`
+	Status          string            `json:"status"`
+	FileReference   *FileReference    `json:"file_reference,omitempty"`
+	File            *File             `json:"file,omitempty"`
+	WasDuplicate    bool              `json:"was_duplicate"`
+	SavedBytes      int64             `json:"saved_bytes"`
+	ChunkSavedBytes int64             `json:"chunk_saved_bytes,omitempty"`
+	Code            string            `json:"code,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	ExtractJobID    *uint             `json:"extract_job_id,omitempty"`
+	Digests         map[string]string `json:"digests,omitempty"`
+
+	Err error `json:"-"`
+}
+
+// UploadCheckRequest asks for a reference to content the server may
+// already hold, named by its SHA-256, so that it need not be uploaded.
+// Name is the display name, which may be a relative path; references are
+// private unless IsPrivate says otherwise.
+type UploadCheckRequest struct {
+	SHA256    string `json:"sha256"`
+	Name      string `json:"name"`
+	IsPrivate *bool  `json:"is_private,omitempty"`
+	Tags      string `json:"tags,omitempty"`
+}
+
+type UploadSummary struct {
+	Total           int   `json:"total"`
+	Uploaded        int   `json:"uploaded"`
+	Duplicates      int   `json:"duplicates"`
+	Failed          int   `json:"failed"`
+	TotalBytes      int64 `json:"total_bytes"`
+	SavedBytes      int64 `json:"saved_bytes"`
+	ChunkSavedBytes int64 `json:"chunk_saved_bytes"`
 }
 
 type FileResponse struct {
-	ID          uint      `json:"id"`
-	UserID      uint      `json:"user_id"`
-	FileID      uint      `json:"file_id"`
-	DisplayName string    `json:"display_name"`
-	IsDuplicate bool      `json:"is_duplicate"`
-	IsPrivate   bool      `json:"is_private"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	File        File      `json:"file"`
+	ID          uint        `json:"id"`
+	UserID      uint        `json:"user_id"`
+	FileID      uint        `json:"file_id"`
+	DisplayName string      `json:"display_name"`
+	IsDuplicate bool        `json:"is_duplicate"`
+	IsPrivate   bool        `json:"is_private"`
+	Tags        string      `json:"tags"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	File        FileSummary `json:"file"`
+}
+
+// FileSummary is the part of a File shown to the users referencing it; where
+// and how its blob is stored stays internal.
+type FileSummary struct {
+	ID             uint      `json:"id"`
+	Hash           string    `json:"hash"`
+	OriginalName   string    `json:"original_name"`
+	MimeType       string    `json:"mime_type"`
+	Size           int64     `json:"size"`
+	ReferenceCount int       `json:"reference_count"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// FilePage is one page of a cursor-paginated file listing. Cursors are opaque
+// and only valid for the sort and filters they were issued with.
+type FilePage struct {
+	Items      []FileResponse `json:"items"`
+	Total      int64          `json:"total"`
+	Limit      int            `json:"limit"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	PrevCursor string         `json:"prev_cursor,omitempty"`
 }
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// IdempotencyKey is the stored response to a POST or DELETE a user sent
+// with an Idempotency-Key header, replayed to retries that send the same
+// key until ExpiresAt. StatusCode is 0 while the first request is still
+// being handled; that claim lapses at LockedUntil, should its replica die.
+// Fingerprint hashes the method, path and body, or the parts of a multipart
+// form, so a key reused for a different request can be told apart.
+type IdempotencyKey struct {
+	UserID      uint                `gorm:"primaryKey" json:"user_id"`
+	Key         string              `gorm:"primaryKey;size:255" json:"key"`
+	Fingerprint string              `gorm:"size:64" json:"-"`
+	StatusCode  int                 `gorm:"not null;default:0" json:"status_code"`
+	Header      map[string][]string `gorm:"serializer:json;type:text" json:"-"`
+	Body        []byte              `json:"-"`
+	LockedUntil time.Time           `json:"locked_until"`
+	CreatedAt   time.Time           `json:"created_at"`
+	ExpiresAt   time.Time           `gorm:"not null;index" json:"expires_at"`
+}
+
+func (IdempotencyKey) TableName() string {
+	return "idempotency_keys"
+}
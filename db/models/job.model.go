@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+)
+
+// ExtractionJob unpacks an archive reference into individual references
+// owned by UserID. Counters are updated while the job runs, so clients can
+// poll it for progress. EntriesTotal is only known up front for ZIP files.
+type ExtractionJob struct {
+	ID               uint       `gorm:"primarykey" json:"id"`
+	UserID           uint       `gorm:"not null;index" json:"user_id"`
+	FileReferenceID  uint       `gorm:"not null;index" json:"file_reference_id"`
+	Status           string     `gorm:"not null;size:20;index" json:"status"`
+	Format           string     `gorm:"size:20" json:"format"`
+	EntriesTotal     int        `json:"entries_total"`
+	EntriesDone      int        `json:"entries_done"`
+	EntriesCreated   int        `json:"entries_created"`
+	EntriesDuplicate int        `json:"entries_duplicate"`
+	EntriesSkipped   int        `json:"entries_skipped"`
+	EntriesFailed    int        `json:"entries_failed"`
+	BytesExtracted   int64      `json:"bytes_extracted"`
+	Errors           []string   `gorm:"serializer:json;type:text" json:"errors,omitempty"`
+	Error            string     `gorm:"size:500" json:"error,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	StartedAt        *time.Time `json:"started_at,omitempty"`
+	FinishedAt       *time.Time `json:"finished_at,omitempty"`
+}
+
+func (ExtractionJob) TableName() string {
+	return "extraction_jobs"
+}
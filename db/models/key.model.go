@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// DataKey is the data key of one or more encrypted blobs, stored only in
+// wrapped form. KEKID names the key-encryption key that wrapped it, so
+// rotating KEKs rewraps these rows and never touches the blobs.
+type DataKey struct {
+	ID         string    `gorm:"primaryKey;size:32" json:"id"`
+	KEKID      string    `gorm:"column:kek_id;not null;size:255;index" json:"kek_id"`
+	WrappedKey []byte    `gorm:"not null" json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (DataKey) TableName() string {
+	return "data_keys"
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// BlobLayout records how an erasure-coded blob is split into shards. The
+// blob is cut into stripes of DataShards blocks of BlockSize bytes, the
+// last one padded with zeros, and every stripe gets ParityShards parity
+// blocks; shard i is the i-th block of every stripe, stored under Key on
+// the backend Shards[i] names. Hash is the content hash the key is named
+// by, so a File's layout is the row whose Hash is File.Hash; it is empty
+// for blobs not named by a hash.
+type BlobLayout struct {
+	Key          string     `gorm:"primaryKey;size:500" json:"key"`
+	Hash         string     `gorm:"size:64;index" json:"hash,omitempty"`
+	Size         int64      `gorm:"not null" json:"size"`
+	DataShards   int        `gorm:"not null" json:"data_shards"`
+	ParityShards int        `gorm:"not null" json:"parity_shards"`
+	BlockSize    int        `gorm:"not null" json:"block_size"`
+	Shards       []ShardRef `gorm:"serializer:json;type:text;not null" json:"shards"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// ShardRef is where one shard of a blob lives. SHA256 is the hash of the
+// complete shard, empty while the shard is missing.
+type ShardRef struct {
+	Backend string `json:"backend"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+func (BlobLayout) TableName() string {
+	return "blob_layouts"
+}
+
+// Stripes is the number of stripes the blob is cut into, which is also the
+// number of blocks in each shard.
+func (l *BlobLayout) Stripes() int64 {
+	stripe := int64(l.DataShards) * int64(l.BlockSize)
+	return (l.Size + stripe - 1) / stripe
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+const (
+	PreviewStatusReady       = "ready"
+	PreviewStatusFailed      = "failed"
+	PreviewStatusUnsupported = "unsupported"
+)
+
+// FilePreview records one rendered preview size of a File. Previews are
+// keyed by the blob's hash, so deduplicated references share them.
+type FilePreview struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	FileID      uint      `gorm:"not null;uniqueIndex:idx_file_previews_file_size" json:"file_id"`
+	Size        string    `gorm:"not null;size:20;uniqueIndex:idx_file_previews_file_size" json:"size"`
+	Hash        string    `gorm:"not null;size:64;index" json:"hash"`
+	Kind        string    `gorm:"size:20" json:"kind"`
+	Status      string    `gorm:"not null;size:20" json:"status"`
+	StorageKey  string    `gorm:"size:500" json:"-"`
+	ContentType string    `gorm:"size:100" json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Error       string    `gorm:"size:500" json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (FilePreview) TableName() string {
+	return "file_previews"
+}
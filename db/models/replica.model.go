@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// BlobReplica records that the replica named Replica holds a complete copy
+// of the blob at Key. A File's replicas are the rows for its StoragePath.
+// Rows are written by the replicating blob store and its repair worker;
+// replicas without a row may still hold a stale copy, never a newer one.
+type BlobReplica struct {
+	Key       string    `gorm:"primaryKey;size:500" json:"key"`
+	Replica   string    `gorm:"primaryKey;size:100;index" json:"replica"`
+	Size      int64     `gorm:"not null" json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (BlobReplica) TableName() string {
+	return "blob_replicas"
+}
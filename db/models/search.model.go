@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// FileText caches the text extracted from a blob. It is keyed by File, so
+// deduplicated references share one extraction.
+type FileText struct {
+	FileID      uint      `gorm:"primarykey" json:"file_id"`
+	Content     string    `gorm:"type:text" json:"-"`
+	Extractor   string    `gorm:"size:50" json:"extractor"`
+	Error       string    `gorm:"size:500" json:"error,omitempty"`
+	ExtractedAt time.Time `json:"extracted_at"`
+}
+
+func (FileText) TableName() string {
+	return "file_texts"
+}
+
+// FileSearchEntry holds the weighted tsvector of one FileReference: display
+// name and tags, MIME type and extracted content.
+type FileSearchEntry struct {
+	FileReferenceID uint      `gorm:"primarykey" json:"file_reference_id"`
+	UserID          uint      `gorm:"not null;index" json:"user_id"`
+	Document        string    `gorm:"type:tsvector;not null" json:"-"`
+	IndexedAt       time.Time `json:"indexed_at"`
+}
+
+func (FileSearchEntry) TableName() string {
+	return "file_search_entries"
+}
+
+type SearchResult struct {
+	FileResponse
+	Rank float64 `json:"rank"`
+}
+
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+	Total   int64          `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+}
@@ -9,11 +9,18 @@
 		"gorm.io/gorm"
 	)
 
+	// Roles are granted directly in the database; new users are RoleUser.
+	const (
+		RoleUser  = "user"
+		RoleAdmin = "admin"
+	)
+
 	type User struct {
 		ID        uint           `gorm:"primarykey" json:"id"`
 		Username  string         `gorm:"unique;not null;size:255" json:"username" validate:"required,min=3,max=50"`
 		Email     string         `gorm:"unique;not null;size:255" json:"email" validate:"required,email"`
 		Password  string         `gorm:"not null" json:"-"`
+		Role      string         `gorm:"not null;size:20;default:user" json:"role"`
 		CreatedAt time.Time      `json:"created_at"`
 		UpdatedAt time.Time      `json:"updated_at"`
 		DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
@@ -31,6 +38,7 @@
 		ID        uint      `json:"id"`
 		Username  string    `json:"username"`
 		Email     string    `json:"email"`
+		Role      string    `json:"role"`
 		CreatedAt time.Time `json:"created_at"`
 		UpdatedAt time.Time `json:"updated_at"`
 	}
@@ -69,6 +77,7 @@
 			ID:        u.ID,
 			Username:  u.Username,
 			Email:     u.Email,
+			Role:      u.Role,
 			CreatedAt: u.CreatedAt,
 			UpdatedAt: u.UpdatedAt,
 		}
@@ -0,0 +1,86 @@
+// Command volt-keys manages the key-encryption keys (KEKs) that wrap the
+// data keys of encrypted blobs. It reads the same environment as the file
+// service.
+//
+//	volt-keys rotate            # rewrap data keys with the current KEK
+//	volt-keys rotate -dry-run   # count data keys still on older KEKs
+//
+// To rotate, make a new KEK current (add it to the keyfile and point
+// "current" at it, or rotate the transit key in Vault), restart the file
+// service so new data keys use it, then run rotate. Blobs are not rewritten.
+// rotate exits 1 when data keys are left on older KEKs.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"volt/db/config"
+	"volt/file-service/pkg/encryption"
+
+	"github.com/joho/godotenv"
+	"gorm.io/gorm/logger"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	godotenv.Load()
+
+	switch os.Args[1] {
+	case "rotate":
+		rotate(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: volt-keys rotate [-dry-run] [-batch n]")
+	os.Exit(2)
+}
+
+func rotate(args []string) {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only count data keys wrapped by older KEKs")
+	batch := fs.Int("batch", 500, "data keys read per query")
+	fs.Parse(args)
+
+	keys, err := encryption.ProviderFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure key provider: %v", err)
+	}
+	if keys == nil {
+		log.Fatal("ENCRYPTION_KEY_PROVIDER is not set")
+	}
+	if err := config.InitDatabase(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer config.CloseDatabase()
+	config.DB.Logger = logger.New(log.New(os.Stderr, "", log.LstdFlags), logger.Config{
+		SlowThreshold: time.Second,
+		LogLevel:      logger.Warn,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := encryption.Rotate(ctx, keys, *batch, *dryRun)
+	if err != nil {
+		log.Fatalf("Rotation failed: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+	if len(result.Remaining) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,167 @@
+// Command volt-migrate-layout moves blobs stored under the old flat layout
+// (uploads/<hash><ext>) to their content-addressed keys (uploads/ab/cd/<hash>)
+// and points File.StoragePath at them. Run it once from the service's working
+// directory (or pass -root), with the same environment as the service.
+//
+// Each blob is copied within its tier under the File's hash lock and checked
+// against the File's hash before the File is updated; the old blob is deleted after the
+// update commits. A File whose blob is missing or corrupt is reported and
+// left as it is. The command can be interrupted and run again, and the
+// service may keep running meanwhile. It exits 1 when any File could not be
+// moved.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/encryption"
+	"volt/file-service/pkg/erasure"
+	"volt/file-service/pkg/replication"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/storage"
+	"volt/file-service/pkg/tiering"
+
+	"github.com/joho/godotenv"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var errChanged = errors.New("file changed during migration")
+
+func main() {
+	root := flag.String("root", ".", "directory the blob keys are relative to")
+	dryRun := flag.Bool("dry-run", false, "only list the blobs that would move")
+	flag.Parse()
+
+	godotenv.Load()
+	if err := os.Chdir(*root); err != nil {
+		log.Fatalf("Failed to enter %s: %v", *root, err)
+	}
+	if err := config.InitDatabase(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer config.CloseDatabase()
+	config.DB.Logger = logger.New(log.New(os.Stderr, "", log.LstdFlags), logger.Config{
+		SlowThreshold: time.Second,
+		LogLevel:      logger.Warn,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := tiering.Configure(); err != nil {
+		log.Fatalf("Failed to configure storage tiers: %v", err)
+	}
+	if _, err := replication.Configure(); err != nil {
+		log.Fatalf("Failed to configure replication: %v", err)
+	}
+	if _, err := erasure.Configure(); err != nil {
+		log.Fatalf("Failed to configure erasure coding: %v", err)
+	}
+	if _, err := encryption.Configure(ctx); err != nil {
+		log.Fatalf("Failed to configure encryption: %v", err)
+	}
+
+	start := time.Now()
+	moved, failed, err := migrateAll(ctx, *dryRun)
+	if err != nil {
+		log.Fatalf("Migration stopped after %d files: %v", moved, err)
+	}
+
+	verb := "Moved"
+	if *dryRun {
+		verb = "Would move"
+	}
+	log.Printf("%s %d blobs in %s, %d failed", verb, moved, time.Since(start).Round(time.Second), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// migrateAll moves the blob of every whole File that is not in the sharded
+// layout yet and reports how many moved and how many could not be moved.
+// With dryRun, it only prints what it would move.
+func migrateAll(ctx context.Context, dryRun bool) (moved, failed int, err error) {
+	var batch []models.File
+	result := config.DB.WithContext(ctx).Where("chunked = ?", false).Order("id").
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				file := &batch[i]
+				key := targetKey(file)
+				if file.StoragePath == key {
+					continue
+				}
+				if dryRun {
+					fmt.Printf("%s -> %s\n", file.StoragePath, key)
+					moved++
+					continue
+				}
+				if err := migrate(ctx, file, key); err != nil {
+					log.Printf("File %d (%s): %v", file.ID, file.StoragePath, err)
+					failed++
+					continue
+				}
+				moved++
+			}
+			return nil
+		})
+	return moved, failed, result.Error
+}
+
+// targetKey is where file's blob belongs in the sharded layout.
+func targetKey(file *models.File) string {
+	key := storage.BlobKey(file.Hash)
+	if strings.HasPrefix(file.StoragePath, path.Join("uploads", "quarantine")+"/") {
+		key = scan.QuarantineKey(file.Hash)
+	}
+	return key + content.Suffix(file.Codec)
+}
+
+func migrate(ctx context.Context, file *models.File, key string) error {
+	store, err := content.StoreFor(file.Tier)
+	if err != nil {
+		return err
+	}
+	old := file.StoragePath
+	err = config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, file.Hash); err != nil {
+			return err
+		}
+		var current models.File
+		if err := tx.First(&current, file.ID).Error; err != nil {
+			return err
+		}
+		if current.StoragePath != old || current.Codec != file.Codec || current.Tier != file.Tier {
+			return errChanged
+		}
+
+		if err := content.Copy(config.WithTx(ctx, tx), &current, store, key); err != nil {
+			return err
+		}
+		if err := tx.Model(&current).UpdateColumn("storage_path", key).Error; err != nil {
+			store.Delete(context.WithoutCancel(ctx), key)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, old)
+}
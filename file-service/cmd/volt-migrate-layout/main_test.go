@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"volt/db/dbtest"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/storage"
+
+	"github.com/klauspost/compress/zstd"
+	"gorm.io/gorm"
+)
+
+func TestTargetKey(t *testing.T) {
+	hash := strings.Repeat("ab12", 16)
+	tests := []struct {
+		path  string
+		codec string
+		want  string
+	}{
+		{path: "uploads/" + hash + ".txt", codec: models.CodecNone, want: storage.BlobKey(hash)},
+		{path: "uploads/" + hash + ".zst", codec: models.CodecZstd, want: storage.BlobKey(hash) + ".zst"},
+		{path: "uploads/quarantine/" + hash + ".exe", codec: models.CodecNone, want: scan.QuarantineKey(hash)},
+		{path: "uploads/quarantined-" + hash, codec: models.CodecNone, want: storage.BlobKey(hash)},
+	}
+	for _, tt := range tests {
+		if got := targetKey(&models.File{Hash: hash, StoragePath: tt.path, Codec: tt.codec}); got != tt.want {
+			t.Errorf("targetKey(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+type seeded struct {
+	file    models.File
+	body    string
+	sharded bool // whether the File ends up in the sharded layout
+}
+
+// seed stores blob at key, in which <hash> and <key> stand for the hash of
+// body and its sharded key, and a File whose content is body pointing at it.
+func seed(t *testing.T, db *gorm.DB, store storage.Store, body, key, codec string, blob []byte) seeded {
+	t.Helper()
+	sum := sha256.Sum256([]byte(body))
+	hash := hex.EncodeToString(sum[:])
+	key = strings.NewReplacer("<hash>", hash, "<key>", storage.BlobKey(hash)).Replace(key)
+	if blob != nil {
+		if _, err := store.Put(context.Background(), key, strings.NewReader(string(blob))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := models.File{
+		Hash: hash, OriginalName: "a.txt", MimeType: "text/plain", Size: int64(len(body)),
+		StoragePath: key, Codec: codec, Tier: models.TierHot,
+	}
+	if err := db.Create(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+	return seeded{file: file, body: body}
+}
+
+func compressed(t *testing.T, body string) []byte {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll([]byte(body), nil)
+}
+
+func TestMigrateAll(t *testing.T) {
+	db := dbtest.Open(t)
+	store := storage.NewLocal(t.TempDir())
+	prev := storage.Blobs
+	storage.Blobs = store
+	t.Cleanup(func() { storage.Blobs = prev })
+
+	files := []seeded{
+		seed(t, db, store, "a flat text file", "uploads/<hash>.txt", models.CodecNone, []byte("a flat text file")),
+		seed(t, db, store, "no extension", "uploads/<hash>", models.CodecNone, []byte("no extension")),
+		seed(t, db, store, "compressed, compressed, compressed", "uploads/<hash>.zst", models.CodecZstd,
+			compressed(t, "compressed, compressed, compressed")),
+		seed(t, db, store, "quarantined", "uploads/quarantine/<hash>.exe", models.CodecNone, []byte("quarantined")),
+	}
+	// A run that was interrupted after copying this blob left the copy behind.
+	interrupted := seed(t, db, store, "copied before an interruption", "uploads/<hash>.md", models.CodecNone,
+		[]byte("copied before an interruption"))
+	if _, err := store.Put(context.Background(), targetKey(&interrupted.file), strings.NewReader(interrupted.body)); err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, interrupted, seed(t, db, store, "already sharded", "<key>", models.CodecNone, []byte("already sharded")))
+	for i := range files {
+		files[i].sharded = true
+	}
+	files = append(files,
+		seed(t, db, store, "missing", "uploads/<hash>.pdf", models.CodecNone, nil),
+		seed(t, db, store, "the original", "uploads/<hash>.bin", models.CodecNone, []byte("bit rot")),
+	)
+
+	if moved, failed, err := migrateAll(context.Background(), true); err != nil || moved != 7 || failed != 0 {
+		t.Errorf("dry run = %d moved, %d failed, %v; want 7 listed", moved, failed, err)
+	}
+	for _, f := range files {
+		if got := storagePath(t, db, f.file.ID); got != f.file.StoragePath {
+			t.Errorf("dry run moved file %d to %s", f.file.ID, got)
+		}
+	}
+
+	// Running again moves nothing, and only the Files that failed fail again.
+	for run, want := range []struct{ moved, failed int }{{5, 2}, {0, 2}} {
+		moved, failed, err := migrateAll(context.Background(), false)
+		if err != nil || moved != want.moved || failed != want.failed {
+			t.Errorf("run %d = %d moved, %d failed, %v; want %d and %d", run+1, moved, failed, err, want.moved, want.failed)
+		}
+		checkAgree(t, db, store, files)
+	}
+}
+
+func storagePath(t *testing.T, db *gorm.DB, id uint) string {
+	t.Helper()
+	var file models.File
+	if err := db.First(&file, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return file.StoragePath
+}
+
+// checkAgree checks that every File that could be moved points at its
+// sharded key, whose blob has its content, that the rest were left as they
+// were, and that no blob but theirs is left in the store.
+func checkAgree(t *testing.T, db *gorm.DB, store storage.Store, files []seeded) {
+	t.Helper()
+	keys := make(map[string]bool)
+	for _, f := range files {
+		got := storagePath(t, db, f.file.ID)
+		if !f.sharded {
+			if got != f.file.StoragePath {
+				t.Errorf("%q: moved to %s", f.body, got)
+			}
+			keys[got] = true
+			continue
+		}
+		want := targetKey(&f.file)
+		if got != want {
+			t.Errorf("%q: at %s, want %s", f.body, got, want)
+			continue
+		}
+		keys[got] = true
+
+		file := f.file
+		file.StoragePath = got
+		obj, err := content.Open(context.Background(), &file)
+		if err != nil {
+			t.Errorf("%q: %v", f.body, err)
+			continue
+		}
+		b, err := io.ReadAll(obj)
+		obj.Close()
+		if err != nil || string(b) != f.body {
+			t.Errorf("%q: content is %q, %v", f.body, b, err)
+		}
+	}
+	err := store.Walk(context.Background(), "uploads/", func(info storage.Info) error {
+		if !keys[info.Key] {
+			t.Errorf("blob %s is left in the store", info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,15 +3,29 @@ module volt/file-service
 go 1.24.0
 
 require (
+	github.com/alecthomas/chroma/v2 v2.20.0
 	github.com/gabriel-vasile/mimetype v1.4.10
 	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/gorilla/mux v1.8.1
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/reedsolomon v1.14.2
+	github.com/ledongthuc/pdf v0.0.0-20240201131950-da5b75280b06
+	go.opentelemetry.io/otel v1.36.0
+	golang.org/x/image v0.31.0
 	gorm.io/gorm v1.31.0
 )
 
 require (
+	github.com/dlclark/regexp2 v1.11.5 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/otel/metric v1.36.0 // indirect
+	go.opentelemetry.io/otel/trace v1.36.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.29.0 // indirect
 )
@@ -1,15 +1,34 @@
 package main
 
 import (
+	"context"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
+	"volt/common/health"
+	"volt/common/lifecycle"
+	"volt/common/metrics"
+	"volt/common/requestid"
+	"volt/common/tracing"
 	"volt/db/config"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/encryption"
+	"volt/file-service/pkg/erasure"
+	"volt/file-service/pkg/extract"
+	"volt/file-service/pkg/fsck"
+	"volt/file-service/pkg/gc"
+	"volt/file-service/pkg/idempotency"
 	"volt/file-service/pkg/middlewares"
+	"volt/file-service/pkg/policy"
+	"volt/file-service/pkg/preview"
+	"volt/file-service/pkg/replication"
 	"volt/file-service/pkg/routes"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/search"
+	"volt/file-service/pkg/storage"
+	"volt/file-service/pkg/tiering"
+	"volt/file-service/pkg/utils"
 
 	"github.com/joho/godotenv"
 
@@ -24,7 +43,12 @@ func main() {
 	if err := config.InitDatabase(); err != nil {
 		log.Fatalf("Failed to initialize GORM database: %v", err)
 	}
-	defer config.CloseDatabase()
+
+	lc := lifecycle.New()
+	lc.OnShutdown("database", func(ctx context.Context) error {
+		config.CloseDatabase()
+		return nil
+	})
 
 	if err := config.AutoMigrate(); err != nil {
 		log.Fatalf("Failed to run GORM migrations: %v", err)
@@ -34,30 +58,170 @@ func main() {
 		log.Fatalf("Failed to create uploads directory: %v", err)
 	}
 
+	shutdownTracing, err := tracing.Init(context.Background(), "file-service", config.GetEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""))
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	lc.OnShutdown("tracing", shutdownTracing)
+
+	if sqlDB, err := config.DB.DB(); err == nil {
+		if err := metrics.RegisterDBStats(sqlDB); err != nil {
+			log.Printf("Failed to register database metrics: %v", err)
+		}
+		health.Register("database", health.DatabaseCheck(sqlDB))
+	}
+	health.Register("jwt_secret", health.SecretCheck("JWT_SECRET", utils.JWTSecret, utils.DevelopmentJWTSecret))
+
+	if err := policy.Load(config.GetEnv("UPLOAD_POLICY_FILE", "")); err != nil {
+		log.Fatalf("Failed to load upload policy: %v", err)
+	}
+
+	if err := tiering.Configure(); err != nil {
+		log.Fatalf("Failed to configure storage tiers: %v", err)
+	}
+	if root := config.GetEnv("COLD_STORAGE_ROOT", ""); root != "" {
+		health.Register("cold_storage", health.StorageCheck(root))
+	}
+
+	replicas, err := replication.Configure()
+	if err != nil {
+		log.Fatalf("Failed to configure replication: %v", err)
+	}
+	if replicas != nil {
+		health.Register("storage_replicas", replicas.Check)
+		interval := config.GetEnvDuration("REPLICA_REPAIR_INTERVAL", time.Hour)
+		lc.Go("replica-repair", func(ctx context.Context) {
+			replication.Run(ctx, replicas, interval)
+		})
+	}
+
+	shards, err := erasure.Configure()
+	if err != nil {
+		log.Fatalf("Failed to configure erasure coding: %v", err)
+	}
+	if shards != nil {
+		health.Register("erasure_backends", shards.Check)
+		interval := config.GetEnvDuration("ERASURE_SCRUB_INTERVAL", 6*time.Hour)
+		verify := config.GetEnv("ERASURE_SCRUB_VERIFY", "false") == "true"
+		lc.Go("erasure-scrub", func(ctx context.Context) {
+			erasure.Run(ctx, shards, interval, verify)
+		})
+	}
+
+	// Replicas and erasure backends have checks of their own.
+	if replicas == nil && shards == nil {
+		health.Register("storage", health.StorageCheck("./uploads"))
+	}
+
+	keys, err := encryption.Configure(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to configure encryption: %v", err)
+	}
+	if keys != nil {
+		health.Register("key_provider", func(ctx context.Context) error {
+			_, err := keys.CurrentKEK(ctx)
+			return err
+		})
+	}
+
+	if err := content.Configure(); err != nil {
+		log.Fatalf("Failed to configure storage: %v", err)
+	}
+
+	if content.Compression {
+		interval := config.GetEnvDuration("RECOMPRESS_INTERVAL", time.Hour)
+		lc.Go("recompressor", func(ctx context.Context) {
+			content.RunRecompress(ctx, interval)
+		})
+	}
+
+	if interval := config.GetEnvDuration("TIER_INTERVAL", time.Hour); interval > 0 {
+		lc.Go("tier-lifecycle", func(ctx context.Context) {
+			tiering.Run(ctx, interval)
+		})
+	}
+	if storage.Cold != nil {
+		interval := config.GetEnvDuration("TIER_RESTORE_INTERVAL", 30*time.Second)
+		lc.Go("tier-restorer", func(ctx context.Context) {
+			tiering.RunRestores(ctx, interval)
+		})
+	}
+
+	clamd, err := scan.Configure()
+	if err != nil {
+		log.Fatalf("Failed to configure malware scanning: %v", err)
+	}
+	if clamd != nil {
+		health.Register("clamd", clamd.Ping)
+		lc.Go("malware-rescan", scan.Run)
+	}
+
+	if interval := config.GetEnvDuration("FSCK_INTERVAL", 24*time.Hour); interval > 0 {
+		opts := fsck.OptionsFromEnv()
+		lc.Go("integrity-check", func(ctx context.Context) {
+			fsck.Run(ctx, interval, opts)
+		})
+	}
+
+	if interval := config.GetEnvDuration("GC_INTERVAL", 6*time.Hour); interval > 0 {
+		opts := gc.OptionsFromEnv()
+		lc.Go("garbage-collector", func(ctx context.Context) {
+			gc.Run(ctx, interval, opts)
+		})
+	}
+
+	idempotency.Configure()
+	lc.Go("idempotency-purge", func(ctx context.Context) {
+		idempotency.Run(ctx, config.GetEnvDuration("IDEMPOTENCY_PURGE_INTERVAL", time.Hour))
+	})
+
+	lc.Go("search-indexer", func(ctx context.Context) {
+		search.Run(ctx, config.GetEnvInt("SEARCH_INDEX_WORKERS", 2))
+	})
+	if interval := config.GetEnvDuration("SEARCH_CATCH_UP_INTERVAL", 5*time.Minute); interval > 0 {
+		lc.Go("search-catch-up", func(ctx context.Context) {
+			search.RunCatchUp(ctx, interval)
+		})
+	}
+	preview.Configure()
+	lc.Go("preview-generator", func(ctx context.Context) {
+		preview.Run(ctx, config.GetEnvInt("PREVIEW_WORKERS", 2))
+	})
+	lc.Go("archive-extractor", func(ctx context.Context) {
+		extract.Run(ctx, config.GetEnvInt("EXTRACT_WORKERS", 1))
+	})
+
 	router := mux.NewRouter()
 
+	router.Use(tracing.Middleware("file-service"))
+	router.Use(requestid.Middleware)
 	router.Use(middlewares.CorsMiddleware)
 	router.Use(middlewares.LoggingMiddleware)
+	router.Use(metrics.Middleware)
 
 	routes.SetupRoutes(router)
 
-	router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads/"))))
-
 	port := config.GetEnv("FILE_PORT", "8081")
 
 	log.Printf("File management service starting on port %s", port)
 	log.Printf("Upload directory: ./uploads")
 
-	// Graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	serverConfig := lifecycle.ServerConfig{
+		ReadHeaderTimeout: config.GetEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       config.GetEnvDuration("HTTP_READ_TIMEOUT", 10*time.Minute),
+		WriteTimeout:      config.GetEnvDuration("HTTP_WRITE_TIMEOUT", 10*time.Minute),
+		IdleTimeout:       config.GetEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		ReadinessDelay:    config.GetEnvDuration("SHUTDOWN_READINESS_DELAY", 5*time.Second),
+		DrainTimeout:      config.GetEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second),
+	}
+	server := lifecycle.NewServer(":"+port, router, serverConfig)
 
-	go func() {
-		<-c
+	err = lifecycle.Serve(server, lc, serverConfig, func() {
+		health.SetShuttingDown()
 		log.Println("Shutting down server...")
-		config.CloseDatabase()
-		os.Exit(0)
-	}()
-
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	})
+	if err != nil {
+		log.Fatalf("Error during shutdown: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
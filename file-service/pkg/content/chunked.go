@@ -0,0 +1,323 @@
+package content
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ChunkKey is where a chunk's blob is stored.
+func ChunkKey(hash string) string {
+	return path.Join("uploads", "chunks", hash[:2], hash)
+}
+
+// stageChunks cuts src into chunks and stores those that have no chunk row
+// yet.
+func stageChunks(ctx context.Context, file *models.File, src Source) (*Staged, error) {
+	s := &Staged{first: make(map[string]int64), written: make(map[string]bool)}
+	uses := make(map[string]*models.Chunk)
+
+	c := newChunker(src, Sizes)
+	var offset int64
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(data))
+		s.manifest = append(s.manifest, models.FileChunk{
+			Seq:       len(s.manifest),
+			ChunkHash: hash,
+			Start:     offset,
+			Size:      int64(len(data)),
+		})
+		if u, ok := uses[hash]; ok {
+			u.ReferenceCount++
+		} else {
+			uses[hash] = &models.Chunk{Hash: hash, Size: int64(len(data)), StorageKey: ChunkKey(hash), ReferenceCount: 1}
+			s.first[hash] = offset
+		}
+		offset += int64(len(data))
+	}
+
+	hashes := make([]string, 0, len(uses))
+	for h := range uses {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	existing := make(map[string]bool, len(hashes))
+	for _, batch := range batches(hashes, 1000) {
+		var found []string
+		err := config.DB.WithContext(ctx).Model(&models.Chunk{}).Where("hash IN ?", batch).Pluck("hash", &found).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range found {
+			existing[h] = true
+		}
+	}
+
+	var written int64
+	for _, h := range hashes {
+		chunk := uses[h]
+		if !existing[h] {
+			if err := s.putChunk(ctx, src, chunk); err != nil {
+				return nil, err
+			}
+			s.written[h] = true
+			written += chunk.Size
+		}
+		s.chunks = append(s.chunks, *chunk)
+	}
+	s.ReusedBytes = offset - written
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("content.chunks", len(s.manifest)),
+		attribute.Int("content.new_chunks", len(s.written)),
+	)
+	return s, nil
+}
+
+func (s *Staged) putChunk(ctx context.Context, src Source, chunk *models.Chunk) error {
+	section := io.NewSectionReader(src, s.first[chunk.Hash], chunk.Size)
+	if _, err := storage.Blobs.Put(ctx, chunk.StorageKey, storage.Verified(section, chunk.Hash)); err != nil {
+		return fmt.Errorf("storing chunk %s: %w", chunk.Hash, err)
+	}
+	return nil
+}
+
+// commitChunks inserts the chunk rows and the manifest. Existing chunk rows
+// are locked in hash order before new ones are inserted in the same order,
+// so a concurrent release cannot delete a chunk this File is about to use
+// and concurrent writers cannot deadlock. A chunk whose row went away since
+// Stage is stored again, since the garbage collector may sweep its blob
+// once nothing refers to it; one Stage stored is only stored again if it
+// was swept already.
+func (s *Staged) commitChunks(ctx context.Context, tx *gorm.DB, file *models.File, src Source) error {
+	hashes := make([]string, len(s.chunks))
+	for i, c := range s.chunks {
+		hashes[i] = c.Hash
+	}
+
+	existing := make(map[string]bool, len(hashes))
+	for _, batch := range batches(hashes, 1000) {
+		var found []string
+		err := tx.Model(&models.Chunk{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("hash IN ?", batch).Order("hash").Pluck("hash", &found).Error
+		if err != nil {
+			return err
+		}
+		for _, h := range found {
+			existing[h] = true
+		}
+	}
+
+	for i := range s.chunks {
+		chunk := &s.chunks[i]
+		if existing[chunk.Hash] {
+			continue
+		}
+		if s.written[chunk.Hash] {
+			_, err := storage.Blobs.Stat(ctx, chunk.StorageKey)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+		}
+		if err := s.putChunk(ctx, src, chunk); err != nil {
+			return err
+		}
+	}
+
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"reference_count": gorm.Expr("chunks.reference_count + excluded.reference_count")}),
+	}).CreateInBatches(s.chunks, 500).Error
+	if err != nil {
+		return err
+	}
+	manifest := make([]models.FileChunk, len(s.manifest))
+	for i, e := range s.manifest {
+		e.FileID = file.ID
+		manifest[i] = e
+	}
+	return tx.CreateInBatches(manifest, 1000).Error
+}
+
+func batches(s []string, n int) [][]string {
+	var out [][]string
+	for len(s) > n {
+		out = append(out, s[:n])
+		s = s[n:]
+	}
+	if len(s) > 0 {
+		out = append(out, s)
+	}
+	return out
+}
+
+type manifestEntry struct {
+	Start      int64
+	Size       int64
+	StorageKey string
+}
+
+func openChunks(ctx context.Context, file *models.File) (storage.Object, error) {
+	var entries []manifestEntry
+	err := config.DB.WithContext(ctx).Table("file_chunks").
+		Select("file_chunks.start, file_chunks.size, chunks.storage_key").
+		Joins("JOIN chunks ON chunks.hash = file_chunks.chunk_hash").
+		Where("file_chunks.file_id = ?", file.ID).
+		Order("file_chunks.seq").
+		Scan(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, e := range entries {
+		if e.Start != size {
+			return nil, fmt.Errorf("manifest of file %d is broken at offset %d", file.ID, size)
+		}
+		size += e.Size
+	}
+	if size != file.Size {
+		return nil, fmt.Errorf("manifest of file %d covers %d of %d bytes", file.ID, size, file.Size)
+	}
+	return &chunkedObject{ctx: ctx, entries: entries, size: size, cur: -1}, nil
+}
+
+// chunkedObject reassembles a chunked File. Sequential reads keep the
+// current chunk open; seeks and ReadAt open the chunks they touch.
+type chunkedObject struct {
+	ctx     context.Context
+	entries []manifestEntry
+	size    int64
+	pos     int64
+
+	cur    int
+	obj    storage.Object
+	objPos int64
+}
+
+func (o *chunkedObject) Size() int64 {
+	return o.size
+}
+
+// find returns the index of the chunk holding offset off.
+func (o *chunkedObject) find(off int64) int {
+	return sort.Search(len(o.entries), func(i int) bool {
+		return o.entries[i].Start+o.entries[i].Size > off
+	})
+}
+
+func (o *chunkedObject) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	i := o.find(o.pos)
+	e := o.entries[i]
+	if o.cur != i {
+		o.closeCurrent()
+		obj, err := storage.Blobs.Open(o.ctx, e.StorageKey)
+		if err != nil {
+			return 0, err
+		}
+		o.cur, o.obj, o.objPos = i, obj, 0
+	}
+	if within := o.pos - e.Start; within != o.objPos {
+		if _, err := o.obj.Seek(within, io.SeekStart); err != nil {
+			return 0, err
+		}
+		o.objPos = within
+	}
+	if left := e.Size - o.objPos; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := o.obj.Read(p)
+	o.pos += int64(n)
+	o.objPos += int64(n)
+	if errors.Is(err, io.EOF) {
+		if o.objPos < e.Size {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (o *chunkedObject) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for n < len(p) {
+		if off >= o.size {
+			return n, io.EOF
+		}
+		e := o.entries[o.find(off)]
+		obj, err := storage.Blobs.Open(o.ctx, e.StorageKey)
+		if err != nil {
+			return n, err
+		}
+		want := p[n:]
+		if left := e.Size - (off - e.Start); int64(len(want)) > left {
+			want = want[:left]
+		}
+		m, err := obj.ReadAt(want, off-e.Start)
+		obj.Close()
+		n += m
+		off += int64(m)
+		if err != nil && !(errors.Is(err, io.EOF) && m == len(want)) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (o *chunkedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *chunkedObject) closeCurrent() {
+	if o.obj != nil {
+		o.obj.Close()
+		o.obj, o.cur = nil, -1
+	}
+}
+
+func (o *chunkedObject) Close() error {
+	o.closeCurrent()
+	return nil
+}
@@ -0,0 +1,107 @@
+package content
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"volt/file-service/pkg/storage"
+)
+
+func useTempBlobs(t *testing.T) {
+	t.Helper()
+	prev := storage.Blobs
+	storage.Blobs = storage.NewLocal(t.TempDir())
+	t.Cleanup(func() { storage.Blobs = prev })
+}
+
+// storeChunks stores data cut at the given sizes and returns an object
+// reassembling it.
+func storeChunks(t *testing.T, data []byte, sizes ...int) *chunkedObject {
+	t.Helper()
+	o := &chunkedObject{ctx: context.Background(), size: int64(len(data)), cur: -1}
+	var start int64
+	for _, size := range sizes {
+		chunk := data[start : start+int64(size)]
+		key := ChunkKey(fmt.Sprintf("%x", sha256.Sum256(chunk)))
+		if _, err := storage.Blobs.Put(context.Background(), key, bytes.NewReader(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		o.entries = append(o.entries, manifestEntry{Start: start, Size: int64(size), StorageKey: key})
+		start += int64(size)
+	}
+	if start != int64(len(data)) {
+		t.Fatalf("chunk sizes cover %d of %d bytes", start, len(data))
+	}
+	return o
+}
+
+func TestChunkedObjectReadAt(t *testing.T) {
+	useTempBlobs(t)
+	data := randomBytes(6, 100)
+	// Chunks cover [0,30) [30,40) [40,41) [41,100).
+	o := storeChunks(t, data, 30, 10, 1, 59)
+
+	tests := []struct {
+		name    string
+		off     int64
+		n       int
+		wantN   int
+		wantEOF bool
+	}{
+		{name: "within first chunk", off: 5, n: 10, wantN: 10},
+		{name: "ends at chunk edge", off: 20, n: 10, wantN: 10},
+		{name: "starts at chunk edge", off: 30, n: 5, wantN: 5},
+		{name: "spans two chunks", off: 25, n: 10, wantN: 10},
+		{name: "spans one-byte chunk", off: 35, n: 10, wantN: 10},
+		{name: "only one-byte chunk", off: 40, n: 1, wantN: 1},
+		{name: "whole content", off: 0, n: 100, wantN: 100},
+		{name: "past the end", off: 90, n: 20, wantN: 10, wantEOF: true},
+		{name: "at the end", off: 100, n: 1, wantN: 0, wantEOF: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make([]byte, tt.n)
+			n, err := o.ReadAt(p, tt.off)
+			if n != tt.wantN {
+				t.Fatalf("ReadAt read %d bytes, want %d", n, tt.wantN)
+			}
+			if tt.wantEOF != errors.Is(err, io.EOF) || err != nil && !errors.Is(err, io.EOF) {
+				t.Fatalf("ReadAt error = %v, want EOF %v", err, tt.wantEOF)
+			}
+			if !bytes.Equal(p[:n], data[tt.off:tt.off+int64(n)]) {
+				t.Errorf("ReadAt returned %x, want %x", p[:n], data[tt.off:tt.off+int64(n)])
+			}
+		})
+	}
+}
+
+func TestChunkedObjectRead(t *testing.T) {
+	useTempBlobs(t)
+	data := randomBytes(7, 100)
+	o := storeChunks(t, data, 30, 10, 1, 59)
+	defer o.Close()
+
+	got, err := io.ReadAll(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("sequential read does not match the content")
+	}
+
+	if _, err := o.Seek(38, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	if _, err := io.ReadFull(o, p); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[38:46]) {
+		t.Errorf("read after seek returned %x, want %x", p, data[38:46])
+	}
+}
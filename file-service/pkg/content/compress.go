@@ -0,0 +1,304 @@
+package content
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"volt/file-service/pkg/storage"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed blobs use the zstd seekable format: the content is cut into
+// frames of frameSize bytes that are compressed independently, followed by
+// a skippable frame holding the compressed and decompressed size of every
+// frame. A range read only decompresses the frames it covers, and any zstd
+// tool can still decompress the whole blob.
+const (
+	frameSize        = 256 << 10
+	skippableMagic   = 0x184D2A5E
+	seekableMagic    = 0x8F92EAB1
+	seekFooterSize   = 9
+	seekEntrySize    = 8
+	seekFrameHdrSize = 8
+)
+
+// compressibleTypes are compressed besides every text/* type.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-sh":       true,
+	"application/sql":        true,
+	"application/yaml":       true,
+	"application/x-yaml":     true,
+	"application/rtf":        true,
+	"application/postscript": true,
+	"application/x-tar":      true,
+	"application/x-sqlite3":  true,
+	"image/svg+xml":          true,
+	"image/bmp":              true,
+	"image/tiff":             true,
+}
+
+// Compressible reports whether content of the sniffed MIME type is worth
+// trying to compress. Already compressed formats are not.
+func Compressible(mimeType string) bool {
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	return strings.HasPrefix(mimeType, "text/") || compressibleTypes[mimeType]
+}
+
+var (
+	encoderOnce sync.Once
+	encoder     *zstd.Encoder
+	decoder, _  = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+func zstdEncoder() *zstd.Encoder {
+	encoderOnce.Do(func() {
+		encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(Level), zstd.WithEncoderConcurrency(1))
+	})
+	return encoder
+}
+
+// worthCompressing compresses a sample of the content and reports whether
+// it shrinks by at least MinSavings.
+func worthCompressing(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	compressed := zstdEncoder().EncodeAll(sample, nil)
+	return saves(int64(len(sample)), int64(len(compressed)))
+}
+
+func saves(size, stored int64) bool {
+	return size > 0 && float64(size-stored) >= MinSavings*float64(size)
+}
+
+// compressingReader produces the seekable zstd form of r.
+type compressingReader struct {
+	r     io.Reader
+	plain []byte
+	out   []byte
+	table []byte
+	n     int
+	done  bool
+}
+
+func newCompressingReader(r io.Reader) *compressingReader {
+	return &compressingReader{r: r, plain: make([]byte, frameSize)}
+}
+
+func (c *compressingReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.frame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *compressingReader) frame() error {
+	n, err := io.ReadFull(c.r, c.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n > 0 {
+		c.out = zstdEncoder().EncodeAll(c.plain[:n], c.out[:0])
+		c.table = binary.LittleEndian.AppendUint32(c.table, uint32(len(c.out)))
+		c.table = binary.LittleEndian.AppendUint32(c.table, uint32(n))
+		c.n++
+	}
+	if n < len(c.plain) {
+		c.out = append(c.out, c.seekTable()...)
+		c.done = true
+	}
+	return nil
+}
+
+func (c *compressingReader) seekTable() []byte {
+	size := len(c.table) + seekFooterSize
+	t := make([]byte, 0, seekFrameHdrSize+size)
+	t = binary.LittleEndian.AppendUint32(t, skippableMagic)
+	t = binary.LittleEndian.AppendUint32(t, uint32(size))
+	t = append(t, c.table...)
+	t = binary.LittleEndian.AppendUint32(t, uint32(c.n))
+	t = append(t, 0)
+	return binary.LittleEndian.AppendUint32(t, seekableMagic)
+}
+
+type frameEntry struct {
+	offset int64 // in the blob
+	stored int64
+	start  int64 // in the content
+	size   int64
+}
+
+// zstdObject decompresses a seekable zstd blob, keeping the last frame it
+// decompressed so sequential reads decompress every frame once.
+type zstdObject struct {
+	obj    storage.Object
+	frames []frameEntry
+	size   int64
+	pos    int64
+
+	mu    sync.Mutex
+	cur   int
+	plain []byte
+	buf   []byte
+}
+
+func openZstd(obj storage.Object, size int64) (*zstdObject, error) {
+	blob := obj.Size()
+	if blob < seekFrameHdrSize+seekFooterSize {
+		return nil, errors.New("compressed blob is truncated")
+	}
+	footer := make([]byte, seekFooterSize)
+	if err := readFull(obj, footer, blob-seekFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic || footer[4] != 0 {
+		return nil, errors.New("compressed blob has no seek table")
+	}
+	n := int64(binary.LittleEndian.Uint32(footer))
+	tableSize := n*seekEntrySize + seekFooterSize
+	if tableSize+seekFrameHdrSize > blob {
+		return nil, errors.New("compressed blob seek table is truncated")
+	}
+	table := make([]byte, seekFrameHdrSize+n*seekEntrySize)
+	if err := readFull(obj, table, blob-tableSize-seekFrameHdrSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table) != skippableMagic || int64(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, errors.New("compressed blob seek table is corrupt")
+	}
+
+	frames := make([]frameEntry, n)
+	var offset, start int64
+	for i := range frames {
+		e := table[seekFrameHdrSize+i*seekEntrySize:]
+		frames[i] = frameEntry{
+			offset: offset,
+			stored: int64(binary.LittleEndian.Uint32(e)),
+			start:  start,
+			size:   int64(binary.LittleEndian.Uint32(e[4:])),
+		}
+		offset += frames[i].stored
+		start += frames[i].size
+	}
+	if offset != blob-tableSize-seekFrameHdrSize || start != size {
+		return nil, fmt.Errorf("compressed blob holds %d bytes in %d frames, want %d", start, n, size)
+	}
+	return &zstdObject{obj: obj, frames: frames, size: size, cur: -1}, nil
+}
+
+// readFull reads len(p) bytes at off, where an io.EOF alongside a full read
+// is not an error.
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n < len(p) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (o *zstdObject) Size() int64 {
+	return o.size
+}
+
+// frame returns the content of frame i. The caller holds o.mu.
+func (o *zstdObject) frame(i int) ([]byte, error) {
+	if i == o.cur {
+		return o.plain, nil
+	}
+	f := o.frames[i]
+	if int64(cap(o.buf)) < f.stored {
+		o.buf = make([]byte, f.stored)
+	}
+	buf := o.buf[:f.stored]
+	if err := readFull(o.obj, buf, f.offset); err != nil {
+		return nil, err
+	}
+	o.cur = -1
+	plain, err := decoder.DecodeAll(buf, o.plain[:0])
+	if err != nil {
+		return nil, fmt.Errorf("decompressing frame %d: %w", i, err)
+	}
+	if int64(len(plain)) != f.size {
+		return nil, fmt.Errorf("frame %d holds %d bytes, want %d", i, len(plain), f.size)
+	}
+	o.cur, o.plain = i, plain
+	return plain, nil
+}
+
+func (o *zstdObject) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var n int
+	for n < len(p) {
+		if off >= o.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(o.frames), func(i int) bool {
+			return o.frames[i].start+o.frames[i].size > off
+		})
+		plain, err := o.frame(i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], plain[off-o.frames[i].start:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (o *zstdObject) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := o.ReadAt(p, o.pos)
+	o.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (o *zstdObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *zstdObject) Close() error {
+	return o.obj.Close()
+}
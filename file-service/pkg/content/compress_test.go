@@ -0,0 +1,129 @@
+package content
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+type memObject struct {
+	*bytes.Reader
+}
+
+func (memObject) Close() error {
+	return nil
+}
+
+// textContent returns n bytes of compressible, non-repeating text.
+func textContent(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < n; i++ {
+		fmt.Fprintf(&b, "line %d of a log file, value %x\n", i, i*2654435761)
+	}
+	return b.Bytes()[:n]
+}
+
+func compress(t *testing.T, plain []byte) []byte {
+	t.Helper()
+	blob, err := io.ReadAll(newCompressingReader(bytes.NewReader(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, frameSize - 1, frameSize, frameSize + 1, 3*frameSize + 7} {
+		plain := textContent(size)
+		blob := compress(t, plain)
+
+		obj, err := openZstd(memObject{bytes.NewReader(blob)}, int64(size))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		got, err := io.ReadAll(obj)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decompressed content differs", size)
+		}
+
+		// The seek table is a skippable frame, so a plain zstd decoder
+		// reads the blob too.
+		whole, err := decoder.DecodeAll(blob, nil)
+		if err != nil || !bytes.Equal(whole, plain) {
+			t.Errorf("%d bytes: plain zstd decoding failed: %v", size, err)
+		}
+	}
+	if blob := compress(t, textContent(3*frameSize)); len(blob) >= 3*frameSize/2 {
+		t.Errorf("text compressed to %d of %d bytes", len(blob), 3*frameSize)
+	}
+}
+
+func TestZstdReadAt(t *testing.T) {
+	plain := textContent(3*frameSize + 100)
+	obj, err := openZstd(memObject{bytes.NewReader(compress(t, plain))}, int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		off     int64
+		n       int
+		wantN   int
+		wantEOF bool
+	}{
+		{off: 0, n: 10, wantN: 10},
+		{off: frameSize - 1, n: 2, wantN: 2},
+		{off: frameSize, n: 1, wantN: 1},
+		{off: frameSize - 10, n: 2*frameSize + 20, wantN: 2*frameSize + 20},
+		{off: 3 * frameSize, n: 100, wantN: 100},
+		{off: 3*frameSize + 90, n: 20, wantN: 10, wantEOF: true},
+		{off: 3*frameSize + 100, n: 1, wantN: 0, wantEOF: true},
+		// Going back to an earlier frame after a later one.
+		{off: 5, n: 5, wantN: 5},
+	}
+	for _, tt := range tests {
+		p := make([]byte, tt.n)
+		n, err := obj.ReadAt(p, tt.off)
+		if n != tt.wantN || errors.Is(err, io.EOF) != tt.wantEOF || err != nil && !errors.Is(err, io.EOF) {
+			t.Errorf("ReadAt(%d bytes at %d) = %d, %v", tt.n, tt.off, n, err)
+			continue
+		}
+		if !bytes.Equal(p[:n], plain[tt.off:tt.off+int64(n)]) {
+			t.Errorf("ReadAt(%d bytes at %d) returned the wrong content", tt.n, tt.off)
+		}
+	}
+
+	if _, err := obj.Seek(2*frameSize-3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 6)
+	if _, err := io.ReadFull(obj, p); err != nil || !bytes.Equal(p, plain[2*frameSize-3:2*frameSize+3]) {
+		t.Errorf("read across a frame edge after Seek = %q, %v", p, err)
+	}
+}
+
+func TestOpenZstdRejectsBrokenBlobs(t *testing.T) {
+	plain := textContent(2*frameSize + 10)
+	blob := compress(t, plain)
+
+	tests := []struct {
+		name string
+		blob []byte
+		size int64
+	}{
+		{name: "truncated", blob: blob[:len(blob)-1], size: int64(len(plain))},
+		{name: "seek table only", blob: blob[len(blob)-seekFooterSize:], size: int64(len(plain))},
+		{name: "wrong size", blob: blob, size: int64(len(plain)) + 1},
+		{name: "not seekable", blob: blob[:len(blob)-seekFrameHdrSize-3*seekEntrySize-seekFooterSize], size: int64(len(plain))},
+	}
+	for _, tt := range tests {
+		if _, err := openZstd(memObject{bytes.NewReader(tt.blob)}, tt.size); err == nil {
+			t.Errorf("%s: openZstd succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Package content stores and reads the content of Files on top of the blob
+// store. A File is kept either as one blob at File.StoragePath, compressed
+// when File.Codec says so, or, in chunked mode, as an ordered manifest of
+// content-defined chunks that are shared between Files.
+package content
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"volt/common/metrics"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+var tracer = tracing.Tracer("volt/file-service/content")
+
+var (
+	// Chunking stores Files of at least ChunkMinFileSize bytes as chunks.
+	Chunking         bool
+	ChunkMinFileSize int64 = 8 << 20
+	Sizes                  = ChunkSizes{Min: 256 << 10, Avg: 1 << 20, Max: 8 << 20}
+
+	// Compression stores whole Files of a compressible type with zstd when
+	// that saves at least MinSavings of their size. It is off by default.
+	Compression bool
+	MinSavings  = 0.1
+	Level       = zstd.SpeedDefault
+)
+
+// Configure reads the storage mode from the environment.
+func Configure() error {
+	Chunking = config.GetEnv("STORAGE_CHUNKING", "false") == "true"
+	ChunkMinFileSize = int64(config.GetEnvInt("CHUNK_MIN_FILE_KB", int(ChunkMinFileSize>>10))) << 10
+	avg := config.GetEnvInt("CHUNK_AVG_KB", Sizes.Avg>>10) << 10
+	Sizes = ChunkSizes{Min: avg / 4, Avg: avg, Max: avg * 8}
+	if err := Sizes.validate(); err != nil {
+		return fmt.Errorf("invalid CHUNK_AVG_KB: %w", err)
+	}
+
+	Compression = config.GetEnv("STORAGE_COMPRESSION", "false") == "true"
+	MinSavings = float64(config.GetEnvInt("COMPRESSION_MIN_SAVINGS_PERCENT", int(MinSavings*100))) / 100
+	if name := config.GetEnv("COMPRESSION_LEVEL", ""); name != "" {
+		ok, level := zstd.EncoderLevelFromString(name)
+		if !ok {
+			return fmt.Errorf("invalid COMPRESSION_LEVEL %q: must be fastest, default, better or best", name)
+		}
+		Level = level
+	}
+	return nil
+}
+
+// ShouldChunk reports whether new content of size bytes is stored as chunks.
+func ShouldChunk(size int64) bool {
+	return Chunking && size >= ChunkMinFileSize
+}
+
+// Source is content being stored. Chunked writes read it twice, and read
+// the new chunks back by offset.
+type Source interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// Staged is content written to the blob store for a File that is not
+// committed yet. Its blobs sit at their content-addressed keys, which serve
+// as staging keys: nothing refers to them until Commit records them, and
+// the garbage collector leaves them alone for its grace period, so content
+// that is never committed needs no cleanup.
+type Staged struct {
+	// ReusedBytes is how much of the content was already stored as chunks.
+	ReusedBytes int64
+
+	manifest []models.FileChunk
+	chunks   []models.Chunk // one per distinct chunk, in hash order
+	first    map[string]int64
+	written  map[string]bool
+}
+
+// Stage writes the content of file to the blob store without touching the
+// database. Whole Files go to file.StoragePath, or compressed to that key
+// plus its Suffix, in which case the File's codec, key and stored size are
+// updated; chunked ones go to the chunk store. Every blob is checked
+// against its hash before it becomes visible. Stage runs outside any
+// transaction, so no lock is held while the content is written.
+func Stage(ctx context.Context, file *models.File, src Source) (_ *Staged, err error) {
+	ctx, span := tracer.Start(ctx, "content.Stage")
+	span.SetAttributes(attribute.Bool("content.chunked", file.Chunked))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if file.Chunked {
+		return stageChunks(ctx, file, src)
+	}
+
+	if Compression && Compressible(file.MimeType) {
+		key := file.StoragePath + Suffix(models.CodecZstd)
+		stored, ok, err := compressTo(ctx, storage.Blobs, key, src, file.Size, file.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			file.StoragePath, file.Codec, file.StoredSize = key, models.CodecZstd, stored
+			span.SetAttributes(attribute.Int64("storage.bytes_written", stored))
+			return &Staged{}, nil
+		}
+	}
+
+	written, err := storage.Blobs.Put(ctx, file.StoragePath, storage.Verified(src, file.Hash))
+	if err != nil {
+		return nil, err
+	}
+	file.StoredSize = written
+	span.SetAttributes(attribute.Int64("storage.bytes_written", written))
+	return &Staged{}, nil
+}
+
+// Commit records staged content for file, whose row must already exist in
+// tx and whose hash lock tx must hold. The lock keeps the garbage collector
+// away from the File's blobs from here on, but it may have swept them
+// between Stage and Commit, so blobs that are gone are written again from
+// src. For chunked Files the chunk rows and the manifest are inserted.
+func (s *Staged) Commit(ctx context.Context, tx *gorm.DB, file *models.File, src Source) (err error) {
+	ctx, span := tracer.Start(ctx, "content.Commit")
+	span.SetAttributes(attribute.Bool("content.chunked", file.Chunked))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	// Blob stores that keep rows of their own write them in tx.
+	ctx = config.WithTx(ctx, tx)
+	if file.Chunked {
+		return s.commitChunks(ctx, tx, file, src)
+	}
+
+	_, err = storage.Blobs.Stat(ctx, file.StoragePath)
+	if errors.Is(err, storage.ErrNotFound) {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var r io.Reader = storage.Verified(src, file.Hash)
+		if file.Codec == models.CodecZstd {
+			r = newCompressingReader(r)
+		}
+		stored, err := storage.Blobs.Put(ctx, file.StoragePath, r)
+		if err != nil {
+			return err
+		}
+		if stored != file.StoredSize {
+			if err := tx.Model(file).Update("stored_size", stored).Error; err != nil {
+				return err
+			}
+			file.StoredSize = stored
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if file.Codec == models.CodecZstd {
+		metrics.CompressionSavedBytesTotal.WithLabelValues("upload").Add(float64(file.Size - file.StoredSize))
+	}
+	return nil
+}
+
+// Suffix is appended to the key of a blob stored with codec.
+func Suffix(codec string) string {
+	if codec == models.CodecZstd {
+		return ".zst"
+	}
+	return ""
+}
+
+// compressTo stores src compressed at key in store if a sample compresses
+// well and the whole content then saves at least MinSavings. Otherwise
+// nothing is left at key and src is rewound for a plain write. The content
+// must hash to hash.
+func compressTo(ctx context.Context, store storage.Store, key string, src Source, size int64, hash string) (stored int64, ok bool, err error) {
+	sample := make([]byte, min(size, 1<<20))
+	if _, err := io.ReadFull(src, sample); err != nil {
+		return 0, false, err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	if !worthCompressing(sample) {
+		return 0, false, nil
+	}
+
+	stored, err = store.Put(ctx, key, newCompressingReader(storage.Verified(src, hash)))
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	if !saves(size, stored) {
+		return 0, false, store.Delete(ctx, key)
+	}
+	return stored, true, nil
+}
+
+// StoreFor returns the blob store of a storage tier.
+func StoreFor(tier string) (storage.Store, error) {
+	switch tier {
+	case models.TierHot, "":
+		return storage.Blobs, nil
+	case models.TierCold:
+		if storage.Cold == nil {
+			return nil, errors.New("no cold tier is configured")
+		}
+		return storage.Cold, nil
+	}
+	return nil, fmt.Errorf("unknown storage tier %q", tier)
+}
+
+// Tiers returns the storage tiers that are configured, hot first.
+func Tiers() []string {
+	if storage.Cold != nil {
+		return []string{models.TierHot, models.TierCold}
+	}
+	return []string{models.TierHot}
+}
+
+// Open returns the content of file.
+func Open(ctx context.Context, file *models.File) (storage.Object, error) {
+	if file.Chunked {
+		return openChunks(ctx, file)
+	}
+	store, err := StoreFor(file.Tier)
+	if err != nil {
+		return nil, err
+	}
+	return openBlob(ctx, store, file.StoragePath, file)
+}
+
+// openBlob returns the content of file from the blob at key in store.
+func openBlob(ctx context.Context, store storage.Store, key string, file *models.File) (storage.Object, error) {
+	obj, err := store.Open(ctx, key)
+	if err != nil || file.Codec != models.CodecZstd {
+		return obj, err
+	}
+	z, err := openZstd(obj, file.Size)
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("blob %s: %w", key, err)
+	}
+	return z, nil
+}
+
+// Copy copies the blob of a whole File as stored to key in the store to,
+// checking it against the File's hash: plain blobs on the way, so they never
+// become visible at key if they do not match, compressed ones through the
+// decompressor once copied.
+func Copy(ctx context.Context, file *models.File, to storage.Store, key string) error {
+	from, err := StoreFor(file.Tier)
+	if err != nil {
+		return err
+	}
+	obj, err := from.Open(ctx, file.StoragePath)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	var src io.Reader = obj
+	if file.Codec == models.CodecNone {
+		src = storage.Verified(obj, file.Hash)
+	}
+	if _, err := to.Put(ctx, key, src); err != nil {
+		return err
+	}
+	if file.Codec == models.CodecNone {
+		return nil
+	}
+	if err := verifyBlob(ctx, to, key, file); err != nil {
+		to.Delete(context.WithoutCancel(ctx), key)
+		return err
+	}
+	return nil
+}
+
+func verifyBlob(ctx context.Context, store storage.Store, key string, file *models.File) error {
+	obj, err := openBlob(ctx, store, key, file)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, obj); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != file.Hash {
+		return fmt.Errorf("%w: got %s, want %s", storage.ErrHashMismatch, got, file.Hash)
+	}
+	return nil
+}
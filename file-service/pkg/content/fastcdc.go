@@ -0,0 +1,137 @@
+package content
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// gear maps each byte to a random 64-bit value for the rolling hash. The
+// seed is fixed: changing it moves every cut point and defeats dedup
+// against chunks stored before.
+var gear = func() [256]uint64 {
+	var t [256]uint64
+	r := rand.New(rand.NewPCG(0x766f6c74, 0x63646321))
+	for i := range t {
+		t[i] = r.Uint64()
+	}
+	return t
+}()
+
+// ChunkSizes bounds the chunks the chunker cuts; Avg must be a power of two.
+type ChunkSizes struct {
+	Min, Avg, Max int
+}
+
+func (s ChunkSizes) validate() error {
+	if s.Avg <= 0 || s.Avg&(s.Avg-1) != 0 {
+		return errors.New("average chunk size must be a power of two")
+	}
+	if s.Min <= 0 || s.Min > s.Avg || s.Max < s.Avg {
+		return errors.New("chunk sizes must satisfy 0 < min <= avg <= max")
+	}
+	return nil
+}
+
+// chunker splits a stream into content-defined chunks with FastCDC: a gear
+// hash rolls over the bytes after the minimum size, and a chunk ends where
+// the hash's top bits are all zero. Before the average size a stricter mask
+// is used and after it a looser one, which keeps sizes close to the average
+// (normalised chunking). Cut points depend only on nearby content, so an
+// insertion only changes the chunks around it.
+type chunker struct {
+	r       io.Reader
+	sizes   ChunkSizes
+	maskS   uint64
+	maskL   uint64
+	buf     []byte
+	start   int
+	end     int
+	readErr error
+}
+
+func newChunker(r io.Reader, sizes ChunkSizes) *chunker {
+	b := bits.TrailingZeros(uint(sizes.Avg))
+	return &chunker{
+		r:     r,
+		sizes: sizes,
+		maskS: topBits(b + 2),
+		maskL: topBits(b - 2),
+		buf:   make([]byte, 2*sizes.Max),
+	}
+}
+
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// next returns the next chunk, which is only valid until the following
+// call, or io.EOF after the last one.
+func (c *chunker) next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill tops the buffer up to at least Max bytes unless the input ended.
+func (c *chunker) fill() error {
+	if c.end-c.start >= c.sizes.Max || c.readErr != nil {
+		if c.readErr != nil && c.readErr != io.EOF {
+			return c.readErr
+		}
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < c.sizes.Max && c.readErr == nil {
+		var n int
+		n, c.readErr = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+	if c.readErr != nil && c.readErr != io.EOF {
+		return c.readErr
+	}
+	return nil
+}
+
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.sizes.Min {
+		return n
+	}
+	if n > c.sizes.Max {
+		n = c.sizes.Max
+	}
+	normal := c.sizes.Avg
+	if n < normal {
+		normal = n
+	}
+
+	var h uint64
+	i := c.sizes.Min
+	for ; i < normal; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
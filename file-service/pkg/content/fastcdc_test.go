@@ -0,0 +1,154 @@
+package content
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"testing/iotest"
+)
+
+var testSizes = ChunkSizes{Min: 256, Avg: 1024, Max: 8192}
+
+func randomBytes(seed uint64, n int) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+	return b
+}
+
+// cuts returns the end offsets of the chunks r is cut into.
+func cuts(t *testing.T, r io.Reader, sizes ChunkSizes) []int {
+	t.Helper()
+	c := newChunker(r, sizes)
+	var out []int
+	var off int
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		off += len(chunk)
+		out = append(out, off)
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	data := randomBytes(1, 200_000)
+	ends := cuts(t, bytes.NewReader(data), testSizes)
+	if ends[len(ends)-1] != len(data) {
+		t.Fatalf("chunks cover %d of %d bytes", ends[len(ends)-1], len(data))
+	}
+	prev := 0
+	for i, end := range ends {
+		size := end - prev
+		if size > testSizes.Max || size < testSizes.Min && i < len(ends)-1 {
+			t.Errorf("chunk %d has %d bytes, outside [%d, %d]", i, size, testSizes.Min, testSizes.Max)
+		}
+		prev = end
+	}
+	if avg := len(data) / len(ends); avg < testSizes.Avg/2 || avg > testSizes.Avg*2 {
+		t.Errorf("average chunk size %d is far from %d", avg, testSizes.Avg)
+	}
+}
+
+func TestChunkerIgnoresReadSizes(t *testing.T) {
+	data := randomBytes(2, 50_000)
+	want := cuts(t, bytes.NewReader(data), testSizes)
+	got := cuts(t, iotest.OneByteReader(bytes.NewReader(data)), testSizes)
+	if !equalInts(got, want) {
+		t.Fatalf("one-byte reads cut at %v, want %v", got, want)
+	}
+}
+
+// TestChunkerBoundaryStability edits the content in one place and checks
+// that every cut point before the edit stays put and that the cut points
+// line up again, shifted by the edit, soon after it.
+func TestChunkerBoundaryStability(t *testing.T) {
+	data := randomBytes(3, 300_000)
+	const at = 150_000
+	tests := []struct {
+		name   string
+		edited []byte
+		edit   int
+		shift  int
+	}{
+		{name: "insert", edited: concat(data[:at], randomBytes(4, 100), data[at:]), edit: at, shift: 100},
+		{name: "delete", edited: concat(data[:at], data[at+100:]), edit: at, shift: -100},
+		{name: "overwrite", edited: concat(data[:at], randomBytes(5, 100), data[at+100:]), edit: at, shift: 0},
+		{name: "prepend", edited: concat([]byte("a new first line\n"), data), edit: 0, shift: 17},
+	}
+	orig := cuts(t, bytes.NewReader(data), testSizes)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edit := tt.edit
+			got := make(map[int]bool)
+			for _, end := range cuts(t, bytes.NewReader(tt.edited), testSizes) {
+				got[end] = true
+			}
+
+			resync := edit + 100 + 4*testSizes.Max
+			var kept, total int
+			for _, end := range orig {
+				switch {
+				case end <= edit:
+					if !got[end] {
+						t.Errorf("cut at %d before the edit moved", end)
+					}
+				case end > resync:
+					total++
+					if got[end+tt.shift] {
+						kept++
+					}
+				}
+			}
+			if total == 0 || kept != total {
+				t.Errorf("%d of %d cuts after offset %d survived the edit", kept, total, resync)
+			}
+		})
+	}
+}
+
+func TestChunkSizesValidate(t *testing.T) {
+	tests := []struct {
+		sizes ChunkSizes
+		ok    bool
+	}{
+		{ChunkSizes{Min: 256, Avg: 1024, Max: 8192}, true},
+		{ChunkSizes{Min: 1024, Avg: 1024, Max: 1024}, true},
+		{ChunkSizes{Min: 256, Avg: 1000, Max: 8192}, false},
+		{ChunkSizes{Min: 2048, Avg: 1024, Max: 8192}, false},
+		{ChunkSizes{Min: 256, Avg: 1024, Max: 512}, false},
+		{ChunkSizes{Min: 0, Avg: 1024, Max: 8192}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.sizes.validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: validate() = %v", tt.sizes, err)
+		}
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package content
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/leader"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// recompressLock is the advisory lock held by the replica that recompresses.
+const recompressLock int64 = 0x766f6c74_00007a73 // "volt", "zs"
+
+// RunRecompress runs Recompress every interval until ctx is cancelled, so
+// Files stored before compression was enabled, or while it was off, are
+// compressed in the background. Of all replicas, only the one that gets the
+// leader lock recompresses.
+func RunRecompress(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		var n int
+		var saved int64
+		err := leader.Do(ctx, recompressLock, func(ctx context.Context) error {
+			var err error
+			n, saved, err = Recompress(ctx)
+			return err
+		})
+		if err != nil && !errors.Is(err, leader.ErrNotLeader) && !errors.Is(err, context.Canceled) {
+			log.Printf("content: recompress failed: %v", err)
+		}
+		if n > 0 {
+			log.Printf("content: compressed %d files in %s, saving %d bytes", n, time.Since(start).Round(time.Second), saved)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Recompress looks at every File whose stored size was never recorded.
+// Whole Files of a compressible type are compressed to a new blob when that
+// saves enough; all others only get their stored size recorded, so each
+// File is looked at once. It returns how many Files it compressed and the
+// bytes that saved. Files that fail are logged and retried on the next run.
+func Recompress(ctx context.Context) (compressed int, saved int64, err error) {
+	db := config.DB.WithContext(ctx)
+	var after uint
+	for {
+		var files []models.File
+		err := db.Where("stored_size = 0 AND size > 0 AND id > ?", after).Order("id").Limit(100).Find(&files).Error
+		if err != nil {
+			return compressed, saved, err
+		}
+		if len(files) == 0 {
+			return compressed, saved, nil
+		}
+		for i := range files {
+			if err := ctx.Err(); err != nil {
+				return compressed, saved, err
+			}
+			n, err := recompress(ctx, &files[i])
+			if err != nil {
+				log.Printf("content: recompressing file %d: %v", files[i].ID, err)
+				continue
+			}
+			if n > 0 {
+				compressed++
+				saved += n
+			}
+		}
+		after = files[len(files)-1].ID
+	}
+}
+
+// recompress compresses one File's blob to its key plus Suffix, in the tier
+// it is stored in, under the hash lock, so the File cannot be released or
+// relocated meanwhile. The uncompressed blob is left for the garbage
+// collector, which deletes it under the hash lock once it is unreferenced.
+func recompress(ctx context.Context, file *models.File) (saved int64, err error) {
+	ctx, span := tracer.Start(ctx, "content.recompress")
+	span.SetAttributes(attribute.Int("file.id", int(file.ID)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	db := config.DB.WithContext(ctx)
+	if file.Chunked || file.Codec != models.CodecNone || !Compression || !Compressible(file.MimeType) {
+		return 0, db.Model(file).UpdateColumn("stored_size", file.Size).Error
+	}
+
+	store, err := StoreFor(file.Tier)
+	if err != nil {
+		return 0, err
+	}
+	old := file.StoragePath
+	key := old + Suffix(models.CodecZstd)
+	var stored int64
+	var ok bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, file.Hash); err != nil {
+			return err
+		}
+		var current models.File
+		if err := tx.First(&current, file.ID).Error; err != nil {
+			return err
+		}
+		if current.StoragePath != old || current.Codec != models.CodecNone || current.Tier != file.Tier {
+			return nil
+		}
+
+		obj, err := store.Open(ctx, old)
+		if err != nil {
+			return err
+		}
+		defer obj.Close()
+		if stored, ok, err = compressTo(config.WithTx(ctx, tx), store, key, obj, current.Size, current.Hash); err != nil {
+			return err
+		}
+		if !ok {
+			return tx.Model(&current).UpdateColumn("stored_size", current.Size).Error
+		}
+		err = tx.Model(&current).UpdateColumns(map[string]interface{}{
+			"storage_path": key,
+			"codec":        models.CodecZstd,
+			"stored_size":  stored,
+		}).Error
+		if err != nil {
+			store.Delete(context.WithoutCancel(ctx), key)
+			ok = false
+		}
+		return err
+	})
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	saved = file.Size - stored
+	metrics.CompressionSavedBytesTotal.WithLabelValues("recompress").Add(float64(saved))
+	return saved, nil
+}
@@ -2,11 +2,29 @@ package controllers
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"path"
 	"strconv"
-
+	"strings"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/problem"
+	"volt/common/tracing"
+	"volt/file-service/pkg/erasure"
+	"volt/file-service/pkg/extract"
+	"volt/file-service/pkg/fsck"
+	"volt/file-service/pkg/gc"
 	"volt/file-service/pkg/middlewares"
+	"volt/file-service/pkg/preview"
+	"volt/file-service/pkg/replication"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/search"
+	"volt/file-service/pkg/storage"
+	"volt/file-service/pkg/tiering"
 	"volt/file-service/pkg/utils"
 
 	"volt/db/config"
@@ -16,129 +34,277 @@ import (
 	"gorm.io/gorm"
 )
 
+// MaxFileSize is how much of a multipart form is held in memory; larger
+// parts spill to temporary files. Upload size limits live in the upload
+// policy.
 const MaxFileSize = 10 * 1024 * 1024 // 10 MB
 
+// HealthCheck is the legacy health endpoint, which the gateway exposes.
+// Like /livez it only reports that the service is up; the dependency checks,
+// whose errors name misconfigured secrets, are reported on /readyz alone.
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{ "database": "connected", "service":"file-service", "status": "healthy"}`))
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "healthy",
+		"service": "file-service",
+	})
 }
 
+// UploadFile accepts one or more "file" parts. Each may be paired, by
+// position, with a "path" field holding its path relative to an uploaded
+// folder; that path becomes the display name. With extract=true, uploaded
+// archives are also unpacked in the background. A single failing file is
+// reported as a problem response as before, while a batch returns
+// 207 Multi-Status with per-file results when any file failed. Files whose
+// content does not match a checksum sent for it are rejected: one given in
+// a "checksum" field, by position like "path", in the Content-Digest or
+// Repr-Digest header of its part, or in those of the request when it
+// carries a single file.
 func UploadFile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	err := r.ParseMultipartForm(MaxFileSize)
+	bodyChecksums, err := utils.ParseDigestFields(r.Header)
+	if err != nil {
+		problem.FromError(w, r, "Invalid digest", err)
+		return
+	}
+	var body *utils.DigestReader
+	if len(bodyChecksums) > 0 {
+		body = utils.NewDigestReader(r.Body)
+		r.Body = body
+	}
+
+	err = r.ParseMultipartForm(MaxFileSize)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to parse form: " + err.Error(),
-		})
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to parse multipart form")
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
 	if !ok {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "User information not found",
-		})
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
 		return
 	}
 	userID := userClaims.UserID
 
-	isPrivate := true
-	if privacyStr := r.FormValue("is_private"); privacyStr == "false" {
-		isPrivate = false
+	opts := utils.UploadOptions{
+		IsPrivate: r.FormValue("is_private") != "false",
+		Tags:      utils.NormalizeTags(r.FormValue("tags")),
+		Role:      userClaims.Role,
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to get file: " + err.Error(),
-		})
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Missing \"file\" form field")
+		return
+	}
+	if maxFiles := config.GetEnvInt("UPLOAD_MAX_FILES", 500); len(headers) > maxFiles {
+		problem.Write(w, r, http.StatusRequestEntityTooLarge, problem.CodePayloadTooLarge,
+			fmt.Sprintf("Too many files: at most %d per request", maxFiles))
 		return
 	}
-	defer file.Close()
 
-	result, err := utils.ProcessFileUpload(file, header, userID, isPrivate)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": err.Error(),
-		})
+	paths := r.MultipartForm.Value["path"]
+	if len(paths) > 0 && len(paths) != len(headers) {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeValidationFailed,
+			fmt.Sprintf("Got %d \"path\" fields for %d files; send one per file or none", len(paths), len(headers)))
+		return
+	}
+
+	checksums := r.MultipartForm.Value["checksum"]
+	if len(checksums) > 0 && len(checksums) != len(headers) {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeValidationFailed,
+			fmt.Sprintf("Got %d \"checksum\" fields for %d files; send one per file, empty for none, or none", len(checksums), len(headers)))
+		return
+	}
+
+	files := make([]utils.BatchFile, len(headers))
+	for i, header := range headers {
+		files[i] = utils.BatchFile{Header: header}
+		if len(paths) > 0 {
+			files[i].Path = paths[i]
+		}
+		if len(checksums) > 0 && checksums[i] != "" {
+			c, err := utils.ParseChecksumField(checksums[i])
+			if err != nil {
+				problem.FromError(w, r, "Invalid checksum", err)
+				return
+			}
+			files[i].Checksums = []utils.Checksum{c}
+		}
+	}
+
+	if body != nil {
+		if err := utils.CheckBodyChecksums(files, body, bodyChecksums); err != nil {
+			problem.FromError(w, r, "Checksum mismatch", err)
+			return
+		}
+	}
+
+	results := utils.ProcessBatchUpload(r.Context(), files, userID, opts, config.GetEnvInt("UPLOAD_CONCURRENCY", 4))
+	extractArchives := r.FormValue("extract") == "true"
+
+	var summary models.UploadSummary
+	summary.Total = len(results)
+	for i, result := range results {
+		if result.Status == models.UploadStatusError {
+			summary.Failed++
+			metrics.UploadsTotal.WithLabelValues("error").Inc()
+			if result.Code == problem.CodeInternal && len(results) > 1 {
+				tracing.Logf(r.Context(), "Failed to process upload of %q: %v", result.Name, result.Err)
+			}
+			continue
+		}
+
+		search.Enqueue(result.FileReference.ID)
+		preview.Enqueue(result.File.ID)
+
+		if extractArchives && extract.Supported(result.File) {
+			job, err := extract.Start(r.Context(), userID, result.FileReference.ID)
+			if err != nil {
+				tracing.Logf(r.Context(), "Failed to start extraction of reference %d: %v", result.FileReference.ID, err)
+			} else {
+				results[i].ExtractJobID = &job.ID
+			}
+		}
+
+		if result.Status == models.UploadStatusDuplicate {
+			summary.Duplicates++
+		} else {
+			summary.Uploaded++
+		}
+		summary.TotalBytes += headers[i].Size
+		summary.SavedBytes += result.SavedBytes
+		summary.ChunkSavedBytes += result.ChunkSavedBytes
+
+		metrics.UploadsTotal.WithLabelValues("success").Inc()
+		metrics.UploadBytesTotal.Add(float64(headers[i].Size))
+		if result.WasDuplicate {
+			metrics.DedupTotal.WithLabelValues("hit").Inc()
+			metrics.DedupSavedBytesTotal.Add(float64(result.SavedBytes))
+		} else {
+			metrics.DedupTotal.WithLabelValues("new").Inc()
+		}
+	}
+
+	if len(results) == 1 && summary.Failed == 1 {
+		problem.FromError(w, r, "Failed to process upload", results[0].Err)
 		return
 	}
 
-	stats, err := utils.GetUserStorageStatsData(userID)
+	stats, err := utils.GetUserStorageStatsData(r.Context(), userID)
 	if err != nil {
-		log.Printf("Failed to get user stats: %v", err)
+		tracing.Logf(r.Context(), "Failed to get user stats: %v", err)
 		stats = &models.UserStorageStats{UserID: int(userID)}
 	}
 
 	response := models.UploadResponse{
-		Success:      true,
+		Success:      summary.Failed == 0,
 		Message:      "File uploaded successfully",
-		Files:        []models.FileUploadResult{*result},
+		Files:        results,
+		Summary:      summary,
 		StorageStats: *stats,
 	}
+	status := http.StatusCreated
+	if len(results) > 1 {
+		response.Message = fmt.Sprintf("%d of %d files uploaded successfully", summary.Total-summary.Failed, summary.Total)
+	}
+	if summary.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
 
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(response)
 }
 
+// CheckUpload references content the server already holds by its
+// SHA-256, so a client can check before uploading and skip sending the
+// bytes. It answers 201 with the new reference, 200 if the user already
+// had one, and 404 when the content has to be uploaded.
+func CheckUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	var req models.UploadCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	name, err := utils.CleanRelativePath(req.Name)
+	if err != nil {
+		problem.FromError(w, r, "Invalid name", err)
+		return
+	}
+	if name == "" {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeValidationFailed, "Missing name")
+		return
+	}
+
+	opts := utils.UploadOptions{
+		IsPrivate:   req.IsPrivate == nil || *req.IsPrivate,
+		Tags:        utils.NormalizeTags(req.Tags),
+		DisplayName: name,
+		Role:        userClaims.Role,
+	}
+	result, created, err := utils.ReferenceByHash(r.Context(), req.SHA256, userClaims.UserID, opts)
+	if err != nil {
+		problem.FromError(w, r, "Failed to reference file", err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		search.Enqueue(result.FileReference.ID)
+		metrics.UploadsTotal.WithLabelValues("success").Inc()
+		metrics.DedupTotal.WithLabelValues("hit").Inc()
+		metrics.DedupSavedBytesTotal.Add(float64(result.SavedBytes))
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
 func GetFiles(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	vars := mux.Vars(r)
-	userID := vars["ID"]
-
-	var fileRefs []models.FileReference
-	result := config.DB.Where("user_id = ?", userID).
-		Preload("File", "deleted_at IS NULL").
-		Order("created_at DESC").
-		Find(&fileRefs)
+	userID, err := strconv.ParseUint(vars["ID"], 10, 32)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid user ID")
+		return
+	}
 
-	if result.Error != nil {
-		log.Printf("GetFiles: Database error: %v", result.Error)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to get files: " + result.Error.Error(),
-		})
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+	if uint(userID) != userClaims.UserID {
+		problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "Cannot list another user's files")
 		return
 	}
 
-	var files []models.FileResponse
-	for _, fileRef := range fileRefs {
-		if fileRef.File.ID == 0 {
-			continue
-		}
+	query, err := utils.ParseFileListQuery(userClaims.UserID, r.URL.Query())
+	if err != nil {
+		problem.FromError(w, r, "Invalid query", err)
+		return
+	}
 
-		fileData := models.FileResponse{
-			ID:          fileRef.ID,
-			UserID:      fileRef.UserID,
-			FileID:      fileRef.FileID,
-			DisplayName: fileRef.DisplayName,
-			IsDuplicate: fileRef.IsDuplicate,
-			IsPrivate:   fileRef.IsPrivate,
-			CreatedAt:   fileRef.CreatedAt,
-			UpdatedAt:   fileRef.UpdatedAt,
-			File: models.File{
-				ID:             fileRef.File.ID,
-				Hash:           fileRef.File.Hash,
-				OriginalName:   fileRef.File.OriginalName,
-				MimeType:       fileRef.File.MimeType,
-				Size:           fileRef.File.Size,
-				StoragePath:    fileRef.File.StoragePath,
-				ReferenceCount: fileRef.File.ReferenceCount,
-				CreatedAt:      fileRef.File.CreatedAt,
-			},
-		}
-		files = append(files, fileData)
+	page, err := utils.ListFiles(r.Context(), query)
+	if err != nil {
+		problem.FromError(w, r, "Failed to get files", err)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(files)
+	json.NewEncoder(w).Encode(page)
 }
 
 func DeleteFile(w http.ResponseWriter, r *http.Request) {
@@ -147,49 +313,40 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	fileRefID, err := strconv.ParseUint(vars["ID"], 10, 32)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid file reference ID",
-		})
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid file reference ID")
 		return
 	}
 
 	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
 	if !ok {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "User information not found",
-		})
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
 		return
 	}
 	userID := userClaims.UserID
 
+	db := config.DB.WithContext(r.Context())
+
 	var fileRef models.FileReference
-	result := config.DB.Where("id = ? AND user_id = ?", uint(fileRefID), userID).First(&fileRef)
+	result := db.Where("id = ? AND user_id = ?", uint(fileRefID), userID).First(&fileRef)
 
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "File not found",
-			})
+			problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "File not found")
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Database error: " + result.Error.Error(),
-		})
+		problem.Internal(w, r, "Failed to look up file", result.Error)
 		return
 	}
 
-	if err := config.DB.Delete(&fileRef).Error; err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to delete file: " + err.Error(),
-		})
+	if err := db.Delete(&fileRef).Error; err != nil {
+		problem.Internal(w, r, "Failed to delete file", err)
 		return
 	}
 
+	if err := search.Remove(r.Context(), fileRef.ID); err != nil {
+		tracing.Logf(r.Context(), "Failed to remove search entry for reference %d: %v", fileRef.ID, err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
@@ -202,21 +359,450 @@ func GetUserStorageStats(w http.ResponseWriter, r *http.Request) {
 
 	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
 	if !ok {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "User information not found",
-		})
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
 		return
 	}
 	userID := userClaims.UserID
 
-	stats, err := utils.GetUserStorageStatsData(userID)
+	stats, err := utils.GetUserStorageStatsData(r.Context(), userID)
+	if err != nil {
+		problem.Internal(w, r, "Failed to get storage stats", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
+
+func SearchFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	params := r.URL.Query()
+	query := search.Query{
+		UserID:        userClaims.UserID,
+		Text:          params.Get("q"),
+		MimePrefix:    params.Get("mime"),
+		IncludePublic: params.Get("scope") == "all",
+		Limit:         utils.DefaultPageSize,
+	}
+	if strings.TrimSpace(query.Text) == "" {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Query parameter q is required")
+		return
+	}
+	if s := params.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid limit: must be a positive integer")
+			return
+		}
+		query.Limit = min(n, utils.MaxPageSize)
+	}
+	if s := params.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid offset: must be a non-negative integer")
+			return
+		}
+		query.Offset = n
+	}
+	if s := params.Get("is_private"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid is_private: must be true or false")
+			return
+		}
+		query.IsPrivate = &b
+	}
+
+	results, err := search.Search(r.Context(), query)
+	if err != nil {
+		problem.Internal(w, r, "Search failed", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
+
+func ReindexFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	if !search.EnqueueUser(userClaims.UserID) {
+		problem.Write(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "Indexing queue is full, try again later")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Reindex scheduled",
+	})
+}
+
+// GetThumbnail serves a JPEG preview of a file the caller owns or that is
+// public, with X-Preview-Kind saying what it shows. Previews are rendered
+// asynchronously after upload, so a missing one is scheduled again and
+// reported as not found until it is ready.
+func GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	fileRefID, err := strconv.ParseUint(mux.Vars(r)["ID"], 10, 32)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid file reference ID")
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = preview.DefaultSize
+	}
+	if _, ok := preview.Sizes[size]; !ok {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid size: must be one of small, medium, large")
+		return
+	}
+
+	db := config.DB.WithContext(r.Context())
+
+	var fileRef models.FileReference
+	err = db.Preload("File").
+		Where("id = ? AND (user_id = ? OR is_private = false)", uint(fileRefID), userClaims.UserID).
+		First(&fileRef).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "File not found")
+			return
+		}
+		problem.Internal(w, r, "Failed to look up file", err)
+		return
+	}
+
+	if scan.Blocked(&fileRef.File) {
+		problem.FromError(w, r, "File is blocked", scan.ErrInfected(&fileRef.File))
+		return
+	}
+
+	var p models.FilePreview
+	err = db.Where("file_id = ? AND size = ?", fileRef.FileID, size).First(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !preview.Supported(fileRef.File.MimeType) {
+			problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "No preview available for this file type")
+			return
+		}
+		preview.Enqueue(fileRef.FileID)
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "Preview is being generated, try again shortly")
+		return
+	}
+	if err != nil {
+		problem.Internal(w, r, "Failed to look up preview", err)
+		return
+	}
+	if p.Status != models.PreviewStatusReady {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("No preview available (%s)", p.Status))
+		return
+	}
+
+	obj, err := storage.Blobs.Open(r.Context(), p.StorageKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			// The record outlived its blob; render it again.
+			db.Delete(&p)
+			preview.Enqueue(fileRef.FileID)
+			problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "Preview is being generated, try again shortly")
+			return
+		}
+		problem.Internal(w, r, "Failed to open preview", err)
+		return
+	}
+	defer obj.Close()
+
+	w.Header().Set("Content-Type", p.ContentType)
+	w.Header().Set("X-Preview-Kind", p.Kind)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", fmt.Sprintf("%q", p.Hash+"-"+p.Size))
+	http.ServeContent(w, r, "", p.UpdatedAt.Truncate(time.Second), obj)
+}
+
+func BulkFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	var req models.BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	resp, err := utils.ApplyBulk(r.Context(), userClaims.UserID, req)
+	if err != nil {
+		problem.FromError(w, r, "Failed to apply bulk action", err)
+		return
+	}
+
+	for _, result := range resp.Results {
+		if result.Status != models.BulkStatusOK {
+			continue
+		}
+		switch req.Action {
+		case models.BulkActionDelete:
+			if err := search.Remove(r.Context(), result.ID); err != nil {
+				tracing.Logf(r.Context(), "Failed to remove search entry for reference %d: %v", result.ID, err)
+			}
+		case models.BulkActionRename:
+			search.Enqueue(result.ID)
+		}
+	}
+
+	status := http.StatusOK
+	if resp.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DownloadArchive streams the selected files as a ZIP. Once the first byte is
+// written the status can no longer change, so a failure mid-stream is only
+// logged and the client sees a truncated archive.
+func DownloadArchive(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	var req models.ArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	refs, err := utils.LoadArchiveEntries(r.Context(), userClaims.UserID, req.IDs)
+	if err != nil {
+		problem.FromError(w, r, "Failed to load files", err)
+		return
+	}
+
+	name := strings.TrimSuffix(path.Base(strings.ReplaceAll(req.Name, "\\", "/")), ".zip")
+	if name == "" || name == "." || name == "/" {
+		name = "volt-files"
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	w.WriteHeader(http.StatusOK)
+
+	if err := utils.WriteArchive(r.Context(), w, refs); err != nil {
+		tracing.Logf(r.Context(), "Archive download aborted: %v", err)
+	}
+}
+
+func ExtractFile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	fileRefID, err := strconv.ParseUint(mux.Vars(r)["ID"], 10, 32)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid file reference ID")
+		return
+	}
+
+	job, err := extract.Start(r.Context(), userClaims.UserID, uint(fileRefID))
+	if err != nil {
+		problem.FromError(w, r, "Failed to start extraction", err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/files/jobs/%d", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	jobID, err := strconv.ParseUint(mux.Vars(r)["ID"], 10, 32)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid job ID")
+		return
+	}
+
+	job, err := extract.Get(r.Context(), userClaims.UserID, uint(jobID))
+	if err != nil {
+		problem.FromError(w, r, "Failed to get job", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+// DownloadFile serves the content of a file the caller owns or that is
+// public. Files the malware scanner flagged are refused unless the policy
+// only flags them. Cold files are restored to the hot tier; in deferred
+// restore mode they are refused with 503 and a Retry-After hint meanwhile.
+func DownloadFile(w http.ResponseWriter, r *http.Request) {
+	userClaims, ok := r.Context().Value(middlewares.UserContextKey).(*utils.Claims)
+	if !ok {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "User information not found")
+		return
+	}
+
+	fileRefID, err := strconv.ParseUint(mux.Vars(r)["ID"], 10, 32)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid file reference ID")
+		return
+	}
+
+	var fileRef models.FileReference
+	err = config.DB.WithContext(r.Context()).Preload("File").
+		Where("id = ? AND (user_id = ? OR is_private = false)", uint(fileRefID), userClaims.UserID).
+		First(&fileRef).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "File not found")
+			return
+		}
+		problem.Internal(w, r, "Failed to look up file", err)
+		return
+	}
+
+	if scan.Blocked(&fileRef.File) {
+		problem.FromError(w, r, "File is blocked", scan.ErrInfected(&fileRef.File))
+		return
+	}
+
+	obj, err := tiering.Open(r.Context(), &fileRef.File)
+	if errors.Is(err, tiering.ErrRestoring) {
+		w.Header().Set("Retry-After", tiering.RetryAfterHeader())
+	}
+	if err != nil {
+		problem.FromError(w, r, "Failed to open file", err)
+		return
+	}
+	defer obj.Close()
+
+	w.Header().Set("Content-Type", fileRef.File.MimeType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(fileRef.DisplayName)}))
+	w.Header().Set("ETag", fmt.Sprintf("%q", fileRef.File.Hash))
+	if fileRef.File.ScanStatus == models.ScanStatusInfected {
+		w.Header().Set("X-Scan-Status", models.ScanStatusInfected)
+	}
+	http.ServeContent(w, r, "", fileRef.File.UpdatedAt.Truncate(time.Second), obj)
+}
+
+func RescanFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := scan.RequestRescan(); err != nil {
+		problem.FromError(w, r, "Failed to schedule rescan", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Rescan scheduled",
+	})
+}
+
+// GetFsckReport returns the report of the last scheduled integrity check
+// this replica led.
+func GetFsckReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	report := fsck.Last()
+	if report == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "No integrity check has finished yet")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// GetGCResult returns the result of the last garbage collection this
+// replica led.
+func GetGCResult(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	result := gc.Last()
+	if result == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "This replica has not led a garbage collection yet")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetReplicationStatus returns the health of each storage replica and the
+// result of the last repair this replica led.
+func GetReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if replication.Default == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "Replication is not configured")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(replication.Default.Status())
+}
+
+// GetErasureStatus returns the health of each erasure-coding backend and
+// the result of the last scrub this replica led.
+func GetErasureStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if erasure.Default == nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "Erasure coding is not configured")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(erasure.Default.Status())
+}
+
+// GetTierStats returns the usage of each storage tier and the lifecycle
+// rules in effect.
+func GetTierStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats, err := tiering.GetStats(r.Context())
 	if err != nil {
-		log.Printf("GetUserStorageStats: Failed to get stats for user %d: %v", userID, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to get storage stats: " + err.Error(),
-		})
+		problem.Internal(w, r, "Failed to get tier stats", err)
 		return
 	}
 
@@ -0,0 +1,67 @@
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"volt/db/config"
+	"volt/file-service/pkg/storage"
+)
+
+// ProviderFromEnv returns the KeyProvider selected by
+// ENCRYPTION_KEY_PROVIDER, or nil when encryption is off.
+func ProviderFromEnv() (KeyProvider, error) {
+	switch name := config.GetEnv("ENCRYPTION_KEY_PROVIDER", ""); name {
+	case "":
+		return nil, nil
+	case "local":
+		file := config.GetEnv("ENCRYPTION_KEYFILE", "")
+		if file == "" {
+			return nil, fmt.Errorf("ENCRYPTION_KEYFILE is required for the local key provider")
+		}
+		return LoadKeyfile(file)
+	case "vault":
+		addr := config.GetEnv("VAULT_ADDR", "")
+		if addr == "" {
+			return nil, fmt.Errorf("VAULT_ADDR is required for the vault key provider")
+		}
+		v := NewVaultTransit(addr, config.GetEnv("VAULT_TOKEN", ""),
+			config.GetEnv("VAULT_TRANSIT_MOUNT", "transit"), config.GetEnv("VAULT_TRANSIT_KEY", "volt"))
+		v.Namespace = config.GetEnv("VAULT_NAMESPACE", "")
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unknown ENCRYPTION_KEY_PROVIDER %q", name)
+	}
+}
+
+// Configure wraps storage.Blobs, and the cold tier's store if there is one,
+// in an encrypting Store when a key provider is configured, and returns the
+// provider. It fails when the provider cannot wrap keys, rather than letting
+// uploads fail later. ENCRYPTION_ALLOW_PLAINTEXT lets the stores serve blobs
+// written before encryption was enabled.
+func Configure(ctx context.Context) (KeyProvider, error) {
+	keys, err := ProviderFromEnv()
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	kek, err := keys.CurrentKEK(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reaching key provider: %w", err)
+	}
+	allowPlaintext := config.GetEnv("ENCRYPTION_ALLOW_PLAINTEXT", "false") == "true"
+	wrap := func(inner storage.Store) storage.Store {
+		s := NewStore(inner, keys)
+		s.AllowPlaintext = allowPlaintext
+		return s
+	}
+	storage.Blobs = wrap(storage.Blobs)
+	if storage.Cold != nil {
+		storage.Cold = wrap(storage.Cold)
+	}
+	log.Printf("Encrypting blobs at rest with key-encryption key %s", kek)
+	if allowPlaintext {
+		log.Printf("Serving blobs stored before encryption was enabled as plaintext")
+	}
+	return keys, nil
+}
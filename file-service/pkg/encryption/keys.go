@@ -0,0 +1,112 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// WrappedKey is a data key encrypted by a key-encryption key (KEK).
+type WrappedKey struct {
+	KEKID      string
+	Ciphertext []byte
+}
+
+// KeyProvider wraps and unwraps data keys with key-encryption keys that
+// never leave the provider.
+type KeyProvider interface {
+	// Wrap encrypts key with the current KEK.
+	Wrap(ctx context.Context, key []byte) (WrappedKey, error)
+	// Unwrap decrypts a key wrapped by any KEK the provider still has.
+	Unwrap(ctx context.Context, wk WrappedKey) ([]byte, error)
+	// CurrentKEK returns the ID of the KEK Wrap uses.
+	CurrentKEK(ctx context.Context) (string, error)
+}
+
+// Rewrapper is implemented by providers that can move a wrapped key to the
+// current KEK without handing out the plaintext key.
+type Rewrapper interface {
+	Rewrap(ctx context.Context, wk WrappedKey) (WrappedKey, error)
+}
+
+// LocalKeys keeps KEKs in a JSON keyfile:
+//
+//	{"current": "2026-10", "keys": {"2026-10": "<base64 32 bytes>", "2025-04": "..."}}
+//
+// Data keys are wrapped with AES-256-GCM under the current KEK. Retired KEKs
+// stay in the file until every data key has been rewrapped.
+type LocalKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+type keyfile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LoadKeyfile reads the KEKs from name.
+func LoadKeyfile(name string) (*LocalKeys, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var kf keyfile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("parsing keyfile %s: %w", name, err)
+	}
+	l := &LocalKeys{current: kf.Current, keys: make(map[string][]byte, len(kf.Keys))}
+	for id, encoded := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q in %s: %w", id, name, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q in %s is %d bytes, want 32", id, name, len(key))
+		}
+		l.keys[id] = key
+	}
+	if _, ok := l.keys[l.current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in %s", l.current, name)
+	}
+	return l, nil
+}
+
+func (l *LocalKeys) Wrap(ctx context.Context, key []byte) (WrappedKey, error) {
+	aead, err := newAEAD(l.keys[l.current])
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return WrappedKey{}, err
+	}
+	return WrappedKey{
+		KEKID:      l.current,
+		Ciphertext: aead.Seal(nonce, nonce, key, []byte(l.current)),
+	}, nil
+}
+
+func (l *LocalKeys) Unwrap(ctx context.Context, wk WrappedKey) ([]byte, error) {
+	kek, ok := l.keys[wk.KEKID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key-encryption key %q", wk.KEKID)
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Ciphertext) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is truncated")
+	}
+	nonce, sealed := wk.Ciphertext[:aead.NonceSize()], wk.Ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(wk.KEKID))
+}
+
+func (l *LocalKeys) CurrentKEK(ctx context.Context) (string, error) {
+	return l.current, nil
+}
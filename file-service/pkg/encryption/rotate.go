@@ -0,0 +1,94 @@
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"volt/db/config"
+	"volt/db/models"
+)
+
+// RotateResult counts the data keys a rotation looked at.
+type RotateResult struct {
+	CurrentKEK string         `json:"current_kek"`
+	Rewrapped  int            `json:"rewrapped"`
+	Failed     int            `json:"failed"`
+	Remaining  map[string]int `json:"remaining"`
+}
+
+// Rotate rewraps every data key not wrapped by the provider's current KEK.
+// Blobs are not touched: their data keys stay the same. Keys that cannot be
+// rewrapped are logged and left as they were; Remaining reports how many
+// keys each old KEK still wraps afterwards, and a KEK can be retired once it
+// wraps none. With dryRun nothing is changed.
+func Rotate(ctx context.Context, keys KeyProvider, batch int, dryRun bool) (*RotateResult, error) {
+	current, err := keys.CurrentKEK(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reaching key provider: %w", err)
+	}
+	result := &RotateResult{CurrentKEK: current, Remaining: make(map[string]int)}
+	db := config.DB.WithContext(ctx)
+
+	if !dryRun {
+		after := ""
+		for {
+			var rows []models.DataKey
+			err := db.Where("kek_id <> ? AND id > ?", current, after).Order("id").Limit(batch).Find(&rows).Error
+			if err != nil {
+				return nil, err
+			}
+			if len(rows) == 0 {
+				break
+			}
+			for _, row := range rows {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				if err := rewrap(ctx, keys, row); err != nil {
+					log.Printf("Failed to rewrap data key %s from %s: %v", row.ID, row.KEKID, err)
+					result.Failed++
+					continue
+				}
+				result.Rewrapped++
+			}
+			after = rows[len(rows)-1].ID
+		}
+	}
+
+	var counts []struct {
+		KEKID string
+		N     int
+	}
+	err = db.Model(&models.DataKey{}).Select("kek_id, COUNT(*) AS n").
+		Where("kek_id <> ?", current).Group("kek_id").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		result.Remaining[c.KEKID] = c.N
+	}
+	return result, nil
+}
+
+// rewrap moves one data key to the current KEK. The update only applies if
+// the row is still wrapped by the KEK it was read with.
+func rewrap(ctx context.Context, keys KeyProvider, row models.DataKey) error {
+	old := WrappedKey{KEKID: row.KEKID, Ciphertext: row.WrappedKey}
+	var wk WrappedKey
+	var err error
+	if r, ok := keys.(Rewrapper); ok {
+		wk, err = r.Rewrap(ctx, old)
+	} else {
+		var key []byte
+		if key, err = keys.Unwrap(ctx, old); err == nil {
+			wk, err = keys.Wrap(ctx, key)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return config.DB.WithContext(ctx).Model(&models.DataKey{}).
+		Where("id = ? AND kek_id = ?", row.ID, row.KEKID).
+		Updates(map[string]interface{}{"kek_id": wk.KEKID, "wrapped_key": wk.Ciphertext}).Error
+}
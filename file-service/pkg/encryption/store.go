@@ -0,0 +1,348 @@
+// Package encryption encrypts blobs at rest. Store wraps the blob store so
+// every blob is written in a segmented AEAD format under its own data key;
+// data keys are kept in the data_keys table, wrapped by a key-encryption key
+// from a KeyProvider. Content hashes, and with them deduplication, are
+// computed on the plaintext before it reaches the store.
+package encryption
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+)
+
+var tracer = tracing.Tracer("volt/file-service/encryption")
+
+// Store encrypts blobs written to Inner and decrypts them when opened.
+// Blobs without the encryption header are refused unless AllowPlaintext is
+// set, when those written before encryption was enabled are read as they
+// are. Stat and Walk report the stored, encrypted sizes.
+type Store struct {
+	Inner          storage.Store
+	Keys           KeyProvider
+	AllowPlaintext bool
+
+	mu    sync.Mutex
+	cache map[[keyIDSize]byte]cipher.AEAD
+}
+
+func NewStore(inner storage.Store, keys KeyProvider) *Store {
+	return &Store{Inner: inner, Keys: keys, cache: make(map[[keyIDSize]byte]cipher.AEAD)}
+}
+
+// maxCachedKeys bounds the unwrapped data keys kept in memory; chunked
+// Files open one blob per chunk, and each would otherwise cost an Unwrap.
+const maxCachedKeys = 4096
+
+// Put stores a new data key, then the blob encrypted under it. The key row
+// is committed first so a stored blob always has its key; if the Put fails
+// the row is removed again. Put returns the number of plaintext bytes.
+func (s *Store) Put(ctx context.Context, key string, r io.Reader) (written int64, err error) {
+	ctx, span := tracer.Start(ctx, "encryption.Put")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	id, aead, err := s.newDataKey(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("creating data key: %w", err)
+	}
+	h, err := newHeader(id)
+	if err != nil {
+		return 0, err
+	}
+	previous, _ := s.keyIDOf(ctx, key)
+
+	counter := &countingReader{r: r}
+	if _, err := s.Inner.Put(ctx, key, newEncryptingReader(counter, aead, h)); err != nil {
+		s.dropDataKey(context.WithoutCancel(ctx), id)
+		return counter.n, err
+	}
+	// The blob this one replaced took the only reference to its key.
+	if previous != nil && *previous != id {
+		s.dropDataKey(ctx, *previous)
+	}
+	return counter.n, nil
+}
+
+func (s *Store) Open(ctx context.Context, key string) (storage.Object, error) {
+	obj, err := s.Inner.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, headerSize)
+	n, err := obj.ReadAt(raw, 0)
+	h, herr := parseHeader(raw[:n])
+	if errors.Is(herr, errNotEncrypted) && s.AllowPlaintext {
+		return obj, nil
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		obj.Close()
+		return nil, err
+	}
+	if herr != nil {
+		obj.Close()
+		return nil, fmt.Errorf("blob %s: %w", key, herr)
+	}
+
+	aead, err := s.dataKey(ctx, h.keyID)
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("blob %s: %w", key, err)
+	}
+	dec, err := newDecryptedObject(obj, aead, h)
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("blob %s: %w", key, err)
+	}
+	return dec, nil
+}
+
+func (s *Store) Stat(ctx context.Context, key string) (storage.Info, error) {
+	return s.Inner.Stat(ctx, key)
+}
+
+// Delete removes the blob and then its data key.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	id, err := s.keyIDOf(ctx, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if err := s.Inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	if id != nil {
+		s.dropDataKey(ctx, *id)
+	}
+	return nil
+}
+
+func (s *Store) Walk(ctx context.Context, prefix string, fn func(storage.Info) error) error {
+	return s.Inner.Walk(ctx, prefix, fn)
+}
+
+// keyIDOf returns the data key ID in the header of the blob at key, or nil
+// when the blob is not encrypted.
+func (s *Store) keyIDOf(ctx context.Context, key string) (*[keyIDSize]byte, error) {
+	obj, err := s.Inner.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	raw := make([]byte, headerSize)
+	n, _ := obj.ReadAt(raw, 0)
+	h, err := parseHeader(raw[:n])
+	if err != nil {
+		return nil, nil
+	}
+	return &h.keyID, nil
+}
+
+func (s *Store) newDataKey(ctx context.Context) ([keyIDSize]byte, cipher.AEAD, error) {
+	var id [keyIDSize]byte
+	key := make([]byte, 32)
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, nil, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return id, nil, err
+	}
+	wk, err := s.Keys.Wrap(ctx, key)
+	if err != nil {
+		return id, nil, err
+	}
+	row := models.DataKey{ID: hex.EncodeToString(id[:]), KEKID: wk.KEKID, WrappedKey: wk.Ciphertext}
+	if err := config.DB.WithContext(ctx).Create(&row).Error; err != nil {
+		return id, nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return id, nil, err
+	}
+	s.remember(id, aead)
+	return id, aead, nil
+}
+
+func (s *Store) dataKey(ctx context.Context, id [keyIDSize]byte) (cipher.AEAD, error) {
+	s.mu.Lock()
+	aead, ok := s.cache[id]
+	s.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	var row models.DataKey
+	if err := config.DB.WithContext(ctx).Where("id = ?", hex.EncodeToString(id[:])).First(&row).Error; err != nil {
+		return nil, fmt.Errorf("loading data key: %w", err)
+	}
+	key, err := s.Keys.Unwrap(ctx, WrappedKey{KEKID: row.KEKID, Ciphertext: row.WrappedKey})
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key with %s: %w", row.KEKID, err)
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	s.remember(id, aead)
+	return aead, nil
+}
+
+func (s *Store) remember(id [keyIDSize]byte, aead cipher.AEAD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cache) >= maxCachedKeys {
+		clear(s.cache)
+	}
+	s.cache[id] = aead
+}
+
+func (s *Store) dropDataKey(ctx context.Context, id [keyIDSize]byte) {
+	s.mu.Lock()
+	delete(s.cache, id)
+	s.mu.Unlock()
+	config.DB.WithContext(ctx).Where("id = ?", hex.EncodeToString(id[:])).Delete(&models.DataKey{})
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decryptedObject decrypts the segments a read touches, keeping the last
+// one so sequential reads decrypt every segment once.
+type decryptedObject struct {
+	obj  storage.Object
+	aead cipher.AEAD
+	h    *header
+	size int64
+	pos  int64
+
+	mu  sync.Mutex
+	cur int64
+	seg []byte
+	buf []byte
+}
+
+func newDecryptedObject(obj storage.Object, aead cipher.AEAD, h *header) (*decryptedObject, error) {
+	size, err := h.plainSize(obj.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &decryptedObject{
+		obj:  obj,
+		aead: aead,
+		h:    h,
+		size: size,
+		seg:  make([]byte, 0, h.segment),
+		buf:  make([]byte, h.segment+tagSize),
+		cur:  -1,
+	}, nil
+}
+
+func (o *decryptedObject) Size() int64 {
+	return o.size
+}
+
+// segment returns the plaintext of segment i. The caller holds o.mu.
+func (o *decryptedObject) segment(i int64) ([]byte, error) {
+	if i == o.cur {
+		return o.seg, nil
+	}
+	segSize := int64(o.h.segment)
+	last := int64(0)
+	if o.size > 0 {
+		last = (o.size - 1) / segSize
+	}
+	n := segSize
+	if i == last {
+		n = o.size - i*segSize
+	}
+	sealed := o.buf[:n+tagSize]
+	m, err := o.obj.ReadAt(sealed, int64(headerSize)+i*(segSize+tagSize))
+	if m < len(sealed) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	o.cur = -1
+	plain, err := o.aead.Open(o.seg[:0], o.h.nonce(i, i == last), sealed, o.h.raw)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting segment %d: %w", i, err)
+	}
+	o.cur, o.seg = i, plain
+	return plain, nil
+}
+
+func (o *decryptedObject) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	segSize := int64(o.h.segment)
+	var n int
+	for n < len(p) {
+		if off >= o.size {
+			return n, io.EOF
+		}
+		i := off / segSize
+		plain, err := o.segment(i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], plain[off-i*segSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (o *decryptedObject) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := o.ReadAt(p, o.pos)
+	o.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (o *decryptedObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *decryptedObject) Close() error {
+	return o.obj.Close()
+}
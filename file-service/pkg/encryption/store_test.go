@@ -0,0 +1,134 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"volt/db/dbtest"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+)
+
+func localKeys(t *testing.T, current string, ids ...string) *LocalKeys {
+	t.Helper()
+	l := &LocalKeys{current: current, keys: make(map[string][]byte)}
+	for _, id := range append(ids, current) {
+		l.keys[id] = randomContent(t, 32)
+	}
+	return l
+}
+
+func TestStoreRefusesPlaintext(t *testing.T) {
+	ctx := context.Background()
+	inner := storage.NewLocal(t.TempDir())
+	if _, err := inner.Put(ctx, "uploads/legacy", strings.NewReader("stored before encryption")); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(inner, localKeys(t, "k1"))
+
+	if obj, err := s.Open(ctx, "uploads/legacy"); err == nil {
+		obj.Close()
+		t.Fatal("opened a plaintext blob without AllowPlaintext")
+	}
+
+	s.AllowPlaintext = true
+	obj, err := s.Open(ctx, "uploads/legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if got, _ := io.ReadAll(obj); string(got) != "stored before encryption" {
+		t.Errorf("plaintext blob read as %q", got)
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	db := dbtest.Open(t)
+	ctx := context.Background()
+	inner := storage.NewLocal(t.TempDir())
+	s := NewStore(inner, localKeys(t, "k1"))
+
+	plain := randomContent(t, 2*SegmentSize+3)
+	if n, err := s.Put(ctx, "uploads/blob", bytes.NewReader(plain)); err != nil || n != int64(len(plain)) {
+		t.Fatalf("Put = %d, %v", n, err)
+	}
+
+	raw, err := inner.Open(ctx, "uploads/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(raw)
+	raw.Close()
+	if !bytes.HasPrefix(stored, []byte(magic)) || bytes.Contains(stored, plain[:64]) {
+		t.Fatal("blob is not stored encrypted")
+	}
+
+	obj, err := s.Open(ctx, "uploads/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+
+	if err := s.Delete(ctx, "uploads/blob"); err != nil {
+		t.Fatal(err)
+	}
+	var keys int64
+	db.Model(&models.DataKey{}).Count(&keys)
+	if keys != 0 {
+		t.Errorf("%d data keys left after Delete", keys)
+	}
+}
+
+func TestRotateDryRun(t *testing.T) {
+	db := dbtest.Open(t)
+	ctx := context.Background()
+	standIn, vault := newTransit(t)
+	inner := storage.NewLocal(t.TempDir())
+	s := NewStore(inner, vault)
+
+	plain := []byte("content under a data key wrapped by v1")
+	for _, key := range []string{"uploads/a", "uploads/b", "uploads/c"} {
+		if _, err := s.Put(ctx, key, bytes.NewReader(plain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	standIn.Rotate()
+
+	result, err := Rotate(ctx, vault, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CurrentKEK != "volt:v2" || result.Rewrapped != 0 || result.Remaining["volt:v1"] != 3 {
+		t.Fatalf("dry run = %+v", result)
+	}
+	var moved int64
+	db.Model(&models.DataKey{}).Where("kek_id = ?", "volt:v2").Count(&moved)
+	if moved != 0 {
+		t.Fatalf("dry run rewrapped %d data keys", moved)
+	}
+
+	result, err = Rotate(ctx, vault, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rewrapped != 3 || len(result.Remaining) != 0 {
+		t.Fatalf("rotation = %+v", result)
+	}
+
+	// A fresh store has no unwrapped keys cached.
+	obj, err := NewStore(inner, vault).Open(ctx, "uploads/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if got, _ := io.ReadAll(obj); !bytes.Equal(got, plain) {
+		t.Error("blob does not decrypt after rotation")
+	}
+}
@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An encrypted blob is a header followed by the content in segments of
+// SegmentSize bytes, each sealed with AES-256-GCM under the blob's data key
+// (the STREAM construction). A segment's nonce is the header's random
+// prefix, the segment's index and a flag set only on the last segment, so
+// segments cannot be reordered, and truncation at a segment boundary is
+// caught because the new last segment was not sealed as last. The header is
+// the additional data of every segment. Since every segment has the same
+// size, a range read decrypts only the segments it covers.
+//
+//	magic "VOLTENC1" | data key ID (16) | segment size (4) | nonce prefix (7)
+const (
+	magic       = "VOLTENC1"
+	keyIDSize   = 16
+	prefixSize  = 7
+	headerSize  = len(magic) + keyIDSize + 4 + prefixSize
+	SegmentSize = 64 << 10
+	tagSize     = 16
+)
+
+var errNotEncrypted = errors.New("blob is not encrypted")
+
+type header struct {
+	keyID   [keyIDSize]byte
+	segment int
+	prefix  [prefixSize]byte
+	raw     []byte
+}
+
+func newHeader(keyID [keyIDSize]byte) (*header, error) {
+	h := &header{keyID: keyID, segment: SegmentSize}
+	if _, err := rand.Read(h.prefix[:]); err != nil {
+		return nil, err
+	}
+	h.raw = make([]byte, 0, headerSize)
+	h.raw = append(h.raw, magic...)
+	h.raw = append(h.raw, keyID[:]...)
+	h.raw = binary.BigEndian.AppendUint32(h.raw, uint32(h.segment))
+	h.raw = append(h.raw, h.prefix[:]...)
+	return h, nil
+}
+
+func parseHeader(raw []byte) (*header, error) {
+	if len(raw) < headerSize || string(raw[:len(magic)]) != magic {
+		return nil, errNotEncrypted
+	}
+	h := &header{raw: raw[:headerSize]}
+	rest := raw[len(magic):]
+	copy(h.keyID[:], rest)
+	h.segment = int(binary.BigEndian.Uint32(rest[keyIDSize:]))
+	copy(h.prefix[:], rest[keyIDSize+4:])
+	if h.segment <= 0 || h.segment > 16<<20 {
+		return nil, fmt.Errorf("invalid segment size %d", h.segment)
+	}
+	return h, nil
+}
+
+func (h *header) nonce(index int64, last bool) []byte {
+	n := make([]byte, 12)
+	copy(n, h.prefix[:])
+	binary.BigEndian.PutUint32(n[prefixSize:], uint32(index))
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// plainSize returns the size of the content in a blob of size bytes.
+func (h *header) plainSize(size int64) (int64, error) {
+	body := size - int64(headerSize)
+	sealed := int64(h.segment + tagSize)
+	full, rest := body/sealed, body%sealed
+	switch {
+	case body < tagSize:
+		return 0, errors.New("encrypted blob is truncated")
+	case rest == 0:
+		return full * int64(h.segment), nil
+	case rest < tagSize:
+		return 0, errors.New("encrypted blob is truncated")
+	}
+	return full*int64(h.segment) + rest - tagSize, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptingReader produces the encrypted form of r.
+type encryptingReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	h      *header
+	plain  []byte
+	out    []byte
+	index  int64
+	done   bool
+	hdrOut bool
+}
+
+func newEncryptingReader(r io.Reader, aead cipher.AEAD, h *header) *encryptingReader {
+	return &encryptingReader{
+		r:     bufio.NewReaderSize(r, h.segment+1),
+		aead:  aead,
+		h:     h,
+		plain: make([]byte, h.segment),
+	}
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	if !e.hdrOut {
+		e.out = append(e.out[:0], e.h.raw...)
+		e.hdrOut = true
+	}
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next segment. A segment is last when nothing follows it,
+// which is why the reader peeks one byte past every full segment.
+func (e *encryptingReader) seal() error {
+	n, err := io.ReadFull(e.r, e.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := n < len(e.plain)
+	if !last {
+		if _, err := e.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	e.out = e.aead.Seal(e.out[:0], e.h.nonce(e.index, last), e.plain[:n], e.h.raw)
+	e.index++
+	e.done = last
+	return nil
+}
@@ -0,0 +1,159 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+type memObject struct {
+	*bytes.Reader
+}
+
+func (memObject) Close() error {
+	return nil
+}
+
+func randomContent(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// seal encrypts plain under a new data key and returns the blob.
+func seal(t *testing.T, plain []byte) ([]byte, cipher.AEAD) {
+	t.Helper()
+	var id [keyIDSize]byte
+	rand.Read(id[:])
+	aead, err := newAEAD(randomContent(t, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHeader(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := io.ReadAll(newEncryptingReader(bytes.NewReader(plain), aead, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob, aead
+}
+
+func openBlob(blob []byte, aead cipher.AEAD) (*decryptedObject, error) {
+	h, err := parseHeader(blob)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptedObject(memObject{bytes.NewReader(blob)}, aead, h)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 5} {
+		plain := randomContent(t, size)
+		blob, aead := seal(t, plain)
+		obj, err := openBlob(blob, aead)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if obj.Size() != int64(size) {
+			t.Errorf("%d bytes: Size() = %d", size, obj.Size())
+		}
+		got, err := io.ReadAll(obj)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted content differs", size)
+		}
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	plain := randomContent(t, 3*SegmentSize+100)
+	blob, aead := seal(t, plain)
+	sealed := SegmentSize + tagSize
+	segment := func(i int) []byte {
+		start := headerSize + i*sealed
+		return blob[start:min(start+sealed, len(blob))]
+	}
+	join := func(parts ...[]byte) []byte {
+		var out []byte
+		for _, p := range parts {
+			out = append(out, p...)
+		}
+		return out
+	}
+	hdr := blob[:headerSize]
+
+	tests := []struct {
+		name string
+		blob []byte
+	}{
+		{name: "truncated at a segment boundary", blob: blob[:headerSize+3*sealed]},
+		{name: "truncated within a segment", blob: blob[:len(blob)-50]},
+		{name: "segments reordered", blob: join(hdr, segment(1), segment(0), segment(2), segment(3))},
+		{name: "segment dropped", blob: join(hdr, segment(0), segment(2), segment(3))},
+		{name: "segment flipped", blob: join(hdr, segment(0), flip(segment(1)), segment(2), segment(3))},
+		{name: "header changed", blob: join(flip(hdr), segment(0), segment(1), segment(2), segment(3))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := openBlob(tt.blob, aead)
+			if err != nil {
+				return
+			}
+			if got, err := io.ReadAll(obj); err == nil {
+				t.Fatalf("read %d bytes of a tampered blob without an error", len(got))
+			}
+		})
+	}
+}
+
+// flip returns a copy of b with its last byte changed.
+func flip(b []byte) []byte {
+	c := bytes.Clone(b)
+	c[len(c)-1] ^= 1
+	return c
+}
+
+func TestStreamReadAtSegmentBoundaries(t *testing.T) {
+	plain := randomContent(t, 3*SegmentSize+100)
+	blob, aead := seal(t, plain)
+	obj, err := openBlob(blob, aead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		off     int64
+		n       int
+		wantN   int
+		wantEOF bool
+	}{
+		{off: 0, n: SegmentSize, wantN: SegmentSize},
+		{off: SegmentSize - 1, n: 2, wantN: 2},
+		{off: SegmentSize, n: 1, wantN: 1},
+		{off: 2*SegmentSize - 10, n: SegmentSize + 20, wantN: SegmentSize + 20},
+		{off: 3 * SegmentSize, n: 100, wantN: 100},
+		{off: 3*SegmentSize + 99, n: 5, wantN: 1, wantEOF: true},
+		{off: 3*SegmentSize + 100, n: 1, wantN: 0, wantEOF: true},
+	}
+	for _, tt := range tests {
+		p := make([]byte, tt.n)
+		n, err := obj.ReadAt(p, tt.off)
+		if n != tt.wantN || errors.Is(err, io.EOF) != tt.wantEOF || err != nil && !errors.Is(err, io.EOF) {
+			t.Errorf("ReadAt(%d bytes at %d) = %d, %v", tt.n, tt.off, n, err)
+			continue
+		}
+		if !bytes.Equal(p[:n], plain[tt.off:tt.off+int64(n)]) {
+			t.Errorf("ReadAt(%d bytes at %d) returned the wrong content", tt.n, tt.off)
+		}
+	}
+}
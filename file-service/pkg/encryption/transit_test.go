@@ -0,0 +1,204 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// transitStandIn serves the subset of Vault's transit API that VaultTransit
+// uses, for one key held in memory, so tests can run the Vault provider
+// without a Vault server.
+type transitStandIn struct {
+	Mount string
+	Key   string
+	Token string
+
+	mu       sync.Mutex
+	versions [][]byte
+}
+
+// newTransit serves a stand-in transit key for the test and returns a
+// VaultTransit client for it.
+func newTransit(t *testing.T) (*transitStandIn, *VaultTransit) {
+	t.Helper()
+	standIn := &transitStandIn{Mount: "transit", Key: "volt", Token: "test-token"}
+	standIn.Rotate()
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+	return standIn, NewVaultTransit(server.URL, standIn.Token, standIn.Mount, standIn.Key)
+}
+
+// Rotate adds a key version, which new ciphertexts use from then on.
+func (t *transitStandIn) Rotate() int {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.versions = append(t.versions, key)
+	return len(t.versions)
+}
+
+func (t *transitStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if t.Token != "" && r.Header.Get("X-Vault-Token") != t.Token {
+		transitError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	prefix := "/v1/" + t.Mount + "/"
+	op, key, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if !strings.HasPrefix(r.URL.Path, prefix) || !ok {
+		transitError(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	if key == t.Key+"/rotate" && op == "keys" && r.Method == http.MethodPost {
+		t.Rotate()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if key != t.Key {
+		transitError(w, http.StatusBadRequest, "encryption key not found")
+		return
+	}
+
+	var in struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			transitError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	var out any
+	var err error
+	switch {
+	case op == "keys" && r.Method == http.MethodGet:
+		t.mu.Lock()
+		out = map[string]any{"name": t.Key, "latest_version": len(t.versions)}
+		t.mu.Unlock()
+	case op == "encrypt" && r.Method == http.MethodPost:
+		var plain []byte
+		if plain, err = base64.StdEncoding.DecodeString(in.Plaintext); err == nil {
+			out, err = t.encrypt(plain)
+		}
+	case op == "decrypt" && r.Method == http.MethodPost:
+		var plain []byte
+		if plain, err = t.decrypt(in.Ciphertext); err == nil {
+			out = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plain)}
+		}
+	case op == "rewrap" && r.Method == http.MethodPost:
+		var plain []byte
+		if plain, err = t.decrypt(in.Ciphertext); err == nil {
+			out, err = t.encrypt(plain)
+		}
+	default:
+		transitError(w, http.StatusNotFound, "no handler for route")
+		return
+	}
+	if err != nil {
+		transitError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": out})
+}
+
+func (t *transitStandIn) encrypt(plain []byte) (map[string]string, error) {
+	t.mu.Lock()
+	version := len(t.versions)
+	aead, err := newAEAD(t.versions[version-1])
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	return map[string]string{
+		"ciphertext": fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(sealed)),
+	}, nil
+}
+
+func (t *transitStandIn) decrypt(ciphertext string) ([]byte, error) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext version")
+	}
+	t.mu.Lock()
+	if version < 1 || version > len(t.versions) {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("invalid key version %d", version)
+	}
+	aead, err := newAEAD(t.versions[version-1])
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func transitError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {msg}})
+}
+
+func TestVaultTransit(t *testing.T) {
+	ctx := context.Background()
+	standIn, vault := newTransit(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	wk, err := vault.Wrap(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wk.KEKID != "volt:v1" {
+		t.Errorf("KEK ID = %q, want volt:v1", wk.KEKID)
+	}
+	got, err := vault.Unwrap(ctx, wk)
+	if err != nil || string(got) != string(key) {
+		t.Fatalf("Unwrap = %q, %v", got, err)
+	}
+
+	standIn.Rotate()
+	if kek, err := vault.CurrentKEK(ctx); err != nil || kek != "volt:v2" {
+		t.Fatalf("CurrentKEK after rotation = %q, %v", kek, err)
+	}
+	rewrapped, err := vault.Rewrap(ctx, wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.KEKID != "volt:v2" {
+		t.Errorf("rewrapped KEK ID = %q, want volt:v2", rewrapped.KEKID)
+	}
+	if got, err := vault.Unwrap(ctx, rewrapped); err != nil || string(got) != string(key) {
+		t.Fatalf("Unwrap after rewrap = %q, %v", got, err)
+	}
+
+	vault.Token = "wrong"
+	if _, err := vault.Wrap(ctx, key); err == nil {
+		t.Error("Wrap succeeded with a wrong token")
+	}
+}
@@ -0,0 +1,136 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultTransit wraps data keys with a key of HashiCorp Vault's transit
+// secrets engine, so the KEK never leaves Vault. Anything serving the same
+// endpoints works. The KEK ID is the key name and version, e.g. "volt:v3";
+// rotating the key in Vault makes new data keys use the next version.
+type VaultTransit struct {
+	Addr      string
+	Token     string
+	Namespace string
+	Mount     string
+	Key       string
+	Client    *http.Client
+}
+
+func NewVaultTransit(addr, token, mount, key string) *VaultTransit {
+	return &VaultTransit{
+		Addr:   strings.TrimRight(addr, "/"),
+		Token:  token,
+		Mount:  strings.Trim(mount, "/"),
+		Key:    key,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (v *VaultTransit) Wrap(ctx context.Context, key []byte) (WrappedKey, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := v.call(ctx, http.MethodPost, "encrypt", map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(key),
+	}, &out)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return v.wrapped(out.Ciphertext)
+}
+
+func (v *VaultTransit) Unwrap(ctx context.Context, wk WrappedKey) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	err := v.call(ctx, http.MethodPost, "decrypt", map[string]string{
+		"ciphertext": string(wk.Ciphertext),
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// Rewrap has Vault re-encrypt the key under the latest key version.
+func (v *VaultTransit) Rewrap(ctx context.Context, wk WrappedKey) (WrappedKey, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := v.call(ctx, http.MethodPost, "rewrap", map[string]string{
+		"ciphertext": string(wk.Ciphertext),
+	}, &out)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	return v.wrapped(out.Ciphertext)
+}
+
+func (v *VaultTransit) CurrentKEK(ctx context.Context) (string, error) {
+	var out struct {
+		LatestVersion int `json:"latest_version"`
+	}
+	if err := v.call(ctx, http.MethodGet, "keys", nil, &out); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:v%d", v.Key, out.LatestVersion), nil
+}
+
+// wrapped derives the KEK ID from a "vault:v<version>:<data>" ciphertext.
+func (v *VaultTransit) wrapped(ciphertext string) (WrappedKey, error) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return WrappedKey{}, fmt.Errorf("unexpected transit ciphertext %.20q", ciphertext)
+	}
+	return WrappedKey{KEKID: v.Key + ":" + parts[1], Ciphertext: []byte(ciphertext)}, nil
+}
+
+func (v *VaultTransit) call(ctx context.Context, method, op string, body any, out any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", v.Addr, v.Mount, op, v.Key)
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("transit %s: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("transit %s: %s: %w", op, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("transit %s: %s: %s", op, resp.Status, strings.Join(result.Errors, "; "))
+	}
+	return json.Unmarshal(result.Data, out)
+}
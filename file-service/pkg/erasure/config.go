@@ -0,0 +1,118 @@
+package erasure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"volt/db/config"
+	"volt/file-service/pkg/storage"
+)
+
+// Default is the erasure-coding store behind storage.Blobs, or nil when
+// erasure coding is off.
+var Default *Store
+
+// Configure replaces storage.Blobs with a Store over the directories listed
+// in ERASURE_BACKENDS, as comma-separated name=path pairs or plain paths
+// named by themselves. ERASURE_PARITY_SHARDS of them hold parity, the rest
+// data. Writes need ERASURE_WRITE_QUORUM shards, by default one more than
+// the data shards. The store it replaces serves the blobs written before.
+// Like replication.Configure, which it excludes, it must run before
+// encryption.Configure, so blobs are encrypted before they are split, and
+// it refuses to run alongside a cold tier, which is not erasure-coded.
+func Configure() (*Store, error) {
+	spec := config.GetEnv("ERASURE_BACKENDS", "")
+	if spec == "" {
+		return nil, nil
+	}
+	if config.GetEnv("STORAGE_REPLICAS", "") != "" {
+		return nil, errors.New("ERASURE_BACKENDS and STORAGE_REPLICAS cannot both be set")
+	}
+	if config.GetEnv("COLD_STORAGE_ROOT", "") != "" {
+		return nil, errors.New("ERASURE_BACKENDS cannot be combined with COLD_STORAGE_ROOT: the cold tier is not erasure-coded")
+	}
+	var backends []*Backend
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, root, ok := strings.Cut(item, "=")
+		if !ok {
+			root = name
+		}
+		if name == "" || root == "" {
+			return nil, fmt.Errorf("invalid ERASURE_BACKENDS entry %q", item)
+		}
+		backends = append(backends, &Backend{Name: name, Store: storage.NewLocal(root)})
+	}
+
+	parity := config.GetEnvInt("ERASURE_PARITY_SHARDS", 2)
+	quorum := config.GetEnvInt("ERASURE_WRITE_QUORUM", min(len(backends)-parity+1, len(backends)))
+	blockSize := config.GetEnvInt("ERASURE_BLOCK_SIZE", DefaultBlockSize)
+	s, err := NewStore(backends, parity, blockSize, quorum)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ERASURE_BACKENDS: %w", err)
+	}
+	Cooldown = config.GetEnvDuration("ERASURE_COOLDOWN", Cooldown)
+	s.Fallback = storage.Blobs
+	storage.Blobs = s
+	Default = s
+	log.Printf("Erasure-coding blobs as %d data and %d parity shards, write quorum %d", s.DataShards, s.ParityShards, quorum)
+	return s, nil
+}
+
+// BackendStatus describes one backend as this service replica sees it.
+type BackendStatus struct {
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type Status struct {
+	Backends     []BackendStatus `json:"backends"`
+	DataShards   int             `json:"data_shards"`
+	ParityShards int             `json:"parity_shards"`
+	BlockSize    int             `json:"block_size"`
+	WriteQuorum  int             `json:"write_quorum"`
+	LastScrub    *Result         `json:"last_scrub,omitempty"`
+}
+
+// Status reports the health of every backend and the last scrub.
+func (s *Store) Status() *Status {
+	status := &Status{
+		DataShards:   s.DataShards,
+		ParityShards: s.ParityShards,
+		BlockSize:    s.BlockSize,
+		WriteQuorum:  s.WriteQuorum,
+		LastScrub:    Last(),
+	}
+	for _, b := range s.Backends {
+		bs := BackendStatus{Name: b.Name, Healthy: b.Healthy()}
+		b.mu.Lock()
+		if b.lastErr != nil {
+			bs.LastError = b.lastErr.Error()
+		}
+		b.mu.Unlock()
+		status.Backends = append(status.Backends, bs)
+	}
+	return status
+}
+
+// Check fails while fewer than WriteQuorum backends are healthy, when
+// uploads would fail.
+func (s *Store) Check(ctx context.Context) error {
+	healthy := 0
+	for _, b := range s.Backends {
+		if b.Healthy() {
+			healthy++
+		}
+	}
+	if healthy < s.WriteQuorum {
+		return fmt.Errorf("%d of %d erasure backends healthy, write quorum is %d", healthy, len(s.Backends), s.WriteQuorum)
+	}
+	return nil
+}
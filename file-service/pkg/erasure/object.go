@@ -0,0 +1,198 @@
+package erasure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"volt/common/metrics"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// object reads an erasure-coded blob. Each read goes to the data shard
+// that holds it; a stripe whose data shard cannot be read is reconstructed
+// from any DataShards shards of it, and kept for the reads that follow.
+type object struct {
+	ctx    context.Context
+	store  *Store
+	layout *models.BlobLayout
+	enc    reedsolomon.Encoder
+
+	mu     sync.Mutex
+	shards []storage.Object
+	tried  []bool
+	cached int64
+	blocks [][]byte
+	pos    int64
+}
+
+// openShard opens shard i unless it was tried before, reporting whether it
+// is open. The caller holds o.mu or owns o.
+func (o *object) openShard(i int) bool {
+	if o.shards[i] != nil {
+		return true
+	}
+	if o.tried[i] {
+		return false
+	}
+	o.tried[i] = true
+	ref := o.layout.Shards[i]
+	b := o.store.backend(ref.Backend)
+	if b == nil || ref.SHA256 == "" {
+		return false
+	}
+	obj, err := b.Store.Open(o.ctx, o.layout.Key)
+	if err != nil {
+		b.fail(err)
+		return false
+	}
+	if obj.Size() != o.layout.Stripes()*int64(o.layout.BlockSize) {
+		obj.Close()
+		return false
+	}
+	o.shards[i] = obj
+	return true
+}
+
+// dropShard stops reading shard i after err.
+func (o *object) dropShard(i int, err error) {
+	if b := o.store.backend(o.layout.Shards[i].Backend); b != nil {
+		b.fail(err)
+	}
+	o.shards[i].Close()
+	o.shards[i] = nil
+}
+
+func (o *object) Size() int64 {
+	return o.layout.Size
+}
+
+func (o *object) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	size := o.layout.Size
+	block := int64(o.layout.BlockSize)
+	stripe := int64(o.layout.DataShards) * block
+	n := 0
+	for n < len(p) && off < size {
+		s, within := off/stripe, off%stripe
+		i, at := int(within/block), within%block
+		want := min(int64(len(p)-n), block-at, size-off)
+		dst := p[n : n+int(want)]
+
+		if s != o.cached && o.shards[i] != nil {
+			m, err := o.shards[i].ReadAt(dst, s*block+at)
+			if m == len(dst) {
+				n += m
+				off += want
+				continue
+			}
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			if o.ctx.Err() != nil {
+				return n, o.ctx.Err()
+			}
+			o.dropShard(i, err)
+		}
+		if s != o.cached {
+			if err := o.reconstruct(s); err != nil {
+				return n, err
+			}
+		}
+		copy(dst, o.blocks[i][at:])
+		n += len(dst)
+		off += want
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// reconstruct reads stripe s from the first DataShards shards that can be
+// read and rebuilds its data blocks into o.blocks.
+func (o *object) reconstruct(s int64) error {
+	block := o.layout.BlockSize
+	if o.blocks == nil {
+		o.blocks = make([][]byte, len(o.shards))
+	}
+	read := 0
+	for i := range o.shards {
+		if read == o.layout.DataShards || !o.openShard(i) {
+			o.blocks[i] = o.blocks[i][:0]
+			continue
+		}
+		if cap(o.blocks[i]) < block {
+			o.blocks[i] = make([]byte, block)
+		}
+		o.blocks[i] = o.blocks[i][:block]
+		if _, err := o.shards[i].ReadAt(o.blocks[i], s*int64(block)); err != nil {
+			if o.ctx.Err() != nil {
+				return o.ctx.Err()
+			}
+			o.dropShard(i, err)
+			o.blocks[i] = o.blocks[i][:0]
+			continue
+		}
+		read++
+	}
+	o.cached = -1
+	if read < o.layout.DataShards {
+		return fmt.Errorf("%w: stripe %d of %s", ErrTooFewShards, s, o.layout.Key)
+	}
+	if err := o.enc.ReconstructData(o.blocks); err != nil {
+		return err
+	}
+	metrics.ErasureReconstructedStripesTotal.Inc()
+	o.cached = s
+	return nil
+}
+
+func (o *object) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := o.ReadAt(p, o.pos)
+	o.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (o *object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var errs []error
+	for i, obj := range o.shards {
+		if obj != nil {
+			errs = append(errs, obj.Close())
+			o.shards[i] = nil
+		}
+	}
+	return errors.Join(errs...)
+}
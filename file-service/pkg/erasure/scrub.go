@@ -0,0 +1,392 @@
+package erasure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/leader"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// leaderLock is the advisory lock held by the replica that scrubs.
+const leaderLock int64 = 0x766f6c74_00006563 // "volt", "ec"
+
+// Result describes one scrub. Lost lists blobs with fewer readable shards
+// than data shards; only a backup can bring those back.
+type Result struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Blobs      int       `json:"blobs"`
+	Degraded   int       `json:"degraded"`
+	Rebuilt    int       `json:"rebuilt"`
+	Lost       []string  `json:"lost,omitempty"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+func (r *Result) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+var last atomic.Pointer[Result]
+
+// Last returns the result of the most recent scrub this replica led, or
+// nil before the first one finishes.
+func Last() *Result {
+	return last.Load()
+}
+
+// Run scrubs s every interval until ctx is cancelled. Only the service
+// replica that gets the leader lock scrubs.
+func Run(ctx context.Context, s *Store, interval time.Duration, verify bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := leader.Do(ctx, leaderLock, func(ctx context.Context) error {
+			result, err := Scrub(ctx, s, verify)
+			if err != nil {
+				return err
+			}
+			last.Store(result)
+			if result.Degraded > 0 || len(result.Lost) > 0 || len(result.Errors) > 0 {
+				log.Printf("erasure: %d of %d blobs degraded, %d shards rebuilt, %d lost, %d errors",
+					result.Degraded, result.Blobs, result.Rebuilt, len(result.Lost), len(result.Errors))
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, leader.ErrNotLeader) && ctx.Err() == nil {
+			log.Printf("erasure: scrub failed: %v", err)
+		}
+	}
+}
+
+// Scrub checks every shard of every erasure-coded blob and rebuilds those
+// that are missing, cut short or on a backend no longer configured, from
+// the shards that are intact. It lists each backend to learn what it
+// holds, so shards lost with a volume are found. With verify it also reads
+// every shard and rebuilds those whose hash changed.
+func Scrub(ctx context.Context, s *Store, verify bool) (_ *Result, err error) {
+	ctx, span := tracer.Start(ctx, "erasure.Scrub")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	result := &Result{StartedAt: time.Now()}
+	db := config.DB.WithContext(ctx)
+
+	held := make(map[*Backend]map[string]int64)
+	for _, b := range s.Backends {
+		keys := make(map[string]int64)
+		err := b.Store.Walk(ctx, "uploads/", func(info storage.Info) error {
+			keys[info.Key] = info.Size
+			return nil
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			b.fail(err)
+			result.errorf("listing %s: %v", b.Name, err)
+			continue
+		}
+		b.recover()
+		held[b] = keys
+	}
+	if len(held) == 0 {
+		return nil, errors.New("no backend could be listed")
+	}
+
+	// Only layouts saved before the backends were listed are checked, so
+	// every shard they record as stored was complete before its listing.
+	var layouts []models.BlobLayout
+	err = db.Where("updated_at < ?", result.StartedAt).
+		FindInBatches(&layouts, 500, func(*gorm.DB, int) error {
+			for i := range layouts {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				result.Blobs++
+				scrubBlob(ctx, s, &layouts[i], held, verify, result)
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, fmt.Errorf("scrubbing layouts: %w", err)
+	}
+
+	metrics.DegradedErasureBlobs.Set(float64(result.Degraded))
+	result.FinishedAt = time.Now()
+	span.SetAttributes(
+		attribute.Int("erasure.blobs", result.Blobs),
+		attribute.Int("erasure.rebuilt", result.Rebuilt),
+	)
+	return result, nil
+}
+
+// scrubBlob finds the bad shards of one blob and rebuilds them. Shards on
+// backends that could not be listed are neither trusted nor rebuilt.
+func scrubBlob(ctx context.Context, s *Store, layout *models.BlobLayout, held map[*Backend]map[string]int64, verify bool, result *Result) {
+	want := layout.Stripes() * int64(layout.BlockSize)
+	var bad []int
+	good, unlisted := 0, 0
+	for i, ref := range layout.Shards {
+		b := s.backend(ref.Backend)
+		if b != nil && held[b] == nil {
+			unlisted++
+			continue
+		}
+		ok := b != nil && ref.SHA256 != ""
+		if ok {
+			n, found := held[b][layout.Key]
+			ok = found && n == want
+		}
+		if ok && verify {
+			sum, err := shardHash(ctx, b, layout.Key)
+			if err != nil {
+				b.fail(err)
+				result.errorf("reading shard %d of %s on %s: %v", i, layout.Key, b.Name, err)
+				continue
+			}
+			ok = sum == ref.SHA256
+		}
+		if ok {
+			good++
+		} else {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 {
+		return
+	}
+	// The blob may have been deleted since the layouts were loaded.
+	if _, err := loadLayout(ctx, layout.Key); err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			result.errorf("reloading layout of %s: %v", layout.Key, err)
+		}
+		return
+	}
+	result.Degraded++
+	if good < layout.DataShards {
+		if unlisted == 0 {
+			result.Lost = append(result.Lost, layout.Key)
+		}
+		return
+	}
+
+	n, err := rebuild(ctx, s, layout, bad)
+	result.Rebuilt += n
+	if err != nil {
+		result.errorf("rebuilding %s: %v", layout.Key, err)
+	}
+}
+
+func shardHash(ctx context.Context, b *Backend, key string) (string, error) {
+	obj, err := b.Store.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, obj); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// rebuild rebuilds the shards in bad and saves the layout with those that
+// were rebuilt. It holds the content hash's lock, which uploads and the
+// garbage collector take too, so the blob cannot be deleted or stored
+// again halfway; a layout that changed since it was loaded is left to the
+// next scrub.
+func rebuild(ctx context.Context, s *Store, layout *models.BlobLayout, bad []int) (int, error) {
+	var rebuilt int
+	var rebuildErr error
+	err := config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if layout.Hash != "" {
+			if err := models.LockHash(tx, layout.Hash); err != nil {
+				return err
+			}
+		}
+		current, err := loadLayout(config.WithTx(ctx, tx), layout.Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !current.UpdatedAt.Equal(layout.UpdatedAt) {
+			return nil
+		}
+
+		rebuilt, rebuildErr = rebuildShards(ctx, s, layout, bad)
+		if rebuilt > 0 {
+			if saveErr := tx.Select("Shards", "UpdatedAt").Updates(layout).Error; saveErr != nil {
+				return fmt.Errorf("recording layout: %w", saveErr)
+			}
+		}
+		return nil
+	})
+	return rebuilt, errors.Join(rebuildErr, err)
+}
+
+// rebuildShards recomputes the shards in bad from the others, stripe by
+// stripe, and writes each to its backend, or to a spare backend holding no
+// shard of the blob when its own is no longer configured. A rebuilt shard
+// whose hash is recorded must match it, which also catches a source shard
+// that is corrupt. layout is updated with the shards that were rebuilt.
+func rebuildShards(ctx context.Context, s *Store, layout *models.BlobLayout, bad []int) (int, error) {
+	enc, err := s.encoder(layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return 0, err
+	}
+
+	targets := make([]*Backend, len(bad))
+	used := make(map[*Backend]bool)
+	for _, ref := range layout.Shards {
+		if b := s.backend(ref.Backend); b != nil {
+			used[b] = true
+		}
+	}
+	for j, i := range bad {
+		targets[j] = s.backend(layout.Shards[i].Backend)
+		if targets[j] != nil {
+			continue
+		}
+		for _, b := range s.Backends {
+			if !used[b] && b.Healthy() {
+				targets[j] = b
+				used[b] = true
+				break
+			}
+		}
+		if targets[j] == nil {
+			return 0, fmt.Errorf("no spare backend for shard %d", i)
+		}
+	}
+
+	sources := make([]storage.Object, len(layout.Shards))
+	defer func() {
+		for _, obj := range sources {
+			if obj != nil {
+				obj.Close()
+			}
+		}
+	}()
+	opened := 0
+	for i, ref := range layout.Shards {
+		if opened == layout.DataShards || slices.Contains(bad, i) {
+			continue
+		}
+		b := s.backend(ref.Backend)
+		if b == nil || ref.SHA256 == "" {
+			continue
+		}
+		obj, err := b.Store.Open(ctx, layout.Key)
+		if err != nil {
+			b.fail(err)
+			continue
+		}
+		sources[i] = obj
+		opened++
+	}
+	if opened < layout.DataShards {
+		return 0, fmt.Errorf("%w: %d of %d shards readable", ErrTooFewShards, opened, layout.DataShards)
+	}
+
+	errs := make([]error, len(bad))
+	pipes := make([]*io.PipeWriter, len(bad))
+	hashes := make([]hash.Hash, len(bad))
+	var wg sync.WaitGroup
+	for j, b := range targets {
+		pr, pw := io.Pipe()
+		pipes[j] = pw
+		hashes[j] = sha256.New()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[j] = b.Store.Put(ctx, layout.Key, pr)
+			pr.CloseWithError(errs[j])
+		}()
+	}
+
+	err = func() error {
+		block := layout.BlockSize
+		blocks := make([][]byte, len(layout.Shards))
+		for stripe := int64(0); stripe < layout.Stripes(); stripe++ {
+			for i, obj := range sources {
+				if obj == nil {
+					blocks[i] = blocks[i][:0]
+					continue
+				}
+				if cap(blocks[i]) < block {
+					blocks[i] = make([]byte, block)
+				}
+				blocks[i] = blocks[i][:block]
+				if _, err := obj.ReadAt(blocks[i], stripe*int64(block)); err != nil {
+					return fmt.Errorf("reading shard %d: %w", i, err)
+				}
+			}
+			if err := enc.Reconstruct(blocks); err != nil {
+				return err
+			}
+			for j, i := range bad {
+				hashes[j].Write(blocks[i])
+				if _, err := pipes[j].Write(blocks[i]); err != nil {
+					pipes[j].CloseWithError(err)
+				}
+			}
+		}
+		return nil
+	}()
+	for j, pw := range pipes {
+		ref := layout.Shards[bad[j]]
+		if err == nil && errs[j] == nil && ref.SHA256 != "" && hex.EncodeToString(hashes[j].Sum(nil)) != ref.SHA256 {
+			// Rebuilding from a corrupt shard; keep the old copy.
+			pw.CloseWithError(fmt.Errorf("rebuilt shard %d does not match its recorded hash", bad[j]))
+			continue
+		}
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return 0, err
+	}
+
+	rebuilt := 0
+	for j, i := range bad {
+		b := targets[j]
+		if errs[j] != nil {
+			b.fail(errs[j])
+			err = errors.Join(err, fmt.Errorf("writing shard %d to %s: %w", i, b.Name, errs[j]))
+			continue
+		}
+		metrics.ErasureShardsRebuiltTotal.WithLabelValues(b.Name).Inc()
+		layout.Shards[i] = models.ShardRef{Backend: b.Name, SHA256: hex.EncodeToString(hashes[j].Sum(nil))}
+		rebuilt++
+	}
+	return rebuilt, err
+}
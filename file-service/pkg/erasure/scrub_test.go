@@ -0,0 +1,162 @@
+package erasure
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"volt/db/dbtest"
+	"volt/db/models"
+)
+
+func checkShard(t *testing.T, s *Store, layout *models.BlobLayout, i int, want string) {
+	t.Helper()
+	ref := layout.Shards[i]
+	if ref.SHA256 != want {
+		t.Errorf("shard %d recorded as %s, want %s", i, ref.SHA256, want)
+	}
+	got, err := shardHash(context.Background(), s.backend(ref.Backend), layout.Key)
+	if err != nil {
+		t.Fatalf("shard %d: %v", i, err)
+	}
+	if got != want {
+		t.Errorf("shard %d on %s hashes to %s, want %s", i, ref.Backend, got, want)
+	}
+}
+
+func TestRebuildShards(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t, 5, 2)
+	content, key := randomBlob(9*3*4096 + 77)
+	layout := writeBlob(t, s, key, content)
+	before := make([]string, len(layout.Shards))
+	for i, ref := range layout.Shards {
+		before[i] = ref.SHA256
+	}
+
+	deleteShard(t, s, layout, 1)
+	truncateShard(t, s, layout, 4)
+	n, err := rebuildShards(ctx, s, layout, []int{1, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("rebuilt %d shards, want 2", n)
+	}
+	checkShard(t, s, layout, 1, before[1])
+	checkShard(t, s, layout, 4, before[4])
+
+	// The rebuilt shards are all that is left to read besides one other.
+	deleteShard(t, s, layout, 0)
+	deleteShard(t, s, layout, 3)
+	got, err := readBlob(t, s, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content read through rebuilt shards differs")
+	}
+}
+
+func TestRebuildShardOntoSpare(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t, 5, 2)
+	content, key := randomBlob(64 << 10)
+	layout := writeBlob(t, s, key, content)
+	want := layout.Shards[2].SHA256
+
+	// The backend of shard 2 is retired and an empty one added.
+	retired := s.backend(layout.Shards[2].Backend)
+	spare := newBackends(t, 1)[0]
+	spare.Name = "spare"
+	backends := []*Backend{spare}
+	for _, b := range s.Backends {
+		if b != retired {
+			backends = append(backends, b)
+		}
+	}
+	s, err := NewStore(backends, 2, 4096, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rebuildShards(ctx, s, layout, []int{2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := layout.Shards[2].Backend; got != "spare" {
+		t.Fatalf("shard 2 rebuilt on %s, want spare", got)
+	}
+	checkShard(t, s, layout, 2, want)
+}
+
+func TestRebuildRefusesCorruptSource(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t, 4, 2)
+	content, key := randomBlob(32 << 10)
+	layout := writeBlob(t, s, key, content)
+	want := layout.Shards[3].SHA256
+
+	// Shard 0 keeps its size but not its content, and shard 3 is gone.
+	b := s.backend(layout.Shards[0].Backend)
+	garbage, _ := randomBlob(int(layout.Stripes()) * layout.BlockSize)
+	if _, err := b.Store.Put(ctx, key, bytes.NewReader(garbage)); err != nil {
+		t.Fatal(err)
+	}
+	deleteShard(t, s, layout, 3)
+
+	if n, err := rebuildShards(ctx, s, layout, []int{3}); err == nil || n != 0 {
+		t.Fatalf("rebuildShards = %d, %v, want an error", n, err)
+	}
+	if layout.Shards[3].SHA256 != want {
+		t.Error("the layout changed after a failed rebuild")
+	}
+	if _, err := s.backend(layout.Shards[3].Backend).Store.Stat(ctx, key); err == nil {
+		t.Error("a shard rebuilt from a corrupt source was stored")
+	}
+}
+
+func TestScrubRebuildsMissingShard(t *testing.T) {
+	db := dbtest.Open(t)
+	ctx := context.Background()
+	s := newTestStore(t, 5, 2)
+	content, key := randomBlob(200 << 10)
+	if _, err := s.Put(ctx, key, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	layout, err := loadLayout(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := layout.Shards[1].SHA256
+	deleteShard(t, s, layout, 1)
+
+	result, err := Scrub(ctx, s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Blobs != 1 || result.Degraded != 1 || result.Rebuilt != 1 || len(result.Errors) > 0 {
+		t.Fatalf("scrub = %+v, want one degraded blob with one shard rebuilt", result)
+	}
+
+	var saved models.BlobLayout
+	if err := db.Where("key = ?", key).Take(&saved).Error; err != nil {
+		t.Fatal(err)
+	}
+	checkShard(t, s, &saved, 1, want)
+
+	// Nothing is left to rebuild.
+	result, err = Scrub(ctx, s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Degraded != 0 || result.Rebuilt != 0 {
+		t.Fatalf("second scrub = %+v, want nothing degraded", result)
+	}
+	got, err := readBlob(t, s, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content read after the scrub differs")
+	}
+}
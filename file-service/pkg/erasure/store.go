@@ -0,0 +1,452 @@
+// Package erasure stores each blob as Reed-Solomon shards on several
+// backends, so that losing up to the number of parity shards loses no
+// content at a fraction of the space full replication takes. Store splits
+// a blob into DataShards data and ParityShards parity shards, one per
+// backend, and records the layout in the blob_layouts table. Reads go to
+// the data shards and reconstruct whatever cannot be read from the others.
+// A scrubber rebuilds shards that went missing.
+package erasure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/gc"
+	"volt/file-service/pkg/storage"
+
+	"github.com/klauspost/reedsolomon"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var tracer = tracing.Tracer("volt/file-service/erasure")
+
+// ErrQuorum is returned by a Put that fewer than WriteQuorum backends
+// stored their shard of.
+var ErrQuorum = errors.New("write quorum not reached")
+
+// ErrTooFewShards is returned by reads of a blob of which fewer shards
+// than it has data shards can be read.
+var ErrTooFewShards = errors.New("too few shards to reconstruct blob")
+
+// Cooldown is how long a backend that failed is reported unhealthy.
+var Cooldown = 30 * time.Second
+
+// DefaultBlockSize is the bytes of each shard per stripe.
+const DefaultBlockSize = 64 << 10
+
+type Backend struct {
+	Name  string
+	Store storage.Store
+
+	mu        sync.Mutex
+	downUntil time.Time
+	lastErr   error
+}
+
+// Healthy reports whether the backend has not failed within Cooldown.
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.downUntil)
+}
+
+// fail marks the backend unhealthy after an error other than a missing
+// shard, which the scrubber rebuilds.
+func (b *Backend) fail(err error) {
+	if err == nil || errors.Is(err, storage.ErrNotFound) || errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mu.Lock()
+	b.downUntil = time.Now().Add(Cooldown)
+	b.lastErr = err
+	b.mu.Unlock()
+}
+
+func (b *Backend) recover() {
+	b.mu.Lock()
+	b.downUntil = time.Time{}
+	b.lastErr = nil
+	b.mu.Unlock()
+}
+
+// Store erasure-codes blobs across Backends, DataShards+ParityShards of
+// them: new blobs put shard i on Backends[i]. Writes need WriteQuorum
+// shards stored; reads need DataShards of them. Blobs without a layout are
+// read from Fallback, which holds those written before erasure coding was
+// turned on.
+type Store struct {
+	Backends     []*Backend
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+	WriteQuorum  int
+	Fallback     storage.Store
+
+	mu       sync.Mutex
+	encoders map[[2]int]reedsolomon.Encoder
+}
+
+func NewStore(backends []*Backend, parity, blockSize, quorum int) (*Store, error) {
+	data := len(backends) - parity
+	if parity < 1 || data < 1 {
+		return nil, fmt.Errorf("%d backends cannot hold %d parity shards and at least one data shard", len(backends), parity)
+	}
+	if blockSize < 1 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	if quorum < data || quorum > len(backends) {
+		return nil, fmt.Errorf("write quorum %d must be between the %d data shards and the %d backends", quorum, data, len(backends))
+	}
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		if seen[b.Name] {
+			return nil, fmt.Errorf("backend %q is listed twice", b.Name)
+		}
+		seen[b.Name] = true
+	}
+	s := &Store{Backends: backends, DataShards: data, ParityShards: parity, BlockSize: blockSize, WriteQuorum: quorum}
+	if _, err := s.encoder(data, parity); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// encoder returns the codec for a layout, which may predate a change of
+// the configured shard counts.
+func (s *Store) encoder(data, parity int) (reedsolomon.Encoder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enc, ok := s.encoders[[2]int{data, parity}]; ok {
+		return enc, nil
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	if s.encoders == nil {
+		s.encoders = make(map[[2]int]reedsolomon.Encoder)
+	}
+	s.encoders[[2]int{data, parity}] = enc
+	return enc, nil
+}
+
+func (s *Store) backend(name string) *Backend {
+	for _, b := range s.Backends {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// Put encodes r stripe by stripe and streams every shard to its backend at
+// once. A backend that fails is dropped from the write and the others
+// carry on; the Put succeeds once WriteQuorum shards are stored and the
+// layout is recorded, in the transaction ctx carries if there is one, with
+// the missing shards left for the scrubber. Otherwise the stored shards are
+// deleted again.
+func (s *Store) Put(ctx context.Context, key string, r io.Reader) (written int64, err error) {
+	ctx, span := tracer.Start(ctx, "erasure.Put")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	layout, err := s.write(ctx, key, r)
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int("erasure.stored", storedShards(layout)))
+	// Without its layout the blob cannot be read. The shards are left to
+	// the garbage collector rather than deleted, as they may be those of an
+	// identical blob stored before under the same key.
+	if err := saveLayout(config.DBFrom(ctx), layout); err != nil {
+		return layout.Size, fmt.Errorf("recording layout of %s: %w", key, err)
+	}
+	return layout.Size, nil
+}
+
+// write stores the shards of r and returns their layout, which Put
+// records.
+func (s *Store) write(ctx context.Context, key string, r io.Reader) (*models.BlobLayout, error) {
+	errs := make([]error, len(s.Backends))
+	pipes := make([]*io.PipeWriter, len(s.Backends))
+	hashes := make([]hash.Hash, len(s.Backends))
+	var wg sync.WaitGroup
+	for i, b := range s.Backends {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		hashes[i] = sha256.New()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = b.Store.Put(ctx, key, pr)
+			// Unblocks the encoder if the backend gave up without reading
+			// everything.
+			pr.CloseWithError(errs[i])
+		}()
+	}
+
+	var written int64
+	enc, err := s.encoder(s.DataShards, s.ParityShards)
+	if err == nil {
+		written, err = encode(enc, r, s.DataShards, s.BlockSize, pipes, hashes)
+	}
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	layout := &models.BlobLayout{
+		Key:          key,
+		Hash:         gc.BlobHash(key),
+		Size:         written,
+		DataShards:   s.DataShards,
+		ParityShards: s.ParityShards,
+		BlockSize:    s.BlockSize,
+		Shards:       make([]models.ShardRef, len(s.Backends)),
+	}
+	stored := 0
+	for i, b := range s.Backends {
+		layout.Shards[i].Backend = b.Name
+		if errs[i] != nil {
+			b.fail(errs[i])
+			metrics.ErasureWriteFailuresTotal.WithLabelValues(b.Name).Inc()
+			tracing.Logf(ctx, "erasure: writing shard %d of %s to %s: %v", i, key, b.Name, errs[i])
+			continue
+		}
+		layout.Shards[i].SHA256 = hex.EncodeToString(hashes[i].Sum(nil))
+		stored++
+	}
+
+	if stored < s.WriteQuorum {
+		for i, b := range s.Backends {
+			if errs[i] == nil {
+				b.Store.Delete(context.WithoutCancel(ctx), key)
+			}
+		}
+		return nil, fmt.Errorf("%w: %d of %d shards of %s stored: %w", ErrQuorum, stored, s.WriteQuorum, key, errors.Join(errs...))
+	}
+	// A backend that missed this write may still hold a shard of an older
+	// blob under the same key; remove it so it is never read.
+	for i, b := range s.Backends {
+		if errs[i] != nil {
+			b.Store.Delete(context.WithoutCancel(ctx), key)
+		}
+	}
+	return layout, nil
+}
+
+// encode cuts r into stripes of data blocks of blockSize bytes, computes
+// their parity and writes block i of every stripe to writers[i]. A writer
+// that fails is left out from then on; only errors reading r are returned.
+func encode(enc reedsolomon.Encoder, r io.Reader, data, blockSize int, writers []*io.PipeWriter, hashes []hash.Hash) (int64, error) {
+	live := make([]*io.PipeWriter, len(writers))
+	copy(live, writers)
+	stripe := make([]byte, data*blockSize)
+	blocks := make([][]byte, len(writers))
+	for i := range blocks {
+		if i < data {
+			blocks[i] = stripe[i*blockSize : (i+1)*blockSize]
+		} else {
+			blocks[i] = make([]byte, blockSize)
+		}
+	}
+
+	var written int64
+	for {
+		n, err := io.ReadFull(r, stripe)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return written, err
+		}
+		written += int64(n)
+		clear(stripe[n:])
+		if err := enc.Encode(blocks); err != nil {
+			return written, err
+		}
+		for i, w := range live {
+			if w == nil {
+				continue
+			}
+			hashes[i].Write(blocks[i])
+			if _, err := w.Write(blocks[i]); err != nil {
+				live[i] = nil
+			}
+		}
+		if err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+	}
+}
+
+// storedShards counts the shards of layout that were stored.
+func storedShards(layout *models.BlobLayout) int {
+	n := 0
+	for _, ref := range layout.Shards {
+		if ref.SHA256 != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func saveLayout(db *gorm.DB, layout *models.BlobLayout) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(layout).Error
+}
+
+// loadLayout returns the layout of key, or storage.ErrNotFound. It reads in
+// the transaction ctx carries if there is one, which sees the layouts that
+// transaction wrote.
+func loadLayout(ctx context.Context, key string) (*models.BlobLayout, error) {
+	var layout models.BlobLayout
+	err := config.DBFrom(ctx).Where("key = ?", key).Take(&layout).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &layout, nil
+}
+
+// Open opens the shards of the blob that reads need: the data shards, and
+// a parity shard for each one that cannot be opened.
+func (s *Store) Open(ctx context.Context, key string) (storage.Object, error) {
+	layout, err := loadLayout(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) && s.Fallback != nil {
+		return s.Fallback.Open(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.openLayout(ctx, layout)
+}
+
+// openLayout opens the blob layout describes.
+func (s *Store) openLayout(ctx context.Context, layout *models.BlobLayout) (storage.Object, error) {
+	enc, err := s.encoder(layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &object{
+		ctx:    ctx,
+		store:  s,
+		layout: layout,
+		enc:    enc,
+		shards: make([]storage.Object, len(layout.Shards)),
+		tried:  make([]bool, len(layout.Shards)),
+		cached: -1,
+	}
+	open := 0
+	for i := range layout.Shards {
+		if open == layout.DataShards {
+			break
+		}
+		if o.openShard(i) {
+			open++
+		}
+	}
+	if open < layout.DataShards {
+		o.Close()
+		return nil, fmt.Errorf("%w: %d of %d shards of %s readable", ErrTooFewShards, open, layout.DataShards, layout.Key)
+	}
+	return o, nil
+}
+
+func (s *Store) Stat(ctx context.Context, key string) (storage.Info, error) {
+	layout, err := loadLayout(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) && s.Fallback != nil {
+		return s.Fallback.Stat(ctx, key)
+	}
+	if err != nil {
+		return storage.Info{}, err
+	}
+	return storage.Info{Key: key, Size: layout.Size, ModTime: layout.UpdatedAt}, nil
+}
+
+// Delete forgets the blob's layout, in the transaction ctx carries if there
+// is one, then deletes every shard and any copy in Fallback. Shards on
+// backends that failed are left to the garbage collector, which sees them
+// through Walk.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if err := config.DBFrom(ctx).Where("key = ?", key).Delete(&models.BlobLayout{}).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for _, b := range s.Backends {
+		if err := b.Store.Delete(ctx, key); err != nil {
+			b.fail(err)
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name, err))
+		}
+	}
+	if s.Fallback != nil {
+		if err := s.Fallback.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Walk lists the union of the shards on all backends and the blobs in
+// Fallback. The sizes of erasure-coded blobs are those of one shard.
+// Backends that cannot be walked are skipped, unless none can.
+func (s *Store) Walk(ctx context.Context, prefix string, fn func(storage.Info) error) error {
+	seen := make(map[string]bool)
+	var fnErr error
+	visit := func(store storage.Store) error {
+		return store.Walk(ctx, prefix, func(info storage.Info) error {
+			if seen[info.Key] {
+				return nil
+			}
+			seen[info.Key] = true
+			fnErr = fn(info)
+			return fnErr
+		})
+	}
+
+	var errs []error
+	for _, b := range s.Backends {
+		err := visit(b.Store)
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			b.fail(err)
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name, err))
+		}
+	}
+	if len(errs) == len(s.Backends) {
+		return errors.Join(errs...)
+	}
+	if s.Fallback != nil {
+		err := visit(s.Fallback)
+		if fnErr != nil {
+			return fnErr
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package erasure
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+)
+
+var errBroken = errors.New("volume broken")
+
+// brokenStore fails every write.
+type brokenStore struct {
+	storage.Store
+}
+
+func (s *brokenStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	return 0, errBroken
+}
+
+func newBackends(t *testing.T, n int) []*Backend {
+	t.Helper()
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = &Backend{Name: fmt.Sprintf("b%d", i), Store: storage.NewLocal(t.TempDir())}
+	}
+	return backends
+}
+
+// newTestStore returns a store of n backends, parity of them parity, with
+// small blocks so blobs span many stripes.
+func newTestStore(t *testing.T, n, parity int) *Store {
+	t.Helper()
+	s, err := NewStore(newBackends(t, n), parity, 4096, n-parity+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// randomBlob returns content of size bytes and the key it is stored under.
+func randomBlob(size int) ([]byte, string) {
+	content := make([]byte, size)
+	rand.Read(content)
+	return content, storage.BlobKey(fmt.Sprintf("%x", sha256.Sum256(content)))
+}
+
+// writeBlob stores content without recording its layout.
+func writeBlob(t *testing.T, s *Store, key string, content []byte) *models.BlobLayout {
+	t.Helper()
+	layout, err := s.write(context.Background(), key, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func deleteShard(t *testing.T, s *Store, layout *models.BlobLayout, i int) {
+	t.Helper()
+	b := s.backend(layout.Shards[i].Backend)
+	if err := b.Store.Delete(context.Background(), layout.Key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// truncateShard cuts shard i to half its size.
+func truncateShard(t *testing.T, s *Store, layout *models.BlobLayout, i int) {
+	t.Helper()
+	ctx := context.Background()
+	b := s.backend(layout.Shards[i].Backend)
+	obj, err := b.Store.Open(ctx, layout.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Store.Put(ctx, layout.Key, bytes.NewReader(data[:len(data)/2])); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBlob(t *testing.T, s *Store, layout *models.BlobLayout) ([]byte, error) {
+	t.Helper()
+	obj, err := s.openLayout(context.Background(), layout)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+func TestPutWithoutQuorumLeavesNothing(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t, 4, 2)
+	s.Backends[2].Store = &brokenStore{s.Backends[2].Store}
+	s.Backends[3].Store = &brokenStore{s.Backends[3].Store}
+
+	content, key := randomBlob(100 << 10)
+	// A backend that stores its shard held one of an older blob.
+	if _, err := s.Backends[0].Store.Put(ctx, key, bytes.NewReader([]byte("older"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Put(ctx, key, bytes.NewReader(content)); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("Put = %v, want ErrQuorum", err)
+	}
+	for _, b := range s.Backends {
+		if _, err := b.Store.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("backend %s: Stat = %v, want ErrNotFound", b.Name, err)
+		}
+	}
+}
+
+func TestReadWithParityShardsLost(t *testing.T) {
+	tests := []struct {
+		name      string
+		deleted   []int
+		truncated []int
+	}{
+		{name: "nothing lost"},
+		{name: "two data shards deleted", deleted: []int{0, 1}},
+		{name: "last data shards deleted", deleted: []int{2, 3}},
+		{name: "parity shards deleted", deleted: []int{4, 5}},
+		{name: "data and parity shard deleted", deleted: []int{1, 5}},
+		{name: "two data shards truncated", truncated: []int{0, 2}},
+		{name: "one deleted, one truncated", deleted: []int{3}, truncated: []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, 6, 2)
+			// Not a whole number of stripes, so the last one is padded.
+			content, key := randomBlob(10*4*4096 + 1234)
+			layout := writeBlob(t, s, key, content)
+			for _, i := range tt.deleted {
+				deleteShard(t, s, layout, i)
+			}
+			for _, i := range tt.truncated {
+				truncateShard(t, s, layout, i)
+			}
+
+			got, err := readBlob(t, s, layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("read %d bytes that differ from the %d stored", len(got), len(content))
+			}
+
+			obj, err := s.openLayout(context.Background(), layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer obj.Close()
+			// Reads that start in one block and end in the next, and the
+			// end of the blob.
+			for _, off := range []int64{0, 4096 - 10, 4*4096 - 10, 7*4096 + 100, int64(len(content)) - 50} {
+				p := make([]byte, 100)
+				n, err := obj.ReadAt(p, off)
+				want := content[off:min(off+100, int64(len(content)))]
+				if n != len(want) || !bytes.Equal(p[:n], want) {
+					t.Errorf("ReadAt(%d) = %d bytes that differ, %v", off, n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadWithTooManyShardsLost(t *testing.T) {
+	s := newTestStore(t, 6, 2)
+	content, key := randomBlob(50 << 10)
+	layout := writeBlob(t, s, key, content)
+	deleteShard(t, s, layout, 0)
+	deleteShard(t, s, layout, 4)
+	truncateShard(t, s, layout, 2)
+
+	if _, err := readBlob(t, s, layout); !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("read = %v, want ErrTooFewShards", err)
+	}
+}
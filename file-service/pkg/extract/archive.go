@@ -0,0 +1,155 @@
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	FormatZip    = "zip"
+	FormatTar    = "tar"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+)
+
+// Limits bound what a single archive may expand to. They protect against
+// archive bombs: a small upload that unpacks to gigabytes or millions of
+// files.
+type Limits struct {
+	MaxEntries    int
+	MaxEntryBytes int64
+	MaxTotalBytes int64
+	// MaxRatio caps uncompressed/compressed size, per entry for ZIP files
+	// and for the whole stream for compressed TARs.
+	MaxRatio int64
+}
+
+var errLimit = errors.New("archive exceeds extraction limits")
+
+// entry is one regular file inside an archive. Size is the declared size and
+// CompressedSize is only known for ZIP members (0 otherwise); neither is
+// trusted when reading.
+type entry struct {
+	Name           string
+	Mode           fs.FileMode
+	Size           int64
+	CompressedSize int64
+	Open           func() (io.ReadCloser, error)
+}
+
+// DetectFormat picks the archive format from the sniffed MIME type, using
+// the file name to tell compressed TARs from plain compressed files.
+func DetectFormat(mimeType, name string) (string, bool) {
+	m := strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	lower := strings.ToLower(name)
+	switch m {
+	case "application/zip", "application/x-zip-compressed":
+		return FormatZip, true
+	case "application/x-tar":
+		return FormatTar, true
+	case "application/gzip", "application/x-gzip":
+		if strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+			return FormatTarGz, true
+		}
+	case "application/zstd":
+		if strings.HasSuffix(lower, ".tar.zst") || strings.HasSuffix(lower, ".tzst") {
+			return FormatTarZst, true
+		}
+	}
+	return "", false
+}
+
+// walkZip calls fn for every member of the ZIP file in ra. The entry count
+// is checked against the central directory before anything is read.
+func walkZip(ra io.ReaderAt, size int64, limits Limits, total func(int), fn func(entry) error) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	if len(zr.File) > limits.MaxEntries {
+		return fmt.Errorf("%w: %d entries, at most %d allowed", errLimit, len(zr.File), limits.MaxEntries)
+	}
+	total(len(zr.File))
+
+	for _, f := range zr.File {
+		e := entry{
+			Name:           f.Name,
+			Mode:           f.Mode(),
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+			Open:           f.Open,
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTar calls fn for every entry of a TAR stream, decompressed according
+// to format. Only regular files can be opened; links, devices and sparse
+// files are passed with a nil Open so they are reported as skipped.
+func walkTar(r io.Reader, format string, limits Limits, fn func(entry) error) error {
+	switch format {
+	case FormatTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case FormatTarZst:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for count := 0; ; count++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if count >= limits.MaxEntries {
+			return fmt.Errorf("%w: more than %d entries", errLimit, limits.MaxEntries)
+		}
+
+		e := entry{Name: hdr.Name, Mode: hdr.FileInfo().Mode(), Size: hdr.Size}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			e.Open = func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		case tar.TypeDir:
+			e.Mode |= fs.ModeDir
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// readLimited copies at most limit bytes from r to w and fails, rather than
+// truncating, when r has more.
+func readLimited(w io.Writer, r io.Reader, limit int64) (int64, error) {
+	n, err := io.Copy(w, io.LimitReader(r, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, fmt.Errorf("%w: entry expands beyond %d bytes", errLimit, limit)
+	}
+	return n, nil
+}
@@ -0,0 +1,281 @@
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"volt/db/models"
+)
+
+var testLimits = Limits{
+	MaxEntries:    100,
+	MaxEntryBytes: 100 << 20,
+	MaxTotalBytes: 1 << 30,
+	MaxRatio:      100,
+}
+
+func TestSafeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // "" when rejected
+	}{
+		{name: "notes.txt", want: "notes.txt"},
+		{name: "dir/notes.txt", want: "dir/notes.txt"},
+		{name: "./dir//notes.txt", want: "dir/notes.txt"},
+		{name: `dir\notes.txt`, want: "dir/notes.txt"},
+		{name: "../notes.txt"},
+		{name: "dir/../../notes.txt"},
+		{name: "dir/../notes.txt"},
+		{name: `..\notes.txt`},
+		{name: "/etc/x"},
+		{name: `\etc\x`},
+		{name: `C:\Windows\x`},
+		{name: "c:x"},
+		{name: "."},
+		{name: ""},
+		{name: strings.Repeat("a", 256)},
+	}
+	for _, tt := range tests {
+		got, err := safeName(tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("safeName(%q) = %q, want it rejected", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("safeName(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+type member struct {
+	name    string
+	mode    fs.FileMode
+	content []byte
+	// typeflag overrides the TAR entry type.
+	typeflag byte
+	// declared overrides the uncompressed size a ZIP member claims.
+	declared uint64
+}
+
+func zipOf(t *testing.T, members ...member) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &zip.FileHeader{Name: m.name, Method: zip.Deflate}
+		hdr.SetMode(m.mode | 0o644)
+		if m.declared == 0 {
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(m.content)
+			continue
+		}
+		// A member whose header understates what it inflates to.
+		var deflated bytes.Buffer
+		fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+		fw.Write(m.content)
+		fw.Close()
+		hdr.CRC32 = crc32.ChecksumIEEE(m.content)
+		hdr.CompressedSize64 = uint64(deflated.Len())
+		hdr.UncompressedSize64 = m.declared
+		w, err := zw.CreateRaw(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(deflated.Bytes())
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarOf(t *testing.T, gzipped bool, members ...member) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: 0o644, Size: int64(len(m.content)), Typeflag: tar.TypeReg}
+		if m.typeflag != 0 {
+			hdr.Typeflag, hdr.Size, hdr.Linkname = m.typeflag, 0, "/etc/passwd"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(m.content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzipped {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+// extractAll walks archive like a job does. Only members that are rejected
+// before being stored can be used, as storing needs the database.
+func extractAll(format string, archive []byte, archiveSize int64, limits Limits) (*run, error) {
+	r := &run{
+		ctx:    context.Background(),
+		job:    &models.ExtractionJob{Format: format},
+		ref:    &models.FileReference{File: models.File{Size: archiveSize}},
+		limits: limits,
+		// Far enough ahead that progress is never saved.
+		lastFlush: time.Now().Add(time.Hour),
+	}
+	if format == FormatZip {
+		return r, walkZip(bytes.NewReader(archive), int64(len(archive)), limits, func(n int) { r.job.EntriesTotal = n }, r.handle)
+	}
+	return r, walkTar(bytes.NewReader(archive), format, limits, r.handle)
+}
+
+func TestUnsafeMembersAreNotExtracted(t *testing.T) {
+	content := []byte("not for you")
+	unsafe := []member{
+		{name: "../escape.txt", content: content},
+		{name: "dir/../../escape.txt", content: content},
+		{name: "/etc/x", content: content},
+		{name: `C:\Windows\x`, content: content},
+	}
+	archives := []struct {
+		format  string
+		special int
+		archive []byte
+	}{
+		{FormatZip, 1, zipOf(t, append(unsafe,
+			member{name: "dir/", mode: fs.ModeDir},
+			member{name: "link", mode: fs.ModeSymlink, content: []byte("/etc/passwd")},
+		)...)},
+		{FormatTar, 3, tarOf(t, false, append(unsafe,
+			member{name: "link", typeflag: tar.TypeSymlink},
+			member{name: "hardlink", typeflag: tar.TypeLink},
+			member{name: "tty", typeflag: tar.TypeChar},
+			member{name: "dir/", typeflag: tar.TypeDir},
+		)...)},
+		{FormatTarGz, 2, tarOf(t, true, append(unsafe,
+			member{name: "link", typeflag: tar.TypeSymlink},
+			member{name: "fifo", typeflag: tar.TypeFifo},
+		)...)},
+	}
+	for _, a := range archives {
+		t.Run(a.format, func(t *testing.T) {
+			r, err := extractAll(a.format, a.archive, int64(len(a.archive)), testLimits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job := r.job
+			if job.EntriesFailed != len(unsafe) {
+				t.Errorf("%d members failed, want the %d unsafe paths: %q", job.EntriesFailed, len(unsafe), job.Errors)
+			}
+			if job.EntriesSkipped != a.special {
+				t.Errorf("%d members skipped, want the %d links and special files: %q", job.EntriesSkipped, a.special, job.Errors)
+			}
+			if job.EntriesCreated != 0 || job.EntriesDuplicate != 0 || job.BytesExtracted != 0 {
+				t.Errorf("job = %+v, want nothing extracted", job)
+			}
+			for _, e := range job.Errors {
+				if strings.HasPrefix(e, "etc/") || strings.HasPrefix(e, "escape.txt") {
+					t.Errorf("error %q names the member as if it were safe", e)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveBombs(t *testing.T) {
+	zeros := make([]byte, 10<<20)
+
+	t.Run("deflate bomb over the ratio cap", func(t *testing.T) {
+		archive := zipOf(t, member{name: "bomb.bin", content: zeros})
+		// The archive as a whole may expand this much; the member may not.
+		r, err := extractAll(FormatZip, archive, 1<<30, testLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.job.EntriesFailed != 1 || r.job.BytesExtracted != 0 {
+			t.Errorf("job = %+v, want the member failed", r.job)
+		}
+	})
+
+	t.Run("deflate bomb with an understated size", func(t *testing.T) {
+		archive := zipOf(t, member{name: "bomb.bin", content: zeros, declared: 1000})
+		r, err := extractAll(FormatZip, archive, 1<<30, testLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.job.EntriesFailed != 1 || r.job.BytesExtracted != 0 {
+			t.Errorf("job = %+v, want the member failed", r.job)
+		}
+	})
+
+	t.Run("archive over the ratio cap", func(t *testing.T) {
+		archive := zipOf(t, member{name: "bomb.bin", content: zeros})
+		if _, err := extractAll(FormatZip, archive, int64(len(archive)), testLimits); !errors.Is(err, errLimit) {
+			t.Fatalf("extraction = %v, want errLimit", err)
+		}
+	})
+
+	t.Run("tar.gz over the ratio cap", func(t *testing.T) {
+		archive := tarOf(t, true, member{name: "bomb.bin", content: zeros})
+		if _, err := extractAll(FormatTarGz, archive, int64(len(archive)), testLimits); !errors.Is(err, errLimit) {
+			t.Fatalf("extraction = %v, want errLimit", err)
+		}
+	})
+
+	t.Run("total size cap", func(t *testing.T) {
+		archive := tarOf(t, false, member{name: "big.bin", content: zeros})
+		limits := testLimits
+		limits.MaxTotalBytes = 1 << 20
+		if _, err := extractAll(FormatTar, archive, int64(len(archive)), limits); !errors.Is(err, errLimit) {
+			t.Fatalf("extraction = %v, want errLimit", err)
+		}
+	})
+
+	t.Run("entry count cap", func(t *testing.T) {
+		var members []member
+		for i := 0; i < 5; i++ {
+			members = append(members, member{name: "../x", content: []byte("x")})
+		}
+		limits := testLimits
+		limits.MaxEntries = 4
+		for _, format := range []string{FormatZip, FormatTar} {
+			archive := zipOf(t, members...)
+			if format == FormatTar {
+				archive = tarOf(t, false, members...)
+			}
+			if _, err := extractAll(format, archive, int64(len(archive)), limits); !errors.Is(err, errLimit) {
+				t.Errorf("%s: extraction = %v, want errLimit", format, err)
+			}
+		}
+	})
+}
+
+func TestReadLimited(t *testing.T) {
+	var buf bytes.Buffer
+	if n, err := readLimited(&buf, strings.NewReader("12345"), 5); err != nil || n != 5 {
+		t.Errorf("at the limit: %d, %v", n, err)
+	}
+	if _, err := readLimited(&buf, strings.NewReader("123456"), 5); !errors.Is(err, errLimit) {
+		t.Errorf("over the limit: %v, want errLimit", err)
+	}
+}
@@ -0,0 +1,428 @@
+// Package extract unpacks uploaded ZIP and TAR archives into individual file
+// references. Every member goes through the normal upload path, so members
+// are deduplicated, indexed and previewed like any other upload.
+package extract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"volt/common/problem"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/preview"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/search"
+	"volt/file-service/pkg/utils"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+const (
+	maxJobErrors     = 100
+	progressInterval = time.Second
+	// staleAfter is how long a running job may go without a progress update
+	// before it is considered abandoned by a crashed instance.
+	staleAfter = 10 * time.Minute
+)
+
+var tracer = tracing.Tracer("volt/file-service/extract")
+
+var queue = make(chan uint, 256)
+
+// LimitsFromEnv reads the extraction limits, falling back to defaults that
+// comfortably fit real-world archives.
+func LimitsFromEnv() Limits {
+	return Limits{
+		MaxEntries:    config.GetEnvInt("EXTRACT_MAX_ENTRIES", 10000),
+		MaxEntryBytes: int64(config.GetEnvInt("EXTRACT_MAX_ENTRY_MB", 100)) << 20,
+		MaxTotalBytes: int64(config.GetEnvInt("EXTRACT_MAX_TOTAL_MB", 1024)) << 20,
+		MaxRatio:      int64(config.GetEnvInt("EXTRACT_MAX_RATIO", 100)),
+	}
+}
+
+// Supported reports whether file can be extracted.
+func Supported(file *models.File) bool {
+	_, ok := DetectFormat(file.MimeType, file.OriginalName)
+	return ok
+}
+
+// Start creates an extraction job for the reference refID, which the user
+// must own or which must be public, and schedules it.
+func Start(ctx context.Context, userID, refID uint) (*models.ExtractionJob, error) {
+	db := config.DB.WithContext(ctx)
+
+	var ref models.FileReference
+	err := db.Preload("File").
+		Where("id = ? AND (user_id = ? OR is_private = false)", refID, userID).
+		First(&ref).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, problem.New(http.StatusNotFound, problem.CodeNotFound, "File not found")
+		}
+		return nil, err
+	}
+
+	if scan.Blocked(&ref.File) {
+		return nil, scan.ErrInfected(&ref.File)
+	}
+
+	format, ok := DetectFormat(ref.File.MimeType, ref.DisplayName)
+	if !ok {
+		format, ok = DetectFormat(ref.File.MimeType, ref.File.OriginalName)
+	}
+	if !ok {
+		return nil, problem.New(http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType,
+			fmt.Sprintf("%s is not a ZIP, TAR, tar.gz or tar.zst archive", ref.DisplayName))
+	}
+
+	job := models.ExtractionJob{
+		UserID:          userID,
+		FileReferenceID: ref.ID,
+		Status:          models.JobStatusPending,
+		Format:          format,
+	}
+	if err := db.Create(&job).Error; err != nil {
+		return nil, err
+	}
+	Enqueue(job.ID)
+	return &job, nil
+}
+
+// Get returns one of the user's jobs.
+func Get(ctx context.Context, userID, jobID uint) (*models.ExtractionJob, error) {
+	var job models.ExtractionJob
+	err := config.DB.WithContext(ctx).Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, problem.New(http.StatusNotFound, problem.CodeNotFound, "Job not found")
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Enqueue schedules a pending job. A dropped job stays pending and is picked
+// up by the periodic sweep in Run.
+func Enqueue(jobID uint) {
+	select {
+	case queue <- jobID:
+	default:
+		log.Printf("extract: queue full, job %d will be picked up later", jobID)
+	}
+}
+
+// Run processes jobs with the given number of workers until ctx is
+// cancelled. It also requeues pending jobs once a minute, which covers jobs
+// dropped from a full queue and jobs abandoned by a crashed instance.
+func Run(ctx context.Context, workers int) {
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-queue:
+					if err := process(ctx, id); err != nil && !errors.Is(err, context.Canceled) {
+						log.Printf("extract: job %d failed: %v", id, err)
+					}
+				}
+			}
+		}()
+	}
+
+	sweep(ctx)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for i := 0; i < workers; i++ {
+				<-done
+			}
+			return
+		case <-ticker.C:
+			sweep(ctx)
+		}
+	}
+}
+
+func sweep(ctx context.Context) {
+	db := config.DB.WithContext(ctx)
+
+	err := db.Model(&models.ExtractionJob{}).
+		Where("status = ? AND updated_at < ?", models.JobStatusRunning, time.Now().Add(-staleAfter)).
+		Update("status", models.JobStatusPending).Error
+	if err != nil {
+		log.Printf("extract: resetting stale jobs failed: %v", err)
+		return
+	}
+
+	var ids []uint
+	if err := db.Model(&models.ExtractionJob{}).Where("status = ?", models.JobStatusPending).Order("id").Limit(cap(queue)).Pluck("id", &ids).Error; err != nil {
+		log.Printf("extract: listing pending jobs failed: %v", err)
+		return
+	}
+	for _, id := range ids {
+		Enqueue(id)
+	}
+}
+
+// run tracks one job while it executes.
+type run struct {
+	ctx       context.Context
+	job       *models.ExtractionJob
+	ref       *models.FileReference
+	limits    Limits
+	role      string
+	lastFlush time.Time
+}
+
+func process(ctx context.Context, jobID uint) (err error) {
+	ctx, span := tracer.Start(ctx, "extract.process")
+	span.SetAttributes(attribute.Int("job.id", int(jobID)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	db := config.DB.WithContext(ctx)
+
+	// Claim the job so that it runs once even if it was queued twice.
+	now := time.Now()
+	claim := db.Model(&models.ExtractionJob{}).
+		Where("id = ? AND status = ?", jobID, models.JobStatusPending).
+		Updates(map[string]interface{}{"status": models.JobStatusRunning, "started_at": now})
+	if claim.Error != nil {
+		return claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return nil
+	}
+
+	var job models.ExtractionJob
+	if err := db.First(&job, jobID).Error; err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("archive.format", job.Format))
+
+	var ref models.FileReference
+	if err := db.Preload("File").First(&ref, job.FileReferenceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return finish(db, &job, errors.New("archive was deleted"))
+		}
+		return err
+	}
+
+	// Counters restart from zero when an abandoned job is resumed; members
+	// that were already stored come back as duplicates.
+	job.EntriesTotal, job.EntriesDone, job.EntriesCreated, job.EntriesDuplicate = 0, 0, 0, 0
+	job.EntriesSkipped, job.EntriesFailed, job.BytesExtracted, job.Errors = 0, 0, 0, nil
+
+	// Members are checked against the upload policy as the job's user.
+	var user models.User
+	if err := db.Select("role").First(&user, job.UserID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	r := &run{ctx: ctx, job: &job, ref: &ref, limits: LimitsFromEnv(), role: user.Role, lastFlush: now}
+	walkErr := r.walk()
+	if ctx.Err() != nil {
+		// Shutting down: hand the job back so the next sweep resumes it.
+		job.Status = models.JobStatusPending
+		r.flush()
+		return ctx.Err()
+	}
+	return finish(db, &job, walkErr)
+}
+
+func finish(db *gorm.DB, job *models.ExtractionJob, cause error) error {
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = models.JobStatusCompleted
+	if cause != nil {
+		job.Status = models.JobStatusFailed
+		job.Error = truncate(cause.Error(), 500)
+	}
+	return db.Save(job).Error
+}
+
+func (r *run) walk() error {
+	obj, err := content.Open(r.ctx, &r.ref.File)
+	if err != nil {
+		return fmt.Errorf("opening archive: %w", err)
+	}
+	defer obj.Close()
+
+	if r.job.Format != FormatZip {
+		return walkTar(obj, r.job.Format, r.limits, r.handle)
+	}
+
+	return walkZip(obj, obj.Size(), r.limits, func(n int) { r.job.EntriesTotal = n }, r.handle)
+}
+
+// handle stores one archive member. Problems with a single member are
+// recorded on the job and extraction continues; only limit violations and
+// read errors of the archive itself abort it.
+func (r *run) handle(e entry) error {
+	defer r.maybeFlush()
+	r.job.EntriesDone++
+
+	if e.Mode.IsDir() || strings.HasPrefix(e.Name, "__MACOSX/") {
+		return nil
+	}
+
+	name, err := safeName(e.Name)
+	if err != nil {
+		r.fail(e.Name, err)
+		return nil
+	}
+	if e.Open == nil || !e.Mode.IsRegular() {
+		r.skip(name, "links and special files are not extracted")
+		return nil
+	}
+
+	remaining := r.limits.MaxTotalBytes - r.job.BytesExtracted
+	if ratioCap := (r.ref.File.Size + 1) * r.limits.MaxRatio; ratioCap-r.job.BytesExtracted < remaining {
+		remaining = ratioCap - r.job.BytesExtracted
+	}
+	limit := min(r.limits.MaxEntryBytes, remaining)
+	if e.CompressedSize > 0 {
+		limit = min(limit, e.CompressedSize*r.limits.MaxRatio)
+	}
+	if e.Size > limit {
+		if e.Size > remaining {
+			return fmt.Errorf("%w: %s would exceed the total size limit", errLimit, name)
+		}
+		r.fail(name, fmt.Errorf("declared size %d exceeds the per-file limit", e.Size))
+		return nil
+	}
+
+	result, err := r.store(e, name, limit)
+	switch {
+	case errors.Is(err, errLimit) && limit == remaining:
+		return fmt.Errorf("%w: total extracted size", errLimit)
+	case errors.Is(err, errLimit):
+		r.fail(name, errors.New("expands beyond the per-file or compression ratio limit"))
+		return nil
+	case err != nil:
+		var p *problem.Problem
+		if errors.As(err, &p) {
+			r.fail(name, errors.New(p.Detail))
+			return nil
+		}
+		if r.ctx.Err() != nil {
+			return r.ctx.Err()
+		}
+		r.fail(name, err)
+		return nil
+	}
+
+	r.job.BytesExtracted += result.File.Size
+	if result.Status == models.UploadStatusDuplicate {
+		r.job.EntriesDuplicate++
+	} else {
+		r.job.EntriesCreated++
+	}
+	search.Enqueue(result.FileReference.ID)
+	preview.Enqueue(result.File.ID)
+	return nil
+}
+
+// store spools the member to a temporary file, since the upload path needs
+// to read it more than once, and uploads it as the job's user.
+func (r *run) store(e entry, name string, limit int64) (*models.FileUploadResult, error) {
+	rc, err := e.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp("", "volt-extract-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := readLimited(tmp, rc, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &multipart.FileHeader{Filename: path.Base(name), Size: n}
+	opts := utils.UploadOptions{
+		IsPrivate:   r.ref.IsPrivate || r.ref.UserID != r.job.UserID,
+		Tags:        r.ref.Tags,
+		DisplayName: name,
+		Role:        r.role,
+	}
+	return utils.ProcessFileUpload(r.ctx, tmp, header, r.job.UserID, opts)
+}
+
+// safeName rejects the member names behind zip-slip attacks (absolute paths
+// and ".." segments) before they become display names.
+func safeName(name string) (string, error) {
+	n := strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(n, "/") || (len(n) > 1 && n[1] == ':') {
+		return "", errors.New("absolute paths are not allowed")
+	}
+	clean, err := utils.CleanRelativePath(n)
+	if err != nil {
+		return "", errors.New("path escapes the archive root")
+	}
+	if clean == "" {
+		return "", errors.New("empty name")
+	}
+	return clean, nil
+}
+
+func (r *run) skip(name, reason string) {
+	r.job.EntriesSkipped++
+	r.note(name, reason)
+}
+
+func (r *run) fail(name string, err error) {
+	r.job.EntriesFailed++
+	r.note(name, err.Error())
+}
+
+func (r *run) note(name, msg string) {
+	if len(r.job.Errors) < maxJobErrors {
+		r.job.Errors = append(r.job.Errors, truncate(name+": "+msg, 500))
+	}
+}
+
+func (r *run) maybeFlush() {
+	if time.Since(r.lastFlush) >= progressInterval {
+		r.flush()
+	}
+}
+
+func (r *run) flush() {
+	r.lastFlush = time.Now()
+	// Saved with a fresh context so progress survives a cancelled run.
+	if err := config.DB.Save(r.job).Error; err != nil {
+		log.Printf("extract: saving progress of job %d failed: %v", r.job.ID, err)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
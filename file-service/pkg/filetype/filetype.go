@@ -0,0 +1,59 @@
+// Package filetype holds the MIME type tests and the guarded PDF parsing
+// that search extraction and previews share.
+package filetype
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// Base returns mimeType without its parameters.
+func Base(mimeType string) string {
+	return strings.TrimSpace(strings.Split(mimeType, ";")[0])
+}
+
+// Is returns a test for MIME types whose base type is want.
+func Is(want string) func(string) bool {
+	return func(mimeType string) bool {
+		return Base(mimeType) == want
+	}
+}
+
+// IsTextual covers plain text, Markdown, CSV and source code, which the MIME
+// sniffer reports as text/* or as one of a few application/* types.
+func IsTextual(mimeType string) bool {
+	m := Base(mimeType)
+	if strings.HasPrefix(m, "text/") {
+		return true
+	}
+	switch m {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-sh", "application/x-php", "application/x-python",
+		"application/x-ndjson", "application/toml", "application/yaml":
+		return true
+	}
+	return false
+}
+
+// ErrMalformedPDF is returned by ReadPDF when the parser gave up on a PDF.
+var ErrMalformedPDF = errors.New("malformed PDF")
+
+// ReadPDF opens the PDF of size bytes in ra and passes it to read. The PDF
+// parser panics on some malformed input, while opening the document as well
+// as while reading its pages, so both are guarded.
+func ReadPDF(ra io.ReaderAt, size int64, read func(*pdf.Reader) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = ErrMalformedPDF
+		}
+	}()
+
+	doc, err := pdf.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	return read(doc)
+}
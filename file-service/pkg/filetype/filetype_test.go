@@ -0,0 +1,85 @@
+package filetype
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ledongthuc/pdf"
+)
+
+func TestMIMETests(t *testing.T) {
+	pdfs := Is("application/pdf")
+	tests := []struct {
+		mimeType string
+		pdf      bool
+		textual  bool
+	}{
+		{mimeType: "application/pdf", pdf: true},
+		{mimeType: " application/pdf ; charset=binary", pdf: true},
+		{mimeType: "application/pdfx"},
+		{mimeType: "text/plain; charset=utf-8", textual: true},
+		{mimeType: "text/csv", textual: true},
+		{mimeType: "application/json", textual: true},
+		{mimeType: "application/x-python", textual: true},
+		{mimeType: "application/octet-stream"},
+		{mimeType: "image/svg+xml"},
+		{mimeType: ""},
+	}
+	for _, tt := range tests {
+		if got := pdfs(tt.mimeType); got != tt.pdf {
+			t.Errorf("Is(application/pdf)(%q) = %v", tt.mimeType, got)
+		}
+		if got := IsTextual(tt.mimeType); got != tt.textual {
+			t.Errorf("IsTextual(%q) = %v", tt.mimeType, got)
+		}
+	}
+}
+
+func TestReadPDFRecoversFromPanics(t *testing.T) {
+	garbage := "%PDF-1.4\ngarbage"
+	err := ReadPDF(strings.NewReader(garbage), int64(len(garbage)), func(*pdf.Reader) error {
+		t.Error("read called for a PDF that did not open")
+		return nil
+	})
+	if err == nil {
+		t.Error("garbage opened as a PDF")
+	}
+
+	// The parser also panics while reading documents it opened.
+	doc := onePagePDF()
+	err = ReadPDF(bytes.NewReader(doc), int64(len(doc)), func(r *pdf.Reader) error {
+		if r.NumPage() != 1 {
+			t.Errorf("%d pages, want 1", r.NumPage())
+		}
+		panic("index out of range")
+	})
+	if !errors.Is(err, ErrMalformedPDF) {
+		t.Errorf("ReadPDF = %v, want ErrMalformedPDF", err)
+	}
+}
+
+// onePagePDF returns a PDF with one empty page.
+func onePagePDF() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,536 @@
+// Package fsck checks that the database and the blob store agree: reference
+// counts match live references, every File has a blob whose content still
+// hashes to File.Hash, and every stored blob belongs to a File. It reports
+// what it finds as JSON and can repair what is safe to repair.
+package fsck
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/gc"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var tracer = tracing.Tracer("volt/file-service/fsck")
+
+// Verify modes decide how many blobs are re-hashed.
+const (
+	VerifyNone   = "none"
+	VerifySample = "sample"
+	VerifyAll    = "all"
+)
+
+type Options struct {
+	// Repair fixes reference counts, releases unreferenced Files and deletes
+	// orphaned blobs. Missing and corrupt blobs are only ever reported.
+	Repair bool
+	Verify string
+	// SampleRate is the fraction of blobs re-hashed in VerifySample mode.
+	SampleRate float64
+	// OrphanMinAge keeps blobs younger than this out of the orphan check, so
+	// uploads that have written their blob but not yet committed their row
+	// are not mistaken for orphans.
+	OrphanMinAge time.Duration
+}
+
+func OptionsFromEnv() Options {
+	return Options{
+		Repair:       config.GetEnv("FSCK_REPAIR", "false") == "true",
+		Verify:       config.GetEnv("FSCK_VERIFY", VerifySample),
+		SampleRate:   float64(config.GetEnvInt("FSCK_SAMPLE_PERCENT", 1)) / 100,
+		OrphanMinAge: config.GetEnvDuration("FSCK_ORPHAN_MIN_AGE", time.Hour),
+	}
+}
+
+type RefCountIssue struct {
+	FileID   uint   `json:"file_id,omitempty"`
+	Hash     string `json:"hash"`
+	Recorded int    `json:"recorded"`
+	Actual   int    `json:"actual"`
+	Repaired bool   `json:"repaired"`
+}
+
+type BlobIssue struct {
+	FileID uint   `json:"file_id,omitempty"`
+	Key    string `json:"key"`
+	Hash   string `json:"hash,omitempty"`
+	// Actual is the hash of the stored content when it differs from Hash.
+	Actual   string `json:"actual,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+type Summary struct {
+	Files                   int   `json:"files"`
+	References              int64 `json:"references"`
+	Chunks                  int   `json:"chunks"`
+	Blobs                   int   `json:"blobs"`
+	BlobsVerified           int   `json:"blobs_verified"`
+	RefCountMismatches      int   `json:"ref_count_mismatches"`
+	ChunkRefCountMismatches int   `json:"chunk_ref_count_mismatches"`
+	Unreferenced            int   `json:"unreferenced_files"`
+	DanglingReferences      int   `json:"dangling_references"`
+	MissingBlobs            int   `json:"missing_blobs"`
+	CorruptBlobs            int   `json:"corrupt_blobs"`
+	OrphanBlobs             int   `json:"orphan_blobs"`
+	Repaired                int   `json:"repaired"`
+}
+
+// Report is the machine-readable result of a check.
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Repair     bool      `json:"repair"`
+	Verify     string    `json:"verify"`
+	SampleRate float64   `json:"sample_rate,omitempty"`
+	Summary    Summary   `json:"summary"`
+
+	RefCounts []RefCountIssue `json:"ref_counts"`
+	// ChunkRefCounts compare chunk counts with manifest entries; Hash is
+	// the chunk's.
+	ChunkRefCounts []RefCountIssue `json:"chunk_ref_counts"`
+	// Unreferenced are live Files without live references.
+	Unreferenced []RefCountIssue `json:"unreferenced_files"`
+	// DanglingReferences are live references to deleted Files.
+	DanglingReferences []uint      `json:"dangling_references"`
+	MissingBlobs       []BlobIssue `json:"missing_blobs"`
+	CorruptBlobs       []BlobIssue `json:"corrupt_blobs"`
+	OrphanBlobs        []BlobIssue `json:"orphan_blobs"`
+	Errors             []string    `json:"errors"`
+}
+
+// Clean reports whether the check found nothing left unrepaired.
+func (r *Report) Clean() bool {
+	s := r.Summary
+	issues := s.RefCountMismatches + s.ChunkRefCountMismatches + s.Unreferenced + s.DanglingReferences + s.MissingBlobs + s.CorruptBlobs + s.OrphanBlobs
+	return issues == s.Repaired && len(r.Errors) == 0
+}
+
+func (r *Report) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Check runs every check. It returns an error only when it could not run at
+// all; problems with individual Files and blobs end up in the report.
+func Check(ctx context.Context, opts Options) (_ *Report, err error) {
+	ctx, span := tracer.Start(ctx, "fsck.Check")
+	span.SetAttributes(attribute.Bool("fsck.repair", opts.Repair), attribute.String("fsck.verify", opts.Verify))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	switch opts.Verify {
+	case VerifyNone, VerifySample, VerifyAll:
+	default:
+		return nil, fmt.Errorf("invalid verify mode %q: must be none, sample or all", opts.Verify)
+	}
+
+	report := &Report{
+		StartedAt:          time.Now(),
+		Repair:             opts.Repair,
+		Verify:             opts.Verify,
+		RefCounts:          []RefCountIssue{},
+		ChunkRefCounts:     []RefCountIssue{},
+		Unreferenced:       []RefCountIssue{},
+		DanglingReferences: []uint{},
+		MissingBlobs:       []BlobIssue{},
+		CorruptBlobs:       []BlobIssue{},
+		OrphanBlobs:        []BlobIssue{},
+		Errors:             []string{},
+	}
+	if opts.Verify == VerifySample {
+		report.SampleRate = opts.SampleRate
+	}
+	db := config.DB.WithContext(ctx)
+
+	if err := checkRefCounts(ctx, db, opts, report); err != nil {
+		return nil, err
+	}
+	if err := checkDangling(db, report); err != nil {
+		return nil, err
+	}
+	known, err := checkBlobs(ctx, db, opts, report)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkChunks(ctx, db, opts, known, report); err != nil {
+		return nil, err
+	}
+	if err := checkOrphans(ctx, db, opts, known, report); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	span.SetAttributes(attribute.Bool("fsck.clean", report.Clean()))
+	return report, nil
+}
+
+type countRow struct {
+	ID             uint
+	Hash           string
+	ReferenceCount int
+	Actual         int
+}
+
+// checkRefCounts recomputes every live File's count from file_references.
+func checkRefCounts(ctx context.Context, db *gorm.DB, opts Options, report *Report) error {
+	if err := db.Model(&models.FileReference{}).Count(&report.Summary.References).Error; err != nil {
+		return err
+	}
+
+	var rows []countRow
+	err := db.Raw(`
+		SELECT files.id, files.hash, files.reference_count, COUNT(file_references.id) AS actual
+		FROM files
+		LEFT JOIN file_references ON file_references.file_id = files.id AND file_references.deleted_at IS NULL
+		WHERE files.deleted_at IS NULL
+		GROUP BY files.id
+		HAVING files.reference_count <> COUNT(file_references.id) OR COUNT(file_references.id) = 0`).
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		issue := RefCountIssue{FileID: row.ID, Hash: row.Hash, Recorded: row.ReferenceCount, Actual: row.Actual}
+		if opts.Repair {
+			if err := repairCount(ctx, db, &issue); err != nil {
+				report.errorf("repairing file %d: %v", row.ID, err)
+			}
+		}
+		if issue.Repaired {
+			report.Summary.Repaired++
+		}
+		if issue.Actual == 0 {
+			report.Unreferenced = append(report.Unreferenced, issue)
+			report.Summary.Unreferenced++
+		} else {
+			report.RefCounts = append(report.RefCounts, issue)
+			report.Summary.RefCountMismatches++
+		}
+	}
+	return nil
+}
+
+// repairCount recounts under the hash lock, since uploads and deletes may
+// have changed the count since it was read, then stores the count or
+// releases the File when nothing references it.
+func repairCount(ctx context.Context, db *gorm.DB, issue *RefCountIssue) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, issue.Hash); err != nil {
+			return err
+		}
+		var file models.File
+		if err := tx.First(&file, issue.FileID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				// Released in the meantime.
+				issue.Repaired = true
+				return nil
+			}
+			return err
+		}
+		var actual int64
+		if err := tx.Model(&models.FileReference{}).Where("file_id = ?", file.ID).Count(&actual).Error; err != nil {
+			return err
+		}
+		issue.Actual = int(actual)
+
+		if actual == 0 {
+			if err := file.Release(tx); err != nil {
+				return err
+			}
+		} else if err := tx.Model(&file).UpdateColumn("reference_count", actual).Error; err != nil {
+			return err
+		}
+		issue.Repaired = true
+		return nil
+	})
+}
+
+// checkDangling finds live references whose File was deleted. They cannot
+// be repaired without the content, so they are only reported.
+func checkDangling(db *gorm.DB, report *Report) error {
+	err := db.Raw(`
+		SELECT file_references.id
+		FROM file_references
+		LEFT JOIN files ON files.id = file_references.file_id AND files.deleted_at IS NULL
+		WHERE file_references.deleted_at IS NULL AND files.id IS NULL
+		ORDER BY file_references.id`).
+		Scan(&report.DanglingReferences).Error
+	report.Summary.DanglingReferences = len(report.DanglingReferences)
+	return err
+}
+
+// checkBlobs makes sure each live File's blob exists and, for the files
+// selected by the verify mode, still has the recorded hash. It returns the
+// keys and hashes in use for the orphan check.
+func checkBlobs(ctx context.Context, db *gorm.DB, opts Options, report *Report) (map[string]bool, error) {
+	known := make(map[string]bool)
+
+	var batch []models.File
+	result := db.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, file := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			report.Summary.Files++
+			known[file.Hash] = true
+			if file.Chunked {
+				checkManifest(ctx, &file, opts, report)
+				continue
+			}
+			store, err := content.StoreFor(file.Tier)
+			if err != nil {
+				report.errorf("file %d: %v", file.ID, err)
+				continue
+			}
+			if file.Tier == models.TierHot {
+				known[file.StoragePath] = true
+			}
+
+			info, err := store.Stat(ctx, file.StoragePath)
+			if errors.Is(err, storage.ErrNotFound) {
+				report.MissingBlobs = append(report.MissingBlobs, BlobIssue{FileID: file.ID, Key: file.StoragePath, Hash: file.Hash, Size: file.Size})
+				report.Summary.MissingBlobs++
+				continue
+			}
+			if err != nil {
+				report.errorf("stat %s: %v", file.StoragePath, err)
+				continue
+			}
+
+			if !selected(opts) {
+				continue
+			}
+			actual, err := hashContent(ctx, &file)
+			if err != nil {
+				report.errorf("hashing %s: %v", file.StoragePath, err)
+				continue
+			}
+			report.Summary.BlobsVerified++
+			if actual != file.Hash {
+				report.CorruptBlobs = append(report.CorruptBlobs, BlobIssue{FileID: file.ID, Key: file.StoragePath, Hash: file.Hash, Actual: actual, Size: info.Size})
+				report.Summary.CorruptBlobs++
+			}
+		}
+		return nil
+	})
+	return known, result.Error
+}
+
+// checkManifest makes sure a chunked File's manifest covers its content and,
+// when selected, that the reassembled content still has the File's hash.
+// The chunks themselves are checked by checkChunks.
+func checkManifest(ctx context.Context, file *models.File, opts Options, report *Report) {
+	obj, err := content.Open(ctx, file)
+	if err != nil {
+		report.MissingBlobs = append(report.MissingBlobs, BlobIssue{FileID: file.ID, Hash: file.Hash, Size: file.Size})
+		report.Summary.MissingBlobs++
+		report.errorf("file %d: %v", file.ID, err)
+		return
+	}
+	defer obj.Close()
+	if !selected(opts) {
+		return
+	}
+	actual, err := hashReader(obj)
+	if err != nil {
+		report.errorf("hashing file %d: %v", file.ID, err)
+		return
+	}
+	report.Summary.BlobsVerified++
+	if actual != file.Hash {
+		report.CorruptBlobs = append(report.CorruptBlobs, BlobIssue{FileID: file.ID, Hash: file.Hash, Actual: actual, Size: file.Size})
+		report.Summary.CorruptBlobs++
+	}
+}
+
+type chunkCountRow struct {
+	Hash           string
+	ReferenceCount int
+	Actual         int
+}
+
+// checkChunks recomputes chunk reference counts from the manifests and
+// checks the chunk blobs like File blobs. Chunk keys are added to known.
+func checkChunks(ctx context.Context, db *gorm.DB, opts Options, known map[string]bool, report *Report) error {
+	var rows []chunkCountRow
+	err := db.Raw(`
+		SELECT chunks.hash, chunks.reference_count, COUNT(file_chunks.seq) AS actual
+		FROM chunks
+		LEFT JOIN file_chunks ON file_chunks.chunk_hash = chunks.hash
+		GROUP BY chunks.hash
+		HAVING chunks.reference_count <> COUNT(file_chunks.seq)`).
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		issue := RefCountIssue{Hash: row.Hash, Recorded: row.ReferenceCount, Actual: row.Actual}
+		if opts.Repair {
+			if err := repairChunkCount(ctx, db, &issue); err != nil {
+				report.errorf("repairing chunk %s: %v", row.Hash, err)
+			}
+		}
+		if issue.Repaired {
+			report.Summary.Repaired++
+		}
+		report.ChunkRefCounts = append(report.ChunkRefCounts, issue)
+		report.Summary.ChunkRefCountMismatches++
+	}
+
+	var batch []models.Chunk
+	result := db.Order("hash").FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+		for _, chunk := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			report.Summary.Chunks++
+			known[chunk.StorageKey] = true
+
+			_, err := storage.Blobs.Stat(ctx, chunk.StorageKey)
+			if errors.Is(err, storage.ErrNotFound) {
+				report.MissingBlobs = append(report.MissingBlobs, BlobIssue{Key: chunk.StorageKey, Hash: chunk.Hash, Size: chunk.Size})
+				report.Summary.MissingBlobs++
+				continue
+			}
+			if err != nil {
+				report.errorf("stat %s: %v", chunk.StorageKey, err)
+				continue
+			}
+			if !selected(opts) {
+				continue
+			}
+			actual, err := hashBlob(ctx, chunk.StorageKey)
+			if err != nil {
+				report.errorf("hashing %s: %v", chunk.StorageKey, err)
+				continue
+			}
+			report.Summary.BlobsVerified++
+			if actual != chunk.Hash {
+				report.CorruptBlobs = append(report.CorruptBlobs, BlobIssue{Key: chunk.StorageKey, Hash: chunk.Hash, Actual: actual, Size: chunk.Size})
+				report.Summary.CorruptBlobs++
+			}
+		}
+		return nil
+	})
+	return result.Error
+}
+
+// repairChunkCount recounts a chunk's manifest entries with its row locked
+// and stores the count, deleting the chunk's row when no manifest uses it;
+// its blob is left to the garbage collector.
+func repairChunkCount(ctx context.Context, db *gorm.DB, issue *RefCountIssue) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var chunk models.Chunk
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&chunk, "hash = ?", issue.Hash).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				issue.Repaired = true
+				return nil
+			}
+			return err
+		}
+		var actual int64
+		if err := tx.Model(&models.FileChunk{}).Where("chunk_hash = ?", chunk.Hash).Count(&actual).Error; err != nil {
+			return err
+		}
+		issue.Actual = int(actual)
+
+		if actual == 0 {
+			if err := tx.Delete(&chunk).Error; err != nil {
+				return err
+			}
+		} else if err := tx.Model(&chunk).UpdateColumn("reference_count", actual).Error; err != nil {
+			return err
+		}
+		issue.Repaired = true
+		return nil
+	})
+}
+
+func selected(opts Options) bool {
+	switch opts.Verify {
+	case VerifyAll:
+		return true
+	case VerifySample:
+		return rand.Float64() < opts.SampleRate
+	}
+	return false
+}
+
+func hashBlob(ctx context.Context, key string) (string, error) {
+	obj, err := storage.Blobs.Open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	return hashReader(obj)
+}
+
+// hashContent hashes a File's content, decompressing its blob if needed.
+func hashContent(ctx context.Context, file *models.File) (string, error) {
+	obj, err := content.Open(ctx, file)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	return hashReader(obj)
+}
+
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// checkOrphans walks the hot tier's uploads area for blobs no live File uses.
+// Previews belong to a File through the hash directory they are stored under.
+// Temporary files of unfinished writes, and the cold tier, are left to the
+// garbage collector.
+func checkOrphans(ctx context.Context, db *gorm.DB, opts Options, known map[string]bool, report *Report) error {
+	cutoff := time.Now().Add(-opts.OrphanMinAge)
+
+	return storage.Blobs.Walk(ctx, "uploads/", func(info storage.Info) error {
+		if gc.IsTemp(info.Key) {
+			return nil
+		}
+		report.Summary.Blobs++
+		if known[info.Key] || info.ModTime.After(cutoff) {
+			return nil
+		}
+		hash := gc.BlobHash(info.Key)
+		if gc.IsPreview(info.Key) && known[hash] {
+			return nil
+		}
+
+		issue := BlobIssue{Key: info.Key, Size: info.Size}
+		if opts.Repair && hash != "" {
+			if err := gc.RemoveOrphan(ctx, db, models.TierHot, info.Key, cutoff); err != nil {
+				report.errorf("removing %s: %v", info.Key, err)
+			} else {
+				issue.Repaired = true
+				report.Summary.Repaired++
+			}
+		}
+		report.OrphanBlobs = append(report.OrphanBlobs, issue)
+		report.Summary.OrphanBlobs++
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+package fsck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"volt/common/metrics"
+	"volt/file-service/pkg/leader"
+)
+
+// leaderLock is the advisory lock held by the replica that checks.
+const leaderLock int64 = 0x766f6c74_00006663 // "volt", "fc"
+
+var last atomic.Pointer[Report]
+
+// Last returns the report of the most recent scheduled check this replica
+// led, or nil before the first one finishes.
+func Last() *Report {
+	return last.Load()
+}
+
+// Run checks every interval until ctx is cancelled, logging each report's
+// summary as JSON and exporting the issue counts as metrics. Of all
+// replicas, only the one that gets the leader lock checks, so repairs are
+// never applied twice at once.
+func Run(ctx context.Context, interval time.Duration, opts Options) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var report *Report
+			err := leader.Do(ctx, leaderLock, func(ctx context.Context) error {
+				var err error
+				report, err = Check(ctx, opts)
+				return err
+			})
+			if err != nil {
+				if !errors.Is(err, leader.ErrNotLeader) && ctx.Err() == nil {
+					log.Printf("fsck: check failed: %v", err)
+				}
+				continue
+			}
+			last.Store(report)
+			record(report)
+		}
+	}
+}
+
+func record(report *Report) {
+	s := report.Summary
+	for kind, n := range map[string]int{
+		"ref_count_mismatch": s.RefCountMismatches,
+		"unreferenced_file":  s.Unreferenced,
+		"dangling_reference": s.DanglingReferences,
+		"missing_blob":       s.MissingBlobs,
+		"corrupt_blob":       s.CorruptBlobs,
+		"orphan_blob":        s.OrphanBlobs,
+	} {
+		metrics.FsckIssues.WithLabelValues(kind).Set(float64(n))
+	}
+	metrics.FsckLastRun.SetToCurrentTime()
+
+	summary, _ := json.Marshal(s)
+	log.Printf("fsck: finished in %s, clean=%v: %s", report.FinishedAt.Sub(report.StartedAt).Round(time.Millisecond), report.Clean(), summary)
+}
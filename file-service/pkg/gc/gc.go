@@ -0,0 +1,278 @@
+// Package gc deletes blobs nothing refers to any more: blobs, chunks and
+// previews of released Files, blobs of failed uploads, and temporary files
+// of writes that never finished. Releasing a File only deletes rows, so
+// this is the one place blobs are deleted and a rolled-back transaction
+// never loses content. It marks every blob key the database still uses in
+// each storage tier, then sweeps each tier's blob store for the rest. Only
+// blobs older than a grace period are swept, so uploads that have written
+// their blob but not yet committed their File are never touched.
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+var tracer = tracing.Tracer("volt/file-service/gc")
+
+type Options struct {
+	// DryRun reports what would be deleted without deleting it.
+	DryRun bool
+	// Grace keeps blobs and temporary files younger than this.
+	Grace time.Duration
+	// TempDir is searched for the service's abandoned temporary files, such
+	// as spooled multipart uploads. Empty skips it.
+	TempDir string
+}
+
+func OptionsFromEnv() Options {
+	return Options{
+		DryRun:  config.GetEnv("GC_DRY_RUN", "false") == "true",
+		Grace:   config.GetEnvDuration("GC_GRACE", time.Hour),
+		TempDir: config.GetEnv("GC_TEMP_DIR", os.TempDir()),
+	}
+}
+
+// tempPatterns match the temporary files the service creates outside the
+// blob store: multipart upload parts spooled by net/http and archive spools.
+var tempPatterns = []string{"multipart-*", "volt-extract-*"}
+
+// Result describes one collection. Swept lists what was deleted, or what
+// would have been in a dry run.
+type Result struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DryRun     bool      `json:"dry_run"`
+	Live       int       `json:"live"`
+	Scanned    int       `json:"scanned"`
+	Young      int       `json:"young"`
+	Swept      []Swept   `json:"swept"`
+	SweptBytes int64     `json:"swept_bytes"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+type Swept struct {
+	Key  string `json:"key"`
+	Tier string `json:"tier,omitempty"`
+	Kind string `json:"kind"`
+	Size int64  `json:"size"`
+}
+
+// Kinds of swept blobs.
+const (
+	KindBlob    = "blob"
+	KindChunk   = "chunk"
+	KindPreview = "preview"
+	KindTemp    = "temp"
+)
+
+func (r *Result) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Collect marks the blobs in use and sweeps the blob store and the local
+// temporary directory. It does not elect a leader; Run does.
+func Collect(ctx context.Context, opts Options) (_ *Result, err error) {
+	ctx, span := tracer.Start(ctx, "gc.Collect")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	result := &Result{StartedAt: time.Now(), DryRun: opts.DryRun}
+	db := config.DB.WithContext(ctx)
+
+	// Blobs written after the mark are younger than the cutoff, so anything
+	// the sweep considers was either marked or is garbage.
+	cutoff := result.StartedAt.Add(-opts.Grace)
+	live, hashes, err := mark(db)
+	if err != nil {
+		return nil, fmt.Errorf("marking live blobs: %w", err)
+	}
+	for _, tier := range content.Tiers() {
+		result.Live += len(live[tier])
+		if err := sweep(ctx, db, tier, live[tier], hashes, cutoff, opts, result); err != nil {
+			return nil, err
+		}
+	}
+
+	sweepTempDir(opts, cutoff, result)
+	result.FinishedAt = time.Now()
+	span.SetAttributes(
+		attribute.Int("gc.scanned", result.Scanned),
+		attribute.Int("gc.swept", len(result.Swept)),
+		attribute.Bool("gc.dry_run", opts.DryRun),
+	)
+	return result, nil
+}
+
+// sweep deletes the blobs of one tier that are not live and older than
+// cutoff. Chunks and previews are only ever stored in the hot tier.
+func sweep(ctx context.Context, db *gorm.DB, tier string, live, hashes map[string]bool, cutoff time.Time, opts Options, result *Result) error {
+	store, err := content.StoreFor(tier)
+	if err != nil {
+		return err
+	}
+	return store.Walk(ctx, "uploads/", func(info storage.Info) error {
+		result.Scanned++
+		if live[info.Key] {
+			return nil
+		}
+		kind := kindOf(info.Key)
+		if kind == KindPreview && hashes[BlobHash(info.Key)] {
+			return nil
+		}
+		if info.ModTime.After(cutoff) {
+			result.Young++
+			return nil
+		}
+		if kind == "" || tier != models.TierHot && kind != KindBlob && kind != KindTemp {
+			return nil
+		}
+
+		if !opts.DryRun {
+			var err error
+			if kind == KindTemp {
+				err = store.Delete(ctx, info.Key)
+			} else {
+				err = RemoveOrphan(ctx, db, tier, info.Key, cutoff)
+			}
+			if errors.Is(err, ErrClaimed) {
+				return nil
+			}
+			if err != nil {
+				result.errorf("deleting %s from the %s tier: %v", info.Key, tier, err)
+				return nil
+			}
+			metrics.GCSweptTotal.WithLabelValues(kind).Inc()
+			metrics.GCSweptBytesTotal.Add(float64(info.Size))
+		}
+		result.Swept = append(result.Swept, Swept{Key: info.Key, Tier: tier, Kind: kind, Size: info.Size})
+		result.SweptBytes += info.Size
+		return nil
+	})
+}
+
+// mark returns the blob keys in use per tier by live Files, their previews
+// and chunks, and the hashes of live Files, which own the previews stored
+// under them.
+func mark(db *gorm.DB) (map[string]map[string]bool, map[string]bool, error) {
+	live := map[string]map[string]bool{
+		models.TierHot:  {},
+		models.TierCold: {},
+	}
+	hashes := make(map[string]bool)
+
+	var files []struct {
+		Hash        string
+		StoragePath string
+		Tier        string
+	}
+	err := db.Table("files").Select("hash, storage_path, tier").Where("deleted_at IS NULL").
+		FindInBatches(&files, 5000, func(*gorm.DB, int) error {
+			for _, f := range files {
+				hashes[f.Hash] = true
+				if f.StoragePath != "" && live[f.Tier] != nil {
+					live[f.Tier][f.StoragePath] = true
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, q := range []string{
+		"SELECT storage_key FROM chunks",
+		"SELECT storage_key FROM file_previews WHERE storage_key <> ''",
+	} {
+		rows, err := db.Raw(q).Rows()
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			live[models.TierHot][key] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return live, hashes, nil
+}
+
+// kindOf classifies a blob key, or returns "" for keys the collector leaves
+// alone because it cannot tell who they belong to.
+func kindOf(key string) string {
+	switch {
+	case IsTemp(key):
+		return KindTemp
+	case BlobHash(key) == "":
+		return ""
+	case IsPreview(key):
+		return KindPreview
+	case strings.HasPrefix(key, chunksPrefix):
+		return KindChunk
+	}
+	return KindBlob
+}
+
+// CollectTemp only sweeps the local temporary directory. Every replica has
+// its own, so replicas that are not the leader still run it.
+func CollectTemp(opts Options) *Result {
+	result := &Result{StartedAt: time.Now(), DryRun: opts.DryRun}
+	sweepTempDir(opts, result.StartedAt.Add(-opts.Grace), result)
+	result.FinishedAt = time.Now()
+	return result
+}
+
+// sweepTempDir removes the service's abandoned temporary files from the
+// local temporary directory.
+func sweepTempDir(opts Options, cutoff time.Time, result *Result) {
+	if opts.TempDir == "" {
+		return
+	}
+	for _, pattern := range tempPatterns {
+		matches, err := filepath.Glob(filepath.Join(opts.TempDir, pattern))
+		if err != nil {
+			result.errorf("listing %s: %v", pattern, err)
+			continue
+		}
+		for _, name := range matches {
+			info, err := os.Lstat(name)
+			if err != nil || !info.Mode().IsRegular() || info.ModTime().After(cutoff) {
+				continue
+			}
+			if !opts.DryRun {
+				if err := os.Remove(name); err != nil {
+					result.errorf("deleting %s: %v", name, err)
+					continue
+				}
+				metrics.GCSweptTotal.WithLabelValues(KindTemp).Inc()
+				metrics.GCSweptBytesTotal.Add(float64(info.Size()))
+			}
+			result.Swept = append(result.Swept, Swept{Key: name, Kind: KindTemp, Size: info.Size()})
+			result.SweptBytes += info.Size()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package gc
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrClaimed is returned by RemoveOrphan for a blob that turned out to be in
+// use after all.
+var ErrClaimed = errors.New("blob is in use")
+
+var (
+	previewsPrefix = path.Join("uploads", "previews") + "/"
+	chunksPrefix   = path.Join("uploads", "chunks") + "/"
+)
+
+// BlobHash extracts the content hash from a blob key: the file name without
+// suffix for blobs and chunks, the directory for previews. It returns "" for
+// keys that are not named by a hash, such as temporary files.
+func BlobHash(key string) string {
+	if dir := path.Dir(key); path.Dir(dir) == path.Join("uploads", "previews") {
+		return path.Base(dir)
+	}
+	base := path.Base(key)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if len(base) != sha256.Size*2 {
+		return ""
+	}
+	return base
+}
+
+// IsTemp reports whether key is a blob store's temporary file, left behind
+// by a write that never finished.
+func IsTemp(key string) bool {
+	return strings.HasPrefix(path.Base(key), ".partial-")
+}
+
+// IsPreview reports whether key is a preview, which belongs to every File
+// with the hash it is stored under.
+func IsPreview(key string) bool {
+	return strings.HasPrefix(key, previewsPrefix)
+}
+
+// RemoveOrphan deletes a blob found unused in a tier, after checking again,
+// under the same lock writers take, that nothing has claimed it since and
+// that it was not rewritten after cutoff.
+func RemoveOrphan(ctx context.Context, db *gorm.DB, tier, key string, cutoff time.Time) error {
+	hash := BlobHash(key)
+	if hash == "" {
+		return errors.New("blob key is not named by a content hash")
+	}
+	store, err := content.StoreFor(tier)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(key, chunksPrefix) {
+		return removeChunk(ctx, db, store, key, hash, cutoff)
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, hash); err != nil {
+			return err
+		}
+		q := tx.Model(&models.File{}).Where("storage_path = ? AND tier = ?", key, tier)
+		if IsPreview(key) {
+			q = tx.Model(&models.File{}).Where("hash = ?", hash)
+		}
+		var n int64
+		if err := q.Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrClaimed
+		}
+		return deleteIfOld(config.WithTx(ctx, tx), store, key, cutoff)
+	})
+}
+
+// deleteIfOld deletes the blob at key unless it was written after cutoff,
+// which means a writer stored it again for a File it has not committed yet.
+func deleteIfOld(ctx context.Context, store storage.Store, key string, cutoff time.Time) error {
+	info, err := store.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime.After(cutoff) {
+		return ErrClaimed
+	}
+	return store.Delete(ctx, key)
+}
+
+// removeChunk deletes a chunk blob unless a chunk row appeared for it.
+// Writers lock existing chunk rows rather than advisory locks, so the row
+// lock is taken here too.
+func removeChunk(ctx context.Context, db *gorm.DB, store storage.Store, key, hash string, cutoff time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// PostgreSQL refuses FOR UPDATE with aggregates, so the row is
+		// selected rather than counted.
+		var found []string
+		if err := tx.Model(&models.Chunk{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where("hash = ?", hash).Pluck("hash", &found).Error; err != nil {
+			return err
+		}
+		if len(found) > 0 {
+			return ErrClaimed
+		}
+		return deleteIfOld(config.WithTx(ctx, tx), store, key, cutoff)
+	})
+}
@@ -0,0 +1,80 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"volt/common/metrics"
+	"volt/file-service/pkg/leader"
+)
+
+// leaderLock is the advisory lock held by the replica that collects.
+const leaderLock int64 = 0x766f6c74_00006763 // "volt", "gc"
+
+var last atomic.Pointer[Result]
+
+// Last returns the result of the most recent collection this replica led,
+// or nil before the first one finishes.
+func Last() *Result {
+	return last.Load()
+}
+
+// ErrNotLeader is returned by CollectAsLeader while another replica holds
+// the leader lock.
+var ErrNotLeader = leader.ErrNotLeader
+
+// Run collects every interval until ctx is cancelled. Of all replicas, only
+// the one that gets the leader lock sweeps the blob store; the others only
+// clean their own temporary directory.
+func Run(ctx context.Context, interval time.Duration, opts Options) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		result, err := CollectAsLeader(ctx, opts)
+		switch {
+		case errors.Is(err, ErrNotLeader):
+			metrics.GCLeader.Set(0)
+			if result := CollectTemp(opts); len(result.Swept) > 0 || len(result.Errors) > 0 {
+				record(result)
+			}
+		case err != nil:
+			if ctx.Err() == nil {
+				log.Printf("gc: collection failed: %v", err)
+			}
+		default:
+			metrics.GCLeader.Set(1)
+			last.Store(result)
+			record(result)
+		}
+	}
+}
+
+// CollectAsLeader runs Collect if this process can take the leader lock.
+func CollectAsLeader(ctx context.Context, opts Options) (result *Result, err error) {
+	err = leader.Do(ctx, leaderLock, func(ctx context.Context) error {
+		result, err = Collect(ctx, opts)
+		return err
+	})
+	return result, err
+}
+
+func record(result *Result) {
+	metrics.GCLastRun.SetToCurrentTime()
+	verb := "swept"
+	if result.DryRun {
+		verb = "would sweep"
+	}
+	log.Printf("gc: %s %d blobs (%d bytes) of %d scanned in %s, %d errors",
+		verb, len(result.Swept), result.SweptBytes, result.Scanned,
+		result.FinishedAt.Sub(result.StartedAt).Round(time.Millisecond), len(result.Errors))
+}
@@ -0,0 +1,312 @@
+// Package idempotency stores the responses to requests sent with an
+// Idempotency-Key header, so a client that retries a POST or DELETE after
+// losing the response gets the original one back instead of a second
+// upload or a 404. The first request with a key claims it by inserting its
+// row, which is the lock concurrent retries find; the response is stored
+// once it is complete.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"volt/db/config"
+	"volt/db/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+	MaxKeyLength   = 255
+)
+
+var (
+	// TTL is how long a response is replayed.
+	TTL = 24 * time.Hour
+	// LockTimeout is how long a request may hold its key before a retry
+	// may take it over.
+	LockTimeout = time.Hour
+	// MaxResponse is the largest response body stored. Requests with a
+	// larger response, such as archive downloads, are not replayed but
+	// handled again.
+	MaxResponse = 1 << 20
+	// maxDrain bounds how much of a body the handler left unread is read
+	// to complete its fingerprint.
+	maxDrain int64 = 1 << 20
+)
+
+// ErrInProgress is returned by Begin while another request holds the key.
+var ErrInProgress = errors.New("a request with this idempotency key is in progress")
+
+func Configure() {
+	TTL = config.GetEnvDuration("IDEMPOTENCY_TTL", TTL)
+	LockTimeout = config.GetEnvDuration("IDEMPOTENCY_LOCK_TIMEOUT", LockTimeout)
+	MaxResponse = config.GetEnvInt("IDEMPOTENCY_MAX_RESPONSE_BYTES", MaxResponse)
+}
+
+// Begin claims key for userID. It returns the stored response when the key
+// was used before and has not expired, ErrInProgress while another request
+// holds it, and nil when the caller now holds it and must Complete or
+// Release it.
+func Begin(ctx context.Context, userID uint, key string) (*models.IdempotencyKey, error) {
+	db := config.DB.WithContext(ctx)
+	for attempt := 0; attempt < 3; attempt++ {
+		now := time.Now()
+		claim := models.IdempotencyKey{UserID: userID, Key: key, LockedUntil: now.Add(LockTimeout), ExpiresAt: now.Add(TTL)}
+		res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&claim)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			return nil, nil
+		}
+
+		var existing models.IdempotencyKey
+		err := db.Where("user_id = ? AND key = ?", userID, key).Take(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Released or purged meanwhile; claim it again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if existing.ExpiresAt.Before(now) {
+			err := db.Where("user_id = ? AND key = ? AND expires_at < ?", userID, key, now).Delete(&models.IdempotencyKey{}).Error
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if existing.StatusCode != 0 {
+			return &existing, nil
+		}
+		if existing.LockedUntil.After(now) {
+			return nil, ErrInProgress
+		}
+
+		// The request holding the key never finished; take it over unless
+		// another retry was faster.
+		res = db.Model(&models.IdempotencyKey{}).
+			Where("user_id = ? AND key = ? AND status_code = 0 AND locked_until = ?", userID, key, existing.LockedUntil).
+			Updates(map[string]any{"locked_until": claim.LockedUntil, "expires_at": claim.ExpiresAt})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			return nil, nil
+		}
+		return nil, ErrInProgress
+	}
+	return nil, ErrInProgress
+}
+
+// Complete stores the response to the request holding key.
+func Complete(ctx context.Context, userID uint, key, fingerprint string, rec *Recorder) error {
+	return config.DB.WithContext(ctx).Model(&models.IdempotencyKey{}).
+		Where("user_id = ? AND key = ? AND status_code = 0", userID, key).
+		Updates(&models.IdempotencyKey{
+			Fingerprint: fingerprint,
+			StatusCode:  rec.Status(),
+			Header:      rec.header,
+			Body:        rec.body,
+			ExpiresAt:   time.Now().Add(TTL),
+		}).Error
+}
+
+// Release gives up a key whose request left no response worth replaying,
+// so that a retry is handled again.
+func Release(ctx context.Context, userID uint, key string) error {
+	return config.DB.WithContext(ctx).
+		Where("user_id = ? AND key = ? AND status_code = 0", userID, key).
+		Delete(&models.IdempotencyKey{}).Error
+}
+
+// Replay writes a stored response.
+func Replay(w http.ResponseWriter, stored *models.IdempotencyKey) {
+	for name, values := range stored.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+// Body fingerprints a request body as the handler reads it.
+type Body struct {
+	r io.ReadCloser
+	h hash.Hash
+	// w receives what is read: h itself, or the pipe to the goroutine
+	// fingerprinting a multipart form, which reports to form.
+	w    io.Writer
+	pw   *io.PipeWriter
+	form chan error
+}
+
+// Fingerprint replaces r.Body with one whose Sum is the fingerprint of the
+// request, once the body has been read. Multipart forms are fingerprinted
+// by their parts rather than their bytes, since clients pick a new
+// boundary for every request, retries included: each part contributes its
+// field name, file name and the SHA-256 of its content.
+func Fingerprint(r *http.Request) *Body {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	b := &Body{r: r.Body, h: h, w: h}
+	if boundary := formBoundary(r.Header); boundary != "" {
+		pr, pw := io.Pipe()
+		b.w, b.pw, b.form = pw, pw, make(chan error, 1)
+		go func() {
+			err := hashForm(h, multipart.NewReader(pr, boundary))
+			// Unblocks Read if the form ended before the body did.
+			pr.CloseWithError(err)
+			b.form <- err
+		}()
+	}
+	r.Body = b
+	return b
+}
+
+func formBoundary(header http.Header) string {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return ""
+	}
+	return params["boundary"]
+}
+
+func hashForm(h hash.Hash, form *multipart.Reader) error {
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content := sha256.New()
+		_, err = io.Copy(content, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %q %x\n", part.FormName(), part.FileName(), content.Sum(nil))
+	}
+}
+
+func (b *Body) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	// A form that failed to parse fails Sum; the handler sees it too.
+	b.w.Write(p[:n])
+	return n, err
+}
+
+func (b *Body) Close() error {
+	return b.r.Close()
+}
+
+// Sum reads what is left of the body and returns the fingerprint, or false
+// when the body could not be read to its end or, for a multipart form,
+// parsed.
+func (b *Body) Sum() (string, bool) {
+	n, err := io.Copy(io.Discard, io.LimitReader(b, maxDrain+1))
+	if b.form != nil {
+		if err == nil && n > maxDrain {
+			err = errors.New("body too long to drain")
+		}
+		b.pw.CloseWithError(err)
+		if formErr := <-b.form; formErr != nil {
+			return "", false
+		}
+	}
+	if err != nil || n > maxDrain {
+		return "", false
+	}
+	return hex.EncodeToString(b.h.Sum(nil)), true
+}
+
+// Recorder passes a response through while keeping a copy of it, up to
+// MaxResponse bytes of body.
+type Recorder struct {
+	http.ResponseWriter
+	status   int
+	header   map[string][]string
+	body     []byte
+	overflow bool
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w}
+}
+
+func (rec *Recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.Header().Clone()
+		// Belongs to the request that is answered, not the one recorded.
+		delete(rec.header, "X-Request-Id")
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *Recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if len(rec.body)+len(p) > MaxResponse {
+			rec.overflow = true
+			rec.body = nil
+		} else {
+			rec.body = append(rec.body, p...)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *Recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Status is the status code written, 200 if only a body was.
+func (rec *Recorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Replayable reports whether the response can be stored: it fit in
+// MaxResponse and was not a server error, which a retry may not repeat.
+func (rec *Recorder) Replayable() bool {
+	return !rec.overflow && rec.Status() < http.StatusInternalServerError
+}
+
+// Run deletes expired keys every interval until ctx is cancelled.
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res := config.DB.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&models.IdempotencyKey{})
+		if res.Error != nil && ctx.Err() == nil {
+			log.Printf("idempotency: purging expired keys failed: %v", res.Error)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package idempotency
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type formPart struct {
+	field, filename, content string
+}
+
+// formRequest builds an upload of parts, with a fresh boundary like every
+// client sends.
+func formRequest(t *testing.T, parts ...formPart) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, p := range parts {
+		var part io.Writer
+		var err error
+		if p.filename != "" {
+			part, err = w.CreateFormFile(p.field, p.filename)
+		} else {
+			part, err = w.CreateFormField(p.field)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, p.content)
+	}
+	w.Close()
+	r := httptest.NewRequest("POST", "/files/upload", &body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+// fingerprint reads the request as a handler would, reading only the first
+// half when partly is set, and returns its fingerprint.
+func fingerprint(t *testing.T, r *http.Request, partly bool) string {
+	t.Helper()
+	body := Fingerprint(r)
+	if partly {
+		io.CopyN(io.Discard, r.Body, r.ContentLength/2)
+	} else if err := r.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	sum, ok := body.Sum()
+	if !ok {
+		t.Fatal("no fingerprint")
+	}
+	return sum
+}
+
+func TestFingerprintOfForms(t *testing.T) {
+	upload := []formPart{
+		{field: "is_private", content: "false"},
+		{field: "file", filename: "a.txt", content: "first file"},
+		{field: "file", filename: "b.txt", content: "second file"},
+	}
+	want := fingerprint(t, formRequest(t, upload...), false)
+
+	t.Run("retry with a new boundary", func(t *testing.T) {
+		if got := fingerprint(t, formRequest(t, upload...), false); got != want {
+			t.Error("the same form sent again has a different fingerprint")
+		}
+	})
+	t.Run("handler reads part of the body", func(t *testing.T) {
+		if got := fingerprint(t, formRequest(t, upload...), true); got != want {
+			t.Error("the fingerprint depends on how much the handler read")
+		}
+	})
+
+	different := map[string][]formPart{
+		"content":  {upload[0], upload[1], {field: "file", filename: "b.txt", content: "changed file"}},
+		"filename": {upload[0], upload[1], {field: "file", filename: "c.txt", content: "second file"}},
+		"value":    {{field: "is_private", content: "true"}, upload[1], upload[2]},
+		"order":    {upload[0], upload[2], upload[1]},
+		"missing":  {upload[0], upload[1]},
+	}
+	for name, parts := range different {
+		t.Run("different "+name, func(t *testing.T) {
+			if got := fingerprint(t, formRequest(t, parts...), false); got == want {
+				t.Error("a different form has the same fingerprint")
+			}
+		})
+	}
+}
+
+func TestFingerprintOfTruncatedForm(t *testing.T) {
+	r := formRequest(t, formPart{field: "file", filename: "a.txt", content: strings.Repeat("x", 10000)})
+	data, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(data[:len(data)-100]))
+	body := Fingerprint(r)
+	if sum, ok := body.Sum(); ok {
+		t.Fatalf("a truncated form has fingerprint %s", sum)
+	}
+}
+
+func TestFingerprintOfRawBodies(t *testing.T) {
+	sum := func(method, target, body string) string {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		s, ok := Fingerprint(r).Sum()
+		if !ok {
+			t.Fatal("no fingerprint")
+		}
+		return s
+	}
+	want := sum("POST", "/files/bulk", `{"ids":[1,2]}`)
+	if sum("POST", "/files/bulk", `{"ids":[1,2]}`) != want {
+		t.Error("the same request has a different fingerprint")
+	}
+	if sum("POST", "/files/bulk", `{"ids":[1,3]}`) == want {
+		t.Error("a different body has the same fingerprint")
+	}
+	if sum("DELETE", "/files/bulk", `{"ids":[1,2]}`) == want {
+		t.Error("a different method has the same fingerprint")
+	}
+}
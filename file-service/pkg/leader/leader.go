@@ -0,0 +1,49 @@
+// Package leader elects the replica that runs a cluster-wide job, such as
+// garbage collection, with session-level Postgres advisory locks. Locks use
+// the one-key lock space, which never conflicts with the two-key hash locks.
+package leader
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+
+	"volt/db/config"
+)
+
+// ErrNotLeader is returned by Do while another replica holds the lock.
+var ErrNotLeader = errors.New("another replica holds the leader lock")
+
+// Do runs fn if this process can take the advisory lock, and returns
+// ErrNotLeader without running it otherwise. The lock belongs to one
+// database session, so a connection is held for the duration; if the
+// process dies the session ends and the lock with it.
+func Do(ctx context.Context, lock int64, fn func(context.Context) error) error {
+	sqlDB, err := config.DB.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lock).Scan(&acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		return ErrNotLeader
+	}
+	defer func() {
+		_, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", lock)
+		if err != nil {
+			// Never hand a session that may still hold the lock back to the
+			// pool: discard it, which ends the session and frees the lock.
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return fn(ctx)
+}
@@ -0,0 +1,164 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"volt/db/dbtest"
+	"volt/file-service/pkg/idempotency"
+	"volt/file-service/pkg/utils"
+)
+
+const testUserID = 7
+
+// uploadRequest builds a multipart upload of content sent with key, with a
+// fresh boundary like every retry a client sends.
+func uploadRequest(t *testing.T, key, content string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, content)
+	w.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/files/upload", &body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	r.Header.Set(idempotency.Header, key)
+	claims := &utils.Claims{UserID: testUserID}
+	return r.WithContext(context.WithValue(r.Context(), UserContextKey, claims))
+}
+
+// countingUpload parses the form like the upload handler and answers 201
+// with how many times it ran.
+type countingUpload struct {
+	runs    atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *countingUpload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	n := h.runs.Add(1)
+	if h.started != nil {
+		h.started <- struct{}{}
+		<-h.release
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, n)
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	IdempotencyMiddleware(h).ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentRetryIsReplayed(t *testing.T) {
+	dbtest.Open(t)
+	h := &countingUpload{}
+
+	first := serve(h, uploadRequest(t, "retry", "same content"))
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first request: %d %s", first.Code, first.Body)
+	}
+	retry := serve(h, uploadRequest(t, "retry", "same content"))
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry: %d %s, want %d %s", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if retry.Header().Get(idempotency.ReplayedHeader) != "true" {
+		t.Errorf("retry is missing %s", idempotency.ReplayedHeader)
+	}
+	if n := h.runs.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyKeyReusedForDifferentBody(t *testing.T) {
+	dbtest.Open(t)
+	h := &countingUpload{}
+
+	if w := serve(h, uploadRequest(t, "reused", "first content")); w.Code != http.StatusCreated {
+		t.Fatalf("first request: %d %s", w.Code, w.Body)
+	}
+	w := serve(h, uploadRequest(t, "reused", "other content"))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("different body: %d %s, want 422", w.Code, w.Body)
+	}
+	if n := h.runs.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyConcurrentRequests(t *testing.T) {
+	dbtest.Open(t)
+	h := &countingUpload{started: make(chan struct{}), release: make(chan struct{})}
+
+	r := uploadRequest(t, "concurrent", "content")
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(h, r)
+	}()
+	<-h.started
+
+	second := serve(h, uploadRequest(t, "concurrent", "content"))
+	close(h.release)
+	first := <-done
+
+	if first.Code != http.StatusCreated {
+		t.Errorf("first request: %d %s", first.Code, first.Body)
+	}
+	if second.Code != http.StatusConflict {
+		t.Errorf("second request: %d %s, want 409", second.Code, second.Body)
+	}
+	if second.Header().Get("Retry-After") == "" {
+		t.Error("409 without Retry-After")
+	}
+	if n := h.runs.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+}
+
+func TestIdempotencyKeyTakenOverAfterLockTimeout(t *testing.T) {
+	dbtest.Open(t)
+	prev := idempotency.LockTimeout
+	idempotency.LockTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { idempotency.LockTimeout = prev })
+	h := &countingUpload{}
+
+	// A request claimed the key and its replica died before answering.
+	stored, err := idempotency.Begin(context.Background(), testUserID, "abandoned")
+	if err != nil || stored != nil {
+		t.Fatalf("Begin = %v, %v", stored, err)
+	}
+	if w := serve(h, uploadRequest(t, "abandoned", "content")); w.Code != http.StatusConflict {
+		t.Fatalf("retry within the lock timeout: %d %s, want 409", w.Code, w.Body)
+	}
+
+	time.Sleep(idempotency.LockTimeout + 100*time.Millisecond)
+	w := serve(h, uploadRequest(t, "abandoned", "content"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("retry after the lock timeout: %d %s, want 201", w.Code, w.Body)
+	}
+	if n := h.runs.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+	replayed := serve(h, uploadRequest(t, "abandoned", "content"))
+	if replayed.Header().Get(idempotency.ReplayedHeader) != "true" || replayed.Body.String() != w.Body.String() {
+		t.Errorf("retry after the takeover: %d %s, want the stored response", replayed.Code, replayed.Body)
+	}
+}
@@ -2,10 +2,17 @@ package middlewares
 
 import (
 	"context"
-	"log"
+	"errors"
+	"io"
 	"net/http"
 	"strings"
 
+	"volt/common/metrics"
+	"volt/common/problem"
+	"volt/common/requestid"
+	"volt/common/tracing"
+	"volt/db/models"
+	"volt/file-service/pkg/idempotency"
 	"volt/file-service/pkg/utils"
 )
 
@@ -17,7 +24,8 @@ func CorsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, Idempotency-Key, Content-Digest, Repr-Digest")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Idempotent-Replayed, X-Preview-Kind")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -30,7 +38,7 @@ func CorsMiddleware(next http.Handler) http.Handler {
 
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.Method, r.RequestURI, r.RemoteAddr)
+		tracing.Logf(r.Context(), "request_id=%s %s %s %s", requestid.FromContext(r.Context()), r.Method, r.RequestURI, r.RemoteAddr)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -39,24 +47,114 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			metrics.JWTValidationFailuresTotal.WithLabelValues("missing").Inc()
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Authorization header required")
 			return
 		}
 
 		tokenParts := strings.Split(authHeader, " ")
 		if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+			metrics.JWTValidationFailuresTotal.WithLabelValues("malformed").Inc()
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid authorization header format")
 			return
 		}
 
 		token := tokenParts[1]
 		claims, err := utils.ValidateJWT(token)
 		if err != nil {
-			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+			metrics.JWTValidationFailuresTotal.WithLabelValues("invalid").Inc()
+			problem.Write(w, r, http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid or expired token")
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), UserContextKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+}
+
+// AdminMiddleware admits only callers whose token carries the admin role. It
+// must run after AuthMiddleware.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserContextKey).(*utils.Claims)
+		if !ok || claims.Role != models.RoleAdmin {
+			problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "Admin role required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IdempotencyMiddleware makes POST and DELETE requests that carry an
+// Idempotency-Key header safe to retry: the first one with a key is
+// handled and its response stored, retries with the same body, or for
+// uploads the same form fields and files, get that response again, and a retry sent while the first is still being handled
+// is refused with 409. It must run after AuthMiddleware, as keys are per
+// user.
+func IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotency.Header)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, ok := r.Context().Value(UserContextKey).(*utils.Claims)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotency.MaxKeyLength {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		ctx := r.Context()
+		stored, err := idempotency.Begin(ctx, claims.UserID, key)
+		if errors.Is(err, idempotency.ErrInProgress) {
+			w.Header().Set("Retry-After", "1")
+			problem.Write(w, r, http.StatusConflict, problem.CodeIdempotencyKeyInUse, "A request with this Idempotency-Key is still being processed")
+			return
+		}
+		if err != nil {
+			problem.Internal(w, r, "Failed to check idempotency key", err)
+			return
+		}
+
+		body := idempotency.Fingerprint(r)
+		if stored != nil {
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to read request body")
+				return
+			}
+			if sum, ok := body.Sum(); !ok || sum != stored.Fingerprint {
+				problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeIdempotencyKeyReused,
+					"Idempotency-Key was already used for a different request")
+				return
+			}
+			idempotency.Replay(w, stored)
+			return
+		}
+
+		completed := false
+		defer func() {
+			if !completed {
+				if err := idempotency.Release(context.WithoutCancel(ctx), claims.UserID, key); err != nil {
+					tracing.Logf(ctx, "idempotency: releasing key: %v", err)
+				}
+			}
+		}()
+
+		rec := idempotency.NewRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		sum, ok := body.Sum()
+		if !ok || !rec.Replayable() {
+			return
+		}
+		if err := idempotency.Complete(context.WithoutCancel(ctx), claims.UserID, key, sum, rec); err != nil {
+			tracing.Logf(ctx, "idempotency: storing response: %v", err)
+			return
+		}
+		completed = true
+	})
+}
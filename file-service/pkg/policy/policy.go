@@ -0,0 +1,360 @@
+// Package policy decides which uploads are accepted: allowed and denied
+// content types and extensions, size limits per type and per role, and
+// which declared types may legitimately sniff as another type.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"volt/common/metrics"
+	"volt/common/problem"
+)
+
+// ByteSize is a size in bytes that may be written as a number or as a
+// string with a unit, e.g. "10MB" or "1.5GiB". Zero means unlimited.
+type ByteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func ParseByteSize(s string) (ByteSize, error) {
+	u := strings.ToUpper(strings.TrimSpace(s))
+	factor := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(u, unit.suffix) {
+			u, factor = strings.TrimSpace(strings.TrimSuffix(u, unit.suffix)), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(u, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n * factor), nil
+}
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a number or a string like \"10MB\"")
+	}
+	v, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+func (b ByteSize) String() string {
+	switch {
+	case b >= 1<<30 && b%(1<<30) == 0:
+		return fmt.Sprintf("%dGiB", b>>30)
+	case b >= 1<<20 && b%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", b>>20)
+	case b >= 1<<10 && b%(1<<10) == 0:
+		return fmt.Sprintf("%dKiB", b>>10)
+	}
+	return fmt.Sprintf("%d bytes", int64(b))
+}
+
+// TypeLimit caps the size of files whose sniffed type matches MIME, which
+// may be a pattern such as "video/*".
+type TypeLimit struct {
+	MIME    string   `json:"mime"`
+	MaxSize ByteSize `json:"max_size"`
+}
+
+// Policy is the upload policy, usually loaded from the JSON file named by
+// UPLOAD_POLICY_FILE. Empty allow lists allow everything not denied.
+type Policy struct {
+	// DryRun logs violations without rejecting uploads.
+	DryRun bool `json:"dry_run"`
+
+	MaxSize ByteSize `json:"max_size"`
+	// TypeLimits are tried in order; the first match caps the size.
+	TypeLimits []TypeLimit `json:"type_limits"`
+	// RoleLimits replace MaxSize for users with the given role.
+	RoleLimits map[string]ByteSize `json:"role_limits"`
+
+	AllowMIME       []string `json:"allow_mime"`
+	DenyMIME        []string `json:"deny_mime"`
+	AllowExtensions []string `json:"allow_extensions"`
+	DenyExtensions  []string `json:"deny_extensions"`
+
+	// CheckDeclaredType rejects files whose declared Content-Type does not
+	// match the sniffed type, its parent types or one of Aliases.
+	CheckDeclaredType bool `json:"check_declared_type"`
+	// Aliases lists, per declared type, the sniffed types it may have.
+	// "*/*" accepts anything, which suits application/octet-stream.
+	Aliases map[string][]string `json:"aliases"`
+}
+
+// Default keeps the limits the service has always advertised (10 MB) and
+// accepts the common declared/sniffed mismatches of browsers and Office.
+var Default = Policy{
+	MaxSize:           10 << 20,
+	CheckDeclaredType: true,
+	Aliases: map[string][]string{
+		"application/octet-stream":     {"*/*"},
+		"text/plain":                   {"application/octet-stream"},
+		"text/csv":                     {"text/plain"},
+		"text/markdown":                {"text/plain"},
+		"text/x-markdown":              {"text/plain"},
+		"application/json":             {"text/plain"},
+		"application/x-yaml":           {"text/plain"},
+		"application/yaml":             {"text/plain"},
+		"image/jpg":                    {"image/jpeg"},
+		"application/x-zip-compressed": {"application/zip"},
+		"application/x-gzip":           {"application/gzip"},
+		"application/x-compressed-tar": {"application/gzip"},
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {"application/zip"},
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {"application/zip"},
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation": {"application/zip"},
+		"application/vnd.ms-excel": {"text/plain", "text/csv"},
+	},
+}
+
+var current atomic.Pointer[Policy]
+
+func init() {
+	p := Default
+	current.Store(&p)
+}
+
+// Current returns the active policy.
+func Current() *Policy {
+	return current.Load()
+}
+
+// Load reads a policy file and makes it the active policy. An empty path
+// keeps the default. The file is applied on top of Default, so settings it
+// leaves out keep their defaults and its aliases add to the built-in ones;
+// "max_size": 0 lifts the size limit.
+func Load(file string) error {
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	p := Default
+	p.Aliases = make(map[string][]string, len(Default.Aliases))
+	for declared, sniffed := range Default.Aliases {
+		p.Aliases[declared] = sniffed
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("parsing %s: %w", file, err)
+	}
+	p.normalise()
+	current.Store(&p)
+	return nil
+}
+
+func (p *Policy) normalise() {
+	for i, e := range p.AllowExtensions {
+		p.AllowExtensions[i] = normaliseExt(e)
+	}
+	for i, e := range p.DenyExtensions {
+		p.DenyExtensions[i] = normaliseExt(e)
+	}
+}
+
+func normaliseExt(e string) string {
+	e = strings.ToLower(strings.TrimSpace(e))
+	if e != "" && !strings.HasPrefix(e, ".") {
+		e = "." + e
+	}
+	return e
+}
+
+// Upload describes the file being checked. Sniffed holds the detected type
+// followed by its parent types, most specific first.
+type Upload struct {
+	Filename string
+	Declared string
+	Sniffed  []string
+	Size     int64
+	Role     string
+}
+
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+// Evaluate returns every rule the upload breaks.
+func (p *Policy) Evaluate(u Upload) []Violation {
+	var violations []Violation
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	sniffed := "application/octet-stream"
+	if len(u.Sniffed) > 0 {
+		sniffed = u.Sniffed[0]
+	}
+	name := strings.ToLower(path.Base(u.Filename))
+
+	if pattern, ok := matchAnyMIME(p.DenyMIME, u.Sniffed); ok {
+		add("mime_denied", "content type %s is not allowed (denied by %s)", sniffed, pattern)
+	} else if len(p.AllowMIME) > 0 {
+		if _, ok := matchAnyMIME(p.AllowMIME, u.Sniffed); !ok {
+			add("mime_not_allowed", "content type %s is not in the list of allowed types", sniffed)
+		}
+	}
+
+	if ext, ok := matchExt(p.DenyExtensions, name); ok {
+		add("extension_denied", "extension %s is not allowed", ext)
+	} else if len(p.AllowExtensions) > 0 {
+		if _, ok := matchExt(p.AllowExtensions, name); !ok {
+			add("extension_not_allowed", "extension %q is not in the list of allowed extensions", path.Ext(name))
+		}
+	}
+
+	if p.CheckDeclaredType && !p.declaredMatches(u.Declared, u.Sniffed) {
+		add("type_mismatch", "declared type %s does not match the content, which is %s", baseMIME(u.Declared), sniffed)
+	}
+
+	if limit, source := p.sizeLimit(u); limit > 0 && u.Size > int64(limit) {
+		add("size_limit", "file is %s, over the %s limit %s", ByteSize(u.Size), limit, source)
+	}
+
+	return violations
+}
+
+// sizeLimit returns the limit that applies and where it comes from. A role
+// limit replaces MaxSize, so it can raise it as well as lower it; a type
+// limit then caps either.
+func (p *Policy) sizeLimit(u Upload) (ByteSize, string) {
+	limit, source := p.MaxSize, "for all files"
+	if l, ok := p.RoleLimits[u.Role]; ok {
+		limit, source = l, "for the "+u.Role+" role"
+	}
+	for _, tl := range p.TypeLimits {
+		if matchesMIME(tl.MIME, u.Sniffed) {
+			if tl.MaxSize > 0 && (limit == 0 || tl.MaxSize < limit) {
+				limit, source = tl.MaxSize, "for "+tl.MIME+" files"
+			}
+			break
+		}
+	}
+	return limit, source
+}
+
+func (p *Policy) declaredMatches(declared string, sniffed []string) bool {
+	d := baseMIME(declared)
+	if d == "" {
+		// Nothing declared, e.g. archive members; nothing to contradict.
+		return true
+	}
+	for _, s := range sniffed {
+		if s == d {
+			return true
+		}
+	}
+	for _, alias := range p.Aliases[d] {
+		if matchesMIME(alias, sniffed) {
+			return true
+		}
+	}
+	return false
+}
+
+func baseMIME(m string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(m, ";")[0]))
+}
+
+// matchesMIME reports whether pattern ("type/subtype", "type/*" or "*/*")
+// matches any of types.
+func matchesMIME(pattern string, types []string) bool {
+	pattern = baseMIME(pattern)
+	for _, t := range types {
+		t = baseMIME(t)
+		switch {
+		case pattern == "*/*" || pattern == t:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(t, strings.TrimSuffix(pattern, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyMIME(patterns, types []string) (string, bool) {
+	for _, p := range patterns {
+		if matchesMIME(p, types) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// matchExt matches by suffix so that compound extensions like ".tar.gz"
+// work.
+func matchExt(exts []string, name string) (string, bool) {
+	for _, e := range exts {
+		if e != "" && strings.HasSuffix(name, e) {
+			return e, true
+		}
+	}
+	return "", false
+}
+
+// Check evaluates u against the active policy. Violations are counted and
+// logged; unless the policy is a dry run they are returned as a problem that
+// explains every broken rule.
+func Check(u Upload) error {
+	p := Current()
+	violations := p.Evaluate(u)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	mode := "enforced"
+	if p.DryRun {
+		mode = "dry_run"
+	}
+	messages := make([]string, len(violations))
+	status := http.StatusUnsupportedMediaType
+	for i, v := range violations {
+		metrics.UploadPolicyViolationsTotal.WithLabelValues(v.Rule, mode).Inc()
+		messages[i] = v.Message
+		if v.Rule == "size_limit" && len(violations) == 1 {
+			status = http.StatusRequestEntityTooLarge
+		}
+	}
+	detail := fmt.Sprintf("%s was rejected: %s", path.Base(u.Filename), strings.Join(messages, "; "))
+
+	if p.DryRun {
+		log.Printf("policy (dry run): %s", detail)
+		return nil
+	}
+
+	code := problem.CodeUnsupportedMediaType
+	if status == http.StatusRequestEntityTooLarge {
+		code = problem.CodePayloadTooLarge
+	}
+	return problem.New(status, code, detail)
+}
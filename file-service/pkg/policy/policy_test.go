@@ -0,0 +1,272 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"volt/common/problem"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ByteSize
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "10MB", want: 10_000_000},
+		{in: "10mb", want: 10_000_000},
+		{in: "10 MiB", want: 10 << 20},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: "2K", want: 2 << 10},
+		{in: "1TB", want: 1e12},
+		{in: "", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "-1MB", wantErr: true},
+		{in: "ten MB", wantErr: true},
+		{in: "10XB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestByteSizeUnmarshal(t *testing.T) {
+	var sizes []ByteSize
+	if err := json.Unmarshal([]byte(`[1024, "1KiB", "1.5 KB"]`), &sizes); err != nil {
+		t.Fatal(err)
+	}
+	if sizes[0] != 1024 || sizes[1] != 1024 || sizes[2] != 1500 {
+		t.Errorf("sizes = %v, want [1024 1024 1500]", sizes)
+	}
+	for _, bad := range []string{`true`, `"lots"`, `{}`} {
+		var b ByteSize
+		if err := json.Unmarshal([]byte(bad), &b); err == nil {
+			t.Errorf("unmarshalling %s: no error", bad)
+		}
+	}
+}
+
+func rules(violations []Violation) []string {
+	var r []string
+	for _, v := range violations {
+		r = append(r, v.Rule)
+	}
+	return r
+}
+
+func TestEvaluateAllowAndDeny(t *testing.T) {
+	p := &Policy{
+		AllowMIME:       []string{"image/*", "text/plain"},
+		DenyMIME:        []string{"image/svg+xml"},
+		AllowExtensions: []string{".png", ".svg", ".txt", ".tar.gz"},
+		DenyExtensions:  []string{".txt.exe"},
+	}
+	p.normalise()
+
+	tests := []struct {
+		name   string
+		upload Upload
+		want   []string
+	}{
+		{name: "allowed", upload: Upload{Filename: "a.png", Sniffed: []string{"image/png"}}},
+		{name: "allowed by parent type", upload: Upload{Filename: "a.txt", Sniffed: []string{"text/csv", "text/plain"}}},
+		{name: "extension case", upload: Upload{Filename: "A.PNG", Sniffed: []string{"image/png"}}},
+		{name: "compound extension", upload: Upload{Filename: "a.tar.gz", Sniffed: []string{"text/plain"}}},
+		{name: "deny wins over allow", upload: Upload{Filename: "a.svg", Sniffed: []string{"image/svg+xml"}},
+			want: []string{"mime_denied"}},
+		{name: "not allowed", upload: Upload{Filename: "a.png", Sniffed: []string{"application/pdf"}},
+			want: []string{"mime_not_allowed"}},
+		{name: "nothing sniffed", upload: Upload{Filename: "a.png"},
+			want: []string{"mime_not_allowed"}},
+		{name: "denied extension", upload: Upload{Filename: "notes.txt.exe", Sniffed: []string{"text/plain"}},
+			want: []string{"extension_denied"}},
+		{name: "extension not allowed", upload: Upload{Filename: "a.jpg", Sniffed: []string{"image/jpeg"}},
+			want: []string{"extension_not_allowed"}},
+		{name: "every broken rule", upload: Upload{Filename: "a.exe", Sniffed: []string{"application/x-dosexec"}},
+			want: []string{"mime_not_allowed", "extension_not_allowed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules(p.Evaluate(tt.upload)); !slices.Equal(got, tt.want) {
+				t.Errorf("violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateDeclaredType(t *testing.T) {
+	p := Default
+	tests := []struct {
+		declared string
+		sniffed  []string
+		ok       bool
+	}{
+		{declared: "", sniffed: []string{"image/png"}, ok: true},
+		{declared: "image/png", sniffed: []string{"image/png"}, ok: true},
+		{declared: "text/plain; charset=utf-8", sniffed: []string{"text/plain"}, ok: true},
+		{declared: "text/plain", sniffed: []string{"text/csv", "text/plain"}, ok: true},
+		{declared: "text/csv", sniffed: []string{"text/plain"}, ok: true},
+		{declared: "application/octet-stream", sniffed: []string{"image/png"}, ok: true},
+		{declared: "image/png", sniffed: []string{"application/x-dosexec"}, ok: false},
+		{declared: "text/csv", sniffed: []string{"image/png"}, ok: false},
+	}
+	for _, tt := range tests {
+		got := rules(p.Evaluate(Upload{Filename: "f", Declared: tt.declared, Sniffed: tt.sniffed}))
+		if ok := len(got) == 0; ok != tt.ok {
+			t.Errorf("declared %q, sniffed %v: violations %v", tt.declared, tt.sniffed, got)
+		}
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	p := &Policy{
+		MaxSize:    10 << 20,
+		RoleLimits: map[string]ByteSize{"admin": 1 << 30, "guest": 1 << 20},
+		TypeLimits: []TypeLimit{
+			{MIME: "image/*", MaxSize: 5 << 20},
+			{MIME: "image/png", MaxSize: 1 << 10},
+			{MIME: "video/*"},
+		},
+	}
+	tests := []struct {
+		name       string
+		sniffed    string
+		role       string
+		wantLimit  ByteSize
+		wantSource string
+	}{
+		{name: "global", sniffed: "text/plain", wantLimit: 10 << 20, wantSource: "for all files"},
+		{name: "role raises", sniffed: "text/plain", role: "admin", wantLimit: 1 << 30, wantSource: "for the admin role"},
+		{name: "role lowers", sniffed: "text/plain", role: "guest", wantLimit: 1 << 20, wantSource: "for the guest role"},
+		{name: "type caps", sniffed: "image/jpeg", wantLimit: 5 << 20, wantSource: "for image/* files"},
+		{name: "type caps a role", sniffed: "image/jpeg", role: "admin", wantLimit: 5 << 20, wantSource: "for image/* files"},
+		{name: "role under the type limit", sniffed: "image/jpeg", role: "guest", wantLimit: 1 << 20, wantSource: "for the guest role"},
+		{name: "first matching type wins", sniffed: "image/png", wantLimit: 5 << 20, wantSource: "for image/* files"},
+		{name: "unlimited type", sniffed: "video/mp4", wantLimit: 10 << 20, wantSource: "for all files"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := Upload{Sniffed: []string{tt.sniffed}, Role: tt.role}
+			limit, source := p.sizeLimit(u)
+			if limit != tt.wantLimit || source != tt.wantSource {
+				t.Fatalf("limit = %v %s, want %v %s", limit, source, tt.wantLimit, tt.wantSource)
+			}
+			u.Size = int64(limit)
+			if v := p.Evaluate(u); len(v) != 0 {
+				t.Errorf("a file at the limit: %v", rules(v))
+			}
+			u.Size++
+			if got := rules(p.Evaluate(u)); !slices.Equal(got, []string{"size_limit"}) {
+				t.Errorf("a file over the limit: %v", got)
+			}
+		})
+	}
+
+	unlimited := &Policy{RoleLimits: map[string]ByteSize{"admin": 0}, TypeLimits: []TypeLimit{{MIME: "image/*", MaxSize: 1 << 20}}}
+	if v := unlimited.Evaluate(Upload{Sniffed: []string{"text/plain"}, Size: 1 << 40}); len(v) != 0 {
+		t.Errorf("no max_size: %v", rules(v))
+	}
+	if got := rules(unlimited.Evaluate(Upload{Sniffed: []string{"image/png"}, Size: 2 << 20, Role: "admin"})); !slices.Equal(got, []string{"size_limit"}) {
+		t.Errorf("type limit without max_size: %v", got)
+	}
+}
+
+// use makes p the active policy for the rest of the test.
+func use(t *testing.T, p Policy) {
+	t.Helper()
+	prev := current.Load()
+	current.Store(&p)
+	t.Cleanup(func() { current.Store(prev) })
+}
+
+func TestCheck(t *testing.T) {
+	p := Policy{MaxSize: 1 << 10, DenyExtensions: []string{".exe"}}
+	p.normalise()
+	use(t, p)
+
+	if err := Check(Upload{Filename: "a.txt", Sniffed: []string{"text/plain"}, Size: 100}); err != nil {
+		t.Errorf("allowed upload: %v", err)
+	}
+
+	var prob *problem.Problem
+	err := Check(Upload{Filename: "a.txt", Sniffed: []string{"text/plain"}, Size: 2 << 10})
+	if !errors.As(err, &prob) || prob.Status != http.StatusRequestEntityTooLarge || prob.Code != problem.CodePayloadTooLarge {
+		t.Errorf("too large: %v, want 413", err)
+	}
+	err = Check(Upload{Filename: "a.exe", Sniffed: []string{"text/plain"}, Size: 2 << 10})
+	if !errors.As(err, &prob) || prob.Status != http.StatusUnsupportedMediaType || prob.Code != problem.CodeUnsupportedMediaType {
+		t.Errorf("denied and too large: %v, want 415", err)
+	}
+
+	p.DryRun = true
+	use(t, p)
+	if err := Check(Upload{Filename: "a.exe", Sniffed: []string{"text/plain"}, Size: 2 << 10}); err != nil {
+		t.Errorf("dry run: %v", err)
+	}
+}
+
+func TestLoadKeepsDefaults(t *testing.T) {
+	use(t, Default)
+	file := filepath.Join(t.TempDir(), "policy.json")
+	data := `{
+		"deny_extensions": ["EXE"],
+		"aliases": {"text/x-log": ["text/plain"]}
+	}`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Current()
+	if p.MaxSize != Default.MaxSize {
+		t.Errorf("MaxSize = %v, want the default %v", p.MaxSize, Default.MaxSize)
+	}
+	if !p.CheckDeclaredType {
+		t.Error("CheckDeclaredType was turned off")
+	}
+	if len(p.DenyExtensions) != 1 || p.DenyExtensions[0] != ".exe" {
+		t.Errorf("DenyExtensions = %v, want [.exe]", p.DenyExtensions)
+	}
+	if len(p.Aliases["text/x-log"]) != 1 || len(p.Aliases["application/octet-stream"]) != 1 {
+		t.Errorf("Aliases = %v, want the file's added to the defaults", p.Aliases)
+	}
+	if _, ok := Default.Aliases["text/x-log"]; ok {
+		t.Error("loading a policy changed the default aliases")
+	}
+
+	if err := os.WriteFile(file, []byte(`{"max_size": 0}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(file); err != nil {
+		t.Fatal(err)
+	}
+	if Current().MaxSize != 0 {
+		t.Errorf("MaxSize = %v after setting it to 0", Current().MaxSize)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"max_size": "huge"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(file); err == nil {
+		t.Error("loading an invalid size: no error")
+	}
+}
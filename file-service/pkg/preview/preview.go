@@ -0,0 +1,226 @@
+// Package preview renders thumbnails of uploaded files in the background.
+// Previews are stored in the blob store under the blob's hash, so every
+// reference to a deduplicated File shares them.
+package preview
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"os/exec"
+	"path"
+
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const DefaultSize = "medium"
+
+// Sizes maps each preview size to the bounding box, in pixels, its longer
+// edge is scaled down to.
+var Sizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  512,
+}
+
+var sizeOrder = []string{"small", "medium", "large"}
+
+var tracer = tracing.Tracer("volt/file-service/preview")
+
+// Key returns the blob key of the given preview size of the blob with hash.
+func Key(hash, size string) string {
+	return path.Join("uploads", "previews", hash, size+".jpg")
+}
+
+// PDFRasterizer is the pdftoppm binary (from poppler-utils) that renders
+// the first page of PDFs, or "" when there is none and PDF previews show
+// the page's text instead.
+var PDFRasterizer string
+
+// Configure looks up the PDF rasterizer named by PREVIEW_PDF_RENDERER,
+// pdftoppm on the PATH by default; "none" turns rasterizing off.
+func Configure() {
+	PDFRasterizer = ""
+	name := config.GetEnv("PREVIEW_PDF_RENDERER", "pdftoppm")
+	if name == "none" {
+		return
+	}
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		log.Printf("preview: no PDF rasterizer (%v); PDF previews show the first page's text", err)
+		return
+	}
+	PDFRasterizer = bin
+}
+
+// Supported reports whether previews can be rendered for mimeType.
+func Supported(mimeType string) bool {
+	_, ok := findRenderer(mimeType)
+	return ok
+}
+
+var queue = make(chan uint, 1024)
+
+// Enqueue schedules preview generation for fileID. Like search indexing it
+// never blocks an upload; a dropped job is retried the next time the
+// thumbnail is requested.
+func Enqueue(fileID uint) {
+	select {
+	case queue <- fileID:
+	default:
+		log.Printf("preview: queue full, dropping job for file %d", fileID)
+	}
+}
+
+// Run processes preview jobs with the given number of workers until ctx is
+// cancelled.
+func Run(ctx context.Context, workers int) {
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-queue:
+					if err := Generate(ctx, id); err != nil && !errors.Is(err, context.Canceled) {
+						log.Printf("preview: generating previews for file %d failed: %v", id, err)
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+}
+
+// Generate renders every missing preview size of fileID. A file that cannot
+// be previewed gets records with status failed or unsupported, so it is not
+// retried on every request; only database and storage errors are returned.
+func Generate(ctx context.Context, fileID uint) (err error) {
+	ctx, span := tracer.Start(ctx, "preview.Generate")
+	span.SetAttributes(attribute.Int("file.id", int(fileID)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	db := config.DB.WithContext(ctx)
+
+	var file models.File
+	if err := db.First(&file, fileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var existing []string
+	if err := db.Model(&models.FilePreview{}).Where("file_id = ?", file.ID).Pluck("size", &existing).Error; err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(existing))
+	for _, s := range existing {
+		have[s] = true
+	}
+	var missing []string
+	for _, s := range sizeOrder {
+		if !have[s] {
+			missing = append(missing, s)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	r, ok := findRenderer(file.MimeType)
+	if !ok {
+		return record(db, &file, missing, "", models.PreviewStatusUnsupported, errUnsupported)
+	}
+	span.SetAttributes(attribute.String("preview.kind", r.kind))
+
+	obj, err := content.Open(ctx, &file)
+	if err != nil {
+		return err
+	}
+	src, err := r.render(obj, file.OriginalName)
+	obj.Close()
+	if err != nil {
+		return record(db, &file, missing, r.kind, models.PreviewStatusFailed, err)
+	}
+
+	for _, size := range missing {
+		img := fit(src, Sizes[size])
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+			return record(db, &file, []string{size}, r.kind, models.PreviewStatusFailed, err)
+		}
+
+		key := Key(file.Hash, size)
+		if _, err := storage.Blobs.Put(ctx, key, &buf); err != nil {
+			return fmt.Errorf("storing %s preview: %w", size, err)
+		}
+
+		p := models.FilePreview{
+			FileID:      file.ID,
+			Hash:        file.Hash,
+			Size:        size,
+			Kind:        r.kind,
+			Status:      models.PreviewStatusReady,
+			StorageKey:  key,
+			ContentType: "image/jpeg",
+			Width:       img.Bounds().Dx(),
+			Height:      img.Bounds().Dy(),
+		}
+		if err := upsert(db, &p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record stores a failed or unsupported outcome for sizes.
+func record(db *gorm.DB, file *models.File, sizes []string, kind, status string, cause error) error {
+	if status == models.PreviewStatusFailed {
+		log.Printf("preview: rendering %s (%s) failed: %v", file.Hash, file.MimeType, cause)
+	}
+	msg := cause.Error()
+	if len(msg) > 500 {
+		msg = msg[:500]
+	}
+	for _, size := range sizes {
+		p := models.FilePreview{
+			FileID: file.ID,
+			Hash:   file.Hash,
+			Size:   size,
+			Kind:   kind,
+			Status: status,
+			Error:  msg,
+		}
+		if err := upsert(db, &p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upsert(db *gorm.DB, p *models.FilePreview) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "size"}},
+		DoUpdates: clause.AssignmentColumns([]string{"hash", "kind", "status", "storage_key", "content_type", "width", "height", "error", "updated_at"}),
+	}).Create(p).Error
+}
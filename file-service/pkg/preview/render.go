@@ -0,0 +1,318 @@
+package preview
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"volt/file-service/pkg/filetype"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// MaxSourcePixels rejects images whose decoded bitmap would be
+	// unreasonably large (e.g. a tiny PNG claiming 50000x50000 pixels).
+	MaxSourcePixels = 40_000_000
+
+	// Documents and text are drawn onto a page of this size, then scaled
+	// down like any other image.
+	pageWidth  = 512
+	pageHeight = 640
+	pageMargin = 12
+
+	maxTextLines = 60
+
+	// MaxPDFBytes is the largest PDF previewed; the parser needs all of it
+	// in memory.
+	MaxPDFBytes = 32 << 20
+)
+
+var errUnsupported = errors.New("no preview renderer for this MIME type")
+
+// Kinds of PDF previews: KindPDF is a rendering of the first page by
+// PDFRasterizer, KindPDFText the text of the first page, drawn when no
+// rasterizer is installed.
+const (
+	KindPDF     = "pdf"
+	KindPDFText = "pdf-text"
+)
+
+// pdfTimeout bounds how long the rasterizer may take over one PDF.
+const pdfTimeout = 30 * time.Second
+
+type renderer struct {
+	kind    string
+	matches func(mimeType string) bool
+	render  func(r io.Reader, name string) (image.Image, error)
+}
+
+var renderers = []renderer{
+	{"image", isImage, renderImage},
+	{KindPDF, isRasterizablePDF, renderPDFPage},
+	{KindPDFText, filetype.Is("application/pdf"), renderPDFText},
+	{"text", filetype.IsTextual, renderText},
+}
+
+func isImage(mimeType string) bool {
+	switch filetype.Base(mimeType) {
+	case "image/jpeg", "image/jpg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+func isRasterizablePDF(mimeType string) bool {
+	return PDFRasterizer != "" && filetype.Base(mimeType) == "application/pdf"
+}
+
+func findRenderer(mimeType string) (renderer, bool) {
+	for _, r := range renderers {
+		if r.matches(mimeType) {
+			return r, true
+		}
+	}
+	return renderer{}, false
+}
+
+func renderImage(r io.Reader, _ string) (image.Image, error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > MaxSourcePixels {
+		return nil, fmt.Errorf("image too large to preview: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(io.MultiReader(&buf, r))
+	return img, err
+}
+
+// readPDF reads a whole PDF, which both renderers need, refusing those over
+// MaxPDFBytes.
+func readPDF(src io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(src, MaxPDFBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxPDFBytes {
+		return nil, fmt.Errorf("PDF too large to preview: over %d bytes", MaxPDFBytes)
+	}
+	return data, nil
+}
+
+// renderPDFPage rasterizes the first page with PDFRasterizer, scaled so its
+// longer edge is that of the largest preview.
+func renderPDFPage(src io.Reader, _ string) (image.Image, error) {
+	data, err := readPDF(src)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "volt-preview-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "document.pdf"), filepath.Join(dir, "page")
+	if err := os.WriteFile(in, data, 0o600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdfTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, PDFRasterizer,
+		"-f", "1", "-l", "1", "-singlefile", "-png",
+		"-scale-to", strconv.Itoa(Sizes["large"]), in, out)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("rasterizing PDF: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	page, err := os.Open(out + ".png")
+	if err != nil {
+		return nil, fmt.Errorf("rasterizing PDF: %w", err)
+	}
+	defer page.Close()
+	return renderImage(page, "")
+}
+
+// renderPDFText draws the text of the first page, for installations without
+// a rasterizer; the text layout is enough to recognise a document in a file
+// list.
+func renderPDFText(src io.Reader, _ string) (image.Image, error) {
+	data, err := readPDF(src)
+	if err != nil {
+		return nil, err
+	}
+	var text string
+	err = filetype.ReadPDF(bytes.NewReader(data), int64(len(data)), func(doc *pdf.Reader) error {
+		if doc.NumPage() < 1 {
+			return errors.New("PDF has no pages")
+		}
+		var err error
+		text, err = doc.Page(1).GetPlainText(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := newPage()
+	drawLines(canvas, []line{{{Text: text, Colour: color.Black}}})
+	return canvas, nil
+}
+
+// renderText draws the start of a text file with syntax highlighting, using
+// the lexer matching the file name or, failing that, its content.
+func renderText(r io.Reader, name string) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ToValidUTF8(string(data), "?")
+	if lines := strings.SplitAfter(text, "\n"); len(lines) > maxTextLines {
+		text = strings.Join(lines[:maxTextLines], "")
+	}
+	text = strings.ReplaceAll(text, "\t", "    ")
+
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		lexer = lexers.Analyse(text)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+	style := styles.Get("github")
+
+	it, err := lexer.Tokenise(nil, text)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []line
+	var current line
+	for tok := it(); tok != chroma.EOF; tok = it() {
+		c := color.Color(color.Black)
+		if entry := style.Get(tok.Type); entry.Colour.IsSet() {
+			c = color.RGBA{entry.Colour.Red(), entry.Colour.Green(), entry.Colour.Blue(), 0xff}
+		}
+		parts := strings.Split(tok.Value, "\n")
+		for i, part := range parts {
+			if i > 0 {
+				lines = append(lines, current)
+				current = nil
+			}
+			if part != "" {
+				current = append(current, span{Text: part, Colour: c})
+			}
+		}
+	}
+	lines = append(lines, current)
+
+	canvas := newPage()
+	drawLines(canvas, lines)
+	return canvas, nil
+}
+
+type span struct {
+	Text   string
+	Colour color.Color
+}
+
+type line []span
+
+func newPage() *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, pageWidth, pageHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	return canvas
+}
+
+// drawLines renders lines top to bottom with the built-in bitmap font,
+// wrapping at the page edge and stopping at the bottom margin. Spans may
+// contain newlines, which start a new line in the same colour.
+func drawLines(canvas *image.RGBA, lines []line) {
+	face := basicfont.Face7x13
+	lineHeight := face.Metrics().Height.Ceil() + 2
+	advance := face.Advance
+	maxX := pageWidth - pageMargin
+
+	d := &font.Drawer{Dst: canvas, Face: face}
+	y := pageMargin + face.Ascent
+	x := pageMargin
+	newline := func() bool {
+		x = pageMargin
+		y += lineHeight
+		return y <= pageHeight-pageMargin
+	}
+
+	for _, l := range lines {
+		for _, s := range l {
+			d.Src = image.NewUniform(s.Colour)
+			for _, r := range s.Text {
+				if r == '\n' {
+					if !newline() {
+						return
+					}
+					continue
+				}
+				if r == '\r' {
+					continue
+				}
+				if x+advance > maxX && !newline() {
+					return
+				}
+				d.Dot = fixed.P(x, y)
+				d.DrawString(string(r))
+				x += advance
+			}
+		}
+		if !newline() {
+			return
+		}
+	}
+}
+
+// fit scales src down to fit within bound x bound, keeping its aspect
+// ratio, and flattens transparency onto white since previews are JPEG.
+func fit(src image.Image, bound int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > bound || h > bound {
+		if w >= h {
+			h = max(1, h*bound/w)
+			w = bound
+		} else {
+			w = max(1, w*bound/h)
+			h = bound
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
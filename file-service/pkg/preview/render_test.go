@@ -0,0 +1,283 @@
+package preview
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// minimalPDF returns a one-page PDF showing text in Helvetica.
+func minimalPDF(text string) []byte {
+	stream := fmt.Sprintf("BT /F1 24 Tf 72 700 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func pngOf(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0x40
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// inked counts the pixels of img that are not white.
+func inked(img image.Image) int {
+	n := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA); c.R < 0xf0 || c.G < 0xf0 || c.B < 0xf0 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// fakeRasterizer installs a script standing in for pdftoppm that records its
+// arguments and writes page as the rendered page, or fails when page is nil.
+func fakeRasterizer(t *testing.T, page []byte) (args func() string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\n"
+	if page == nil {
+		script += "echo 'Syntax Error: broken document' >&2\nexit 1\n"
+	} else {
+		if err := os.WriteFile(filepath.Join(dir, "page.png"), page, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		script += "for last; do :; done\ncp " + filepath.Join(dir, "page.png") + " \"$last.png\"\n"
+	}
+	bin := filepath.Join(dir, "pdftoppm")
+	if err := os.WriteFile(bin, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	prev := PDFRasterizer
+	PDFRasterizer = bin
+	t.Cleanup(func() { PDFRasterizer = prev })
+	return func() string {
+		b, _ := os.ReadFile(filepath.Join(dir, "args"))
+		return string(b)
+	}
+}
+
+func TestFindRenderer(t *testing.T) {
+	tests := []struct {
+		mimeType   string
+		kind       string
+		rasterized string
+	}{
+		{mimeType: "image/png", kind: "image"},
+		{mimeType: "image/webp", kind: "image"},
+		{mimeType: "application/pdf", kind: KindPDFText, rasterized: KindPDF},
+		{mimeType: "application/pdf; charset=binary", kind: KindPDFText, rasterized: KindPDF},
+		{mimeType: "text/x-go; charset=utf-8", kind: "text"},
+		{mimeType: "application/json", kind: "text"},
+		{mimeType: "image/svg+xml"},
+		{mimeType: "application/zip"},
+	}
+	for _, tt := range tests {
+		r, ok := findRenderer(tt.mimeType)
+		if ok != (tt.kind != "") || r.kind != tt.kind {
+			t.Errorf("renderer for %s = %q, want %q", tt.mimeType, r.kind, tt.kind)
+		}
+	}
+
+	fakeRasterizer(t, nil)
+	for _, tt := range tests {
+		want := tt.kind
+		if tt.rasterized != "" {
+			want = tt.rasterized
+		}
+		if r, _ := findRenderer(tt.mimeType); r.kind != want {
+			t.Errorf("with a rasterizer, renderer for %s = %q, want %q", tt.mimeType, r.kind, want)
+		}
+	}
+}
+
+func TestRenderImage(t *testing.T) {
+	img, err := renderImage(bytes.NewReader(pngOf(t, 300, 200)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 200 {
+		t.Errorf("decoded %v, want 300x200", b)
+	}
+
+	// A tiny GIF claiming a 65535x65535 screen is refused before decoding.
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}), nil); err != nil {
+		t.Fatal(err)
+	}
+	bomb := buf.Bytes()
+	copy(bomb[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := renderImage(bytes.NewReader(bomb), ""); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("decompression bomb: %v, want it refused", err)
+	}
+
+	if _, err := renderImage(strings.NewReader("not an image"), ""); err == nil {
+		t.Error("garbage decoded")
+	}
+}
+
+func TestRenderPDFPage(t *testing.T) {
+	args := fakeRasterizer(t, pngOf(t, 396, 512))
+
+	img, err := renderPDFPage(bytes.NewReader(minimalPDF("Quarterly report")), "report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 396 || b.Dy() != 512 {
+		t.Errorf("page is %v, want the rasterizer's 396x512", b)
+	}
+	if got := args(); !strings.HasPrefix(got, "-f 1 -l 1 -singlefile -png -scale-to 512 ") {
+		t.Errorf("rasterizer arguments = %q, want the first page scaled to 512", got)
+	}
+
+	fakeRasterizer(t, nil)
+	if _, err := renderPDFPage(bytes.NewReader(minimalPDF("x")), ""); err == nil || !strings.Contains(err.Error(), "broken document") {
+		t.Errorf("failing rasterizer: %v, want its error output", err)
+	}
+
+	args = fakeRasterizer(t, pngOf(t, 1, 1))
+	huge := io.LimitReader(zeros{}, MaxPDFBytes+1)
+	if _, err := renderPDFPage(huge, ""); err == nil {
+		t.Error("a PDF over MaxPDFBytes was rendered")
+	}
+	if args() != "" {
+		t.Error("the rasterizer ran on a PDF over MaxPDFBytes")
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestRenderPDFText(t *testing.T) {
+	img, err := renderPDFText(bytes.NewReader(minimalPDF("Quarterly report")), "report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != pageWidth || b.Dy() != pageHeight {
+		t.Errorf("page is %v, want %dx%d", b, pageWidth, pageHeight)
+	}
+	if inked(img) == 0 {
+		t.Error("the page text was not drawn")
+	}
+
+	pdf := minimalPDF("Quarterly report")
+	for name, data := range map[string][]byte{
+		"garbage":   []byte("%PDF-1.4\nnot really"),
+		"truncated": pdf[:len(pdf)/2],
+		"no xref":   bytes.Replace(pdf, []byte("xref"), []byte("xxxx"), 1),
+	} {
+		if _, err := renderPDFText(bytes.NewReader(data), ""); err == nil {
+			t.Errorf("%s PDF: no error", name)
+		}
+	}
+}
+
+func TestRenderText(t *testing.T) {
+	src := "package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n" + strings.Repeat("// filler\n", 200)
+	img, err := renderText(strings.NewReader(src), "main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inked(img) == 0 {
+		t.Error("the text was not drawn")
+	}
+	// Text past the page is dropped rather than drawn over the margin.
+	rgba := img.(*image.RGBA)
+	bottom := rgba.SubImage(image.Rect(0, pageHeight-pageMargin+4, pageWidth, pageHeight))
+	if inked(bottom) != 0 {
+		t.Error("text was drawn into the bottom margin")
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, bound int
+		wantW       int
+		wantH       int
+	}{
+		{w: 1000, h: 500, bound: 256, wantW: 256, wantH: 128},
+		{w: 500, h: 1000, bound: 256, wantW: 128, wantH: 256},
+		{w: 100, h: 50, bound: 256, wantW: 100, wantH: 50},
+		{w: 5000, h: 1, bound: 128, wantW: 128, wantH: 1},
+	}
+	for _, tt := range tests {
+		got := fit(image.NewRGBA(image.Rect(0, 0, tt.w, tt.h)), tt.bound)
+		if got.Bounds().Dx() != tt.wantW || got.Bounds().Dy() != tt.wantH {
+			t.Errorf("fit(%dx%d, %d) = %v, want %dx%d", tt.w, tt.h, tt.bound, got.Bounds(), tt.wantW, tt.wantH)
+		}
+	}
+
+	// Transparency is flattened onto white.
+	got := fit(image.NewNRGBA(image.Rect(0, 0, 10, 10)), 256)
+	if inked(got) != 0 {
+		t.Error("a transparent image is not white")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	prev := PDFRasterizer
+	t.Cleanup(func() { PDFRasterizer = prev })
+
+	t.Setenv("PREVIEW_PDF_RENDERER", "none")
+	Configure()
+	if PDFRasterizer != "" {
+		t.Errorf("PDFRasterizer = %q with rasterizing turned off", PDFRasterizer)
+	}
+
+	t.Setenv("PREVIEW_PDF_RENDERER", filepath.Join(t.TempDir(), "missing"))
+	Configure()
+	if PDFRasterizer != "" {
+		t.Errorf("PDFRasterizer = %q for a missing binary", PDFRasterizer)
+	}
+
+	bin := filepath.Join(t.TempDir(), "pdftoppm")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PREVIEW_PDF_RENDERER", bin)
+	Configure()
+	if PDFRasterizer != bin {
+		t.Errorf("PDFRasterizer = %q, want %s", PDFRasterizer, bin)
+	}
+}
@@ -0,0 +1,102 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"volt/db/config"
+	"volt/file-service/pkg/storage"
+)
+
+// Default is the replicating store behind storage.Blobs, or nil when
+// replication is off.
+var Default *Store
+
+// Configure replaces storage.Blobs with a Store over the directories listed
+// in STORAGE_REPLICAS, as comma-separated name=path pairs or plain paths
+// named by themselves. Writes need STORAGE_WRITE_QUORUM of them, by default
+// a majority. It must run before encryption.Configure, so blobs are
+// encrypted once and the ciphertext replicated. Only the hot tier is
+// replicated, so it refuses to run alongside a cold tier, which would keep
+// moved Files on a single volume.
+func Configure() (*Store, error) {
+	spec := config.GetEnv("STORAGE_REPLICAS", "")
+	if spec == "" {
+		return nil, nil
+	}
+	if config.GetEnv("COLD_STORAGE_ROOT", "") != "" {
+		return nil, errors.New("STORAGE_REPLICAS cannot be combined with COLD_STORAGE_ROOT: the cold tier is not replicated")
+	}
+	var replicas []*Replica
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, root, ok := strings.Cut(item, "=")
+		if !ok {
+			root = name
+		}
+		if name == "" || root == "" {
+			return nil, fmt.Errorf("invalid STORAGE_REPLICAS entry %q", item)
+		}
+		replicas = append(replicas, &Replica{Name: name, Store: storage.NewLocal(root)})
+	}
+
+	quorum := config.GetEnvInt("STORAGE_WRITE_QUORUM", len(replicas)/2+1)
+	s, err := NewStore(replicas, quorum)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STORAGE_REPLICAS: %w", err)
+	}
+	Cooldown = config.GetEnvDuration("REPLICA_COOLDOWN", Cooldown)
+	storage.Blobs = s
+	Default = s
+	log.Printf("Replicating blobs to %d replicas, write quorum %d", len(replicas), quorum)
+	return s, nil
+}
+
+// ReplicaStatus describes one replica as this service replica sees it.
+type ReplicaStatus struct {
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type Status struct {
+	Replicas   []ReplicaStatus `json:"replicas"`
+	Quorum     int             `json:"quorum"`
+	LastRepair *Result         `json:"last_repair,omitempty"`
+}
+
+// Status reports the health of every replica and the last repair.
+func (s *Store) Status() *Status {
+	status := &Status{Quorum: s.Quorum, LastRepair: Last()}
+	for _, rep := range s.Replicas {
+		rs := ReplicaStatus{Name: rep.Name, Healthy: rep.Healthy()}
+		rep.mu.Lock()
+		if rep.lastErr != nil {
+			rs.LastError = rep.lastErr.Error()
+		}
+		rep.mu.Unlock()
+		status.Replicas = append(status.Replicas, rs)
+	}
+	return status
+}
+
+// Check fails while fewer than Quorum replicas are healthy, when uploads
+// would fail.
+func (s *Store) Check(ctx context.Context) error {
+	healthy := 0
+	for _, rep := range s.Replicas {
+		if rep.Healthy() {
+			healthy++
+		}
+	}
+	if healthy < s.Quorum {
+		return fmt.Errorf("%d of %d replicas healthy, write quorum is %d", healthy, len(s.Replicas), s.Quorum)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"volt/common/metrics"
+	"volt/file-service/pkg/storage"
+)
+
+// failoverObject reads a blob from one replica and, when a read fails,
+// reopens it on a replica it has not tried yet and retries the read there.
+// Replicas only ever hold complete copies of the same blob, so reads can
+// continue at any offset.
+type failoverObject struct {
+	ctx   context.Context
+	store *Store
+	key   string
+
+	mu    sync.Mutex
+	obj   storage.Object
+	rep   *Replica
+	tried map[*Replica]bool
+	pos   int64
+}
+
+func (o *failoverObject) Size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.obj.Size()
+}
+
+func (o *failoverObject) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		n, err := o.obj.ReadAt(p, off)
+		if err == nil || errors.Is(err, io.EOF) || o.ctx.Err() != nil {
+			return n, err
+		}
+		if !o.failover(err) {
+			return n, err
+		}
+	}
+}
+
+// failover switches to the next replica after err. The caller holds o.mu.
+func (o *failoverObject) failover(err error) bool {
+	o.rep.fail(err)
+	if o.tried == nil {
+		o.tried = make(map[*Replica]bool)
+	}
+	o.tried[o.rep] = true
+	obj, rep, openErr := o.store.open(o.ctx, o.key, o.tried)
+	if openErr != nil {
+		return false
+	}
+	metrics.ReplicaReadFailoversTotal.WithLabelValues(o.rep.Name).Inc()
+	o.obj.Close()
+	o.obj, o.rep = obj, rep
+	return true
+}
+
+func (o *failoverObject) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := o.ReadAt(p, o.pos)
+	o.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (o *failoverObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *failoverObject) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.obj.Close()
+}
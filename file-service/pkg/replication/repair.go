@@ -0,0 +1,297 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/leader"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// leaderLock is the advisory lock held by the replica that repairs.
+const leaderLock int64 = 0x766f6c74_00007270 // "volt", "rp"
+
+// Result describes one repair pass. Lost lists live blobs no replica holds;
+// only a backup can bring those back.
+type Result struct {
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	Live            int       `json:"live"`
+	UnderReplicated int       `json:"under_replicated"`
+	Repaired        int       `json:"repaired"`
+	Lost            []string  `json:"lost,omitempty"`
+	Errors          []string  `json:"errors,omitempty"`
+}
+
+func (r *Result) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+var last atomic.Pointer[Result]
+
+// Last returns the result of the most recent repair this replica led, or
+// nil before the first one finishes.
+func Last() *Result {
+	return last.Load()
+}
+
+// Run repairs s every interval until ctx is cancelled. Only the service
+// replica that gets the leader lock repairs.
+func Run(ctx context.Context, s *Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := leader.Do(ctx, leaderLock, func(ctx context.Context) error {
+			result, err := Repair(ctx, s)
+			if err != nil {
+				return err
+			}
+			last.Store(result)
+			if result.Repaired > 0 || len(result.Lost) > 0 || len(result.Errors) > 0 {
+				log.Printf("replication: %d of %d live blobs under-replicated, %d copies repaired, %d lost, %d errors",
+					result.UnderReplicated, result.Live, result.Repaired, len(result.Lost), len(result.Errors))
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, leader.ErrNotLeader) && ctx.Err() == nil {
+			log.Printf("replication: repair failed: %v", err)
+		}
+	}
+}
+
+// Repair finds every live blob that some reachable replica is missing, or
+// holds at a different size than the replica recorded for it, and copies
+// it there from a replica that has it. It lists each replica to learn what
+// it holds, so copies lost with a volume are found even though their rows
+// remain, and it corrects the rows to match.
+func Repair(ctx context.Context, s *Store) (_ *Result, err error) {
+	ctx, span := tracer.Start(ctx, "replication.Repair")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	result := &Result{StartedAt: time.Now()}
+	db := config.DB.WithContext(ctx)
+
+	live, err := liveKeys(db)
+	if err != nil {
+		return nil, fmt.Errorf("listing live blobs: %w", err)
+	}
+	recorded, err := recordedReplicas(db)
+	if err != nil {
+		return nil, fmt.Errorf("loading replica rows: %w", err)
+	}
+
+	// Live blobs are looked up before the replicas are listed, so each one
+	// was complete on a quorum of them before its listing.
+	held := make(map[*Replica]map[string]int64)
+	for _, rep := range s.Replicas {
+		keys := make(map[string]int64)
+		err := rep.Store.Walk(ctx, "uploads/", func(info storage.Info) error {
+			keys[info.Key] = info.Size
+			return nil
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			rep.fail(err)
+			result.errorf("listing %s: %v", rep.Name, err)
+			continue
+		}
+		rep.recover()
+		held[rep] = keys
+	}
+	if len(held) == 0 {
+		return nil, errors.New("no replica could be listed")
+	}
+
+	for _, key := range live {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result.Live++
+		repairKey(ctx, s, key, held, recorded[key], result)
+	}
+
+	metrics.UnderReplicatedBlobs.Set(float64(result.UnderReplicated))
+	result.FinishedAt = time.Now()
+	span.SetAttributes(
+		attribute.Int("replication.live", result.Live),
+		attribute.Int("replication.repaired", result.Repaired),
+	)
+	return result, nil
+}
+
+// repairKey brings one live blob to every listed replica and corrects its
+// rows. rows holds the recorded size per replica.
+func repairKey(ctx context.Context, s *Store, key string, held map[*Replica]map[string]int64, rows map[string]int64, result *Result) {
+	source, size := sourceOf(s, key, held, rows)
+	if source == nil {
+		if len(held) == len(s.Replicas) {
+			result.Lost = append(result.Lost, key)
+		}
+		return
+	}
+
+	var holders []*Replica
+	var missing []*Replica
+	for _, rep := range s.Replicas {
+		keys, listed := held[rep]
+		if !listed {
+			// Unreachable replicas keep their rows until they are back.
+			if _, ok := rows[rep.Name]; ok {
+				holders = append(holders, rep)
+			}
+			continue
+		}
+		if n, ok := keys[key]; ok && n == size {
+			holders = append(holders, rep)
+		} else {
+			missing = append(missing, rep)
+		}
+	}
+	if len(missing) == 0 && sameReplicas(rows, holders) {
+		return
+	}
+	if len(missing) > 0 {
+		result.UnderReplicated++
+	}
+
+	for _, rep := range missing {
+		if err := copyBlob(ctx, source, rep, key, size); err != nil {
+			rep.fail(err)
+			result.errorf("copying %s from %s to %s: %v", key, source.Name, rep.Name, err)
+			continue
+		}
+		metrics.ReplicaRepairsTotal.WithLabelValues(rep.Name).Inc()
+		result.Repaired++
+		holders = append(holders, rep)
+	}
+	if err := s.record(ctx, key, holders, size); err != nil {
+		result.errorf("recording replicas of %s: %v", key, err)
+	}
+}
+
+// sourceOf picks the copy of key to repair from: one a row records at the
+// size it has, as rows are only written for complete, current copies, or
+// else the first copy found.
+func sourceOf(s *Store, key string, held map[*Replica]map[string]int64, rows map[string]int64) (*Replica, int64) {
+	var first *Replica
+	for _, rep := range s.Replicas {
+		n, ok := held[rep][key]
+		if !ok {
+			continue
+		}
+		if want, recorded := rows[rep.Name]; recorded && want == n {
+			return rep, n
+		}
+		if first == nil {
+			first = rep
+		}
+	}
+	if first == nil {
+		return nil, 0
+	}
+	return first, held[first][key]
+}
+
+func sameReplicas(rows map[string]int64, holders []*Replica) bool {
+	if len(rows) != len(holders) {
+		return false
+	}
+	for _, rep := range holders {
+		if _, ok := rows[rep.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// copyBlob copies the blob as stored from one replica to another.
+func copyBlob(ctx context.Context, from, to *Replica, key string, size int64) error {
+	obj, err := from.Store.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	n, err := to.Store.Put(ctx, key, obj)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		to.Store.Delete(context.WithoutCancel(ctx), key)
+		return fmt.Errorf("copied %d bytes, want %d", n, size)
+	}
+	return nil
+}
+
+// liveKeys returns the keys of the blobs live Files, chunks and previews
+// keep in the hot tier, which is the replicated one.
+func liveKeys(db *gorm.DB) ([]string, error) {
+	var keys []string
+	for _, q := range []string{
+		"SELECT storage_path FROM files WHERE deleted_at IS NULL AND storage_path <> '' AND tier = 'hot'",
+		"SELECT storage_key FROM chunks",
+		"SELECT storage_key FROM file_previews WHERE storage_key <> ''",
+	} {
+		rows, err := db.Raw(q).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// recordedReplicas returns the recorded size of each blob per replica.
+func recordedReplicas(db *gorm.DB) (map[string]map[string]int64, error) {
+	recorded := make(map[string]map[string]int64)
+	rows, err := db.Model(&models.BlobReplica{}).Select("key, replica, size").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, replica string
+		var size int64
+		if err := rows.Scan(&key, &replica, &size); err != nil {
+			return nil, err
+		}
+		if recorded[key] == nil {
+			recorded[key] = make(map[string]int64)
+		}
+		recorded[key][replica] = size
+	}
+	return recorded, rows.Err()
+}
@@ -0,0 +1,319 @@
+// Package replication keeps every blob on several storage backends, so
+// losing one volume loses no content. Store writes each blob to all
+// replicas at once and succeeds once a quorum has it, records which
+// replicas hold it in the blob_replicas table, and reads from whichever
+// healthy replica has it, failing over to the next one on errors. A repair
+// worker copies blobs to the replicas that are missing them.
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm/clause"
+)
+
+var tracer = tracing.Tracer("volt/file-service/replication")
+
+// ErrQuorum is returned by a Put that fewer than Quorum replicas stored.
+var ErrQuorum = errors.New("write quorum not reached")
+
+// Cooldown is how long a replica that failed is tried only after all
+// healthy ones.
+var Cooldown = 30 * time.Second
+
+type Replica struct {
+	Name  string
+	Store storage.Store
+
+	mu        sync.Mutex
+	downUntil time.Time
+	lastErr   error
+}
+
+// Healthy reports whether the replica has not failed within Cooldown.
+func (r *Replica) Healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Now().After(r.downUntil)
+}
+
+// fail marks the replica unhealthy after an error other than a missing
+// blob, which only means this replica never got it.
+func (r *Replica) fail(err error) {
+	if err == nil || errors.Is(err, storage.ErrNotFound) || errors.Is(err, context.Canceled) {
+		return
+	}
+	r.mu.Lock()
+	r.downUntil = time.Now().Add(Cooldown)
+	r.lastErr = err
+	r.mu.Unlock()
+}
+
+func (r *Replica) recover() {
+	r.mu.Lock()
+	r.downUntil = time.Time{}
+	r.lastErr = nil
+	r.mu.Unlock()
+}
+
+// Store replicates blobs to every replica. Writes need Quorum of them;
+// reads need one.
+type Store struct {
+	Replicas []*Replica
+	Quorum   int
+}
+
+func NewStore(replicas []*Replica, quorum int) (*Store, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("no replicas")
+	}
+	if quorum < 1 || quorum > len(replicas) {
+		return nil, fmt.Errorf("write quorum %d must be between 1 and the %d replicas", quorum, len(replicas))
+	}
+	seen := make(map[string]bool)
+	for _, r := range replicas {
+		if seen[r.Name] {
+			return nil, fmt.Errorf("replica %q is listed twice", r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return &Store{Replicas: replicas, Quorum: quorum}, nil
+}
+
+// readOrder lists healthy replicas first, each group in configured order.
+func (s *Store) readOrder() []*Replica {
+	order := make([]*Replica, 0, len(s.Replicas))
+	var down []*Replica
+	for _, r := range s.Replicas {
+		if r.Healthy() {
+			order = append(order, r)
+		} else {
+			down = append(down, r)
+		}
+	}
+	return append(order, down...)
+}
+
+// Put streams r to every replica at once. A replica that fails is dropped
+// from the copy and the others carry on; the Put succeeds once Quorum
+// replicas have the complete blob. Otherwise the copies that were stored
+// are deleted again, so a failed Put still leaves nothing behind.
+func (s *Store) Put(ctx context.Context, key string, r io.Reader) (written int64, err error) {
+	ctx, span := tracer.Start(ctx, "replication.Put")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	errs := make([]error, len(s.Replicas))
+	pipes := make([]*io.PipeWriter, len(s.Replicas))
+	var wg sync.WaitGroup
+	for i, rep := range s.Replicas {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = rep.Store.Put(ctx, key, pr)
+			// Unblocks the copy if the replica gave up without reading
+			// everything.
+			pr.CloseWithError(errs[i])
+		}()
+	}
+
+	written, err = fanOut(r, pipes)
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return written, err
+	}
+
+	var stored []*Replica
+	for i, rep := range s.Replicas {
+		if errs[i] != nil {
+			rep.fail(errs[i])
+			metrics.ReplicaWriteFailuresTotal.WithLabelValues(rep.Name).Inc()
+			tracing.Logf(ctx, "replication: writing %s to %s: %v", key, rep.Name, errs[i])
+			continue
+		}
+		stored = append(stored, rep)
+	}
+	span.SetAttributes(attribute.Int("replication.stored", len(stored)))
+
+	if len(stored) < s.Quorum {
+		for _, rep := range stored {
+			rep.Store.Delete(context.WithoutCancel(ctx), key)
+		}
+		return written, fmt.Errorf("%w: %d of %d replicas stored %s: %w", ErrQuorum, len(stored), s.Quorum, key, errors.Join(errs...))
+	}
+	// A replica that missed this write may still hold an older blob under
+	// the same key; remove it so it is never served, and let repair copy
+	// the new one.
+	for i, rep := range s.Replicas {
+		if errs[i] != nil {
+			rep.Store.Delete(context.WithoutCancel(ctx), key)
+		}
+	}
+	if err := s.record(ctx, key, stored, written); err != nil {
+		tracing.Logf(ctx, "replication: recording replicas of %s: %v", key, err)
+	}
+	return written, nil
+}
+
+// fanOut copies r to every writer. A writer that fails is left out from
+// then on; only errors reading r are returned.
+func fanOut(r io.Reader, writers []*io.PipeWriter) (int64, error) {
+	live := make([]*io.PipeWriter, len(writers))
+	copy(live, writers)
+	buf := make([]byte, 256<<10)
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, w := range live {
+				if w == nil {
+					continue
+				}
+				if _, err := w.Write(buf[:n]); err != nil {
+					live[i] = nil
+				}
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// record replaces the replica rows of key with the replicas that now hold
+// it, in the transaction ctx carries if there is one.
+func (s *Store) record(ctx context.Context, key string, stored []*Replica, size int64) error {
+	rows := make([]models.BlobReplica, len(stored))
+	names := make([]string, len(stored))
+	for i, rep := range stored {
+		rows[i] = models.BlobReplica{Key: key, Replica: rep.Name, Size: size}
+		names[i] = rep.Name
+	}
+	db := config.DBFrom(ctx)
+	if err := db.Where("key = ? AND replica NOT IN ?", key, names).Delete(&models.BlobReplica{}).Error; err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&rows).Error
+}
+
+// Open opens the blob on the first replica that has it. Reads that fail
+// later continue on another replica.
+func (s *Store) Open(ctx context.Context, key string) (storage.Object, error) {
+	obj, rep, err := s.open(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &failoverObject{ctx: ctx, store: s, key: key, obj: obj, rep: rep}, nil
+}
+
+// open tries the replicas in read order, skipping those in tried.
+func (s *Store) open(ctx context.Context, key string, tried map[*Replica]bool) (storage.Object, *Replica, error) {
+	var errs []error
+	for _, rep := range s.readOrder() {
+		if tried[rep] {
+			continue
+		}
+		obj, err := rep.Store.Open(ctx, key)
+		if err == nil {
+			return obj, rep, nil
+		}
+		rep.fail(err)
+		if !errors.Is(err, storage.ErrNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", rep.Name, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil, nil, storage.ErrNotFound
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (s *Store) Stat(ctx context.Context, key string) (storage.Info, error) {
+	var errs []error
+	for _, rep := range s.readOrder() {
+		info, err := rep.Store.Stat(ctx, key)
+		if err == nil {
+			return info, nil
+		}
+		rep.fail(err)
+		if !errors.Is(err, storage.ErrNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", rep.Name, err))
+		}
+	}
+	if len(errs) == 0 {
+		return storage.Info{}, storage.ErrNotFound
+	}
+	return storage.Info{}, errors.Join(errs...)
+}
+
+// Delete forgets the blob's replicas, in the transaction ctx carries if
+// there is one, then deletes every copy. Copies on replicas that failed are
+// left to the garbage collector, which sees them through Walk.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if err := config.DBFrom(ctx).Where("key = ?", key).Delete(&models.BlobReplica{}).Error; err != nil {
+		return err
+	}
+	var errs []error
+	for _, rep := range s.Replicas {
+		if err := rep.Store.Delete(ctx, key); err != nil {
+			rep.fail(err)
+			errs = append(errs, fmt.Errorf("%s: %w", rep.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Walk lists the union of the blobs on all replicas. Replicas that cannot
+// be walked are skipped, unless none can.
+func (s *Store) Walk(ctx context.Context, prefix string, fn func(storage.Info) error) error {
+	seen := make(map[string]bool)
+	var errs []error
+	for _, rep := range s.Replicas {
+		var fnErr error
+		err := rep.Store.Walk(ctx, prefix, func(info storage.Info) error {
+			if seen[info.Key] {
+				return nil
+			}
+			seen[info.Key] = true
+			fnErr = fn(info)
+			return fnErr
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			rep.fail(err)
+			errs = append(errs, fmt.Errorf("%s: %w", rep.Name, err))
+		}
+	}
+	if len(errs) == len(s.Replicas) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
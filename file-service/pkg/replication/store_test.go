@@ -0,0 +1,238 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"volt/db/config"
+	"volt/db/dbtest"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+
+	"gorm.io/gorm"
+)
+
+var errBroken = errors.New("volume broken")
+
+// brokenStore fails writes after reading failAfter bytes, and reads of
+// anything at or past failAfter.
+type brokenStore struct {
+	storage.Store
+	failAfter int64
+}
+
+func (s *brokenStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	n, err := io.CopyN(io.Discard, r, s.failAfter)
+	if err != nil {
+		return n, err
+	}
+	return n, errBroken
+}
+
+func (s *brokenStore) Open(ctx context.Context, key string) (storage.Object, error) {
+	obj, err := s.Store.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &brokenObject{Object: obj, failAfter: s.failAfter}, nil
+}
+
+type brokenObject struct {
+	storage.Object
+	failAfter int64
+}
+
+func (o *brokenObject) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) <= o.failAfter {
+		return o.Object.ReadAt(p, off)
+	}
+	n := 0
+	if off < o.failAfter {
+		n, _ = o.Object.ReadAt(p[:o.failAfter-off], off)
+	}
+	return n, errBroken
+}
+
+func newReplicas(t *testing.T, names ...string) []*Replica {
+	t.Helper()
+	var replicas []*Replica
+	for _, name := range names {
+		replicas = append(replicas, &Replica{Name: name, Store: storage.NewLocal(t.TempDir())})
+	}
+	return replicas
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestPutWithoutQuorumLeavesNothing(t *testing.T) {
+	ctx := context.Background()
+	replicas := newReplicas(t, "a", "b", "c")
+	replicas[1].Store = &brokenStore{Store: replicas[1].Store, failAfter: 1000}
+	replicas[2].Store = &brokenStore{Store: replicas[2].Store, failAfter: 0}
+	s, err := NewStore(replicas, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const key = "uploads/ab/cd/blob"
+	// The replica that stores the blob held an older one under the key.
+	if _, err := replicas[0].Store.Put(ctx, key, bytes.NewReader([]byte("older"))); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Put(ctx, key, bytes.NewReader(randomBytes(1<<20)))
+	if !errors.Is(err, ErrQuorum) {
+		t.Fatalf("Put = %v, want ErrQuorum", err)
+	}
+	for _, rep := range replicas {
+		if _, err := rep.Store.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("replica %s: Stat = %v, want ErrNotFound", rep.Name, err)
+		}
+	}
+	if _, err := s.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat = %v, want ErrNotFound", err)
+	}
+	for _, rep := range replicas[1:] {
+		if rep.Healthy() {
+			t.Errorf("replica %s is healthy after a failed write", rep.Name)
+		}
+	}
+}
+
+func TestReadFailsOverMidStream(t *testing.T) {
+	ctx := context.Background()
+	replicas := newReplicas(t, "a", "b", "c")
+	content := randomBytes(3<<20 + 17)
+	const key = "uploads/ab/cd/blob"
+	for _, rep := range replicas {
+		if _, err := rep.Store.Put(ctx, key, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first replica breaks a third of the way in, the second two
+	// thirds of the way in.
+	replicas[0].Store = &brokenStore{Store: replicas[0].Store, failAfter: int64(len(content) / 3)}
+	replicas[1].Store = &brokenStore{Store: replicas[1].Store, failAfter: int64(2 * len(content) / 3)}
+	s, err := NewStore(replicas, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	got, err := io.ReadAll(iotest.HalfReader(obj))
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("read %d bytes that differ from the %d stored", len(got), len(content))
+	}
+	if replicas[0].Healthy() || replicas[1].Healthy() || !replicas[2].Healthy() {
+		t.Errorf("health = %v, %v, %v, want false, false, true",
+			replicas[0].Healthy(), replicas[1].Healthy(), replicas[2].Healthy())
+	}
+
+	// Reads by offset fail over too.
+	for _, rep := range replicas {
+		rep.recover()
+	}
+	obj2, err := s.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj2.Close()
+	p := make([]byte, 4096)
+	off := int64(len(content) - len(p))
+	if n, err := obj2.ReadAt(p, off); err != nil && !errors.Is(err, io.EOF) || n != len(p) {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(p, content[off:]) {
+		t.Fatal("ReadAt returned the wrong bytes")
+	}
+}
+
+func TestReadFailsWhenEveryReplicaBreaks(t *testing.T) {
+	ctx := context.Background()
+	replicas := newReplicas(t, "a", "b")
+	content := randomBytes(64 << 10)
+	const key = "uploads/ab/cd/blob"
+	for _, rep := range replicas {
+		if _, err := rep.Store.Put(ctx, key, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		rep.Store = &brokenStore{Store: rep.Store, failAfter: 1000}
+	}
+	s, err := NewStore(replicas, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if _, err := io.ReadAll(obj); !errors.Is(err, errBroken) {
+		t.Fatalf("ReadAll = %v, want %v", err, errBroken)
+	}
+}
+
+func TestRowsFollowTheCallersTransaction(t *testing.T) {
+	db := dbtest.Open(t)
+	ctx := context.Background()
+	s, err := NewStore(newReplicas(t, "a", "b"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "uploads/ab/cd/blob"
+	countRows := func() int64 {
+		t.Helper()
+		var n int64
+		if err := db.Model(&models.BlobReplica{}).Where("key = ?", key).Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	errRollback := errors.New("rollback")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.Put(config.WithTx(ctx, tx), key, bytes.NewReader(randomBytes(1000))); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatal(err)
+	}
+	if n := countRows(); n != 0 {
+		t.Fatalf("%d replica rows after the write's transaction rolled back, want 0", n)
+	}
+
+	if _, err := s.Put(ctx, key, bytes.NewReader(randomBytes(1000))); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := s.Delete(config.WithTx(ctx, tx), key); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatal(err)
+	}
+	if n := countRows(); n != 2 {
+		t.Fatalf("%d replica rows after the delete's transaction rolled back, want 2", n)
+	}
+}
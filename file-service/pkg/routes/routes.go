@@ -1,6 +1,9 @@
 package routes
 
 import (
+	"volt/common/health"
+	"volt/common/metrics"
+	"volt/common/problem"
 	"volt/file-service/pkg/controllers"
 	"volt/file-service/pkg/middlewares"
 
@@ -8,6 +11,13 @@ import (
 )
 
 func SetupRoutes(router *mux.Router) {
+	router.NotFoundHandler = problem.NotFoundHandler()
+	router.MethodNotAllowedHandler = problem.MethodNotAllowedHandler()
+
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	router.HandleFunc("/livez", health.LivenessHandler).Methods("GET")
+	router.HandleFunc("/readyz", health.ReadinessHandler).Methods("GET")
+
 	api := router.PathPrefix("/api/v1").Subrouter()
 
 	// Health check endpoint
@@ -15,10 +25,29 @@ func SetupRoutes(router *mux.Router) {
 
 	protected := api.PathPrefix("").Subrouter()
 	protected.Use(middlewares.AuthMiddleware)
+	protected.Use(middlewares.IdempotencyMiddleware)
 
 	// File upload and management routes
 	protected.HandleFunc("/files/upload", controllers.UploadFile).Methods("POST")
+	protected.HandleFunc("/files/upload/check", controllers.CheckUpload).Methods("POST")
+	protected.HandleFunc("/files/bulk", controllers.BulkFiles).Methods("POST")
+	protected.HandleFunc("/files/archive", controllers.DownloadArchive).Methods("POST")
+	protected.HandleFunc("/files/search", controllers.SearchFiles).Methods("GET")
+	protected.HandleFunc("/files/search/reindex", controllers.ReindexFiles).Methods("POST")
+	protected.HandleFunc("/files/jobs/{ID}", controllers.GetJob).Methods("GET")
+	protected.HandleFunc("/files/{ID}/download", controllers.DownloadFile).Methods("GET")
+	protected.HandleFunc("/files/{ID}/thumbnail", controllers.GetThumbnail).Methods("GET")
+	protected.HandleFunc("/files/{ID}/extract", controllers.ExtractFile).Methods("POST")
 	protected.HandleFunc("/files/{ID}", controllers.GetFiles).Methods("GET")
 	protected.HandleFunc("/files/{ID}", controllers.DeleteFile).Methods("DELETE")
 	protected.HandleFunc("/users/storage-stats", controllers.GetUserStorageStats).Methods("GET")
+
+	admin := protected.PathPrefix("/files/admin").Subrouter()
+	admin.Use(middlewares.AdminMiddleware)
+	admin.HandleFunc("/rescan", controllers.RescanFiles).Methods("POST")
+	admin.HandleFunc("/fsck", controllers.GetFsckReport).Methods("GET")
+	admin.HandleFunc("/gc", controllers.GetGCResult).Methods("GET")
+	admin.HandleFunc("/tiers", controllers.GetTierStats).Methods("GET")
+	admin.HandleFunc("/replication", controllers.GetReplicationStatus).Methods("GET")
+	admin.HandleFunc("/erasure", controllers.GetErasureStatus).Methods("GET")
 }
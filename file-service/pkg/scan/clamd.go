@@ -0,0 +1,158 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Clamd talks to a ClamAV daemon. Addr is host:port for TCP or a socket path
+// (optionally prefixed with "unix:") for a Unix socket, so a fake daemon on
+// a local listener works just as well as the real one.
+type Clamd struct {
+	Addr    string
+	Timeout time.Duration
+	// ChunkSize must stay below clamd's StreamMaxLength.
+	ChunkSize int
+}
+
+func NewClamd(addr string, timeout time.Duration) *Clamd {
+	return &Clamd{Addr: addr, Timeout: timeout, ChunkSize: 64 * 1024}
+}
+
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	network, addr := "tcp", c.Addr
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	} else if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to clamd: %w", err)
+	}
+	return conn, nil
+}
+
+// session runs fn on a fresh connection that is closed when ctx is done or
+// the timeout passes, which unblocks any pending read or write.
+func (c *Clamd) session(ctx context.Context, fn func(net.Conn) error) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := fn(conn); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// Ping checks that the daemon is up.
+func (c *Clamd) Ping(ctx context.Context) error {
+	return c.session(ctx, func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+			return err
+		}
+		reply, err := readReply(conn)
+		if err != nil {
+			return err
+		}
+		if reply != "PONG" {
+			return fmt.Errorf("unexpected clamd reply %q", reply)
+		}
+		return nil
+	})
+}
+
+// Scan streams r to clamd with the INSTREAM command: the data is sent as
+// length-prefixed chunks terminated by a zero-length chunk, and the daemon
+// answers "stream: OK" or "stream: <signature> FOUND".
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	var result Result
+	err := c.session(ctx, func(conn net.Conn) error {
+		w := bufio.NewWriterSize(conn, c.ChunkSize+4)
+		if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+			return err
+		}
+
+		buf := make([]byte, c.ChunkSize)
+		var size [4]byte
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				binary.BigEndian.PutUint32(size[:], uint32(n))
+				if _, err := w.Write(size[:]); err != nil {
+					return err
+				}
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("reading blob: %w", err)
+			}
+		}
+		binary.BigEndian.PutUint32(size[:], 0)
+		if _, err := w.Write(size[:]); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		reply, err := readReply(conn)
+		if err != nil {
+			return err
+		}
+		result, err = parseReply(reply)
+		return err
+	})
+	return result, err
+}
+
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", fmt.Errorf("reading clamd reply: %w", err)
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+func parseReply(reply string) (Result, error) {
+	body := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case body == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(body, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(body, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", body)
+	}
+}
@@ -0,0 +1,138 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd serves every connection with serve on a local listener and
+// returns a client for it.
+func fakeClamd(t *testing.T, serve func(conn net.Conn, r *bufio.Reader)) *Clamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+	c := NewClamd(ln.Addr().String(), 5*time.Second)
+	c.ChunkSize = 7
+	return c
+}
+
+// readInstream reads an INSTREAM command and its chunks up to the
+// terminating zero-length chunk.
+func readInstream(r *bufio.Reader) ([]byte, error) {
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return nil, err
+	}
+	if cmd != "zINSTREAM\x00" {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var data []byte
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// replying answers INSTREAM with reply once the whole stream was received,
+// after checking it arrived intact.
+func replying(t *testing.T, want []byte, reply string) func(net.Conn, *bufio.Reader) {
+	return func(conn net.Conn, r *bufio.Reader) {
+		data, err := readInstream(r)
+		if err != nil {
+			t.Errorf("reading stream: %v", err)
+			return
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("clamd received %q, want %q", data, want)
+		}
+		conn.Write([]byte(reply + "\x00"))
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	content := []byte("content spread over several INSTREAM chunks")
+	tests := []struct {
+		name    string
+		reply   string
+		want    Result
+		wantErr string
+	}{
+		{name: "clean", reply: "stream: OK", want: Result{}},
+		{name: "infected", reply: "stream: Eicar-Signature FOUND", want: Result{Infected: true, Signature: "Eicar-Signature"}},
+		{name: "size limit", reply: "INSTREAM size limit exceeded. ERROR", wantErr: "size limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fakeClamd(t, replying(t, content, tt.reply))
+			got, err := c.Scan(context.Background(), bytes.NewReader(content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Scan error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Scan = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClamdDroppedConnection(t *testing.T) {
+	c := fakeClamd(t, func(conn net.Conn, r *bufio.Reader) {
+		r.ReadString(0)
+	})
+	if _, err := c.Scan(context.Background(), strings.NewReader("never answered")); err == nil {
+		t.Fatal("Scan succeeded on a dropped connection")
+	}
+	if err := c.Ping(context.Background()); err == nil {
+		t.Fatal("Ping succeeded on a dropped connection")
+	}
+}
+
+func TestClamdPing(t *testing.T) {
+	c := fakeClamd(t, func(conn net.Conn, r *bufio.Reader) {
+		if cmd, _ := r.ReadString(0); cmd == "zPING\x00" {
+			conn.Write([]byte("PONG\x00"))
+		}
+	})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
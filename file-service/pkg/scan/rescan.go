@@ -0,0 +1,171 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/problem"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/storage"
+
+	"gorm.io/gorm"
+)
+
+var (
+	rescanRequests = make(chan struct{}, 1)
+	rescanning     atomic.Bool
+)
+
+// RequestRescan schedules a rescan of every stored blob, e.g. after the
+// signature database was updated.
+func RequestRescan() error {
+	if Default == nil {
+		return problem.New(http.StatusServiceUnavailable, problem.CodeUnavailable, "No malware scanner is configured")
+	}
+	if rescanning.Load() {
+		return problem.New(http.StatusConflict, problem.CodeConflict, "A rescan is already running")
+	}
+	select {
+	case rescanRequests <- struct{}{}:
+		return nil
+	default:
+		return problem.New(http.StatusConflict, problem.CodeConflict, "A rescan is already scheduled")
+	}
+}
+
+// Run performs requested rescans until ctx is cancelled.
+func Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rescanRequests:
+			rescanning.Store(true)
+			start := time.Now()
+			scanned, infected, err := Rescan(ctx)
+			rescanning.Store(false)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("scan: rescan failed after %d files: %v", scanned, err)
+				continue
+			}
+			log.Printf("scan: rescanned %d files in %s, %d infected", scanned, time.Since(start).Round(time.Second), infected)
+		}
+	}
+}
+
+// Rescan scans every File again and applies the current policy to the
+// result. Files that are no longer infected are released from quarantine.
+func Rescan(ctx context.Context) (scanned, infected int, err error) {
+	db := config.DB.WithContext(ctx)
+
+	var batch []models.File
+	result := db.Order("id").FindInBatches(&batch, 100, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := rescanFile(ctx, db, &batch[i]); err != nil {
+				log.Printf("scan: rescanning %s failed: %v", batch[i].Hash, err)
+				continue
+			}
+			scanned++
+			if batch[i].ScanStatus == models.ScanStatusInfected {
+				infected++
+			}
+		}
+		return nil
+	})
+	return scanned, infected, result.Error
+}
+
+func rescanFile(ctx context.Context, db *gorm.DB, file *models.File) error {
+	obj, err := content.Open(ctx, file)
+	if err != nil {
+		return err
+	}
+	res, err := Default.Scan(ctx, obj)
+	obj.Close()
+	if err != nil {
+		metrics.ScansTotal.WithLabelValues("error").Inc()
+		return err
+	}
+
+	now := time.Now()
+	file.ScannedAt = &now
+	file.ScanStatus = models.ScanStatusClean
+	file.ScanSignature = ""
+	if res.Infected {
+		metrics.ScansTotal.WithLabelValues("infected").Inc()
+		file.ScanStatus = models.ScanStatusInfected
+		file.ScanSignature = res.Signature
+	} else {
+		metrics.ScansTotal.WithLabelValues("clean").Inc()
+	}
+
+	// Blocked files found on rescan cannot be rejected any more, so both
+	// block and quarantine move them out of the regular blob space. Chunks
+	// are shared and stay put; the scan status alone blocks chunked files.
+	suffix := content.Suffix(file.Codec)
+	quarantined := strings.HasPrefix(file.StoragePath, path.Join("uploads", "quarantine")+"/")
+	switch {
+	case file.Chunked:
+	case Blocked(file) && !quarantined:
+		if err := relocate(ctx, db, file, QuarantineKey(file.Hash)+suffix); err != nil {
+			return err
+		}
+	case !res.Infected && quarantined:
+		if err := relocate(ctx, db, file, storage.BlobKey(file.Hash)+suffix); err != nil {
+			return err
+		}
+	}
+
+	return db.Model(file).Updates(map[string]interface{}{
+		"scan_status":    file.ScanStatus,
+		"scan_signature": file.ScanSignature,
+		"scanned_at":     file.ScannedAt,
+	}).Error
+}
+
+// relocate copies a blob to key within its tier and points the File at it.
+// It holds the hash lock so that a concurrent release or tier move of the
+// File cannot delete either copy halfway through. The old copy is left for
+// the garbage collector, which deletes it under the same lock.
+func relocate(ctx context.Context, db *gorm.DB, file *models.File, key string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, file.Hash); err != nil {
+			return err
+		}
+		var current models.File
+		if err := tx.First(&current, file.ID).Error; err != nil {
+			return err
+		}
+		store, err := content.StoreFor(current.Tier)
+		if err != nil {
+			return err
+		}
+
+		if err := content.Copy(config.WithTx(ctx, tx), &current, store, key); err != nil {
+			return fmt.Errorf("moving blob to %s: %w", key, err)
+		}
+		if err := tx.Model(file).Update("storage_path", key).Error; err != nil {
+			store.Delete(ctx, key)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	file.StoragePath = key
+	return nil
+}
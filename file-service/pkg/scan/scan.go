@@ -0,0 +1,133 @@
+// Package scan checks blobs for malware before they are stored and applies
+// the configured policy to infected ones.
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/problem"
+	"volt/db/config"
+	"volt/db/models"
+)
+
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner inspects the content read from r.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// Policy decides what happens to an infected upload:
+//   - block rejects it, so the blob is never stored;
+//   - quarantine stores it under quarantine/ and refuses downloads;
+//   - flag stores it normally and only marks the File.
+type Policy string
+
+const (
+	PolicyBlock      Policy = "block"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyFlag       Policy = "flag"
+)
+
+var (
+	// Default is nil when no scanner is configured; uploads are then stored
+	// as unscanned.
+	Default Scanner
+
+	CurrentPolicy = PolicyBlock
+
+	// FailOpen stores uploads whose scan failed (scanner down or erroring)
+	// instead of rejecting them.
+	FailOpen bool
+)
+
+// Configure sets up scanning from the environment and returns the clamd
+// client, if any, so main can register a health check for it.
+func Configure() (*Clamd, error) {
+	switch p := Policy(config.GetEnv("SCAN_POLICY", string(PolicyBlock))); p {
+	case PolicyBlock, PolicyQuarantine, PolicyFlag:
+		CurrentPolicy = p
+	default:
+		return nil, fmt.Errorf("invalid SCAN_POLICY %q: must be block, quarantine or flag", p)
+	}
+	FailOpen = config.GetEnv("SCAN_FAIL_OPEN", "false") == "true"
+
+	addr := config.GetEnv("CLAMD_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+	clamd := NewClamd(addr, config.GetEnvDuration("CLAMD_TIMEOUT", 60*time.Second))
+	Default = clamd
+	return clamd, nil
+}
+
+// QuarantineKey is where a quarantined blob is kept. It sits next to the
+// regular blobs so that moving one never crosses volumes, sharded the same
+// way.
+func QuarantineKey(hash string) string {
+	return path.Join("uploads", "quarantine", hash[:2], hash[2:4], hash)
+}
+
+// Blocked reports whether references to file must not be served.
+func Blocked(file *models.File) bool {
+	return file.ScanStatus == models.ScanStatusInfected && CurrentPolicy != PolicyFlag
+}
+
+// ErrInfected is the problem returned for uploads and downloads of
+// infected content.
+func ErrInfected(file *models.File) error {
+	return problem.New(http.StatusForbidden, problem.CodeMalwareDetected,
+		fmt.Sprintf("File is infected (%s) and cannot be used", file.ScanSignature))
+}
+
+// Check scans a new upload and fills in the File's scan fields. It returns
+// a problem when the upload must be rejected: the content is infected under
+// the block policy, or the scanner failed and FailOpen is off.
+func Check(ctx context.Context, r io.Reader, file *models.File) error {
+	now := time.Now()
+	if Default == nil {
+		file.ScanStatus = models.ScanStatusUnscanned
+		return nil
+	}
+
+	result, err := Default.Scan(ctx, r)
+	file.ScannedAt = &now
+	if err != nil {
+		metrics.ScansTotal.WithLabelValues("error").Inc()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("scan: scanning %s failed: %v", file.Hash, err)
+		file.ScanStatus = models.ScanStatusError
+		if FailOpen {
+			return nil
+		}
+		return problem.New(http.StatusServiceUnavailable, problem.CodeUnavailable, "Malware scanner unavailable, try again later")
+	}
+
+	if !result.Infected {
+		metrics.ScansTotal.WithLabelValues("clean").Inc()
+		file.ScanStatus = models.ScanStatusClean
+		return nil
+	}
+
+	metrics.ScansTotal.WithLabelValues("infected").Inc()
+	log.Printf("scan: %s (%s) is infected: %s", file.Hash, file.OriginalName, result.Signature)
+	file.ScanStatus = models.ScanStatusInfected
+	file.ScanSignature = result.Signature
+	if CurrentPolicy == PolicyBlock {
+		return problem.New(http.StatusUnprocessableEntity, problem.CodeMalwareDetected,
+			fmt.Sprintf("%s is infected (%s) and was rejected", file.OriginalName, result.Signature))
+	}
+	return nil
+}
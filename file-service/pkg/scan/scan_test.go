@@ -0,0 +1,95 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"volt/common/problem"
+	"volt/db/models"
+)
+
+type stubScanner struct {
+	result Result
+	err    error
+}
+
+func (s stubScanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	io.Copy(io.Discard, r)
+	return s.result, s.err
+}
+
+func setScanner(t *testing.T, s Scanner, policy Policy, failOpen bool) {
+	t.Helper()
+	prevScanner, prevPolicy, prevFailOpen := Default, CurrentPolicy, FailOpen
+	Default, CurrentPolicy, FailOpen = s, policy, failOpen
+	t.Cleanup(func() { Default, CurrentPolicy, FailOpen = prevScanner, prevPolicy, prevFailOpen })
+}
+
+func TestCheck(t *testing.T) {
+	infected := stubScanner{result: Result{Infected: true, Signature: "Eicar-Signature"}}
+	down := stubScanner{err: errors.New("connection refused")}
+	tests := []struct {
+		name        string
+		scanner     Scanner
+		policy      Policy
+		failOpen    bool
+		wantStatus  string
+		wantBlocked bool
+		wantCode    string
+		wantHTTP    int
+	}{
+		{name: "clean", scanner: stubScanner{}, policy: PolicyBlock, wantStatus: models.ScanStatusClean},
+		{name: "block", scanner: infected, policy: PolicyBlock, wantStatus: models.ScanStatusInfected, wantBlocked: true,
+			wantCode: problem.CodeMalwareDetected, wantHTTP: http.StatusUnprocessableEntity},
+		{name: "quarantine", scanner: infected, policy: PolicyQuarantine, wantStatus: models.ScanStatusInfected, wantBlocked: true},
+		{name: "flag", scanner: infected, policy: PolicyFlag, wantStatus: models.ScanStatusInfected},
+		{name: "scanner down", scanner: down, policy: PolicyFlag, wantStatus: models.ScanStatusError,
+			wantCode: problem.CodeUnavailable, wantHTTP: http.StatusServiceUnavailable},
+		{name: "scanner down, fail open", scanner: down, policy: PolicyBlock, failOpen: true, wantStatus: models.ScanStatusError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setScanner(t, tt.scanner, tt.policy, tt.failOpen)
+			file := models.File{Hash: strings.Repeat("ab", 32), OriginalName: "eicar.txt"}
+			err := Check(context.Background(), strings.NewReader("content"), &file)
+
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("Check: %v", err)
+				}
+			} else {
+				var p *problem.Problem
+				if !errors.As(err, &p) || p.Code != tt.wantCode || p.Status != tt.wantHTTP {
+					t.Fatalf("Check error = %v, want %d %s", err, tt.wantHTTP, tt.wantCode)
+				}
+			}
+			if file.ScanStatus != tt.wantStatus {
+				t.Errorf("ScanStatus = %q, want %q", file.ScanStatus, tt.wantStatus)
+			}
+			if file.ScannedAt == nil {
+				t.Error("ScannedAt is not set")
+			}
+			if tt.wantStatus == models.ScanStatusInfected && file.ScanSignature != "Eicar-Signature" {
+				t.Errorf("ScanSignature = %q", file.ScanSignature)
+			}
+			if got := Blocked(&file); got != tt.wantBlocked {
+				t.Errorf("Blocked = %v, want %v", got, tt.wantBlocked)
+			}
+		})
+	}
+}
+
+func TestCheckWithoutScanner(t *testing.T) {
+	setScanner(t, nil, PolicyBlock, false)
+	var file models.File
+	if err := Check(context.Background(), strings.NewReader("content"), &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.ScanStatus != models.ScanStatusUnscanned || file.ScannedAt != nil {
+		t.Errorf("unscanned file has status %q, scanned at %v", file.ScanStatus, file.ScannedAt)
+	}
+}
@@ -0,0 +1,159 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"volt/file-service/pkg/filetype"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// MaxTextBytes caps how much extracted text is indexed per file. Postgres
+// rejects tsvectors above 1 MB, and the head of a document is what matters
+// most for search anyway.
+const MaxTextBytes = 512 * 1024
+
+var errUnsupported = errors.New("no extractor for this MIME type")
+
+type extractor struct {
+	name    string
+	matches func(mimeType string) bool
+	extract func(r io.ReaderAt, size int64) (string, error)
+}
+
+var extractors = []extractor{
+	{"pdf", filetype.Is("application/pdf"), extractPDF},
+	{"docx", filetype.Is("application/vnd.openxmlformats-officedocument.wordprocessingml.document"), officeExtractor("word/document.xml", "word/header", "word/footer")},
+	{"xlsx", filetype.Is("application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"), officeExtractor("xl/sharedStrings.xml", "xl/worksheets/")},
+	{"pptx", filetype.Is("application/vnd.openxmlformats-officedocument.presentationml.presentation"), officeExtractor("ppt/slides/")},
+	{"odf", isOpenDocument, officeExtractor("content.xml")},
+	{"text", filetype.IsTextual, extractText},
+}
+
+func isOpenDocument(mimeType string) bool {
+	return strings.HasPrefix(filetype.Base(mimeType), "application/vnd.oasis.opendocument.")
+}
+
+// Extract returns the indexable text of size bytes of content read from r
+// and the name of the extractor that produced it.
+func Extract(r io.ReaderAt, size int64, mimeType string) (string, string, error) {
+	for _, e := range extractors {
+		if e.matches(mimeType) {
+			text, err := e.extract(r, size)
+			return clean(text), e.name, err
+		}
+	}
+	return "", "", errUnsupported
+}
+
+func clean(text string) string {
+	if len(text) > MaxTextBytes {
+		text = text[:MaxTextBytes]
+	}
+	text = strings.ToValidUTF8(text, " ")
+	return strings.ReplaceAll(text, "\x00", " ")
+}
+
+func extractText(r io.ReaderAt, size int64) (string, error) {
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, min(size, MaxTextBytes)))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func extractPDF(ra io.ReaderAt, size int64) (string, error) {
+	var buf strings.Builder
+	err := filetype.ReadPDF(ra, size, func(r *pdf.Reader) error {
+		fonts := make(map[string]*pdf.Font)
+		for i := 1; i <= r.NumPage() && buf.Len() < MaxTextBytes; i++ {
+			page := r.Page(i)
+			if page.V.IsNull() {
+				continue
+			}
+			for _, name := range page.Fonts() {
+				if _, ok := fonts[name]; !ok {
+					font := page.Font(name)
+					fonts[name] = &font
+				}
+			}
+			pageText, err := page.GetPlainText(fonts)
+			if err != nil {
+				continue
+			}
+			buf.WriteString(pageText)
+			buf.WriteByte('\n')
+		}
+		return nil
+	})
+	return buf.String(), err
+}
+
+// officeExtractor pulls the character data out of the XML parts of an Office
+// Open XML or OpenDocument package whose names start with one of prefixes.
+func officeExtractor(prefixes ...string) func(io.ReaderAt, int64) (string, error) {
+	return func(r io.ReaderAt, size int64) (string, error) {
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return "", err
+		}
+
+		var parts []*zip.File
+		for _, f := range zr.File {
+			for _, p := range prefixes {
+				if strings.HasPrefix(f.Name, p) && strings.HasSuffix(f.Name, ".xml") {
+					parts = append(parts, f)
+					break
+				}
+			}
+		}
+		sort.Slice(parts, func(i, j int) bool { return parts[i].Name < parts[j].Name })
+
+		var buf bytes.Buffer
+		for _, part := range parts {
+			if buf.Len() >= MaxTextBytes {
+				break
+			}
+			if err := xmlText(part, &buf); err != nil {
+				return buf.String(), err
+			}
+		}
+		return buf.String(), nil
+	}
+}
+
+func xmlText(f *zip.File, buf *bytes.Buffer) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dec := xml.NewDecoder(io.LimitReader(rc, 16*MaxTextBytes))
+	for buf.Len() < MaxTextBytes {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			buf.Write(t)
+		case xml.EndElement:
+			// Paragraphs, rows and cells end without whitespace between them.
+			switch t.Name.Local {
+			case "p", "tc", "c", "si", "tab", "br":
+				buf.WriteByte(' ')
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/leader"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type job struct {
+	refID  uint
+	userID uint
+}
+
+var queue = make(chan job, 1024)
+
+// catchUpLock is the advisory lock held by the replica that indexes the
+// references whose jobs were dropped.
+const catchUpLock int64 = 0x766f6c74_00007378 // "volt", "sx"
+
+// Enqueue schedules the FileReference refID for (re)indexing. It never
+// blocks an upload: when the queue is full the job is dropped, and the
+// reference is indexed by the next catch-up pass instead.
+func Enqueue(refID uint) {
+	select {
+	case queue <- job{refID: refID}:
+	default:
+		log.Printf("search: queue full, dropping index job for reference %d", refID)
+	}
+}
+
+// EnqueueUser schedules all of a user's files for reindexing.
+func EnqueueUser(userID uint) bool {
+	select {
+	case queue <- job{userID: userID}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run processes index jobs with the given number of workers until ctx is
+// cancelled.
+func Run(ctx context.Context, workers int) {
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-queue:
+					handle(ctx, j)
+				}
+			}
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+}
+
+// RunCatchUp indexes stale references every interval until ctx is
+// cancelled. Only the service replica that gets the leader lock does.
+func RunCatchUp(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := leader.Do(ctx, catchUpLock, func(ctx context.Context) error {
+			n, err := CatchUp(ctx)
+			if n > 0 {
+				log.Printf("search: caught up on %d references", n)
+			}
+			return err
+		})
+		if err != nil && !errors.Is(err, leader.ErrNotLeader) && ctx.Err() == nil {
+			log.Printf("search: catch-up failed: %v", err)
+		}
+	}
+}
+
+// CatchUp indexes every reference whose search entry is missing or older
+// than its last change, such as those whose index job was dropped, and
+// returns how many it indexed.
+func CatchUp(ctx context.Context) (int, error) {
+	db := config.DB.WithContext(ctx)
+	indexed := 0
+	var after uint
+	for {
+		var ids []uint
+		err := db.Raw(`
+			SELECT fr.id FROM file_references fr
+			LEFT JOIN file_search_entries e ON e.file_reference_id = fr.id
+			WHERE fr.deleted_at IS NULL AND fr.id > ?
+				AND (e.file_reference_id IS NULL OR e.indexed_at < fr.updated_at)
+			ORDER BY fr.id
+			LIMIT 500`, after).Scan(&ids).Error
+		if err != nil || len(ids) == 0 {
+			return indexed, err
+		}
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return indexed, err
+			}
+			if err := IndexReference(ctx, id); err != nil {
+				log.Printf("search: indexing reference %d failed: %v", id, err)
+				continue
+			}
+			indexed++
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+func handle(ctx context.Context, j job) {
+	if j.userID != 0 {
+		if err := ReindexUser(ctx, j.userID); err != nil {
+			log.Printf("search: reindex of user %d failed: %v", j.userID, err)
+		}
+		return
+	}
+	if err := IndexReference(ctx, j.refID); err != nil && !errors.Is(err, context.Canceled) {
+		log.Printf("search: indexing reference %d failed: %v", j.refID, err)
+	}
+}
+
+// ReindexUser rebuilds the entries of every file owned by userID and removes
+// entries whose reference no longer exists.
+func ReindexUser(ctx context.Context, userID uint) error {
+	db := config.DB.WithContext(ctx)
+
+	err := db.Where("user_id = ? AND file_reference_id NOT IN (?)", userID,
+		db.Model(&models.FileReference{}).Select("id").Where("user_id = ?", userID),
+	).Delete(&models.FileSearchEntry{}).Error
+	if err != nil {
+		return err
+	}
+
+	var ids []uint
+	if err := db.Model(&models.FileReference{}).Where("user_id = ?", userID).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := IndexReference(ctx, id); err != nil {
+			log.Printf("search: indexing reference %d failed: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// IndexReference extracts the content of the reference's blob, unless it was
+// already extracted for another reference to the same File, and upserts the
+// reference's search entry.
+func IndexReference(ctx context.Context, refID uint) error {
+	db := config.DB.WithContext(ctx)
+
+	var ref models.FileReference
+	if err := db.Preload("File").First(&ref, refID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Remove(ctx, refID)
+		}
+		return err
+	}
+
+	if err := ensureText(ctx, db, &ref.File); err != nil {
+		return err
+	}
+
+	return db.Exec(`
+		INSERT INTO file_search_entries (file_reference_id, user_id, document, indexed_at)
+		SELECT fr.id, fr.user_id,
+			setweight(to_tsvector('simple', regexp_replace(fr.display_name, '[._/-]+', ' ', 'g')), 'A') ||
+			setweight(to_tsvector('simple', replace(coalesce(fr.tags, ''), ',', ' ')), 'A') ||
+			setweight(to_tsvector('simple', replace(f.mime_type, '/', ' ')), 'B') ||
+			setweight(to_tsvector('simple', coalesce(ft.content, '')), 'C'),
+			?
+		FROM file_references fr
+		JOIN files f ON f.id = fr.file_id
+		LEFT JOIN file_texts ft ON ft.file_id = f.id
+		WHERE fr.id = ?
+		ON CONFLICT (file_reference_id) DO UPDATE
+		SET document = EXCLUDED.document, user_id = EXCLUDED.user_id, indexed_at = EXCLUDED.indexed_at`,
+		time.Now(), ref.ID,
+	).Error
+}
+
+func ensureText(ctx context.Context, db *gorm.DB, file *models.File) error {
+	var count int64
+	if err := db.Model(&models.FileText{}).Where("file_id = ?", file.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	text := models.FileText{FileID: file.ID, ExtractedAt: time.Now()}
+	obj, err := content.Open(ctx, file)
+	if err != nil {
+		return err
+	}
+	text.Content, text.Extractor, err = Extract(obj, obj.Size(), file.MimeType)
+	obj.Close()
+	switch {
+	case errors.Is(err, errUnsupported):
+		// Nothing to extract; the name, tags and type are still indexed.
+	case err != nil:
+		text.Error = truncate(err.Error(), 500)
+		log.Printf("search: extracting %s (%s) failed: %v", file.Hash, file.MimeType, err)
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&text).Error
+}
+
+// Remove deletes the search entry of a reference.
+func Remove(ctx context.Context, refID uint) error {
+	return config.DB.WithContext(ctx).Delete(&models.FileSearchEntry{}, refID).Error
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,156 @@
+package search
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode"
+
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+type Query struct {
+	UserID        uint
+	Text          string
+	MimePrefix    string
+	IsPrivate     *bool
+	IncludePublic bool
+	Limit         int
+	Offset        int
+}
+
+// ToTSQuery turns user input into a to_tsquery expression: bare words are
+// ANDed, "quoted phrases" must appear in order and a trailing * makes a word
+// a prefix match. A quote that is never closed runs to the end of the input.
+// Everything except letters, digits and combining marks is treated as a word
+// separator, so the result is always syntactically valid.
+func ToTSQuery(input string) string {
+	var terms []string
+	rest := input
+	for rest != "" {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" {
+			break
+		}
+
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			phrase := rest[1:]
+			rest = ""
+			if end >= 0 {
+				phrase, rest = phrase[:end], phrase[end+1:]
+			}
+			if words := lexemes(phrase); len(words) > 0 {
+				terms = append(terms, "("+strings.Join(words, " <-> ")+")")
+			}
+			continue
+		}
+
+		end := strings.IndexFunc(rest, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+		word := rest
+		rest = ""
+		if end >= 0 {
+			word, rest = word[:end], word[end:]
+		}
+		prefix := strings.HasSuffix(word, "*")
+		words := lexemes(word)
+		if len(words) == 0 {
+			continue
+		}
+		if prefix {
+			words[len(words)-1] += ":*"
+		}
+		terms = append(terms, strings.Join(words, " <-> "))
+	}
+	return strings.Join(terms, " & ")
+}
+
+// lexemes splits s into lowercase words. Combining marks belong to the word
+// they follow, so decomposed accents do not split it; marks on their own are
+// dropped.
+func lexemes(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+	return slices.DeleteFunc(words, func(w string) bool {
+		return !strings.ContainsFunc(w, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) })
+	})
+}
+
+// Search returns the references matching q that the user may see: their own
+// files and, if requested, files other users have made public.
+func Search(ctx context.Context, q Query) (*models.SearchResponse, error) {
+	resp := &models.SearchResponse{Query: q.Text, Results: []models.SearchResult{}, Limit: q.Limit, Offset: q.Offset}
+
+	tsquery := ToTSQuery(q.Text)
+	if tsquery == "" {
+		return resp, nil
+	}
+
+	db := config.DB.WithContext(ctx)
+	base := db.Table("file_search_entries AS e").
+		Joins("JOIN file_references ON file_references.id = e.file_reference_id AND file_references.deleted_at IS NULL").
+		Joins("JOIN files ON files.id = file_references.file_id AND files.deleted_at IS NULL").
+		Where("e.document @@ to_tsquery('simple', ?)", tsquery)
+
+	if q.IncludePublic {
+		base = base.Where("(file_references.user_id = ? OR file_references.is_private = false)", q.UserID)
+	} else {
+		base = base.Where("file_references.user_id = ?", q.UserID)
+	}
+	if q.MimePrefix != "" {
+		base = base.Where("files.mime_type LIKE ?", strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.MimePrefix)+"%")
+	}
+	if q.IsPrivate != nil {
+		base = base.Where("file_references.is_private = ?", *q.IsPrivate)
+	}
+
+	if err := base.Session(&gorm.Session{}).Count(&resp.Total).Error; err != nil {
+		return nil, err
+	}
+
+	var ids []struct {
+		ID   uint
+		Rank float64
+	}
+	err := base.Select("file_references.id AS id, ts_rank_cd(e.document, to_tsquery('simple', ?)) AS rank", tsquery).
+		Order("rank DESC, file_references.id DESC").
+		Limit(q.Limit).
+		Offset(q.Offset).
+		Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return resp, nil
+	}
+
+	refIDs := make([]uint, len(ids))
+	for i, row := range ids {
+		refIDs[i] = row.ID
+	}
+	var refs []models.FileReference
+	if err := db.Preload("File").Where("id IN ?", refIDs).Find(&refs).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*models.FileReference, len(refs))
+	for i := range refs {
+		byID[refs[i].ID] = &refs[i]
+	}
+
+	for _, row := range ids {
+		ref, ok := byID[row.ID]
+		if !ok {
+			continue
+		}
+		resp.Results = append(resp.Results, models.SearchResult{
+			FileResponse: utils.ToFileResponse(ref),
+			Rank:         row.Rank,
+		})
+	}
+	return resp, nil
+}
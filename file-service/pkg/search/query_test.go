@@ -0,0 +1,59 @@
+package search
+
+import (
+	"testing"
+
+	"volt/db/dbtest"
+)
+
+var toTSQueryTests = []struct {
+	name  string
+	input string
+	want  string
+}{
+	{name: "empty", input: "", want: ""},
+	{name: "blank", input: " \t\n ", want: ""},
+	{name: "words", input: "Quarterly  Report", want: "quarterly & report"},
+	{name: "prefix", input: "rep*", want: "rep:*"},
+	{name: "lone star", input: "* report", want: "report"},
+	{name: "phrase", input: `"annual report" 2024`, want: "(annual <-> report) & 2024"},
+	{name: "one word phrase", input: `"report"`, want: "(report)"},
+	{name: "empty phrase", input: `"" report ""`, want: "report"},
+	{name: "unclosed phrase", input: `draft "annual report`, want: "draft & (annual <-> report)"},
+	{name: "lone quote", input: `report "`, want: "report"},
+	{name: "phrase inside a word", input: `final"annual report"`, want: "final & (annual <-> report)"},
+	{name: "prefix before a phrase", input: `rep*"annual report"`, want: "rep:* & (annual <-> report)"},
+	{name: "star in a phrase", input: `"annual rep*"`, want: "(annual <-> rep)"},
+	{name: "separators join parts", input: "report-2024_final.pdf", want: "report <-> 2024 <-> final <-> pdf"},
+	{name: "prefix on the last part", input: "report-20*", want: "report <-> 20:*"},
+	{name: "operators", input: `a & b | !c <-> (d) <2> e:* f:AB \g 'h'`, want: "a & b & c & d & 2 & e:* & f <-> ab & g & h"},
+	{name: "only operators", input: `& | ! ( ) <-> : * ' \ "&"`, want: ""},
+	{name: "stop words are kept by the simple configuration", input: "the and of", want: "the & and & of"},
+	{name: "unicode", input: "Überweisung 東京 ΑΘΗΝΑ", want: "überweisung & 東京 & αθηνα"},
+	{name: "decomposed accent", input: "cafe\u0301 menu", want: "cafe\u0301 & menu"},
+	{name: "lone combining mark", input: "\u0301 menu", want: "menu"},
+}
+
+func TestToTSQuery(t *testing.T) {
+	for _, tt := range toTSQueryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ToTSQuery(tt.input); got != tt.want {
+				t.Errorf("ToTSQuery(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToTSQueryIsValid(t *testing.T) {
+	db := dbtest.Open(t)
+	for _, tt := range toTSQueryTests {
+		tsquery := ToTSQuery(tt.input)
+		if tsquery == "" {
+			continue
+		}
+		var parsed string
+		if err := db.Raw("SELECT to_tsquery('simple', ?)::text", tsquery).Scan(&parsed).Error; err != nil {
+			t.Errorf("%s: to_tsquery(%q): %v", tt.name, tsquery, err)
+		}
+	}
+}
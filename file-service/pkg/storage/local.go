@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores blobs as files below Root.
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{Root: root}
+}
+
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(l.Root, filepath.FromSlash(clean[1:])), nil
+}
+
+// Put streams r into a temporary sibling of the destination, flushes it to
+// disk and renames it into place only once the copy has completed, so a
+// crash leaves either the old blob or the complete new one. The directory
+// is synced too, making the rename itself durable.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) (written int64, err error) {
+	dest, err := l.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".partial-*")
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	written, err = io.Copy(tmp, &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		return written, fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return written, err
+	}
+	if err = tmp.Close(); err != nil {
+		return written, err
+	}
+	if err = os.Rename(tmpPath, dest); err != nil {
+		return written, err
+	}
+	return written, syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type localObject struct {
+	*os.File
+	size int64
+}
+
+func (o *localObject) Size() int64 {
+	return o.size
+}
+
+func (l *Local) Open(ctx context.Context, key string) (Object, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &localObject{File: f, size: st.Size()}, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, err
+	}
+	return Info{Key: key, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) Walk(ctx context.Context, prefix string, fn func(Info) error) error {
+	start := l.Root
+	if dir := path.Dir(prefix); prefix != "" && dir != "." {
+		start = filepath.Join(l.Root, filepath.FromSlash(dir))
+	}
+
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return fn(Info{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	return err
+}
@@ -0,0 +1,60 @@
+// Package storage is the blob store behind uploads, downloads and derived
+// artifacts such as previews. Keys are slash-separated relative paths; for the
+// local backend a blob key is the same as File.StoragePath.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Object is an open blob. Seeking makes range requests possible, ReadAt
+// random access such as reading a ZIP directory.
+type Object interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Size() int64
+}
+
+type Store interface {
+	// Put stores r under key. The blob only becomes visible once fully
+	// written; a failed or cancelled Put leaves nothing behind.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Open(ctx context.Context, key string) (Object, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	Delete(ctx context.Context, key string) error
+	// Walk calls fn for every blob whose key starts with prefix.
+	Walk(ctx context.Context, prefix string, fn func(Info) error) error
+}
+
+// Blobs is the store used by the service; main replaces it at startup when
+// a different backend is configured.
+var Blobs Store = NewLocal(".")
+
+// Cold is the store of the cold tier, for blobs that are rarely read. It is
+// nil unless a cold tier is configured.
+var Cold Store
+
+// contextReader stops a copy as soon as ctx is done, e.g. when the client
+// disconnects or the server starts shutting down.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+)
+
+// ErrHashMismatch is returned by a Put whose content did not have the hash
+// it was stored under.
+var ErrHashMismatch = errors.New("content does not match its hash")
+
+// BlobKey is where the blob of the content with the given SHA-256 hash is
+// stored. Keys depend only on the hash and spread blobs over two levels of
+// 256 directories each, so no directory grows too large.
+func BlobKey(hash string) string {
+	return path.Join("uploads", hash[:2], hash[2:4], hash)
+}
+
+// Verified returns a reader that reads r and, at its end, fails with
+// ErrHashMismatch unless what was read hashes to want. Given to Put, it
+// keeps content that changed or was cut short from ever becoming visible.
+func Verified(r io.Reader, want string) io.Reader {
+	return &verifyingReader{r: r, h: sha256.New(), want: want}
+}
+
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := fmt.Sprintf("%x", v.h.Sum(nil)); got != v.want {
+			return n, fmt.Errorf("%w: got %s, want %s", ErrHashMismatch, got, v.want)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,153 @@
+package tiering
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"volt/db/models"
+	"volt/file-service/pkg/policy"
+)
+
+// Rule moves whole Files that match all of its conditions to Tier. Rules
+// are tried in order and the first match decides, so a rule without
+// conditions placed first pins everything, and one placed last is the
+// default. Files no rule matches stay where they are.
+type Rule struct {
+	Name string `json:"name"`
+	Tier string `json:"tier"`
+	// NotAccessedFor matches Files last downloaded at least this long ago,
+	// or created that long ago if they were never downloaded.
+	NotAccessedFor Duration `json:"not_accessed_for,omitempty"`
+	// MinSize matches Files of at least this size.
+	MinSize policy.ByteSize `json:"min_size,omitempty"`
+	// MimeTypes match the sniffed type, e.g. "video/*". Empty matches all.
+	MimeTypes []string `json:"mime_types,omitempty"`
+}
+
+// Rules is the content of LIFECYCLE_RULES_FILE.
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+var current atomic.Pointer[Rules]
+
+func init() {
+	current.Store(&Rules{})
+}
+
+// CurrentRules returns the lifecycle rules in effect.
+func CurrentRules() *Rules {
+	return current.Load()
+}
+
+// LoadRules reads lifecycle rules from a JSON file. An empty name means no
+// rules: Files are never moved to the cold tier.
+func LoadRules(file string) (*Rules, error) {
+	if file == "" {
+		return &Rules{}, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	for i, r := range rules.Rules {
+		if r.Tier != models.TierHot && r.Tier != models.TierCold {
+			return nil, fmt.Errorf("%s: rule %d has unknown tier %q", file, i+1, r.Tier)
+		}
+	}
+	return &rules, nil
+}
+
+// TierFor returns the tier the first matching rule puts file in, given
+// that it was last accessed at lastAccess, or "" when no rule matches.
+func (rs *Rules) TierFor(file *models.File, lastAccess, now time.Time) string {
+	for _, r := range rs.Rules {
+		if r.matches(file, lastAccess, now) {
+			return r.Tier
+		}
+	}
+	return ""
+}
+
+// needsCold reports whether any rule can move Files to the cold tier.
+func (rs *Rules) needsCold() bool {
+	for _, r := range rs.Rules {
+		if r.Tier == models.TierCold {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matches(file *models.File, lastAccess, now time.Time) bool {
+	if r.NotAccessedFor > 0 && now.Sub(lastAccess) < time.Duration(r.NotAccessedFor) {
+		return false
+	}
+	if file.Size < int64(r.MinSize) {
+		return false
+	}
+	if len(r.MimeTypes) == 0 {
+		return true
+	}
+	mimeType := strings.TrimSpace(strings.Split(file.MimeType, ";")[0])
+	for _, pattern := range r.MimeTypes {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if strings.EqualFold(pattern, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastAccess is when file was last downloaded, or created if never.
+func lastAccess(file *models.File) time.Time {
+	if file.LastAccessedAt != nil {
+		return *file.LastAccessedAt
+	}
+	return file.CreatedAt
+}
+
+// Duration is a duration written like time.ParseDuration accepts, or as a
+// whole number of days such as "90d".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"90d\" or \"36h\"")
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	v := time.Duration(d)
+	if v%(24*time.Hour) == 0 {
+		return json.Marshal(fmt.Sprintf("%dd", v/(24*time.Hour)))
+	}
+	return json.Marshal(v.String())
+}
@@ -0,0 +1,55 @@
+package tiering
+
+import (
+	"context"
+
+	"volt/db/config"
+	"volt/file-service/pkg/content"
+)
+
+// TierUsage describes the live Files stored in one tier. PhysicalBytes is
+// what their blobs take as stored, after compression.
+type TierUsage struct {
+	Tier          string `json:"tier"`
+	Files         int64  `json:"files"`
+	LogicalBytes  int64  `json:"logical_bytes"`
+	PhysicalBytes int64  `json:"physical_bytes"`
+}
+
+type Stats struct {
+	Tiers           []TierUsage `json:"tiers"`
+	PendingRestores int64       `json:"pending_restores"`
+	RestoreMode     string      `json:"restore_mode"`
+	Rules           []Rule      `json:"rules"`
+}
+
+// GetStats reports the usage of every configured tier, including tiers
+// that hold no Files yet.
+func GetStats(ctx context.Context) (*Stats, error) {
+	db := config.DB.WithContext(ctx)
+	var usage []TierUsage
+	err := db.Table("files").
+		Select("tier, COUNT(*) AS files, COALESCE(SUM(size), 0) AS logical_bytes, COALESCE(SUM(CASE WHEN stored_size > 0 THEN stored_size ELSE size END), 0) AS physical_bytes").
+		Where("deleted_at IS NULL").Group("tier").Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{RestoreMode: RestoreMode, Rules: CurrentRules().Rules}
+	for _, tier := range content.Tiers() {
+		u := TierUsage{Tier: tier}
+		for _, row := range usage {
+			if row.Tier == tier {
+				u = row
+			}
+		}
+		stats.Tiers = append(stats.Tiers, u)
+	}
+	if stats.Rules == nil {
+		stats.Rules = []Rule{}
+	}
+
+	err = db.Table("files").Where("deleted_at IS NULL AND restore_requested_at IS NOT NULL").
+		Count(&stats.PendingRestores).Error
+	return stats, err
+}
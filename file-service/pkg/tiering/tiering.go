@@ -0,0 +1,233 @@
+// Package tiering moves the blobs of whole Files between the hot tier, the
+// service's main blob store, and a cheaper cold tier. Lifecycle rules decide
+// where each File belongs based on when it was last downloaded, its size and
+// its type; a background worker applies them, and downloading a cold File
+// restores it to the hot tier. Chunked Files share their chunks and always
+// stay hot.
+package tiering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"volt/common/metrics"
+	"volt/common/problem"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+var tracer = tracing.Tracer("volt/file-service/tiering")
+
+// Restore modes decide what a download of a cold File does. Transparent
+// serves it from the cold tier while it is restored in the background;
+// deferred refuses it with ErrRestoring until the restore has finished, for
+// cold tiers too slow to serve from.
+const (
+	RestoreTransparent = "transparent"
+	RestoreDeferred    = "deferred"
+)
+
+var (
+	RestoreMode = RestoreTransparent
+	// RetryAfter is the retry hint sent with ErrRestoring.
+	RetryAfter = 30 * time.Second
+)
+
+// accessResolution is how stale a File's recorded access time may get
+// before a download updates it, so popular Files do not cost a write on
+// every download.
+const accessResolution = time.Hour
+
+// ErrRestoring is returned by Open for a cold File in deferred mode.
+var ErrRestoring = problem.New(http.StatusServiceUnavailable, problem.CodeRestoring,
+	"File is being restored from cold storage; retry later")
+
+// Configure sets up the cold tier from COLD_STORAGE_ROOT and loads the
+// lifecycle rules. It must run before encryption.Configure so the cold
+// tier is encrypted too.
+func Configure() error {
+	if root := config.GetEnv("COLD_STORAGE_ROOT", ""); root != "" {
+		storage.Cold = storage.NewLocal(root)
+	}
+
+	RestoreMode = config.GetEnv("TIER_RESTORE_MODE", RestoreTransparent)
+	if RestoreMode != RestoreTransparent && RestoreMode != RestoreDeferred {
+		return fmt.Errorf("invalid TIER_RESTORE_MODE %q: must be transparent or deferred", RestoreMode)
+	}
+	RetryAfter = config.GetEnvDuration("TIER_RESTORE_RETRY_AFTER", RetryAfter)
+
+	rules, err := LoadRules(config.GetEnv("LIFECYCLE_RULES_FILE", ""))
+	if err != nil {
+		return fmt.Errorf("loading lifecycle rules: %w", err)
+	}
+	if rules.needsCold() && storage.Cold == nil {
+		return errors.New("lifecycle rules move files to the cold tier, but COLD_STORAGE_ROOT is not set")
+	}
+	current.Store(rules)
+	return nil
+}
+
+// RetryAfterHeader is the Retry-After value to send with ErrRestoring.
+func RetryAfterHeader() string {
+	return strconv.Itoa(int(max(RetryAfter.Round(time.Second), time.Second) / time.Second))
+}
+
+// Open returns the content of file for a user's download and records the
+// access. Downloading a cold File requests its restore, unless the rules
+// would put it straight back; in deferred mode such a File is not served
+// and ErrRestoring is returned instead.
+func Open(ctx context.Context, file *models.File) (storage.Object, error) {
+	if err := Touch(ctx, file); err != nil {
+		tracing.Logf(ctx, "tiering: recording access to file %d: %v", file.ID, err)
+	}
+	if file.Tier == models.TierCold && file.RestoreRequestedAt != nil && RestoreMode == RestoreDeferred {
+		return nil, ErrRestoring
+	}
+
+	obj, err := content.Open(ctx, file)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return obj, err
+	}
+	// The File may have moved to another tier since it was looked up.
+	var current models.File
+	if config.DB.WithContext(ctx).First(&current, file.ID).Error != nil || current.Tier == file.Tier {
+		return nil, err
+	}
+	file.Tier, file.StoragePath, file.Codec = current.Tier, current.StoragePath, current.Codec
+	return content.Open(ctx, file)
+}
+
+// Touch records that a user read file, and requests the restore of a cold
+// File the rules no longer keep cold. It updates file to match.
+func Touch(ctx context.Context, file *models.File) error {
+	now := time.Now()
+	updates := make(map[string]interface{})
+	if file.LastAccessedAt == nil || now.Sub(*file.LastAccessedAt) >= accessResolution {
+		updates["last_accessed_at"] = now
+	}
+	restore := file.Tier == models.TierCold && file.RestoreRequestedAt == nil && !file.Chunked &&
+		CurrentRules().TierFor(file, now, now) != models.TierCold
+	if restore {
+		updates["restore_requested_at"] = now
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	err := config.DB.WithContext(ctx).Model(&models.File{}).Where("id = ?", file.ID).UpdateColumns(updates).Error
+	if err != nil {
+		return err
+	}
+	if _, ok := updates["last_accessed_at"]; ok {
+		file.LastAccessedAt = &now
+	}
+	if restore {
+		file.RestoreRequestedAt = &now
+		wakeRestorer()
+	}
+	return nil
+}
+
+// errChanged is returned by Move for a File that was changed or deleted
+// since it was read.
+var errChanged = errors.New("file changed while moving it")
+
+// Move moves the blob of a whole File to tier under the File's hash lock,
+// checking the copy against the File's hash before the File points at it,
+// and clears a pending restore. The copy in the old tier is deleted once
+// the move has committed. It reports whether the blob moved.
+func Move(ctx context.Context, file *models.File, tier, reason string) (moved bool, err error) {
+	ctx, span := tracer.Start(ctx, "tiering.Move")
+	span.SetAttributes(
+		attribute.Int("file.id", int(file.ID)),
+		attribute.String("tier.from", file.Tier),
+		attribute.String("tier.to", tier),
+	)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	to, err := content.StoreFor(tier)
+	if err != nil {
+		return false, err
+	}
+	db := config.DB.WithContext(ctx)
+	var current models.File
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, file.Hash); err != nil {
+			return err
+		}
+		if err := tx.First(&current, file.ID).Error; err != nil {
+			return err
+		}
+		if current.Chunked || current.StoragePath != file.StoragePath {
+			return errChanged
+		}
+		if current.Tier == tier {
+			return tx.Model(&current).UpdateColumn("restore_requested_at", nil).Error
+		}
+
+		if err := content.Copy(config.WithTx(ctx, tx), &current, to, current.StoragePath); err != nil {
+			return err
+		}
+		err := tx.Model(&current).UpdateColumns(map[string]interface{}{
+			"tier":                 tier,
+			"restore_requested_at": nil,
+		}).Error
+		if err != nil {
+			to.Delete(context.WithoutCancel(ctx), current.StoragePath)
+			return err
+		}
+		moved = true
+		return nil
+	})
+	if err != nil || !moved {
+		return false, err
+	}
+
+	stored := current.StoredSize
+	if stored == 0 {
+		stored = current.Size
+	}
+	metrics.TierMovesTotal.WithLabelValues(tier, reason).Inc()
+	metrics.TierMovedBytesTotal.WithLabelValues(tier).Add(float64(stored))
+	return true, removeSource(ctx, &current, tier)
+}
+
+// removeSource deletes the copy a move left in the old tier. It checks
+// under the hash lock that the File is still in the new tier: a move back
+// that ran since would have written the copy anew. Copies it leaves behind
+// are garbage collected.
+func removeSource(ctx context.Context, file *models.File, tier string) error {
+	from, err := content.StoreFor(file.Tier)
+	if err != nil {
+		return err
+	}
+	return config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, file.Hash); err != nil {
+			return err
+		}
+		var current models.File
+		if err := tx.First(&current, file.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		if current.Tier != tier || current.StoragePath != file.StoragePath {
+			return nil
+		}
+		return from.Delete(config.WithTx(ctx, tx), file.StoragePath)
+	})
+}
@@ -0,0 +1,402 @@
+package tiering
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"volt/db/dbtest"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/storage"
+
+	"gorm.io/gorm"
+)
+
+const day = 24 * time.Hour
+
+func TestTierFor(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	rules := &Rules{Rules: []Rule{
+		{Name: "pin docs", Tier: models.TierHot, MimeTypes: []string{"application/pdf"}},
+		{Name: "old videos", Tier: models.TierCold, NotAccessedFor: Duration(30 * day), MimeTypes: []string{"video/*"}},
+		{Name: "big and stale", Tier: models.TierCold, NotAccessedFor: Duration(90 * day), MinSize: 1 << 20},
+	}}
+	tests := []struct {
+		name     string
+		mimeType string
+		size     int64
+		idle     time.Duration
+		want     string
+	}{
+		{name: "first match wins", mimeType: "application/pdf", size: 1 << 30, idle: 365 * day, want: models.TierHot},
+		{name: "pattern", mimeType: "video/mp4", idle: 30 * day, want: models.TierCold},
+		{name: "pattern with parameters", mimeType: "video/webm; codecs=vp9", idle: 31 * day, want: models.TierCold},
+		{name: "accessed too recently", mimeType: "video/mp4", idle: 30*day - time.Second},
+		{name: "pattern is a whole type", mimeType: "videos/mp4", size: 1 << 20, idle: 60 * day},
+		{name: "size and age", mimeType: "application/zip", size: 1 << 20, idle: 90 * day, want: models.TierCold},
+		{name: "too small", mimeType: "application/zip", size: 1<<20 - 1, idle: 90 * day},
+		{name: "too recent", mimeType: "application/zip", size: 1 << 30, idle: 89 * day},
+	}
+	for _, tt := range tests {
+		file := &models.File{MimeType: tt.mimeType, Size: tt.size}
+		if got := rules.TierFor(file, now.Add(-tt.idle), now); got != tt.want {
+			t.Errorf("%s: tier = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if got := (&Rules{Rules: []Rule{{Tier: models.TierCold, MimeTypes: []string{"IMAGE/PNG"}}}}).TierFor(&models.File{MimeType: "image/png"}, now, now); got != models.TierCold {
+		t.Errorf("exact types match regardless of case, got %q", got)
+	}
+}
+
+func TestLastAccess(t *testing.T) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	accessed := created.Add(10 * day)
+	if got := lastAccess(&models.File{CreatedAt: created}); !got.Equal(created) {
+		t.Errorf("never downloaded: last access = %v, want the creation time", got)
+	}
+	if got := lastAccess(&models.File{CreatedAt: created, LastAccessedAt: &accessed}); !got.Equal(accessed) {
+		t.Errorf("last access = %v, want %v", got, accessed)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	write := func(content string) string {
+		name := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	rules, err := LoadRules(write(`{"rules": [
+		{"name": "stale", "tier": "cold", "not_accessed_for": "90d", "min_size": "10MB"},
+		{"name": "recent", "tier": "hot", "not_accessed_for": "36h"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Rules) != 2 || time.Duration(rules.Rules[0].NotAccessedFor) != 90*day ||
+		time.Duration(rules.Rules[1].NotAccessedFor) != 36*time.Hour || rules.Rules[0].MinSize != 10_000_000 {
+		t.Errorf("rules = %+v", rules.Rules)
+	}
+	if !rules.needsCold() {
+		t.Error("a rule moves files to the cold tier, but needsCold is false")
+	}
+
+	if rules, err := LoadRules(""); err != nil || len(rules.Rules) != 0 {
+		t.Errorf("no file: %v, %v, want no rules", rules, err)
+	}
+	for _, bad := range []string{
+		`{"rules": [{"tier": "glacier"}]}`,
+		`{"rules": [{"tier": "cold", "not_accessed_for": "-3d"}]}`,
+		`{"rules": [{"tier": "cold", "not_accessed_for": "soon"}]}`,
+		`{"rules": [{"tier": "cold", "not_accessed_for": 90}]}`,
+	} {
+		if _, err := LoadRules(write(bad)); err == nil {
+			t.Errorf("%s loaded", bad)
+		}
+	}
+}
+
+func TestDurationRoundTrip(t *testing.T) {
+	for _, d := range []Duration{Duration(90 * day), Duration(36 * time.Hour), Duration(90 * time.Second)} {
+		b, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Duration
+		if err := json.Unmarshal(b, &got); err != nil || got != d {
+			t.Errorf("%s round trips to %s, %v", b, time.Duration(got), err)
+		}
+	}
+}
+
+// useTiers gives the test a hot and a cold tier of its own, and rules that
+// move Files not downloaded for 30 days to the cold tier.
+func useTiers(t *testing.T) (hot, cold *storage.Local) {
+	t.Helper()
+	hot, cold = storage.NewLocal(t.TempDir()), storage.NewLocal(t.TempDir())
+	prevHot, prevCold, prevMode := storage.Blobs, storage.Cold, RestoreMode
+	prevRules := CurrentRules()
+	storage.Blobs, storage.Cold = hot, cold
+	current.Store(&Rules{Rules: []Rule{{Name: "stale", Tier: models.TierCold, NotAccessedFor: Duration(30 * day)}}})
+	t.Cleanup(func() {
+		storage.Blobs, storage.Cold, RestoreMode = prevHot, prevCold, prevMode
+		current.Store(prevRules)
+	})
+	return hot, cold
+}
+
+// seedFile stores body in the hot tier as a File created at created and
+// last downloaded at accessed, if that is set.
+func seedFile(t *testing.T, db *gorm.DB, body string, created time.Time, accessed *time.Time) *models.File {
+	t.Helper()
+	sum := sha256.Sum256([]byte(body))
+	hash := hex.EncodeToString(sum[:])
+	key := storage.BlobKey(hash)
+	if _, err := storage.Blobs.Put(context.Background(), key, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	file := &models.File{
+		Hash: hash, OriginalName: "a.bin", MimeType: "application/octet-stream", Size: int64(len(body)),
+		StoragePath: key, Codec: models.CodecNone, Tier: models.TierHot,
+		CreatedAt: created, LastAccessedAt: accessed,
+	}
+	if err := db.Create(file).Error; err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func reload(t *testing.T, db *gorm.DB, file *models.File) *models.File {
+	t.Helper()
+	var current models.File
+	if err := db.First(&current, file.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &current
+}
+
+func wantBlob(t *testing.T, store *storage.Local, name, key string, want bool) {
+	t.Helper()
+	_, err := store.Stat(context.Background(), key)
+	if got := err == nil; got != want {
+		t.Errorf("blob in the %s tier: %v, want %v (%v)", name, got, want, err)
+	}
+}
+
+func readAll(t *testing.T, file *models.File) string {
+	t.Helper()
+	obj, err := content.Open(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestApplyMovesStaleFiles(t *testing.T) {
+	db := dbtest.Open(t)
+	hot, cold := useTiers(t)
+	now := time.Now()
+	recently := now.Add(-day)
+
+	stale := seedFile(t, db, "created long ago, never downloaded", now.Add(-60*day), nil)
+	downloaded := seedFile(t, db, "created long ago, downloaded yesterday", now.Add(-60*day), &recently)
+	fresh := seedFile(t, db, "created this week", now.Add(-5*day), nil)
+
+	result, err := Apply(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 3 || result.Moved != 1 || result.MovedBytes != stale.Size || result.Failed != 0 {
+		t.Errorf("result = %+v, want one of three files moved", result)
+	}
+
+	moved := reload(t, db, stale)
+	if moved.Tier != models.TierCold {
+		t.Fatalf("stale file is %s, want cold", moved.Tier)
+	}
+	wantBlob(t, cold, "cold", stale.StoragePath, true)
+	wantBlob(t, hot, "hot", stale.StoragePath, false)
+	if got := readAll(t, moved); got != "created long ago, never downloaded" {
+		t.Errorf("cold content = %q", got)
+	}
+	for _, f := range []*models.File{downloaded, fresh} {
+		if tier := reload(t, db, f).Tier; tier != models.TierHot {
+			t.Errorf("file %d moved to %s", f.ID, tier)
+		}
+		wantBlob(t, hot, "hot", f.StoragePath, true)
+		wantBlob(t, cold, "cold", f.StoragePath, false)
+	}
+
+	// A second pass finds nothing left to move.
+	if result, err := Apply(context.Background()); err != nil || result.Moved != 0 {
+		t.Errorf("second pass = %+v, %v", result, err)
+	}
+}
+
+func TestMoveChecksTheCopy(t *testing.T) {
+	db := dbtest.Open(t)
+	hot, cold := useTiers(t)
+	file := seedFile(t, db, "the original content", time.Now().Add(-60*day), nil)
+
+	// Content that no longer matches the hash is not copied.
+	if _, err := hot.Put(context.Background(), file.StoragePath, strings.NewReader("bit rot")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Move(context.Background(), file, models.TierCold, "test"); !errors.Is(err, storage.ErrHashMismatch) {
+		t.Errorf("Move of a corrupt blob = %v, want ErrHashMismatch", err)
+	}
+	if tier := reload(t, db, file).Tier; tier != models.TierHot {
+		t.Errorf("file is %s after a failed move", tier)
+	}
+	wantBlob(t, cold, "cold", file.StoragePath, false)
+
+	// Nor is a File whose blob changed since it was read.
+	stale := *file
+	stale.StoragePath = "uploads/elsewhere"
+	if _, err := Move(context.Background(), &stale, models.TierCold, "test"); !errors.Is(err, errChanged) {
+		t.Errorf("Move of a changed file = %v, want errChanged", err)
+	}
+}
+
+func TestRemoveSourceAfterMoveBack(t *testing.T) {
+	db := dbtest.Open(t)
+	hot, cold := useTiers(t)
+	file := seedFile(t, db, "moved to cold and straight back", time.Now(), nil)
+	if _, err := cold.Put(context.Background(), file.StoragePath, strings.NewReader("moved to cold and straight back")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A move to the cold tier whose source is removed after a move back
+	// has put the File in the hot tier again keeps the hot copy.
+	if err := removeSource(context.Background(), file, models.TierCold); err != nil {
+		t.Fatal(err)
+	}
+	wantBlob(t, hot, "hot", file.StoragePath, true)
+
+	if err := db.Model(file).UpdateColumn("tier", models.TierCold).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := removeSource(context.Background(), file, models.TierCold); err != nil {
+		t.Fatal(err)
+	}
+	wantBlob(t, hot, "hot", file.StoragePath, false)
+	wantBlob(t, cold, "cold", file.StoragePath, true)
+
+	// A File deleted in the meantime is no error.
+	if err := removeSource(context.Background(), &models.File{ID: file.ID + 1000, Hash: file.Hash, Tier: models.TierHot}, models.TierCold); err != nil {
+		t.Errorf("removeSource of a deleted file: %v", err)
+	}
+}
+
+func TestRestoreRoundTrip(t *testing.T) {
+	db := dbtest.Open(t)
+	hot, cold := useTiers(t)
+	const body = "archived, then downloaded"
+	file := seedFile(t, db, body, time.Now().Add(-60*day), nil)
+	if _, err := Move(context.Background(), file, models.TierCold, "test"); err != nil {
+		t.Fatal(err)
+	}
+	file = reload(t, db, file)
+
+	// Downloading it serves it from the cold tier and requests its restore.
+	obj, err := Open(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(got) != body {
+		t.Errorf("downloaded %q", got)
+	}
+	requested := reload(t, db, file)
+	if requested.RestoreRequestedAt == nil || requested.LastAccessedAt == nil {
+		t.Fatalf("download did not record the access and request a restore: %+v", requested)
+	}
+
+	// The lifecycle pass leaves it to the restorer.
+	if result, err := Apply(context.Background()); err != nil || result.Files != 0 {
+		t.Errorf("lifecycle pass = %+v, %v, want the file skipped", result, err)
+	}
+
+	if n, err := Restore(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Restore = %d, %v, want 1", n, err)
+	}
+	restored := reload(t, db, file)
+	if restored.Tier != models.TierHot || restored.RestoreRequestedAt != nil {
+		t.Errorf("after the restore the file is %s, restore requested at %v", restored.Tier, restored.RestoreRequestedAt)
+	}
+	wantBlob(t, hot, "hot", file.StoragePath, true)
+	wantBlob(t, cold, "cold", file.StoragePath, false)
+	if got := readAll(t, restored); got != body {
+		t.Errorf("restored content = %q", got)
+	}
+
+	// Having just been downloaded, it stays hot.
+	if result, err := Apply(context.Background()); err != nil || result.Moved != 0 {
+		t.Errorf("lifecycle pass after the restore = %+v, %v", result, err)
+	}
+}
+
+func TestDeferredRestore(t *testing.T) {
+	db := dbtest.Open(t)
+	useTiers(t)
+	RestoreMode = RestoreDeferred
+	file := seedFile(t, db, "too slow to serve from cold", time.Now().Add(-60*day), nil)
+	if _, err := Move(context.Background(), file, models.TierCold, "test"); err != nil {
+		t.Fatal(err)
+	}
+	file = reload(t, db, file)
+
+	for i := 0; i < 2; i++ {
+		if _, err := Open(context.Background(), file); !errors.Is(err, ErrRestoring) {
+			t.Fatalf("download %d of a cold file = %v, want ErrRestoring", i+1, err)
+		}
+	}
+	if _, err := Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := Open(context.Background(), reload(t, db, file))
+	if err != nil {
+		t.Fatalf("download after the restore: %v", err)
+	}
+	obj.Close()
+}
+
+func TestTouch(t *testing.T) {
+	db := dbtest.Open(t)
+	useTiers(t)
+
+	// Accesses within accessResolution of the recorded one are not written.
+	recent := time.Now().Add(-10 * time.Minute).Truncate(time.Microsecond)
+	file := seedFile(t, db, "downloaded a moment ago", time.Now().Add(-day), &recent)
+	if err := Touch(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	if got := reload(t, db, file).LastAccessedAt; got == nil || !got.Equal(recent) {
+		t.Errorf("last access = %v, want it left at %v", got, recent)
+	}
+
+	old := time.Now().Add(-2 * accessResolution)
+	file = seedFile(t, db, "downloaded a while ago", time.Now().Add(-day), &old)
+	if err := Touch(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	got := reload(t, db, file).LastAccessedAt
+	if got == nil || time.Since(*got) > time.Minute {
+		t.Errorf("last access = %v, want now", got)
+	}
+	if file.LastAccessedAt == nil || !file.LastAccessedAt.After(old) {
+		t.Error("Touch did not update the file it was given")
+	}
+
+	// A cold File the rules would keep cold is not restored.
+	current.Store(&Rules{Rules: []Rule{{Tier: models.TierCold}}})
+	cold := seedFile(t, db, "pinned to the cold tier", time.Now(), nil)
+	if _, err := Move(context.Background(), cold, models.TierCold, "test"); err != nil {
+		t.Fatal(err)
+	}
+	cold = reload(t, db, cold)
+	if err := Touch(context.Background(), cold); err != nil {
+		t.Fatal(err)
+	}
+	if reload(t, db, cold).RestoreRequestedAt != nil {
+		t.Error("a file the rules keep cold was restored")
+	}
+}
@@ -0,0 +1,175 @@
+package tiering
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/leader"
+
+	"gorm.io/gorm"
+)
+
+// leaderLock is the advisory lock held by the replica applying the rules.
+const leaderLock int64 = 0x766f6c74_00007472 // "volt", "tr"
+
+// Result describes one pass of the lifecycle rules.
+type Result struct {
+	Files      int   `json:"files"`
+	Moved      int   `json:"moved"`
+	MovedBytes int64 `json:"moved_bytes"`
+	Failed     int   `json:"failed"`
+}
+
+// Run applies the lifecycle rules every interval until ctx is cancelled.
+// Only the replica that gets the leader lock applies them.
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		var result *Result
+		err := leader.Do(ctx, leaderLock, func(ctx context.Context) error {
+			var err error
+			result, err = Apply(ctx)
+			return err
+		})
+		switch {
+		case errors.Is(err, leader.ErrNotLeader):
+		case err != nil && ctx.Err() == nil:
+			log.Printf("tiering: applying lifecycle rules failed: %v", err)
+		case result != nil && (result.Moved > 0 || result.Failed > 0):
+			log.Printf("tiering: moved %d of %d files (%d bytes) in %s, %d failed",
+				result.Moved, result.Files, result.MovedBytes, time.Since(start).Round(time.Second), result.Failed)
+		}
+	}
+}
+
+// Apply moves every whole File the lifecycle rules put in another tier
+// than the one it is in. Files waiting for a restore are left to the
+// restorer, and Files that fail are logged and retried on the next pass.
+func Apply(ctx context.Context) (*Result, error) {
+	rules := CurrentRules()
+	result := &Result{}
+	if len(rules.Rules) == 0 {
+		return result, nil
+	}
+
+	db := config.DB.WithContext(ctx)
+	var after uint
+	for {
+		var files []models.File
+		err := db.Where("chunked = ? AND restore_requested_at IS NULL AND id > ?", false, after).
+			Order("id").Limit(500).Find(&files).Error
+		if err != nil {
+			return result, err
+		}
+		if len(files) == 0 {
+			return result, nil
+		}
+		now := time.Now()
+		for i := range files {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			file := &files[i]
+			result.Files++
+			tier := rules.TierFor(file, lastAccess(file), now)
+			if tier == "" || tier == file.Tier {
+				continue
+			}
+			moved, err := Move(ctx, file, tier, "lifecycle")
+			if err != nil {
+				log.Printf("tiering: moving file %d to the %s tier: %v", file.ID, tier, err)
+				result.Failed++
+				continue
+			}
+			if moved {
+				result.Moved++
+				result.MovedBytes += file.Size
+			}
+		}
+		after = files[len(files)-1].ID
+	}
+}
+
+// wake makes the restorer on this replica look for restores right away.
+var wake = make(chan struct{}, 1)
+
+func wakeRestorer() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunRestores restores cold Files whose download requested it, as soon as
+// a download on this replica does and otherwise every interval, which
+// picks up requests other replicas could not finish. Every replica runs
+// it; the hash lock keeps two from moving the same File.
+func RunRestores(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+
+		n, err := Restore(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("tiering: restoring files failed: %v", err)
+		}
+		if n > 0 {
+			log.Printf("tiering: restored %d files to the hot tier", n)
+		}
+	}
+}
+
+// Restore moves every File with a pending restore to the hot tier, oldest
+// request first, and returns how many it moved.
+func Restore(ctx context.Context) (restored int, err error) {
+	db := config.DB.WithContext(ctx)
+	var after uint
+	for {
+		var files []models.File
+		err := db.Where("restore_requested_at IS NOT NULL AND id > ?", after).
+			Order("id").Limit(100).Find(&files).Error
+		if err != nil {
+			return restored, err
+		}
+		if len(files) == 0 {
+			return restored, nil
+		}
+		for i := range files {
+			if err := ctx.Err(); err != nil {
+				return restored, err
+			}
+			moved, err := Move(ctx, &files[i], models.TierHot, "restore")
+			if errors.Is(err, errChanged) || errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			if err != nil {
+				log.Printf("tiering: restoring file %d: %v", files[i].ID, err)
+				continue
+			}
+			if moved {
+				restored++
+			}
+		}
+		after = files[len(files)-1].ID
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"volt/common/problem"
+	"volt/common/tracing"
+	"volt/db/config"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/tiering"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// LoadArchiveEntries returns the references named by ids, in request order,
+// that the user owns or that are public. Any missing ID fails the whole
+// request, since nothing has been streamed yet at this point.
+func LoadArchiveEntries(ctx context.Context, userID uint, ids []uint) ([]models.FileReference, error) {
+	if len(ids) == 0 {
+		return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "No file IDs given")
+	}
+	if len(ids) > MaxBulkItems {
+		return nil, problem.New(http.StatusRequestEntityTooLarge, problem.CodePayloadTooLarge,
+			fmt.Sprintf("Too many files: at most %d per archive", MaxBulkItems))
+	}
+
+	var refs []models.FileReference
+	err := config.DB.WithContext(ctx).Preload("File").
+		Where("id IN ? AND (user_id = ? OR is_private = false)", ids, userID).
+		Find(&refs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]models.FileReference, len(refs))
+	for _, ref := range refs {
+		byID[ref.ID] = ref
+	}
+	ordered := make([]models.FileReference, 0, len(ids))
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ref, ok := byID[id]
+		if !ok {
+			return nil, problem.New(http.StatusNotFound, problem.CodeNotFound, fmt.Sprintf("File %d not found", id))
+		}
+		if scan.Blocked(&ref.File) {
+			return nil, scan.ErrInfected(&ref.File)
+		}
+		ordered = append(ordered, ref)
+	}
+	return ordered, nil
+}
+
+// WriteArchive streams refs into a ZIP written to w, one entry at a time
+// straight from the blob store. Entries are named by display name, with
+// " (2)", " (3)", ... added to repeated names, and carry the time the file
+// was uploaded. Formats that are already compressed are stored rather than
+// deflated again.
+func WriteArchive(ctx context.Context, w io.Writer, refs []models.FileReference) error {
+	ctx, span := tracer.Start(ctx, "WriteArchive")
+	span.SetAttributes(attribute.Int("archive.entries", len(refs)))
+	defer span.End()
+
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool, len(refs))
+
+	for _, ref := range refs {
+		header := &zip.FileHeader{
+			Name:     uniqueName(names, ref.DisplayName),
+			Method:   zip.Deflate,
+			Modified: ref.CreatedAt,
+		}
+		if isCompressed(ref.File.MimeType) {
+			header.Method = zip.Store
+		}
+
+		if err := writeArchiveEntry(ctx, zw, header, &ref.File); err != nil {
+			return fmt.Errorf("adding %s: %w", header.Name, err)
+		}
+	}
+	return zw.Close()
+}
+
+func writeArchiveEntry(ctx context.Context, zw *zip.Writer, header *zip.FileHeader, file *models.File) error {
+	// Archives are built from cold Files as they are, without waiting for
+	// their restore.
+	if err := tiering.Touch(ctx, file); err != nil {
+		tracing.Logf(ctx, "Failed to record access to file %d: %v", file.ID, err)
+	}
+	obj, err := content.Open(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, obj)
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func uniqueName(names map[string]bool, name string) string {
+	name = strings.TrimLeft(name, "/")
+	if name == "" {
+		name = "file"
+	}
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; names[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	names[candidate] = true
+	return candidate
+}
+
+func isCompressed(mimeType string) bool {
+	m := strings.Split(mimeType, ";")[0]
+	if strings.HasPrefix(m, "image/") && m != "image/bmp" && m != "image/svg+xml" && m != "image/tiff" {
+		return true
+	}
+	if strings.HasPrefix(m, "video/") || strings.HasPrefix(m, "audio/") {
+		return true
+	}
+	switch m {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/x-xz",
+		"application/x-bzip2", "application/pdf":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"volt/common/problem"
+	"volt/db/models"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BatchFile is one part of a multi-file upload. Path is the optional
+// relative path the client sent for it, e.g. "photos/2024/img_001.jpg".
+// Checksums are those sent for it outside its part's own Content-Digest
+// and Repr-Digest headers.
+type BatchFile struct {
+	Header    *multipart.FileHeader
+	Path      string
+	Checksums []Checksum
+}
+
+// CleanRelativePath normalises a client-supplied relative path so it can be
+// stored as a display name: separators become slashes, "." segments and
+// leading slashes are dropped, and paths escaping the upload root are
+// rejected.
+func CleanRelativePath(p string) (string, error) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+				fmt.Sprintf("Invalid path %q: must not contain \"..\"", p))
+		}
+	}
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if len(p) > 255 {
+		return "", problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+			fmt.Sprintf("Invalid path %q: longer than 255 characters", p))
+	}
+	return p, nil
+}
+
+// ProcessBatchUpload stores files with at most concurrency uploads in
+// flight and returns one result per file, in input order. A failing file
+// never aborts the others; its result carries the error instead, with
+// internal errors reduced to a generic message.
+func ProcessBatchUpload(ctx context.Context, files []BatchFile, userID uint, opts UploadOptions, concurrency int) []models.FileUploadResult {
+	ctx, span := tracer.Start(ctx, "ProcessBatchUpload")
+	span.SetAttributes(
+		attribute.Int("upload.files", len(files)),
+		attribute.Int("upload.concurrency", concurrency),
+	)
+	defer span.End()
+
+	results := make([]models.FileUploadResult, len(files))
+	sem := make(chan struct{}, max(1, concurrency))
+	var wg sync.WaitGroup
+
+	for i, f := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = processBatchFile(ctx, f, userID, opts)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func processBatchFile(ctx context.Context, f BatchFile, userID uint, opts UploadOptions) models.FileUploadResult {
+	name := f.Header.Filename
+	fail := func(err error) models.FileUploadResult {
+		res := models.FileUploadResult{Name: name, Status: models.UploadStatusError, Err: err}
+		var p *problem.Problem
+		if errors.As(err, &p) {
+			res.Code, res.Error = p.Code, p.Detail
+		} else {
+			res.Code, res.Error = problem.CodeInternal, "Failed to process upload"
+		}
+		return res
+	}
+
+	if f.Path != "" {
+		p, err := CleanRelativePath(f.Path)
+		if err != nil {
+			return fail(err)
+		}
+		if p != "" {
+			name = p
+		}
+	}
+	opts.DisplayName = name
+
+	checksums, err := ParseDigestFields(http.Header(f.Header.Header))
+	if err != nil {
+		return fail(err)
+	}
+	opts.Checksums = append(checksums, f.Checksums...)
+
+	file, err := f.Header.Open()
+	if err != nil {
+		return fail(problem.New(http.StatusBadRequest, problem.CodeInvalidRequest,
+			fmt.Sprintf("Failed to read %s from the multipart form", name)))
+	}
+	defer file.Close()
+
+	result, err := ProcessFileUpload(ctx, file, f.Header, userID, opts)
+	if err != nil {
+		return fail(err)
+	}
+	return *result
+}
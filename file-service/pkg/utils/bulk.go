@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"volt/common/problem"
+	"volt/db/config"
+	"volt/db/models"
+
+	"gorm.io/gorm"
+)
+
+// MaxBulkItems caps the number of references one bulk or archive request
+// may name.
+const MaxBulkItems = 1000
+
+// ApplyBulk runs req against the user's references in a single transaction.
+// Each item gets its own savepoint, so a failing item is rolled back and
+// reported without undoing the others. Request-level problems (unknown
+// action, missing parameters) are returned as errors before anything runs.
+func ApplyBulk(ctx context.Context, userID uint, req models.BulkRequest) (*models.BulkResponse, error) {
+	items := req.Items
+	switch req.Action {
+	case models.BulkActionDelete:
+	case models.BulkActionSetPrivate:
+		if req.IsPrivate == nil {
+			return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "is_private is required for set_private")
+		}
+	case models.BulkActionRename:
+		if len(req.IDs) > 0 {
+			return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "rename takes items with id and name, not ids")
+		}
+	default:
+		return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+			fmt.Sprintf("Unknown action %q: must be delete, set_private or rename", req.Action))
+	}
+	for _, id := range req.IDs {
+		items = append(items, models.BulkItem{ID: id})
+	}
+	if len(items) == 0 {
+		return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "No file IDs given")
+	}
+	if len(items) > MaxBulkItems {
+		return nil, problem.New(http.StatusRequestEntityTooLarge, problem.CodePayloadTooLarge,
+			fmt.Sprintf("Too many items: at most %d per request", MaxBulkItems))
+	}
+
+	resp := &models.BulkResponse{Action: req.Action, Results: make([]models.BulkResult, 0, len(items))}
+
+	err := config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, item := range items {
+			savepoint := fmt.Sprintf("bulk_item_%d", i)
+			if err := tx.SavePoint(savepoint).Error; err != nil {
+				return err
+			}
+
+			result := models.BulkResult{ID: item.ID, Status: models.BulkStatusOK}
+			if err := applyBulkItem(tx, userID, req, item); err != nil {
+				if err := tx.RollbackTo(savepoint).Error; err != nil {
+					return err
+				}
+				var p *problem.Problem
+				if !errors.As(err, &p) {
+					if ctx.Err() != nil {
+						return err
+					}
+					p = problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to apply action")
+				}
+				result.Status, result.Code, result.Error = models.BulkStatusError, p.Code, p.Detail
+				resp.Failed++
+			} else {
+				resp.Succeeded++
+			}
+			resp.Results = append(resp.Results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func applyBulkItem(tx *gorm.DB, userID uint, req models.BulkRequest, item models.BulkItem) error {
+	var ref models.FileReference
+	if err := tx.Where("id = ? AND user_id = ?", item.ID, userID).First(&ref).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return problem.New(http.StatusNotFound, problem.CodeNotFound, "File not found")
+		}
+		return err
+	}
+
+	switch req.Action {
+	case models.BulkActionDelete:
+		return tx.Delete(&ref).Error
+	case models.BulkActionSetPrivate:
+		return tx.Model(&ref).Update("is_private", *req.IsPrivate).Error
+	case models.BulkActionRename:
+		name, err := CleanRelativePath(item.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Name must not be empty")
+		}
+		return tx.Model(&ref).Update("display_name", name).Error
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"volt/db/dbtest"
+	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/gc"
+	"volt/file-service/pkg/storage"
+
+	"gorm.io/gorm"
+)
+
+// seedFile stores content as a blob and gives a new user one reference to it.
+func seedFile(t *testing.T, db *gorm.DB, content []byte) (models.User, models.File, models.FileReference) {
+	t.Helper()
+	ctx := context.Background()
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+	key := storage.BlobKey(hash)
+	if _, err := storage.Blobs.Put(ctx, key, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	user := createUser(t, db, "bulk-"+hash[:8])
+	file := models.File{Hash: hash, OriginalName: "a.txt", MimeType: "text/plain", Size: int64(len(content)), StoragePath: key}
+	if err := db.Create(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+	ref := models.FileReference{UserID: user.ID, FileID: file.ID, DisplayName: "a.txt"}
+	if err := db.Create(&ref).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user, file, ref
+}
+
+func useTempBlobs(t *testing.T) {
+	t.Helper()
+	prev := storage.Blobs
+	storage.Blobs = storage.NewLocal(t.TempDir())
+	t.Cleanup(func() { storage.Blobs = prev })
+}
+
+func TestBulkDeleteRollbackKeepsBlob(t *testing.T) {
+	db := dbtest.Open(t)
+	useTempBlobs(t)
+	user, file, ref := seedFile(t, db, []byte("bulk delete that is rolled back"))
+
+	errRollback := errors.New("roll back")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		req := models.BulkRequest{Action: models.BulkActionDelete}
+		if err := applyBulkItem(tx, user.ID, req, models.BulkItem{ID: ref.ID}); err != nil {
+			return err
+		}
+		var live int64
+		if err := tx.Model(&models.File{}).Where("id = ?", file.ID).Count(&live).Error; err != nil {
+			return err
+		}
+		if live != 0 {
+			t.Errorf("file %d was not released by the delete", file.ID)
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("transaction: %v", err)
+	}
+
+	if _, err := storage.Blobs.Stat(context.Background(), file.StoragePath); err != nil {
+		t.Fatalf("blob is gone after the rollback: %v", err)
+	}
+	var got models.File
+	if err := db.First(&got, file.ID).Error; err != nil {
+		t.Fatalf("file row is gone after the rollback: %v", err)
+	}
+	if got.ReferenceCount != 1 {
+		t.Errorf("reference count = %d after the rollback, want 1", got.ReferenceCount)
+	}
+}
+
+func TestBulkDeleteLeavesBlobToGC(t *testing.T) {
+	db := dbtest.Open(t)
+	useTempBlobs(t)
+	ctx := context.Background()
+	user, file, ref := seedFile(t, db, []byte("bulk delete that is committed"))
+
+	resp, err := ApplyBulk(ctx, user.ID, models.BulkRequest{Action: models.BulkActionDelete, IDs: []uint{ref.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Succeeded != 1 {
+		t.Fatalf("bulk delete: %+v", resp.Results)
+	}
+	if _, err := storage.Blobs.Stat(ctx, file.StoragePath); err != nil {
+		t.Fatalf("blob was deleted with the reference: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	result, err := gc.Collect(ctx, gc.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Swept) != 1 || result.Swept[0].Key != file.StoragePath {
+		t.Fatalf("gc swept %+v, want only %s", result.Swept, file.StoragePath)
+	}
+	if _, err := storage.Blobs.Stat(ctx, file.StoragePath); err == nil {
+		t.Fatal("blob survived the collection")
+	}
+}
+
+func TestBulkDeleteRollbackKeepsChunks(t *testing.T) {
+	db := dbtest.Open(t)
+	useTempBlobs(t)
+	ctx := context.Background()
+	user := createUser(t, db, "chunked")
+
+	chunking, minSize, sizes := content.Chunking, content.ChunkMinFileSize, content.Sizes
+	content.Chunking, content.ChunkMinFileSize, content.Sizes = true, 1, content.ChunkSizes{Min: 64, Avg: 256, Max: 2048}
+	t.Cleanup(func() { content.Chunking, content.ChunkMinFileSize, content.Sizes = chunking, minSize, sizes })
+
+	data := bytes.Repeat([]byte("chunked content that is deleted and rolled back. "), 200)
+	file, header := formFile(t, "chunked.txt", data)
+	result, err := ProcessFileUpload(ctx, file, header, user.ID, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.File.Chunked {
+		t.Fatal("upload was not chunked")
+	}
+
+	var keys []string
+	if err := db.Model(&models.Chunk{}).Pluck("storage_key", &keys).Error; err != nil || len(keys) == 0 {
+		t.Fatalf("no chunks stored: %v", err)
+	}
+
+	errRollback := errors.New("roll back")
+	err = db.Transaction(func(tx *gorm.DB) error {
+		req := models.BulkRequest{Action: models.BulkActionDelete}
+		if err := applyBulkItem(tx, user.ID, req, models.BulkItem{ID: result.FileReference.ID}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("transaction: %v", err)
+	}
+	for _, key := range keys {
+		if _, err := storage.Blobs.Stat(ctx, key); err != nil {
+			t.Errorf("chunk %s is gone after the rollback: %v", key, err)
+		}
+	}
+}
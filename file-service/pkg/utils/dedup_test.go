@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"volt/db/dbtest"
+	"volt/db/models"
+	"volt/file-service/pkg/storage"
+
+	"gorm.io/gorm"
+)
+
+// TestDedupUnderConcurrency has many users upload and delete the same
+// content at once and checks after every phase that the File's
+// reference_count equals its live references. Each round:
+//  1. every user uploads the content twice at once;
+//  2. half the users delete their reference while the other half upload
+//     again, racing the release of the File against new references;
+//  3. everyone deletes, which must release the File.
+func TestDedupUnderConcurrency(t *testing.T) {
+	db := dbtest.Open(t)
+	useTempBlobs(t)
+
+	const users, rounds = 20, 3
+	var all []models.User
+	for i := 0; i < users; i++ {
+		all = append(all, createUser(t, db, fmt.Sprintf("dedup-%d", i)))
+	}
+
+	for round := 1; round <= rounds; round++ {
+		payload, hash := writePayload(t, 256<<10)
+
+		err := parallel(all, func(u models.User) error {
+			for i := 0; i < 2; i++ {
+				if err := uploadPayload(u, payload); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("round %d, uploads: %v", round, err)
+		}
+		checkReferences(t, db, hash, users)
+
+		err = parallel(all, func(u models.User) error {
+			if u.ID%2 == 0 {
+				return deleteReferences(db, u, hash)
+			}
+			return uploadPayload(u, payload)
+		})
+		if err != nil {
+			t.Fatalf("round %d, mixed: %v", round, err)
+		}
+		checkReferences(t, db, hash, users-countEven(all))
+
+		err = parallel(all, func(u models.User) error {
+			return deleteReferences(db, u, hash)
+		})
+		if err != nil {
+			t.Fatalf("round %d, deletes: %v", round, err)
+		}
+		checkReferences(t, db, hash, 0)
+	}
+}
+
+// writePayload writes size random bytes to a temporary file and returns its
+// path and hash.
+func writePayload(t *testing.T, size int) (string, string) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	name := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name, fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// parallel runs fn for every user at once and joins their errors.
+func parallel(users []models.User, fn func(models.User) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(users))
+	start := make(chan struct{})
+	for i, u := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := fn(u); err != nil {
+				errs[i] = fmt.Errorf("user %d: %w", u.ID, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func uploadPayload(u models.User, payload string) error {
+	f, err := os.Open(payload)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := &multipart.FileHeader{
+		Filename: "payload.bin",
+		Size:     info.Size(),
+		Header:   textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}},
+	}
+	_, err = ProcessFileUpload(context.Background(), f, header, u.ID, UploadOptions{IsPrivate: true})
+	return err
+}
+
+func deleteReferences(db *gorm.DB, u models.User, hash string) error {
+	var refs []models.FileReference
+	err := db.Joins("JOIN files ON files.id = file_references.file_id").
+		Where("file_references.user_id = ? AND files.hash = ?", u.ID, hash).
+		Find(&refs).Error
+	if err != nil {
+		return err
+	}
+	for i := range refs {
+		if err := db.Delete(&refs[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReferences checks that the content has exactly want live references,
+// that the File's reference_count says so, and that the File and its blob
+// are there while it has any. Blobs of released Files are left to the
+// garbage collector, so their absence is not checked.
+func checkReferences(t *testing.T, db *gorm.DB, hash string, want int) {
+	t.Helper()
+	var files []models.File
+	if err := db.Unscoped().Where("hash = ?", hash).Find(&files).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d File rows for hash %s, want 1", len(files), hash)
+	}
+	file := files[0]
+
+	var refs int64
+	if err := db.Model(&models.FileReference{}).Where("file_id = ?", file.ID).Count(&refs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if int(refs) != want {
+		t.Fatalf("%d live references, want %d", refs, want)
+	}
+	if file.ReferenceCount != int(refs) {
+		t.Fatalf("reference_count is %d, but there are %d live references", file.ReferenceCount, refs)
+	}
+
+	live := !file.DeletedAt.Valid
+	if live != (want > 0) {
+		t.Fatalf("File live=%v with %d references", live, want)
+	}
+	if live {
+		if _, err := storage.Blobs.Stat(context.Background(), file.StoragePath); err != nil {
+			t.Fatalf("blob %s of a live File: %v", file.StoragePath, err)
+		}
+	}
+}
+
+func countEven(users []models.User) int {
+	n := 0
+	for _, u := range users {
+		if u.ID%2 == 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"volt/common/problem"
+)
+
+// Digest algorithms a client may send checksums in, named as in the
+// RFC 9530 hash algorithm registry.
+const (
+	DigestSHA256 = "sha-256"
+	DigestSHA512 = "sha-512"
+	DigestMD5    = "md5"
+	DigestCRC32C = "crc32c"
+)
+
+var digestAlgorithms = []string{DigestSHA256, DigestSHA512, DigestMD5, DigestCRC32C}
+
+func newDigest(algorithm string) hash.Hash {
+	switch algorithm {
+	case DigestSHA256:
+		return sha256.New()
+	case DigestSHA512:
+		return sha512.New()
+	case DigestMD5:
+		return md5.New()
+	case DigestCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return nil
+}
+
+// Checksum is a digest a client expects some content to have.
+type Checksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// ParseDigestFields returns the checksums in the Content-Digest and
+// Repr-Digest fields of h, RFC 9530 dictionaries such as
+// "sha-256=:<base64>:". Algorithms that are not supported are skipped;
+// fields that name none that is are rejected, as the client asked for a
+// check that cannot be made.
+func ParseDigestFields(h http.Header) ([]Checksum, error) {
+	var checks []Checksum
+	seen := false
+	for _, field := range []string{"Content-Digest", "Repr-Digest"} {
+		for _, value := range h.Values(field) {
+			for _, member := range strings.Split(value, ",") {
+				member, _, _ = strings.Cut(member, ";")
+				name, sum, ok := strings.Cut(strings.TrimSpace(member), "=")
+				if !ok || len(sum) < 2 || sum[0] != ':' || sum[len(sum)-1] != ':' {
+					return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+						fmt.Sprintf("Invalid %s field %q", field, value))
+				}
+				seen = true
+				name = strings.ToLower(name)
+				if newDigest(name) == nil {
+					continue
+				}
+				b, err := base64.StdEncoding.DecodeString(sum[1 : len(sum)-1])
+				if err != nil {
+					return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+						fmt.Sprintf("Invalid %s field %q: digest is not base64", field, value))
+				}
+				if len(b) != newDigest(name).Size() {
+					return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+						fmt.Sprintf("Invalid %s field %q: a %s digest is %d bytes", field, value, name, newDigest(name).Size()))
+				}
+				checks = append(checks, Checksum{Algorithm: name, Sum: b})
+			}
+		}
+	}
+	if seen && len(checks) == 0 {
+		return nil, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+			"No supported digest algorithm; use one of "+strings.Join(digestAlgorithms, ", "))
+	}
+	return checks, nil
+}
+
+// ParseChecksumField parses a checksum form field, the algorithm and the
+// hex digest separated by a colon, e.g. "sha256:9f86d0...". The hyphen in
+// the algorithm name is optional.
+func ParseChecksumField(value string) (Checksum, error) {
+	name, sum, ok := strings.Cut(strings.TrimSpace(value), ":")
+	name = strings.ToLower(name)
+	switch name {
+	case "sha256":
+		name = DigestSHA256
+	case "sha512":
+		name = DigestSHA512
+	}
+	if !ok || newDigest(name) == nil {
+		return Checksum{}, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+			fmt.Sprintf("Invalid checksum %q: expected <algorithm>:<hex digest> with one of %s", value, strings.Join(digestAlgorithms, ", ")))
+	}
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return Checksum{}, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+			fmt.Sprintf("Invalid checksum %q: digest is not hex", value))
+	}
+	if len(b) != newDigest(name).Size() {
+		return Checksum{}, problem.New(http.StatusBadRequest, problem.CodeValidationFailed,
+			fmt.Sprintf("Invalid checksum %q: a %s digest is %d hex digits", value, name, 2*newDigest(name).Size()))
+	}
+	return Checksum{Algorithm: name, Sum: b}, nil
+}
+
+// VerifyChecksums fails with a checksum_mismatch problem unless every
+// checksum matches its digest in digests, which must hold every supported
+// algorithm.
+func VerifyChecksums(name string, digests map[string][]byte, checks []Checksum) error {
+	for _, c := range checks {
+		if !bytes.Equal(digests[c.Algorithm], c.Sum) {
+			return problem.New(http.StatusBadRequest, problem.CodeChecksumMismatch,
+				fmt.Sprintf("%s of %s is %x, not %x as sent; the upload was not stored", c.Algorithm, name, digests[c.Algorithm], c.Sum))
+		}
+	}
+	return nil
+}
+
+// CheckBodyChecksums verifies the checksums sent in the request's own digest
+// fields against the digests of the multipart body read through body. Those
+// fields cover the whole body, but clients commonly send the digest of the
+// one file they upload instead, so when a single file was sent a mismatch
+// makes them checksums of that file, which is then rejected unless its
+// content matches.
+func CheckBodyChecksums(files []BatchFile, body *DigestReader, checks []Checksum) error {
+	digests, err := body.Digests()
+	if err != nil {
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to read request body")
+	}
+	err = VerifyChecksums("the request body", digests, checks)
+	if err == nil || len(files) != 1 {
+		return err
+	}
+	files[0].Checksums = append(files[0].Checksums, checks...)
+	return nil
+}
+
+// HexDigests formats digests for a response.
+func HexDigests(digests map[string][]byte) map[string]string {
+	out := make(map[string]string, len(digests))
+	for name, sum := range digests {
+		out[name] = hex.EncodeToString(sum)
+	}
+	return out
+}
+
+// DigestReader computes the digests of everything read through it.
+type DigestReader struct {
+	r      io.ReadCloser
+	hashes map[string]hash.Hash
+	w      io.Writer
+}
+
+func NewDigestReader(r io.ReadCloser) *DigestReader {
+	d := &DigestReader{r: r, hashes: make(map[string]hash.Hash)}
+	writers := make([]io.Writer, len(digestAlgorithms))
+	for i, name := range digestAlgorithms {
+		d.hashes[name] = newDigest(name)
+		writers[i] = d.hashes[name]
+	}
+	d.w = io.MultiWriter(writers...)
+	return d
+}
+
+func (d *DigestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.w.Write(p[:n])
+	return n, err
+}
+
+func (d *DigestReader) Close() error {
+	return d.r.Close()
+}
+
+// Digests reads what is left and returns the digest per algorithm.
+func (d *DigestReader) Digests() (map[string][]byte, error) {
+	if _, err := io.Copy(io.Discard, d); err != nil {
+		return nil, err
+	}
+	digests := make(map[string][]byte, len(d.hashes))
+	for name, h := range d.hashes {
+		digests[name] = h.Sum(nil)
+	}
+	return digests, nil
+}
@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"volt/common/problem"
+	"volt/db/dbtest"
+	"volt/db/models"
+)
+
+func sha256Sum(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+func sha512Sum(s string) []byte {
+	sum := sha512.Sum512([]byte(s))
+	return sum[:]
+}
+
+// field formats sum as an RFC 9530 byte sequence.
+func field(sum []byte) string {
+	return ":" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+func wantProblem(t *testing.T, err error, code string) {
+	t.Helper()
+	var p *problem.Problem
+	if !errors.As(err, &p) || p.Status != http.StatusBadRequest || p.Code != code {
+		t.Errorf("error = %v, want a 400 %s problem", err, code)
+	}
+}
+
+func TestParseDigestFields(t *testing.T) {
+	hello := sha256Sum("hello")
+	helloMD5 := md5.Sum([]byte("hello"))
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    []Checksum
+		wantErr bool
+	}{
+		{name: "none", header: http.Header{}},
+		{name: "sha-256", header: http.Header{"Content-Digest": {"sha-256=" + field(hello)}},
+			want: []Checksum{{DigestSHA256, hello}}},
+		{name: "algorithm case", header: http.Header{"Content-Digest": {"SHA-256=" + field(hello)}},
+			want: []Checksum{{DigestSHA256, hello}}},
+		{name: "parameters and spaces", header: http.Header{"Content-Digest": {" sha-256=" + field(hello) + ";q=1 "}},
+			want: []Checksum{{DigestSHA256, hello}}},
+		{name: "both fields and several members",
+			header: http.Header{
+				"Content-Digest": {"sha-512=" + field(sha512Sum("hello")) + ", md5=" + field(helloMD5[:])},
+				"Repr-Digest":    {"sha-256=" + field(hello)},
+			},
+			want: []Checksum{{DigestSHA512, sha512Sum("hello")}, {DigestMD5, helloMD5[:]}, {DigestSHA256, hello}}},
+		{name: "unknown algorithms are skipped", header: http.Header{"Content-Digest": {"sha-1=:AAAA:, sha-256=" + field(hello)}},
+			want: []Checksum{{DigestSHA256, hello}}},
+		{name: "only unknown algorithms", header: http.Header{"Content-Digest": {"sha-1=:AAAA:, unixsum=:AAAA:"}}, wantErr: true},
+		{name: "not a byte sequence", header: http.Header{"Content-Digest": {"sha-256=" + hex.EncodeToString(hello)}}, wantErr: true},
+		{name: "unterminated byte sequence", header: http.Header{"Content-Digest": {"sha-256=:AAAA"}}, wantErr: true},
+		{name: "no value", header: http.Header{"Content-Digest": {"sha-256"}}, wantErr: true},
+		{name: "empty member", header: http.Header{"Content-Digest": {"sha-256=" + field(hello) + ","}}, wantErr: true},
+		{name: "not base64", header: http.Header{"Repr-Digest": {"sha-256=:not base64!:"}}, wantErr: true},
+		{name: "truncated digest", header: http.Header{"Content-Digest": {"sha-256=" + field(hello[:16])}}, wantErr: true},
+		{name: "digest of another algorithm", header: http.Header{"Content-Digest": {"sha-512=" + field(hello)}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDigestFields(tt.header)
+			if tt.wantErr {
+				wantProblem(t, err, problem.CodeValidationFailed)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("checksums = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Algorithm != tt.want[i].Algorithm || string(got[i].Sum) != string(tt.want[i].Sum) {
+					t.Errorf("checksum %d = %s %x, want %s %x", i, got[i].Algorithm, got[i].Sum, tt.want[i].Algorithm, tt.want[i].Sum)
+				}
+			}
+		})
+	}
+}
+
+func TestParseChecksumField(t *testing.T) {
+	hello := hex.EncodeToString(sha256Sum("hello"))
+	tests := []struct {
+		value     string
+		algorithm string
+	}{
+		{value: "sha256:" + hello, algorithm: DigestSHA256},
+		{value: "sha-256:" + hello, algorithm: DigestSHA256},
+		{value: " SHA256:" + strings.ToUpper(hello) + " ", algorithm: DigestSHA256},
+		{value: "sha512:" + hex.EncodeToString(sha512Sum("hello")), algorithm: DigestSHA512},
+		{value: "md5:5d41402abc4b2a76b9719d911017c592", algorithm: DigestMD5},
+		{value: "crc32c:c893e257", algorithm: DigestCRC32C},
+		{value: "sha1:" + hello},
+		{value: hello},
+		{value: "sha256:"},
+		{value: "sha256:xyz"},
+		{value: "sha256:" + hello[:32]},
+		{value: "sha512:" + hello},
+		{value: "sha256:" + base64.StdEncoding.EncodeToString(sha256Sum("hello"))},
+	}
+	for _, tt := range tests {
+		c, err := ParseChecksumField(tt.value)
+		if tt.algorithm == "" {
+			if err == nil {
+				t.Errorf("ParseChecksumField(%q) = %+v, want an error", tt.value, c)
+			}
+			wantProblem(t, err, problem.CodeValidationFailed)
+			continue
+		}
+		if err != nil || c.Algorithm != tt.algorithm {
+			t.Errorf("ParseChecksumField(%q) = %+v, %v, want %s", tt.value, c, err, tt.algorithm)
+		}
+	}
+}
+
+func digestsOf(t *testing.T, content string) map[string][]byte {
+	t.Helper()
+	digests, err := NewDigestReader(io.NopCloser(strings.NewReader(content))).Digests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digests
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	digests := digestsOf(t, "hello")
+	md5Sum := md5.Sum([]byte("hello"))
+
+	if err := VerifyChecksums("a.txt", digests, nil); err != nil {
+		t.Errorf("no checksums: %v", err)
+	}
+	matching := []Checksum{{DigestSHA256, sha256Sum("hello")}, {DigestSHA512, sha512Sum("hello")}, {DigestMD5, md5Sum[:]}}
+	if err := VerifyChecksums("a.txt", digests, matching); err != nil {
+		t.Errorf("matching checksums: %v", err)
+	}
+
+	for _, c := range []Checksum{
+		{DigestSHA256, sha256Sum("hullo")},
+		{DigestSHA512, sha512Sum("hullo")},
+		{DigestSHA256, sha256Sum("hello")[:16]},
+	} {
+		err := VerifyChecksums("a.txt", digests, append(matching[:1:1], c))
+		wantProblem(t, err, problem.CodeChecksumMismatch)
+		if err != nil && !strings.Contains(err.Error(), c.Algorithm+" of a.txt") {
+			t.Errorf("error %q does not name the algorithm and file", err)
+		}
+	}
+}
+
+func TestDigestReader(t *testing.T) {
+	content := strings.Repeat("volt ", 10000)
+	d := NewDigestReader(io.NopCloser(strings.NewReader(content)))
+
+	// Part is read by the caller, in small pieces; Digests reads the rest.
+	p := make([]byte, 1000)
+	if _, err := io.ReadFull(iotest.OneByteReader(d), p); err != nil {
+		t.Fatal(err)
+	}
+	digests, err := d.Digests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != len(digestAlgorithms) {
+		t.Errorf("%d digests, want one per algorithm", len(digests))
+	}
+	if hex.EncodeToString(digests[DigestSHA256]) != hex.EncodeToString(sha256Sum(content)) {
+		t.Error("sha-256 digest differs from the content's")
+	}
+	if hex.EncodeToString(digests[DigestSHA512]) != hex.EncodeToString(sha512Sum(content)) {
+		t.Error("sha-512 digest differs from the content's")
+	}
+
+	broken := NewDigestReader(io.NopCloser(iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if _, err := broken.Digests(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Digests of a failing body = %v", err)
+	}
+}
+
+func TestCheckBodyChecksums(t *testing.T) {
+	const body = "--boundary\r\n...the multipart body...\r\n--boundary--\r\n"
+	reader := func() *DigestReader { return NewDigestReader(io.NopCloser(strings.NewReader(body))) }
+	ofBody := []Checksum{{DigestSHA256, sha256Sum(body)}}
+	ofFile := []Checksum{{DigestSHA256, sha256Sum("the file")}}
+
+	t.Run("digest of the body", func(t *testing.T) {
+		files := []BatchFile{{}, {}}
+		if err := CheckBodyChecksums(files, reader(), ofBody); err != nil {
+			t.Fatal(err)
+		}
+		if len(files[0].Checksums) != 0 {
+			t.Error("a digest matching the body was applied to the file")
+		}
+	})
+	t.Run("single file", func(t *testing.T) {
+		own := Checksum{DigestMD5, []byte{1}}
+		files := []BatchFile{{Checksums: []Checksum{own}}}
+		if err := CheckBodyChecksums(files, reader(), ofFile); err != nil {
+			t.Fatal(err)
+		}
+		if len(files[0].Checksums) != 2 || files[0].Checksums[1].Algorithm != DigestSHA256 {
+			t.Errorf("file checksums = %v, want its own and the request's", files[0].Checksums)
+		}
+	})
+	t.Run("several files", func(t *testing.T) {
+		files := []BatchFile{{}, {}}
+		wantProblem(t, CheckBodyChecksums(files, reader(), ofFile), problem.CodeChecksumMismatch)
+	})
+}
+
+func TestSingleFileWithRequestDigest(t *testing.T) {
+	db := dbtest.Open(t)
+	useTempBlobs(t)
+	user := createUser(t, db, "digests")
+	const body = "the multipart body, whose digest the client did not send"
+
+	tests := []struct {
+		name    string
+		content string
+		sent    string
+		wantErr bool
+	}{
+		{name: "digest of the file", content: "content the client hashed", sent: "content the client hashed"},
+		{name: "digest of neither", content: "content changed in transit", sent: "content the client hashed", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, header := formFile(t, "upload.txt", []byte(tt.content))
+			files := []BatchFile{{Header: header}}
+			checks := []Checksum{{DigestSHA256, sha256Sum(tt.sent)}}
+			if err := CheckBodyChecksums(files, NewDigestReader(io.NopCloser(strings.NewReader(body))), checks); err != nil {
+				t.Fatal(err)
+			}
+
+			result := ProcessBatchUpload(context.Background(), files, user.ID, UploadOptions{}, 1)[0]
+			var n int64
+			db.Model(&models.File{}).Where("hash = ?", hex.EncodeToString(sha256Sum(tt.content))).Count(&n)
+			if tt.wantErr {
+				if result.Status != models.UploadStatusError || result.Code != problem.CodeChecksumMismatch {
+					t.Fatalf("result = %s %s, want %s", result.Status, result.Code, problem.CodeChecksumMismatch)
+				}
+				if n != 0 {
+					t.Error("the mismatching file was stored")
+				}
+				return
+			}
+			if result.Status == models.UploadStatusError {
+				t.Fatalf("upload failed: %s %s", result.Code, result.Error)
+			}
+			if n != 1 {
+				t.Errorf("%d Files stored, want 1", n)
+			}
+		})
+	}
+}
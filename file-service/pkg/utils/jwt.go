@@ -8,12 +8,22 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret = []byte(config.GetEnv("JWT_SECRET", "fallback-jwt-token-secret--dhairya-is-awsm"))
+// DevelopmentJWTSecret signs tokens while JWT_SECRET is unset. It is only
+// fit for local development; the readiness check fails while it is in use.
+const DevelopmentJWTSecret = "fallback-jwt-token-secret--dhairya-is-awsm"
+
+var jwtSecret = []byte(config.GetEnv("JWT_SECRET", DevelopmentJWTSecret))
+
+// JWTSecret returns the key used to sign and verify tokens.
+func JWTSecret() []byte {
+	return jwtSecret
+}
 
 type Claims struct {
 	UserID   uint   `json:"user_id"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
+	Role     string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
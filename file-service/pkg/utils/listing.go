@@ -0,0 +1,339 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"volt/common/problem"
+	"volt/db/config"
+	"volt/db/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// sortColumns maps the public sort keys to the column that backs them. Every
+// column is paired with file_references.id as a tie-breaker for keyset paging.
+var sortColumns = map[string]string{
+	"name":    "file_references.display_name",
+	"size":    "file_references.size",
+	"created": "file_references.created_at",
+	"updated": "file_references.updated_at",
+	"mime":    "file_references.mime_type",
+}
+
+type FileListQuery struct {
+	UserID uint
+	Limit  int
+	Sort   string
+	Desc   bool
+	Cursor *pageCursor
+
+	MimePrefix    string
+	MinSize       *int64
+	MaxSize       *int64
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	IsPrivate     *bool
+	IsDuplicate   *bool
+}
+
+// pageCursor points just past the last (or before the first) row of a page.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+	Prev  bool   `json:"p,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func invalidParam(name, reason string) error {
+	return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, fmt.Sprintf("Invalid %s: %s", name, reason))
+}
+
+// ParseFileListQuery reads paging, sorting and filter parameters. The sort and
+// order of a cursor always win over the query string so a client cannot mix
+// positions from differently ordered listings.
+func ParseFileListQuery(userID uint, v url.Values) (*FileListQuery, error) {
+	q := &FileListQuery{UserID: userID, Limit: DefaultPageSize, Sort: "created", Desc: true}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, invalidParam("limit", "must be a positive integer")
+		}
+		q.Limit = min(n, MaxPageSize)
+	}
+
+	if s := v.Get("sort"); s != "" {
+		if _, ok := sortColumns[s]; !ok {
+			return nil, invalidParam("sort", "must be one of name, size, created, updated, mime")
+		}
+		q.Sort = s
+	}
+
+	switch v.Get("order") {
+	case "":
+		q.Desc = q.Sort == "created" || q.Sort == "updated"
+	case "asc":
+		q.Desc = false
+	case "desc":
+		q.Desc = true
+	default:
+		return nil, invalidParam("order", "must be asc or desc")
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil || sortColumns[c.Sort] == "" {
+			return nil, invalidParam("cursor", "malformed")
+		}
+		q.Cursor = c
+		q.Sort = c.Sort
+		q.Desc = c.Desc
+	}
+
+	q.MimePrefix = v.Get("mime")
+
+	var err error
+	if q.MinSize, err = parseInt64Param(v, "min_size"); err != nil {
+		return nil, err
+	}
+	if q.MaxSize, err = parseInt64Param(v, "max_size"); err != nil {
+		return nil, err
+	}
+	if q.CreatedAfter, err = parseTimeParam(v, "created_after"); err != nil {
+		return nil, err
+	}
+	if q.CreatedBefore, err = parseTimeParam(v, "created_before"); err != nil {
+		return nil, err
+	}
+	if q.IsPrivate, err = parseBoolParam(v, "is_private"); err != nil {
+		return nil, err
+	}
+	if q.IsDuplicate, err = parseBoolParam(v, "is_duplicate"); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func parseInt64Param(v url.Values, name string) (*int64, error) {
+	s := v.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return nil, invalidParam(name, "must be a non-negative integer")
+	}
+	return &n, nil
+}
+
+func parseTimeParam(v url.Values, name string) (*time.Time, error) {
+	s := v.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, s); err != nil {
+			return nil, invalidParam(name, "must be an RFC 3339 timestamp or YYYY-MM-DD date")
+		}
+	}
+	return &t, nil
+}
+
+func parseBoolParam(v url.Values, name string) (*bool, error) {
+	s := v.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, invalidParam(name, "must be true or false")
+	}
+	return &b, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (q *FileListQuery) filtered(db *gorm.DB) *gorm.DB {
+	tx := db.Model(&models.FileReference{}).
+		Joins("JOIN files ON files.id = file_references.file_id AND files.deleted_at IS NULL").
+		Where("file_references.user_id = ?", q.UserID)
+
+	if q.MimePrefix != "" {
+		tx = tx.Where("file_references.mime_type LIKE ?", escapeLike(q.MimePrefix)+"%")
+	}
+	if q.MinSize != nil {
+		tx = tx.Where("file_references.size >= ?", *q.MinSize)
+	}
+	if q.MaxSize != nil {
+		tx = tx.Where("file_references.size <= ?", *q.MaxSize)
+	}
+	if q.CreatedAfter != nil {
+		tx = tx.Where("file_references.created_at >= ?", *q.CreatedAfter)
+	}
+	if q.CreatedBefore != nil {
+		tx = tx.Where("file_references.created_at < ?", *q.CreatedBefore)
+	}
+	if q.IsPrivate != nil {
+		tx = tx.Where("file_references.is_private = ?", *q.IsPrivate)
+	}
+	if q.IsDuplicate != nil {
+		tx = tx.Where("file_references.is_duplicate = ?", *q.IsDuplicate)
+	}
+	return tx
+}
+
+func (q *FileListQuery) cursorValue(ref *models.FileReference) string {
+	switch q.Sort {
+	case "name":
+		return ref.DisplayName
+	case "size":
+		return strconv.FormatInt(ref.Size, 10)
+	case "updated":
+		return ref.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	case "mime":
+		return ref.MimeType
+	default:
+		return ref.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+func (q *FileListQuery) parseCursorValue() (interface{}, error) {
+	switch q.Sort {
+	case "size":
+		return strconv.ParseInt(q.Cursor.Value, 10, 64)
+	case "created", "updated":
+		return time.Parse(time.RFC3339Nano, q.Cursor.Value)
+	default:
+		return q.Cursor.Value, nil
+	}
+}
+
+// ListFiles returns one page of the user's files using keyset pagination on
+// (sort column, id), which stays fast however deep the client pages.
+func ListFiles(ctx context.Context, q *FileListQuery) (*models.FilePage, error) {
+	db := config.DB.WithContext(ctx)
+	column := sortColumns[q.Sort]
+
+	var total int64
+	if err := q.filtered(db).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	// Walking backwards means flipping the order for the query and reversing
+	// the rows afterwards.
+	backwards := q.Cursor != nil && q.Cursor.Prev
+	desc := q.Desc != backwards
+	dir, cmp := "ASC", ">"
+	if desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	tx := q.filtered(db)
+	if q.Cursor != nil {
+		value, err := q.parseCursorValue()
+		if err != nil {
+			return nil, invalidParam("cursor", "malformed")
+		}
+		tx = tx.Where(fmt.Sprintf("(%s, file_references.id) %s (?, ?)", column, cmp), value, q.Cursor.ID)
+	}
+
+	var refs []models.FileReference
+	err := tx.Preload("File").
+		Order(fmt.Sprintf("%s %s, file_references.id %s", column, dir, dir)).
+		Limit(q.Limit + 1).
+		Find(&refs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(refs) > q.Limit
+	if hasMore {
+		refs = refs[:q.Limit]
+	}
+	if backwards {
+		for i, j := 0, len(refs)-1; i < j; i, j = i+1, j-1 {
+			refs[i], refs[j] = refs[j], refs[i]
+		}
+	}
+
+	page := &models.FilePage{
+		Items: make([]models.FileResponse, 0, len(refs)),
+		Total: total,
+		Limit: q.Limit,
+	}
+	for i := range refs {
+		page.Items = append(page.Items, ToFileResponse(&refs[i]))
+	}
+
+	if len(refs) == 0 {
+		return page, nil
+	}
+
+	first, last := &refs[0], &refs[len(refs)-1]
+	if hasMore || backwards {
+		page.NextCursor = pageCursor{Sort: q.Sort, Desc: q.Desc, Value: q.cursorValue(last), ID: last.ID}.encode()
+	}
+	if q.Cursor != nil && (!backwards || hasMore) {
+		page.PrevCursor = pageCursor{Sort: q.Sort, Desc: q.Desc, Value: q.cursorValue(first), ID: first.ID, Prev: true}.encode()
+	}
+
+	return page, nil
+}
+
+func ToFileResponse(fileRef *models.FileReference) models.FileResponse {
+	return models.FileResponse{
+		ID:          fileRef.ID,
+		UserID:      fileRef.UserID,
+		FileID:      fileRef.FileID,
+		DisplayName: fileRef.DisplayName,
+		IsDuplicate: fileRef.IsDuplicate,
+		IsPrivate:   fileRef.IsPrivate,
+		Tags:        fileRef.Tags,
+		CreatedAt:   fileRef.CreatedAt,
+		UpdatedAt:   fileRef.UpdatedAt,
+		File: models.FileSummary{
+			ID:             fileRef.File.ID,
+			Hash:           fileRef.File.Hash,
+			OriginalName:   fileRef.File.OriginalName,
+			MimeType:       fileRef.File.MimeType,
+			Size:           fileRef.File.Size,
+			ReferenceCount: fileRef.File.ReferenceCount,
+			CreatedAt:      fileRef.File.CreatedAt,
+		},
+	}
+}
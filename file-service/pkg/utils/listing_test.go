@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"volt/common/problem"
+	"volt/db/dbtest"
+	"volt/db/models"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, c := range []pageCursor{
+		{Sort: "created", Desc: true, Value: "2026-01-02T03:04:05.123456Z", ID: 7},
+		{Sort: "name", Value: "résumé, final (2).pdf", ID: 1 << 31},
+		{Sort: "size", Desc: true, Value: "1024", ID: 42, Prev: true},
+	} {
+		encoded := c.encode()
+		if _, err := url.ParseQuery("cursor=" + encoded); err != nil {
+			t.Errorf("cursor %q is not URL safe: %v", encoded, err)
+		}
+		got, err := decodeCursor(encoded)
+		if err != nil {
+			t.Fatalf("decodeCursor(%q): %v", encoded, err)
+		}
+		if *got != c {
+			t.Errorf("cursor round trip = %+v, want %+v", *got, c)
+		}
+	}
+
+	for _, s := range []string{"", "not base64!", base64.RawURLEncoding.EncodeToString([]byte(`{"s":"name"`))} {
+		if c, err := decodeCursor(s); err == nil {
+			t.Errorf("decodeCursor(%q) = %+v, want an error", s, c)
+		}
+	}
+}
+
+func TestParseFileListQuery(t *testing.T) {
+	sizeCursor := pageCursor{Sort: "size", Desc: true, Value: "10", ID: 3}.encode()
+	unknownSort := pageCursor{Sort: "owner", Value: "x", ID: 3}.encode()
+
+	tests := []struct {
+		query    string
+		limit    int
+		sort     string
+		desc     bool
+		cursored bool
+	}{
+		{query: "", limit: DefaultPageSize, sort: "created", desc: true},
+		{query: "limit=500", limit: MaxPageSize, sort: "created", desc: true},
+		{query: "sort=updated", limit: DefaultPageSize, sort: "updated", desc: true},
+		{query: "sort=name", limit: DefaultPageSize, sort: "name"},
+		{query: "sort=size&order=desc&limit=10", limit: 10, sort: "size", desc: true},
+		{query: "sort=created&order=asc", limit: DefaultPageSize, sort: "created"},
+		// The cursor's sort and order win over the query string.
+		{query: "sort=name&order=asc&cursor=" + sizeCursor, limit: DefaultPageSize, sort: "size", desc: true, cursored: true},
+	}
+	for _, tt := range tests {
+		v, _ := url.ParseQuery(tt.query)
+		q, err := ParseFileListQuery(5, v)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if q.UserID != 5 || q.Limit != tt.limit || q.Sort != tt.sort || q.Desc != tt.desc || (q.Cursor != nil) != tt.cursored {
+			t.Errorf("%q = %+v", tt.query, q)
+		}
+	}
+
+	for _, query := range []string{
+		"limit=0", "limit=ten", "sort=owner", "order=up",
+		"cursor=garbage", "cursor=" + unknownSort,
+		"min_size=-1", "max_size=1e6", "created_after=yesterday", "created_before=2026-13-01",
+		"is_private=maybe", "is_duplicate=2",
+	} {
+		v, _ := url.ParseQuery(query)
+		_, err := ParseFileListQuery(5, v)
+		wantProblem(t, err, problem.CodeInvalidRequest)
+	}
+
+	v, _ := url.ParseQuery("mime=image/&min_size=10&max_size=20&created_after=2026-01-01&created_before=2026-02-01T00:00:00Z&is_private=false&is_duplicate=true")
+	q, err := ParseFileListQuery(5, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.MimePrefix != "image/" || *q.MinSize != 10 || *q.MaxSize != 20 || *q.IsPrivate || !*q.IsDuplicate ||
+		!q.CreatedAfter.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) || !q.CreatedBefore.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("filters = %+v", q)
+	}
+}
+
+func TestParseCursorValue(t *testing.T) {
+	for _, sort := range []string{"size", "created", "updated"} {
+		q := &FileListQuery{Sort: sort, Cursor: &pageCursor{Sort: sort, Value: "not a value"}}
+		if _, err := q.parseCursorValue(); err == nil {
+			t.Errorf("%s cursor with a malformed value parsed", sort)
+		}
+	}
+}
+
+// seedListing gives a user references to files whose names, sizes, types and
+// creation times repeat, so that every sort has ties to break.
+func seedListing(t *testing.T) (userID uint, refs []models.FileReference) {
+	t.Helper()
+	db := dbtest.Open(t)
+	user := createUser(t, db, "listing")
+	other := createUser(t, db, "listing-other")
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	seeds := []struct {
+		name, mime string
+		size       int64
+		hours      int
+	}{
+		{"report", "application/pdf", 300, 0},
+		{"photo", "image/png", 100, 1},
+		{"notes", "text/plain", 20, 1},
+		{"photo", "image/png", 100, 2},
+		{"notes", "text/plain", 20, 3},
+		{"scan", "image/png", 300, 3},
+		{"report", "application/pdf", 5, 3},
+		{"photo", "image/jpeg", 100, 4},
+		{"zebra", "text/plain", 0, 5},
+		{"archive", "application/zip", 300, 5},
+	}
+	for i, s := range seeds {
+		hash := fmt.Sprintf("%064x", i+1)
+		file := models.File{Hash: hash, OriginalName: s.name, MimeType: s.mime, Size: s.size, StoragePath: "uploads/" + hash}
+		if err := db.Create(&file).Error; err != nil {
+			t.Fatal(err)
+		}
+		ref := models.FileReference{UserID: user.ID, FileID: file.ID, DisplayName: s.name, CreatedAt: base.Add(time.Duration(s.hours) * time.Hour)}
+		if err := db.Create(&ref).Error; err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			theirs := models.FileReference{UserID: other.ID, FileID: file.ID, DisplayName: s.name}
+			if err := db.Create(&theirs).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := db.Where("user_id = ?", user.ID).Find(&refs).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.ID, refs
+}
+
+func listQuery(t *testing.T, userID uint, params string) *FileListQuery {
+	t.Helper()
+	v, _ := url.ParseQuery(params)
+	q, err := ParseFileListQuery(userID, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func pageIDs(page *models.FilePage) []uint {
+	ids := make([]uint, len(page.Items))
+	for i, item := range page.Items {
+		ids[i] = item.ID
+	}
+	return ids
+}
+
+func TestListFilesPagesAreStable(t *testing.T) {
+	userID, refs := seedListing(t)
+	for _, ref := range refs {
+		if ref.Size == 0 && ref.DisplayName != "zebra" || ref.MimeType == "" {
+			t.Fatalf("reference %d did not copy its file's size and type: %+v", ref.ID, ref)
+		}
+	}
+
+	keys := map[string]func(a, b models.FileReference) int{
+		"name":    func(a, b models.FileReference) int { return cmp.Compare(a.DisplayName, b.DisplayName) },
+		"size":    func(a, b models.FileReference) int { return cmp.Compare(a.Size, b.Size) },
+		"created": func(a, b models.FileReference) int { return a.CreatedAt.Compare(b.CreatedAt) },
+		"updated": func(a, b models.FileReference) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+		"mime":    func(a, b models.FileReference) int { return cmp.Compare(a.MimeType, b.MimeType) },
+	}
+	for sort, key := range keys {
+		for _, order := range []string{"asc", "desc"} {
+			t.Run(sort+" "+order, func(t *testing.T) {
+				want := slices.Clone(refs)
+				slices.SortFunc(want, func(a, b models.FileReference) int {
+					c := cmp.Or(key(a, b), cmp.Compare(a.ID, b.ID))
+					if order == "desc" {
+						return -c
+					}
+					return c
+				})
+				var wantIDs []uint
+				for _, ref := range want {
+					wantIDs = append(wantIDs, ref.ID)
+				}
+
+				// Forward through every page...
+				var pages [][]uint
+				var page *models.FilePage
+				q := listQuery(t, userID, "limit=3&sort="+sort+"&order="+order)
+				for {
+					var err error
+					if page, err = ListFiles(context.Background(), q); err != nil {
+						t.Fatal(err)
+					}
+					if page.Total != int64(len(refs)) {
+						t.Fatalf("total = %d, want %d", page.Total, len(refs))
+					}
+					pages = append(pages, pageIDs(page))
+					if page.NextCursor == "" {
+						break
+					}
+					q = listQuery(t, userID, "cursor="+page.NextCursor)
+				}
+				if got := slices.Concat(pages...); !slices.Equal(got, wantIDs) {
+					t.Fatalf("pages = %v, want %v", pages, wantIDs)
+				}
+
+				// ...and back again from the last one.
+				for i := len(pages) - 2; i >= 0; i-- {
+					if page.PrevCursor == "" {
+						t.Fatalf("page %d has no previous cursor", i+1)
+					}
+					var err error
+					if page, err = ListFiles(context.Background(), listQuery(t, userID, "cursor="+page.PrevCursor)); err != nil {
+						t.Fatal(err)
+					}
+					if !slices.Equal(pageIDs(page), pages[i]) {
+						t.Errorf("walking back, page %d = %v, want %v", i, pageIDs(page), pages[i])
+					}
+				}
+				if page.PrevCursor != "" {
+					t.Error("the first page has a previous cursor")
+				}
+			})
+		}
+	}
+}
+
+func TestListFilesFilters(t *testing.T) {
+	userID, refs := seedListing(t)
+	tests := []struct {
+		params string
+		keep   func(models.FileReference) bool
+	}{
+		{"mime=image/", func(r models.FileReference) bool { return r.MimeType == "image/png" || r.MimeType == "image/jpeg" }},
+		{"mime=image/png&min_size=200", func(r models.FileReference) bool { return r.MimeType == "image/png" && r.Size >= 200 }},
+		{"min_size=20&max_size=100", func(r models.FileReference) bool { return r.Size >= 20 && r.Size <= 100 }},
+		{"created_after=2026-01-01T03:00:00Z&created_before=2026-01-01T05:00:00Z", func(r models.FileReference) bool {
+			return r.CreatedAt.UTC().Hour() >= 3 && r.CreatedAt.UTC().Hour() < 5
+		}},
+		{"mime=%25", func(models.FileReference) bool { return false }},
+	}
+	for _, tt := range tests {
+		page, err := ListFiles(context.Background(), listQuery(t, userID, "limit=200&sort=name&"+tt.params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		for _, ref := range refs {
+			if tt.keep(ref) {
+				want++
+			}
+		}
+		if page.Total != int64(want) || len(page.Items) != want {
+			t.Errorf("%s: %d of %d files, want %d", tt.params, len(page.Items), page.Total, want)
+		}
+		for _, item := range page.Items {
+			if item.File.Size == 0 && item.DisplayName != "zebra" {
+				t.Errorf("%s: item %d has no file", tt.params, item.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"testing"
+
+	"volt/common/problem"
+	"volt/db/dbtest"
+	"volt/db/models"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/storage"
+
+	"gorm.io/gorm"
+)
+
+func createUser(t *testing.T, db *gorm.DB, name string) models.User {
+	t.Helper()
+	user := models.User{Username: name, Email: name + "@example.com", Password: "x"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// formFile returns content as the one file of a parsed multipart form.
+func formFile(t *testing.T, name string, content []byte) (multipart.File, *multipart.FileHeader) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	w.Close()
+
+	form, err := multipart.NewReader(&body, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	header := form.File["file"][0]
+	file, err := header.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file, header
+}
+
+type infectedScanner struct{}
+
+func (infectedScanner) Scan(ctx context.Context, r io.Reader) (scan.Result, error) {
+	io.Copy(io.Discard, r)
+	return scan.Result{Infected: true, Signature: "Eicar-Signature"}, nil
+}
+
+func TestUploadScanPolicies(t *testing.T) {
+	db := dbtest.Open(t)
+	useTempBlobs(t)
+	ctx := context.Background()
+	user := createUser(t, db, "scanned")
+
+	prevScanner, prevPolicy := scan.Default, scan.CurrentPolicy
+	scan.Default = infectedScanner{}
+	t.Cleanup(func() { scan.Default, scan.CurrentPolicy = prevScanner, prevPolicy })
+
+	tests := []struct {
+		policy   scan.Policy
+		wantFile bool
+		wantKey  func(hash string) string
+	}{
+		{policy: scan.PolicyBlock},
+		{policy: scan.PolicyQuarantine, wantFile: true, wantKey: scan.QuarantineKey},
+		{policy: scan.PolicyFlag, wantFile: true, wantKey: storage.BlobKey},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			scan.CurrentPolicy = tt.policy
+			content := []byte("infected content uploaded under the " + string(tt.policy) + " policy")
+			file, header := formFile(t, "eicar.txt", content)
+
+			result, err := ProcessFileUpload(ctx, file, header, user.ID, UploadOptions{})
+			if !tt.wantFile {
+				var p *problem.Problem
+				if !errors.As(err, &p) || p.Code != problem.CodeMalwareDetected {
+					t.Fatalf("upload error = %v, want %s", err, problem.CodeMalwareDetected)
+				}
+				var n int64
+				db.Unscoped().Model(&models.File{}).Where("original_name = ?", "eicar.txt").
+					Where("size = ?", len(content)).Count(&n)
+				if n != 0 {
+					t.Errorf("blocked upload left %d File rows", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got models.File
+			if err := db.First(&got, result.File.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if got.ScanStatus != models.ScanStatusInfected || got.ScanSignature != "Eicar-Signature" {
+				t.Errorf("File scan state = %q %q", got.ScanStatus, got.ScanSignature)
+			}
+			if want := tt.wantKey(got.Hash); got.StoragePath != want {
+				t.Errorf("StoragePath = %s, want %s", got.StoragePath, want)
+			}
+			if _, err := storage.Blobs.Stat(ctx, got.StoragePath); err != nil {
+				t.Errorf("blob is not stored: %v", err)
+			}
+			if blocked := scan.Blocked(&got); blocked != (tt.policy == scan.PolicyQuarantine) {
+				t.Errorf("Blocked = %v under the %s policy", blocked, tt.policy)
+			}
+		})
+	}
+}
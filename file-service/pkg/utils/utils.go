@@ -1,230 +1,537 @@
 package utils
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
-	"os"
-	"path/filepath"
+	"net/http"
+	"path"
 	"strings"
+	"unicode/utf8"
 
+	"volt/common/problem"
+	"volt/common/tracing"
 	"volt/db/config"
 	"volt/db/models"
+	"volt/file-service/pkg/content"
+	"volt/file-service/pkg/policy"
+	"volt/file-service/pkg/scan"
+	"volt/file-service/pkg/storage"
 
 	"github.com/gabriel-vasile/mimetype"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
 )
 
-func ProcessFileUpload(file multipart.File, header *multipart.FileHeader, userID uint, isPrivate bool) (*models.FileUploadResult, error) {
-	hashResult, err := calculateFileHash(file)
+var tracer = tracing.Tracer("volt/file-service/utils")
+
+// UploadOptions carries the per-reference settings supplied with an upload.
+// DisplayName overrides the multipart file name, e.g. with a relative path.
+type UploadOptions struct {
+	IsPrivate   bool
+	Tags        string
+	DisplayName string
+	// Role is the uploader's role, which may carry its own size limit.
+	Role string
+	// Checksums are digests the client sent for the content, which must
+	// all match for it to be stored.
+	Checksums []Checksum
+}
+
+// NormalizeTags trims a comma-separated tag list, drops empty and repeated
+// entries and keeps it within the 1000 bytes a reference's tags may take.
+func NormalizeTags(raw string) string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	joined := strings.Join(tags, ",")
+	if len(joined) <= 1000 {
+		return joined
+	}
+	// Drop the tags that do not fit; a first tag too long on its own is cut
+	// short instead, at a character boundary.
+	if i := strings.LastIndex(joined[:1001], ","); i > 0 {
+		return joined[:i]
+	}
+	n := 1000
+	for n > 0 && !utf8.RuneStart(joined[n]) {
+		n--
+	}
+	return joined[:n]
+}
+
+func ProcessFileUpload(ctx context.Context, file multipart.File, header *multipart.FileHeader, userID uint, opts UploadOptions) (_ *models.FileUploadResult, err error) {
+	ctx, span := tracer.Start(ctx, "ProcessFileUpload")
+	span.SetAttributes(
+		attribute.Int64("file.size", header.Size),
+		attribute.Int("user.id", int(userID)),
+	)
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	hashResult, err := calculateFileHash(ctx, file)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := validateFileContent(file, header.Header.Get("Content-Type"), header.Filename); err != nil {
+	displayName := header.Filename
+	if opts.DisplayName != "" {
+		displayName = opts.DisplayName
+	}
+
+	if err := VerifyChecksums(displayName, hashResult.Digests, opts.Checksums); err != nil {
+		return nil, err
+	}
+	if err := checkUploadPolicy(ctx, hashResult, header, opts); err != nil {
 		return nil, err
 	}
 
-	var existingFile models.File
-	fileExists := config.DB.Where("hash = ?", hashResult.Hash).First(&existingFile).Error == nil
+	// Content that is not stored yet is scanned and written to its
+	// content-addressed key before the transaction, which then only holds
+	// the content hash's advisory lock to look again and insert. Reference
+	// deletes take the same lock, so identical uploads cannot race on the
+	// unique hash and a File cannot be released between being found and
+	// being referenced. Blobs of uploads that fail are left to the garbage
+	// collector.
+	var staged *stagedUpload
+	existing, err := liveFile(ctx, hashResult.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		if staged, err = stageUpload(ctx, file, header, hashResult); err != nil {
+			return nil, err
+		}
+	} else if scan.Blocked(existing) {
+		return nil, errInfected(header.Filename, existing)
+	}
 
-	var gormFile models.File
-	var wasDuplicate bool
+	var result *models.FileUploadResult
+	for {
+		err = config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := models.LockHash(tx, hashResult.Hash); err != nil {
+				return err
+			}
 
-	if fileExists {
-		gormFile = existingFile
-		wasDuplicate = true
-	} else {
-		storagePath := filepath.Join("uploads", hashResult.Hash+filepath.Ext(header.Filename))
+			gormFile, created, err := findOrCommitFile(ctx, tx, file, header, hashResult.Hash, staged)
+			if err != nil {
+				return err
+			}
+			wasDuplicate := !created
+			span.SetAttributes(attribute.Bool("file.duplicate", wasDuplicate))
 
-		if err := saveFileToDisk(file, storagePath); err != nil {
+			result, _, err = addReference(tx, gormFile, userID, displayName, opts, wasDuplicate)
+			if err != nil {
+				return err
+			}
+			if created {
+				result.ChunkSavedBytes = staged.content.ReusedBytes
+			}
+			return nil
+		})
+		if !errors.Is(err, errReleased) {
+			break
+		}
+		// The File found before the lock was released since, so the
+		// content has to be stored after all.
+		if staged, err = stageUpload(ctx, file, header, hashResult); err != nil {
 			return nil, err
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Digests = HexDigests(hashResult.Digests)
+	return result, nil
+}
 
-		gormFile = models.File{
-			Hash:           hashResult.Hash,
-			OriginalName:   header.Filename,
-			MimeType:       hashResult.MimeType,
-			Size:           hashResult.Size,
-			StoragePath:    storagePath,
-			ReferenceCount: 0,
+// ReferenceByHash gives the user a reference to the live File whose
+// content hashes to hash, without any of it being sent. Knowing a hash is
+// not proof of holding the content, so only Files the user already
+// references or that someone shares publicly qualify; any other hash gets
+// the same not_found as an unknown one, and the client uploads as usual.
+// It reports whether the reference is new.
+func ReferenceByHash(ctx context.Context, hash string, userID uint, opts UploadOptions) (_ *models.FileUploadResult, created bool, err error) {
+	ctx, span := tracer.Start(ctx, "ReferenceByHash")
+	span.SetAttributes(attribute.Int("user.id", int(userID)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	hash = strings.ToLower(hash)
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return nil, false, problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "sha256 must be 64 hex characters")
+	}
+
+	notFound := problem.New(http.StatusNotFound, problem.CodeNotFound, "No file with this hash to reference; upload its content")
+	var result *models.FileUploadResult
+	err = config.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := models.LockHash(tx, hash); err != nil {
+			return err
 		}
 
-		if err := config.DB.Create(&gormFile).Error; err != nil {
-			os.Remove(storagePath)
-			return nil, err
+		var file models.File
+		err := tx.Where("hash = ?", hash).First(&file).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return notFound
+		}
+		if err != nil {
+			return err
+		}
+		var visible int64
+		err = tx.Model(&models.FileReference{}).
+			Where("file_id = ? AND (user_id = ? OR is_private = ?)", file.ID, userID, false).
+			Count(&visible).Error
+		if err != nil {
+			return err
+		}
+		if visible == 0 {
+			return notFound
 		}
+		if scan.Blocked(&file) {
+			return errInfected(opts.DisplayName, &file)
+		}
+		sniffed := strings.Split(file.MimeType, ";")[0]
+		chain := mimeChain(mimetype.Lookup(sniffed))
+		if len(chain) == 0 {
+			chain = []string{sniffed}
+		}
+		err = policy.Check(policy.Upload{
+			Filename: path.Base(opts.DisplayName),
+			Sniffed:  chain,
+			Size:     file.Size,
+			Role:     opts.Role,
+		})
+		if err != nil {
+			return err
+		}
+
+		result, created, err = addReference(tx, &file, userID, opts.DisplayName, opts, true)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
 	}
+	result.Digests = map[string]string{DigestSHA256: hash}
+	return result, created, nil
+}
 
+// addReference gives the user a reference to gormFile under displayName,
+// or returns the one they already have, reporting which. tx must hold the
+// hash lock.
+func addReference(tx *gorm.DB, gormFile *models.File, userID uint, displayName string, opts UploadOptions, wasDuplicate bool) (*models.FileUploadResult, bool, error) {
 	var existingRef models.FileReference
-	refExists := config.DB.Where("user_id = ? AND file_id = ?", userID, gormFile.ID).First(&existingRef).Error == nil
-
-	if refExists {
-		config.DB.Preload("File").First(&existingRef, existingRef.ID)
+	err := tx.Where("user_id = ? AND file_id = ?", userID, gormFile.ID).First(&existingRef).Error
+	if err == nil {
+		existingRef.File = *gormFile
 		return &models.FileUploadResult{
-			FileReference: existingRef,
-			File:          existingRef.File,
+			Name:          displayName,
+			Status:        models.UploadStatusDuplicate,
+			FileReference: &existingRef,
+			File:          gormFile,
 			WasDuplicate:  true,
-			SavedBytes:    existingRef.File.Size,
-		}, nil
+			SavedBytes:    gormFile.Size,
+		}, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
 	}
 
 	fileRef := models.FileReference{
 		UserID:      userID,
 		FileID:      gormFile.ID,
-		DisplayName: header.Filename,
+		DisplayName: displayName,
 		IsDuplicate: wasDuplicate,
-		IsPrivate:   isPrivate,
+		IsPrivate:   opts.IsPrivate,
+		Tags:        opts.Tags,
 	}
-
-	if err := config.DB.Create(&fileRef).Error; err != nil {
-		if !fileExists {
-			config.DB.Delete(&gormFile)
-			os.Remove(gormFile.StoragePath)
-		}
-		return nil, err
+	if err := tx.Create(&fileRef).Error; err != nil {
+		return nil, false, err
 	}
+	// The reference hook bumped the count in the database.
+	gormFile.ReferenceCount++
+	fileRef.File = *gormFile
 
-	config.DB.Preload("File").First(&fileRef, fileRef.ID)
-
+	status := models.UploadStatusUploaded
 	savedBytes := int64(0)
 	if wasDuplicate {
+		status = models.UploadStatusDuplicate
 		savedBytes = gormFile.Size
 	}
-
 	return &models.FileUploadResult{
-		FileReference: fileRef,
+		Name:          displayName,
+		Status:        status,
+		FileReference: &fileRef,
 		File:          gormFile,
 		WasDuplicate:  wasDuplicate,
 		SavedBytes:    savedBytes,
-	}, nil
+	}, true, nil
 }
 
-func validateFileContent(file multipart.File, declaredMimeType string, filename string) error {
-	file.Seek(0, io.SeekStart)
-	defer file.Seek(0, io.SeekStart)
+// errReleased is returned by findOrCommitFile when no content was staged
+// because a live File had it, and that File was released since.
+var errReleased = errors.New("file was released before it could be referenced")
 
-	buffer := make([]byte, 512)
-	n, err := file.Read(buffer)
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("failed to read file content: %w", err)
+func errInfected(name string, file *models.File) error {
+	return problem.New(http.StatusUnprocessableEntity, problem.CodeMalwareDetected,
+		fmt.Sprintf("%s is infected (%s) and was rejected", name, file.ScanSignature))
+}
+
+// liveFile returns the live File with hash, or nil if there is none. It
+// takes no lock, so the answer only decides whether to stage the content.
+func liveFile(ctx context.Context, hash string) (*models.File, error) {
+	var file models.File
+	err := config.DB.WithContext(ctx).Where("hash = ?", hash).First(&file).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	return &file, nil
+}
 
-	actualMime := mimetype.Detect(buffer[:n])
-	actualMimeType := actualMime.String()
+// stagedUpload is content scanned and written for a File not inserted yet.
+type stagedUpload struct {
+	file    models.File
+	content *content.Staged
+}
 
-	declaredBase := strings.Split(declaredMimeType, ";")[0]
-	actualBase := strings.Split(actualMimeType, ";")[0]
+// stageUpload scans the upload and writes its content, quarantined if the
+// scan says so, without holding any lock.
+func stageUpload(ctx context.Context, file multipart.File, header *multipart.FileHeader, hashResult *FileHashResult) (*stagedUpload, error) {
+	gormFile := models.File{
+		Hash:           hashResult.Hash,
+		OriginalName:   header.Filename,
+		MimeType:       hashResult.MimeType,
+		Size:           hashResult.Size,
+		StoragePath:    storage.BlobKey(hashResult.Hash),
+		Chunked:        content.ShouldChunk(hashResult.Size),
+		Codec:          models.CodecNone,
+		StoredSize:     hashResult.Size,
+		Tier:           models.TierHot,
+		ReferenceCount: 0,
+	}
 
-	if !isMimeTypeCompatible(declaredBase, actualBase) {
-		return fmt.Errorf("MIME type mismatch for %s: expected %s, got %s - %s",
-			filename, declaredBase, actualBase, "file content does not match declared type")
+	if err := scanFile(ctx, file, &gormFile); err != nil {
+		return nil, err
+	}
+	switch {
+	case gormFile.Chunked:
+		// Chunks are shared, so blocked chunked content stays where it is
+		// and is only refused when served.
+		gormFile.StoragePath = ""
+	case scan.Blocked(&gormFile):
+		gormFile.StoragePath = scan.QuarantineKey(hashResult.Hash)
 	}
 
-	return nil
+	staged, err := content.Stage(ctx, &gormFile, file)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedUpload{file: gormFile, content: staged}, nil
 }
 
-func isMimeTypeCompatible(declared, actual string) bool {
-	if declared == actual {
-		return true
+// findOrCommitFile returns the live File with hash, or inserts staged as a
+// new one, reporting whether it did. A soft-deleted File with the same
+// hash, whose content went with its last reference, is brought back rather
+// than inserted again, since the hash stays unique across deleted rows. tx
+// must hold the hash lock.
+func findOrCommitFile(ctx context.Context, tx *gorm.DB, file multipart.File, header *multipart.FileHeader, hash string, staged *stagedUpload) (*models.File, bool, error) {
+	var existing models.File
+	err := tx.Unscoped().Where("hash = ?", hash).First(&existing).Error
+	found := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
 	}
 
-	compatibilityMap := map[string][]string{
-		"text/plain":                   {"application/octet-stream"},
-		"application/octet-stream":     {"text/plain"},
-		"image/jpeg":                   {"image/jpg"},
-		"image/jpg":                    {"image/jpeg"},
-		"application/x-zip-compressed": {"application/zip"},
-		"application/zip":              {"application/x-zip-compressed"},
+	if found && !existing.DeletedAt.Valid {
+		if scan.Blocked(&existing) {
+			return nil, false, errInfected(header.Filename, &existing)
+		}
+		return &existing, false, nil
+	}
+	if staged == nil {
+		return nil, false, errReleased
 	}
 
-	if compatible, exists := compatibilityMap[declared]; exists {
-		for _, compatibleType := range compatible {
-			if compatibleType == actual {
-				return true
-			}
-		}
+	gormFile := staged.file
+	if found {
+		gormFile.ID = existing.ID
+		gormFile.CreatedAt = existing.CreatedAt
+		err = tx.Unscoped().Model(&gormFile).Select(
+			"original_name", "mime_type", "size", "storage_path", "chunked", "codec", "stored_size", "tier",
+			"last_accessed_at", "restore_requested_at", "reference_count", "scan_status", "scan_signature", "scanned_at", "deleted_at",
+		).Updates(&gormFile).Error
+	} else {
+		err = tx.Create(&gormFile).Error
+	}
+	if err != nil {
+		return nil, false, err
 	}
 
-	return false
+	if err := staged.content.Commit(ctx, tx, &gormFile, file); err != nil {
+		return nil, false, err
+	}
+	return &gormFile, true, nil
 }
 
-func saveFileToDisk(file multipart.File, storagePath string) error {
-	file.Seek(0, 0)
+// checkUploadPolicy applies the upload policy to the sniffed type, the
+// declared type, the name and the size of an upload.
+func checkUploadPolicy(ctx context.Context, hashResult *FileHashResult, header *multipart.FileHeader, opts UploadOptions) error {
+	_, span := tracer.Start(ctx, "checkUploadPolicy")
+	defer span.End()
+
+	return tracing.RecordError(span, policy.Check(policy.Upload{
+		Filename: header.Filename,
+		Declared: header.Header.Get("Content-Type"),
+		Sniffed:  hashResult.MimeChain,
+		Size:     hashResult.Size,
+		Role:     opts.Role,
+	}))
+}
 
-	dir := filepath.Dir(storagePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
+// scanFile runs the malware scanner over a new blob before it is stored.
+func scanFile(ctx context.Context, file multipart.File, gormFile *models.File) (err error) {
+	ctx, span := tracer.Start(ctx, "scanFile")
+	defer func() {
+		span.SetAttributes(attribute.String("scan.status", gormFile.ScanStatus))
+		tracing.RecordError(span, err)
+		span.End()
+	}()
 
-	dst, err := os.Create(storagePath)
-	if err != nil {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	defer dst.Close()
+	defer file.Seek(0, io.SeekStart)
 
-	return err
+	return scan.Check(ctx, file, gormFile)
 }
 
 type FileHashResult struct {
-	Hash     string
+	Hash string
+	// Digests holds the content's digest in every algorithm clients may
+	// send checksums in, SHA-256 included.
+	Digests  map[string][]byte
 	Size     int64
 	MimeType string
+	// MimeChain is the sniffed type without parameters followed by the
+	// types it specialises, e.g. text/csv, text/plain.
+	MimeChain []string
 }
 
-func calculateFileHash(file multipart.File) (*FileHashResult, error) {
+func calculateFileHash(ctx context.Context, file multipart.File) (*FileHashResult, error) {
+	_, span := tracer.Start(ctx, "calculateFileHash")
+	defer span.End()
+
 	file.Seek(0, io.SeekStart)
 	defer file.Seek(0, io.SeekStart)
 
-	hasher := sha256.New()
-	size, err := io.Copy(hasher, file)
+	// The upload was spooled before it got here; failing to read it back
+	// means the client's multipart data was cut short or malformed.
+	digests := NewDigestReader(io.NopCloser(file))
+	size, err := io.Copy(io.Discard, digests)
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate hash: %w", err)
+		tracing.RecordError(span, err)
+		return nil, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to read uploaded file")
 	}
+	sums, err := digests.Digests()
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to read uploaded file")
+	}
+	span.SetAttributes(attribute.Int64("file.size", size))
 
 	file.Seek(0, io.SeekStart)
 
-	buffer := make([]byte, 512)
-	n, _ := file.Read(buffer)
-
-	mtype := mimetype.Detect(buffer[:n])
+	mtype, err := mimetype.DetectReader(file)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to detect content type of uploaded file")
+	}
 
 	file.Seek(0, io.SeekStart)
 
 	return &FileHashResult{
-		Hash:     fmt.Sprintf("%x", hasher.Sum(nil)),
-		Size:     size,
-		MimeType: mtype.String(),
+		Hash:      hex.EncodeToString(sums[DigestSHA256]),
+		Digests:   sums,
+		Size:      size,
+		MimeType:  mtype.String(),
+		MimeChain: mimeChain(mtype),
 	}, nil
 }
 
-func GetUserStorageStatsData(userID uint) (*models.UserStorageStats, error) {
+// mimeChain lists a type without parameters followed by the types it
+// specialises.
+func mimeChain(mtype *mimetype.MIME) []string {
+	var chain []string
+	for m := mtype; m != nil; m = m.Parent() {
+		chain = append(chain, strings.Split(m.String(), ";")[0])
+	}
+	return chain
+}
+
+func GetUserStorageStatsData(ctx context.Context, userID uint) (*models.UserStorageStats, error) {
+	db := config.DB.WithContext(ctx)
+
 	var stats models.UserStorageStats
 	stats.UserID = int(userID)
 
 	var totalFiles int64
-	if err := config.DB.Model(&models.FileReference{}).Where("user_id = ?", userID).Count(&totalFiles).Error; err != nil {
+	if err := db.Model(&models.FileReference{}).Where("user_id = ?", userID).Count(&totalFiles).Error; err != nil {
 		return &stats, err
 	}
 	stats.TotalFiles = int(totalFiles)
 
-	var totalSize int64
-	result := config.DB.Table("file_references").
-		Select("COALESCE(SUM(files.size), 0)").
+	var sizes struct {
+		Logical  int64
+		Physical int64
+	}
+	result := db.Table("file_references").
+		Select("COALESCE(SUM(files.size), 0) AS logical, COALESCE(SUM(CASE WHEN files.stored_size > 0 THEN files.stored_size ELSE files.size END), 0) AS physical").
 		Joins("JOIN files ON file_references.file_id = files.id").
 		Where("file_references.user_id = ?", userID).
-		Scan(&totalSize)
+		Scan(&sizes)
 
 	if result.Error != nil {
 		return &stats, result.Error
 	}
-	stats.TotalStorageUsed = totalSize
+	stats.TotalStorageUsed = sizes.Logical
+	stats.LogicalBytes = sizes.Logical
+	stats.PhysicalBytes = sizes.Physical
 
 	var duplicates int64
-	if err := config.DB.Model(&models.FileReference{}).Where("user_id = ? AND is_duplicate = ?", userID, true).Count(&duplicates).Error; err != nil {
+	if err := db.Model(&models.FileReference{}).Where("user_id = ? AND is_duplicate = ?", userID, true).Count(&duplicates).Error; err != nil {
 		return &stats, err
 	}
 	stats.DuplicateFiles = int(duplicates)
 
+	var chunkSaved float64
+	result = db.Raw(`
+		SELECT COALESCE(SUM(fc.size - fc.size::float8 / c.reference_count), 0)
+		FROM file_chunks fc
+		JOIN chunks c ON c.hash = fc.chunk_hash
+		WHERE c.reference_count > 0 AND fc.file_id IN (
+			SELECT file_id FROM file_references WHERE user_id = ? AND deleted_at IS NULL
+		)`, userID).Scan(&chunkSaved)
+	if result.Error != nil {
+		return &stats, result.Error
+	}
+	stats.ChunkSavedBytes = int64(chunkSaved)
+
 	return &stats, nil
 }